@@ -0,0 +1,358 @@
+package main
+
+import "fmt"
+
+// ----- DescribeAcls (api key 29), CreateAcls (api key 30), DeleteAcls (api key 31) -----
+
+func init() {
+	registerHandler(apiKeyDescribeAcls, handleDescribeAcls)
+	registerHandler(apiKeyCreateAcls, handleCreateAcls)
+	registerHandler(apiKeyDeleteAcls, handleDeleteAcls)
+}
+
+// Codes of the ACL fields on the wire, by the names aclBinding holds. Code
+// 1 (ANY), and 2 (MATCH) for pattern types, only appear in filters; 0 is
+// UNKNOWN.
+var (
+	aclResourceTypeCodes = []string{2: aclResourceTopic, 3: aclResourceGroup, 4: aclResourceCluster, 5: "TRANSACTIONAL_ID"}
+	aclPatternTypeCodes  = []string{2: aclPatternMatch, 3: aclPatternLiteral, 4: aclPatternPrefixed}
+	aclOperationCodes    = []string{2: aclOpAll, 3: aclOpRead, 4: aclOpWrite, 5: aclOpCreate, 6: aclOpDelete, 7: aclOpAlter,
+		8: aclOpDescribe, 9: aclOpClusterAction, 10: aclOpDescribeConfigs, 11: aclOpAlterConfigs, 12: "IDEMPOTENT_WRITE"}
+	aclPermissionCodes = []string{2: aclDeny, 3: aclAllow}
+)
+
+const aclCodeAny = int8(1)
+
+// aclName returns the name of code in codes, or "" if it has none.
+func aclName(codes []string, code int8) string {
+	if code < 0 || int(code) >= len(codes) {
+		return ""
+	}
+	return codes[code]
+}
+
+// aclCode returns the code of name in codes.
+func aclCode(codes []string, name string) int8 {
+	for code, n := range codes {
+		if n != "" && n == name {
+			return int8(code)
+		}
+	}
+	return 0
+}
+
+// aclFilterCodes is an aclFilter as a request encodes it.
+type aclFilterCodes struct {
+	resourceType, patternType, operation, permission int8
+	resourceName, principal, host                    string // "": null
+}
+
+func readACLFilter(c *cursor) (aclFilterCodes, error) {
+	var f aclFilterCodes
+	var err error
+	if f.resourceType, err = c.i8(); err != nil {
+		return f, err
+	}
+	if f.resourceName, err = c.compactNullableString(); err != nil {
+		return f, err
+	}
+	if f.patternType, err = c.i8(); err != nil {
+		return f, err
+	}
+	if f.principal, err = c.compactNullableString(); err != nil {
+		return f, err
+	}
+	if f.host, err = c.compactNullableString(); err != nil {
+		return f, err
+	}
+	if f.operation, err = c.i8(); err != nil {
+		return f, err
+	}
+	if f.permission, err = c.i8(); err != nil {
+		return f, err
+	}
+	return f, c.skipTagged()
+}
+
+// filter converts fc, failing on UNKNOWN or out of range codes. A host other
+// than "*" can match nothing, since bindings are never host-specific; ok
+// is false then.
+func (fc aclFilterCodes) filter() (f aclFilter, ok bool, err error) {
+	name := func(codes []string, code int8, what string) (string, error) {
+		if code == aclCodeAny {
+			return "", nil
+		}
+		if n := aclName(codes, code); n != "" {
+			return n, nil
+		}
+		return "", fmt.Errorf("invalid %s %d in ACL filter", what, code)
+	}
+	if f.resourceType, err = name(aclResourceTypeCodes, fc.resourceType, "resource type"); err != nil {
+		return f, false, err
+	}
+	if f.patternType, err = name(aclPatternTypeCodes, fc.patternType, "pattern type"); err != nil {
+		return f, false, err
+	}
+	if f.operation, err = name(aclOperationCodes, fc.operation, "operation"); err != nil {
+		return f, false, err
+	}
+	if f.permission, err = name(aclPermissionCodes, fc.permission, "permission"); err != nil {
+		return f, false, err
+	}
+	f.resourceName, f.principal = fc.resourceName, fc.principal
+	return f, fc.host == "" || fc.host == aclWildcard, nil
+}
+
+// aclAuthorizerOrNil returns authz if ACLs are on, or nil: with no
+// authorizer there are no ACLs to read or change, and the ACL requests get
+// SECURITY_DISABLED.
+func aclAuthorizerOrNil() *aclAuthorizer {
+	a, _ := authz.(*aclAuthorizer)
+	return a
+}
+
+// handleDescribeAcls parses a v3 DescribeAcls request and lists the
+// bindings matching its filter.
+func handleDescribeAcls(c *cursor, corrID int32, apiVer int16, _ *session) ([]byte, error) {
+	fc, err := readACLFilter(c)
+	if err != nil {
+		return nil, err
+	}
+
+	a := aclAuthorizerOrNil()
+	if a == nil {
+		return buildDescribeAclsResponse(corrID, apiVer, errSecurityDisabled, "No Authorizer is configured.", nil), nil
+	}
+	f, ok, err := fc.filter()
+	if err != nil {
+		return buildDescribeAclsResponse(corrID, apiVer, errInvalidRequest, err.Error(), nil), nil
+	}
+	var acls []aclBinding
+	if ok {
+		acls = a.find(f)
+	}
+	return buildDescribeAclsResponse(corrID, apiVer, errNone, "", acls), nil
+}
+
+func buildDescribeAclsResponse(corrID int32, apiVer, errCode int16, errMessage string, acls []aclBinding) []byte {
+	// Body (flex v3):
+	// throttle_time_ms (INT32), error_code (INT16), error_message (COMPACT_NULLABLE_STRING)
+	// resources (COMPACT_ARRAY) -> {resource_type (INT8), resource_name, pattern_type (INT8),
+	//                               acls (COMPACT_ARRAY), TAGS}
+	//   acls -> {principal, host, operation (INT8), permission_type (INT8), TAGS}
+	// response TAG_BUFFER count = 0
+	type resource struct{ resourceType, resourceName, patternType string }
+	var resources []resource
+	byResource := map[resource][]aclBinding{}
+	for _, b := range acls {
+		res := resource{b.ResourceType, b.ResourceName, b.PatternType}
+		if _, ok := byResource[res]; !ok {
+			resources = append(resources, res)
+		}
+		byResource[res] = append(byResource[res], b)
+	}
+
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putI16(errCode)
+	r.putCompactNullableString(errMessage)
+	r.putCompactArrayLen(len(resources))
+	for _, res := range resources {
+		r.putI8(aclCode(aclResourceTypeCodes, res.resourceType))
+		r.putCompactString(res.resourceName)
+		r.putI8(aclCode(aclPatternTypeCodes, res.patternType))
+		r.putCompactArrayLen(len(byResource[res]))
+		for _, b := range byResource[res] {
+			r.putCompactString(b.Principal)
+			r.putCompactString(aclWildcard) // host
+			r.putI8(aclCode(aclOperationCodes, b.Operation))
+			r.putI8(aclCode(aclPermissionCodes, b.Permission))
+			r.putTags()
+		}
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyDescribeAcls, apiVer))
+}
+
+type aclResult struct {
+	errCode    int16
+	errMessage string
+}
+
+// handleCreateAcls parses a v3 CreateAcls request and adds its bindings.
+// Bindings may only name the host "*": the authorizer doesn't see where
+// requests come from.
+func handleCreateAcls(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	n, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]aclResult, n)
+	var add []aclBinding
+	for i := 0; i < n; i++ {
+		// Creations are filters with nothing left as ANY.
+		fc, err := readACLFilter(c)
+		if err != nil {
+			return nil, err
+		}
+		b := aclBinding{
+			ResourceType: aclName(aclResourceTypeCodes, fc.resourceType),
+			ResourceName: fc.resourceName,
+			PatternType:  aclName(aclPatternTypeCodes, fc.patternType),
+			Principal:    fc.principal,
+			Operation:    aclName(aclOperationCodes, fc.operation),
+			Permission:   aclName(aclPermissionCodes, fc.permission),
+		}
+		switch err := b.validate(); {
+		case fc.patternType != aclCode(aclPatternTypeCodes, aclPatternLiteral) &&
+			fc.patternType != aclCode(aclPatternTypeCodes, aclPatternPrefixed):
+			results[i] = aclResult{errInvalidRequest, fmt.Sprintf("Invalid pattern type %d", fc.patternType)}
+		case err != nil:
+			results[i] = aclResult{errInvalidRequest, err.Error()}
+		case fc.host != aclWildcard:
+			results[i] = aclResult{errInvalidRequest, fmt.Sprintf("Invalid host %q; only * is supported", fc.host)}
+		default:
+			add = append(add, b)
+		}
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+
+	// Unlike the other cluster operations, each creation is refused on its
+	// own, as clients expect a result for every one.
+	a := aclAuthorizerOrNil()
+	switch {
+	case a == nil:
+		for i := range results {
+			results[i] = aclResult{errSecurityDisabled, "No Authorizer is configured."}
+		}
+		return buildCreateAclsResponse(corrID, apiVer, results), nil
+	case !sess.authorized(aclOpAlter, aclResourceCluster, clusterResourceName):
+		for i := range results {
+			results[i] = aclResult{errClusterAuthorizationFailed, "Authorization failed."}
+		}
+		return buildCreateAclsResponse(corrID, apiVer, results), nil
+	}
+	if err := a.add(add); err != nil {
+		sess.log.Error("failed to save ACLs", "correlation_id", corrID, "err", err)
+		for i := range results {
+			if results[i].errCode == errNone {
+				results[i] = aclResult{errUnknownServerError, err.Error()}
+			}
+		}
+	}
+	return buildCreateAclsResponse(corrID, apiVer, results), nil
+}
+
+func buildCreateAclsResponse(corrID int32, apiVer int16, results []aclResult) []byte {
+	// Body (flex v3):
+	// throttle_time_ms (INT32)
+	// results (COMPACT_ARRAY) -> {error_code, error_message, TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putCompactArrayLen(len(results))
+	for _, res := range results {
+		r.putI16(res.errCode)
+		r.putCompactNullableString(res.errMessage)
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyCreateAcls, apiVer))
+}
+
+type deleteAclsResult struct {
+	aclResult
+	matching []aclBinding
+}
+
+// handleDeleteAcls parses a v3 DeleteAcls request and removes the bindings
+// matching each of its filters.
+func handleDeleteAcls(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	n, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]deleteAclsResult, n)
+	var filters []aclFilter
+	var filterResult []int // index in results of each of filters
+	for i := 0; i < n; i++ {
+		fc, err := readACLFilter(c)
+		if err != nil {
+			return nil, err
+		}
+		f, ok, err := fc.filter()
+		switch {
+		case err != nil:
+			results[i].aclResult = aclResult{errInvalidRequest, err.Error()}
+		case ok:
+			filters = append(filters, f)
+			filterResult = append(filterResult, i)
+		}
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+
+	// As with CreateAcls, each filter is refused on its own.
+	a := aclAuthorizerOrNil()
+	switch {
+	case a == nil:
+		for i := range results {
+			results[i].aclResult = aclResult{errSecurityDisabled, "No Authorizer is configured."}
+		}
+		return buildDeleteAclsResponse(corrID, apiVer, results), nil
+	case !sess.authorized(aclOpAlter, aclResourceCluster, clusterResourceName):
+		for i := range results {
+			results[i].aclResult = aclResult{errClusterAuthorizationFailed, "Authorization failed."}
+		}
+		return buildDeleteAclsResponse(corrID, apiVer, results), nil
+	}
+	removed, err := a.remove(filters)
+	if err != nil {
+		sess.log.Error("failed to save ACLs", "correlation_id", corrID, "err", err)
+		for _, i := range filterResult {
+			results[i].aclResult = aclResult{errUnknownServerError, err.Error()}
+		}
+		return buildDeleteAclsResponse(corrID, apiVer, results), nil
+	}
+	for j, i := range filterResult {
+		results[i].matching = removed[j]
+	}
+	return buildDeleteAclsResponse(corrID, apiVer, results), nil
+}
+
+func buildDeleteAclsResponse(corrID int32, apiVer int16, results []deleteAclsResult) []byte {
+	// Body (flex v3):
+	// throttle_time_ms (INT32)
+	// filter_results (COMPACT_ARRAY) -> {error_code, error_message, matching_acls (COMPACT_ARRAY), TAGS}
+	//   matching_acls -> {error_code, error_message, resource_type (INT8), resource_name,
+	//                     pattern_type (INT8), principal, host, operation (INT8),
+	//                     permission_type (INT8), TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putCompactArrayLen(len(results))
+	for _, res := range results {
+		r.putI16(res.errCode)
+		r.putCompactNullableString(res.errMessage)
+		r.putCompactArrayLen(len(res.matching))
+		for _, b := range res.matching {
+			r.putI16(errNone)
+			r.putCompactNullableString("") // error_message: null
+			r.putI8(aclCode(aclResourceTypeCodes, b.ResourceType))
+			r.putCompactString(b.ResourceName)
+			r.putI8(aclCode(aclPatternTypeCodes, b.PatternType))
+			r.putCompactString(b.Principal)
+			r.putCompactString(aclWildcard) // host
+			r.putI8(aclCode(aclOperationCodes, b.Operation))
+			r.putI8(aclCode(aclPermissionCodes, b.Permission))
+			r.putTags()
+		}
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyDeleteAcls, apiVer))
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// putACLFilter encodes fc as DescribeAcls, CreateAcls and DeleteAcls do.
+func putACLFilter(req *respBuf, fc aclFilterCodes) {
+	req.putI8(fc.resourceType)
+	req.putCompactNullableString(fc.resourceName)
+	req.putI8(fc.patternType)
+	req.putCompactNullableString(fc.principal)
+	req.putCompactNullableString(fc.host)
+	req.putI8(fc.operation)
+	req.putI8(fc.permission)
+	req.putTags()
+}
+
+// bindingCodes returns b as a request encodes it, for any host.
+func bindingCodes(b aclBinding) aclFilterCodes {
+	return aclFilterCodes{
+		resourceType: aclCode(aclResourceTypeCodes, b.ResourceType),
+		resourceName: b.ResourceName,
+		patternType:  aclCode(aclPatternTypeCodes, b.PatternType),
+		principal:    b.Principal,
+		host:         aclWildcard,
+		operation:    aclCode(aclOperationCodes, b.Operation),
+		permission:   aclCode(aclPermissionCodes, b.Permission),
+	}
+}
+
+// readACLBinding reads the resource and ACL fields of a binding in a
+// DescribeAcls or DeleteAcls response.
+func readACLBinding(r *cursor, resourceType, patternType int8, resourceName string) aclBinding {
+	b := aclBinding{
+		ResourceType: aclName(aclResourceTypeCodes, resourceType),
+		ResourceName: resourceName,
+		PatternType:  aclName(aclPatternTypeCodes, patternType),
+	}
+	b.Principal, _ = r.compactNullableString()
+	r.compactNullableString() // host
+	op, _ := r.i8()
+	perm, _ := r.i8()
+	b.Operation, b.Permission = aclName(aclOperationCodes, op), aclName(aclPermissionCodes, perm)
+	r.skipTagged()
+	return b
+}
+
+// createAcls sends a v3 CreateAcls request and returns the error code of
+// each creation.
+func (c *testConn) createAcls(bindings ...aclBinding) []int16 {
+	c.t.Helper()
+	var req respBuf
+	req.putCompactArrayLen(len(bindings))
+	for _, b := range bindings {
+		putACLFilter(&req, bindingCodes(b))
+	}
+	req.putTags()
+	r := c.call(apiKeyCreateAcls, 3, req.b)
+	r.i32() // throttle_time_ms
+	n, _, _ := r.compactArrayLen()
+	var errCodes []int16
+	for range n {
+		errCode, _ := r.i16()
+		r.compactNullableString() // error_message
+		r.skipTagged()
+		errCodes = append(errCodes, errCode)
+	}
+	return errCodes
+}
+
+// describeAcls sends a v3 DescribeAcls request and returns its error code
+// and the bindings matching fc.
+func (c *testConn) describeAcls(fc aclFilterCodes) (int16, []aclBinding) {
+	c.t.Helper()
+	var req respBuf
+	putACLFilter(&req, fc)
+	r := c.call(apiKeyDescribeAcls, 3, req.b)
+	r.i32() // throttle_time_ms
+	errCode, _ := r.i16()
+	r.compactNullableString() // error_message
+	nResources, _, _ := r.compactArrayLen()
+	var acls []aclBinding
+	for range nResources {
+		resourceType, _ := r.i8()
+		resourceName, _ := r.compactNullableString()
+		patternType, _ := r.i8()
+		n, _, _ := r.compactArrayLen()
+		for range n {
+			acls = append(acls, readACLBinding(r, resourceType, patternType, resourceName))
+		}
+		r.skipTagged()
+	}
+	r.skipTagged()
+	checkConsumed(c.t, r)
+	return errCode, acls
+}
+
+// deleteAcls sends a v3 DeleteAcls request with one filter and returns its
+// error code and the bindings it removed.
+func (c *testConn) deleteAcls(fc aclFilterCodes) (int16, []aclBinding) {
+	c.t.Helper()
+	var req respBuf
+	req.putCompactArrayLen(1)
+	putACLFilter(&req, fc)
+	req.putTags()
+	r := c.call(apiKeyDeleteAcls, 3, req.b)
+	r.i32() // throttle_time_ms
+	if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+		c.t.Fatalf("%d filter results (%v), want 1", n, err)
+	}
+	errCode, _ := r.i16()
+	r.compactNullableString() // error_message
+	n, _, _ := r.compactArrayLen()
+	var acls []aclBinding
+	for range n {
+		r.i16()                   // error_code
+		r.compactNullableString() // error_message
+		resourceType, _ := r.i8()
+		resourceName, _ := r.compactNullableString()
+		patternType, _ := r.i8()
+		acls = append(acls, readACLBinding(r, resourceType, patternType, resourceName))
+	}
+	return errCode, acls
+}
+
+// topicACLs matches every binding on topic.
+func topicACLs(topic string) aclFilterCodes {
+	return aclFilterCodes{
+		resourceType: aclCode(aclResourceTypeCodes, aclResourceTopic),
+		resourceName: topic,
+		patternType:  aclCodeAny,
+		operation:    aclCodeAny,
+		permission:   aclCodeAny,
+	}
+}
+
+func TestCreateDescribeDeleteAcls(t *testing.T) {
+	c := dialWithACLs(t, allowAnonymous(aclOpAlter, aclResourceCluster, clusterResourceName))
+	read := aclBinding{
+		ResourceType: aclResourceTopic,
+		ResourceName: "orders",
+		PatternType:  aclPatternLiteral,
+		Principal:    "User:alice",
+		Operation:    aclOpRead,
+		Permission:   aclAllow,
+	}
+	if errCodes := c.createAcls(read); !slices.Equal(errCodes, []int16{errNone}) {
+		t.Fatalf("CreateAcls = errors %v, want none", errCodes)
+	}
+
+	if errCode, acls := c.describeAcls(topicACLs("orders")); errCode != errNone || !slices.Equal(acls, []aclBinding{read}) {
+		t.Errorf("DescribeAcls = error %d, %+v; want %+v", errCode, acls, read)
+	}
+	if errCode, acls := c.deleteAcls(topicACLs("orders")); errCode != errNone || !slices.Equal(acls, []aclBinding{read}) {
+		t.Errorf("DeleteAcls = error %d, removed %+v; want %+v", errCode, acls, read)
+	}
+	if errCode, acls := c.describeAcls(topicACLs("orders")); errCode != errNone || len(acls) != 0 {
+		t.Errorf("DescribeAcls after deleting = error %d, %+v; want nothing", errCode, acls)
+	}
+	// The cluster binding the test started with is untouched.
+	cluster := aclFilterCodes{resourceType: aclCodeAny, patternType: aclCodeAny, operation: aclCodeAny, permission: aclCodeAny}
+	if _, acls := c.describeAcls(cluster); len(acls) != 1 || acls[0].ResourceType != aclResourceCluster {
+		t.Errorf("all ACLs after deleting = %+v, want just the cluster one", acls)
+	}
+}
+
+// Without the ACL authorizer there are no ACLs to read or change.
+func TestAclsWithoutAuthorizer(t *testing.T) {
+	c := newTestServer(t).dial()
+	if errCode, _ := c.describeAcls(topicACLs("orders")); errCode != errSecurityDisabled {
+		t.Errorf("DescribeAcls = error %d, want %d", errCode, errSecurityDisabled)
+	}
+	read := allowAnonymous(aclOpRead, aclResourceTopic, "orders")
+	if errCodes := c.createAcls(read); !slices.Equal(errCodes, []int16{errSecurityDisabled}) {
+		t.Errorf("CreateAcls = errors %v, want %d", errCodes, errSecurityDisabled)
+	}
+	if errCode, _ := c.deleteAcls(topicACLs("orders")); errCode != errSecurityDisabled {
+		t.Errorf("DeleteAcls = error %d, want %d", errCode, errSecurityDisabled)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ----- server-side partition assignment -----
+
+// groupAssignor, set with the -group-assignor flag, makes the coordinator
+// assign partitions to the members of consumer groups itself, with one of
+// assignors, in place of what the leader sends in SyncGroup. "" leaves
+// assignment to the leader, as Kafka does.
+var groupAssignor = ""
+
+// assignors computes an assignment from each member's subscribed topics, in
+// member order, and the partitions of those topics.
+var assignors = map[string]func(members []subscription, partitions map[string][]int32) map[string]map[string][]int32{
+	"range":      assignRange,
+	"roundrobin": assignRoundRobin,
+}
+
+// checkGroupAssignor reports whether name is "" or one of assignors.
+func checkGroupAssignor(name string) error {
+	if _, ok := assignors[name]; ok || name == "" {
+		return nil
+	}
+	return fmt.Errorf("unknown group assignor %q; want range or roundrobin", name)
+}
+
+// subscription is a consumer group member's ConsumerProtocolSubscription,
+// the metadata it joins with.
+type subscription struct {
+	memberID string
+	topics   []string
+}
+
+// parseSubscription decodes the topics of a ConsumerProtocolSubscription.
+// Every version starts with them; what follows is left unread.
+func parseSubscription(b []byte) ([]string, error) {
+	c := &cursor{b: b}
+	if _, err := c.i16(); err != nil { // version
+		return nil, err
+	}
+	n, err := c.i32()
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || int(n) > len(c.b) {
+		return nil, fmt.Errorf("bad subscription topic count %d", n)
+	}
+	topics := make([]string, 0, n)
+	for i := int32(0); i < n; i++ {
+		topic, err := c.str16()
+		if err != nil {
+			return nil, err
+		}
+		topics = append(topics, topic)
+	}
+	return topics, nil
+}
+
+// encodeAssignment encodes a v0 ConsumerProtocolAssignment of assigned,
+// topics in name order, with null user data.
+func encodeAssignment(assigned map[string][]int32) []byte {
+	topics := make([]string, 0, len(assigned))
+	for topic := range assigned {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	var r respBuf
+	r.putI16(0) // version
+	r.putI32(int32(len(topics)))
+	for _, topic := range topics {
+		r.putString(topic)
+		r.putI32(int32(len(assigned[topic])))
+		for _, p := range assigned[topic] {
+			r.putI32(p)
+		}
+	}
+	r.putI32(-1) // user_data: null
+	return r.b
+}
+
+// assignLocked computes every member's assignment with assignor name over
+// the partitions of the topics they subscribe to, keyed by member id.
+// Caller holds gc.mu.
+func (g *group) assignLocked(name string) map[string][]byte {
+	var members []subscription
+	partitions := map[string][]int32{}
+	for _, id := range g.order {
+		topics, err := parseSubscription(g.members[id].metadata(g.protocolName))
+		if err != nil {
+			topics = nil // no topics, so no partitions
+		}
+		for _, topic := range topics {
+			if _, ok := partitions[topic]; !ok {
+				partitions[topic] = store.partitions(topic)
+			}
+		}
+		members = append(members, subscription{id, topics})
+	}
+	// Like Kafka's assignors, hand partitions out in member id order.
+	sort.Slice(members, func(i, j int) bool { return members[i].memberID < members[j].memberID })
+
+	assignment := assignors[name](members, partitions)
+	out := make(map[string][]byte, len(members))
+	for _, m := range members {
+		out[m.memberID] = encodeAssignment(assignment[m.memberID])
+	}
+	return out
+}
+
+// assignRange gives each topic's subscribers consecutive ranges of its
+// partitions, the first ones getting one more when they don't divide
+// evenly.
+func assignRange(members []subscription, partitions map[string][]int32) map[string]map[string][]int32 {
+	out := make(map[string]map[string][]int32, len(members))
+	subscribers := map[string][]string{}
+	for _, m := range members {
+		out[m.memberID] = map[string][]int32{}
+		for _, topic := range m.topics {
+			subscribers[topic] = append(subscribers[topic], m.memberID)
+		}
+	}
+	for topic, ids := range subscribers {
+		parts := partitions[topic]
+		per, extra := len(parts)/len(ids), len(parts)%len(ids)
+		start := 0
+		for i, id := range ids {
+			n := per
+			if i < extra {
+				n++
+			}
+			if n > 0 {
+				out[id][topic] = parts[start : start+n]
+			}
+			start += n
+		}
+	}
+	return out
+}
+
+// assignRoundRobin deals every partition of every subscribed topic, in
+// topic and partition order, to the members in turn, skipping members not
+// subscribed to its topic.
+func assignRoundRobin(members []subscription, partitions map[string][]int32) map[string]map[string][]int32 {
+	out := make(map[string]map[string][]int32, len(members))
+	subscribed := map[string]map[string]bool{}
+	for _, m := range members {
+		out[m.memberID] = map[string][]int32{}
+		subscribed[m.memberID] = map[string]bool{}
+		for _, topic := range m.topics {
+			subscribed[m.memberID][topic] = true
+		}
+	}
+	topics := make([]string, 0, len(partitions))
+	for topic := range partitions {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	next := 0
+	for _, topic := range topics {
+		for _, p := range partitions[topic] {
+			for range members {
+				m := members[next%len(members)]
+				next++
+				if subscribed[m.memberID][topic] {
+					out[m.memberID][topic] = append(out[m.memberID][topic], p)
+					break
+				}
+			}
+		}
+	}
+	return out
+}
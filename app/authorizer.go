@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ----- authorization -----
+
+// authorizer decides whether principal, e.g. "User:alice", may perform
+// operation on a resource. Operations, resource types and principals are
+// named as in Kafka's ACLs.
+type authorizer interface {
+	authorize(principal, operation, resourceType, resourceName string) bool
+}
+
+// authz authorizes every request. It allows everything unless the
+// -authorizer flag picks ACLs.
+var authz authorizer = allowAll{}
+
+// Operations and resource types requests are authorized for.
+const (
+	aclOpAll             = "ALL"
+	aclOpRead            = "READ"
+	aclOpWrite           = "WRITE"
+	aclOpCreate          = "CREATE"
+	aclOpDelete          = "DELETE"
+	aclOpAlter           = "ALTER"
+	aclOpDescribe        = "DESCRIBE"
+	aclOpClusterAction   = "CLUSTER_ACTION"
+	aclOpDescribeConfigs = "DESCRIBE_CONFIGS"
+	aclOpAlterConfigs    = "ALTER_CONFIGS"
+
+	aclResourceTopic           = "TOPIC"
+	aclResourceGroup           = "GROUP"
+	aclResourceCluster         = "CLUSTER"
+	aclResourceTransactionalID = "TRANSACTIONAL_ID"
+
+	clusterResourceName = "kafka-cluster"
+)
+
+// Principal of clients that neither authenticated with SASL nor presented a
+// certificate.
+const anonymousPrincipal = "User:ANONYMOUS"
+
+// kafkaPrincipal returns who s is as ACLs name it: its SASL user, else its
+// TLS client certificate's subject, else ANONYMOUS.
+func (s *session) kafkaPrincipal() string {
+	switch {
+	case s.principal != "":
+		return "User:" + s.principal
+	case s.tlsSubject != "":
+		return "User:" + s.tlsSubject
+	}
+	return anonymousPrincipal
+}
+
+// authorized reports whether authz lets s perform operation on a resource,
+// logging denials as Kafka's authorizer does.
+func (s *session) authorized(operation, resourceType, resourceName string) bool {
+	principal := s.kafkaPrincipal()
+	if authz.authorize(principal, operation, resourceType, resourceName) {
+		return true
+	}
+	s.log.Info("authorization denied", "principal", principal, "operation", operation,
+		"resource_type", resourceType, "resource_name", resourceName)
+	return false
+}
+
+// canCreateTopic reports whether s may create topic, which takes CREATE on
+// the cluster or on the topic.
+func (s *session) canCreateTopic(topic string) bool {
+	return authz.authorize(s.kafkaPrincipal(), aclOpCreate, aclResourceCluster, clusterResourceName) ||
+		s.authorized(aclOpCreate, aclResourceTopic, topic)
+}
+
+// allowAll is the authorizer without ACLs.
+type allowAll struct{}
+
+func (allowAll) authorize(string, string, string, string) bool { return true }
+
+// ----- ACL authorizer -----
+
+// aclsFileName lives in the data directory next to configsFileName and
+// holds the ACL bindings. It may be edited by hand while the broker is
+// stopped, e.g. to give an admin its first ACLs.
+const aclsFileName = "__acls.json"
+
+type aclsFile struct {
+	ACLs []aclBinding `json:"acls"`
+}
+
+// aclBinding allows or denies principal an operation on the resources
+// matching resource type and name. "*" as the name or the principal's user
+// matches every one.
+type aclBinding struct {
+	ResourceType string `json:"resource_type"`
+	ResourceName string `json:"resource_name"`
+	PatternType  string `json:"pattern_type"` // LITERAL (default) or PREFIXED
+	Principal    string `json:"principal"`
+	Operation    string `json:"operation"`
+	Permission   string `json:"permission"` // ALLOW or DENY
+}
+
+const (
+	aclPatternLiteral  = "LITERAL"
+	aclPatternPrefixed = "PREFIXED"
+	aclAllow           = "ALLOW"
+	aclDeny            = "DENY"
+	aclWildcard        = "*"
+)
+
+// aclOperations lists the operations a binding may name.
+var aclOperations = []string{
+	aclOpAll, aclOpRead, aclOpWrite, aclOpCreate, aclOpDelete, aclOpAlter, aclOpDescribe,
+	aclOpClusterAction, aclOpDescribeConfigs, aclOpAlterConfigs, "IDEMPOTENT_WRITE",
+}
+
+// aclResourceTypes lists the resource types a binding may name.
+var aclResourceTypes = []string{aclResourceTopic, aclResourceGroup, aclResourceCluster, aclResourceTransactionalID}
+
+// validate checks b's fields, defaulting its pattern type to LITERAL.
+func (b *aclBinding) validate() error {
+	if b.PatternType == "" {
+		b.PatternType = aclPatternLiteral
+	}
+	switch {
+	case !slices.Contains(aclResourceTypes, b.ResourceType):
+		return fmt.Errorf("unknown resource type %q", b.ResourceType)
+	case b.ResourceName == "":
+		return errors.New("empty resource name")
+	case b.PatternType != aclPatternLiteral && b.PatternType != aclPatternPrefixed:
+		return fmt.Errorf("unknown pattern type %q", b.PatternType)
+	case !strings.HasPrefix(b.Principal, "User:"):
+		return fmt.Errorf("principal %q is not of the form User:name", b.Principal)
+	case !slices.Contains(aclOperations, b.Operation):
+		return fmt.Errorf("unknown operation %q", b.Operation)
+	case b.Permission != aclAllow && b.Permission != aclDeny:
+		return fmt.Errorf("unknown permission %q", b.Permission)
+	}
+	return nil
+}
+
+// matches reports whether b applies to principal performing operation on
+// the named resource. As in Kafka, an ALLOW of READ, WRITE, DELETE or ALTER
+// also allows DESCRIBE, and one of ALTER_CONFIGS allows DESCRIBE_CONFIGS.
+func (b *aclBinding) matches(principal, operation, resourceType, resourceName string) bool {
+	if b.ResourceType != resourceType {
+		return false
+	}
+	switch {
+	case b.ResourceName == aclWildcard:
+	case b.PatternType == aclPatternPrefixed:
+		if !strings.HasPrefix(resourceName, b.ResourceName) {
+			return false
+		}
+	case b.ResourceName != resourceName:
+		return false
+	}
+	if b.Principal != principal && b.Principal != "User:"+aclWildcard {
+		return false
+	}
+	switch {
+	case b.Operation == aclOpAll, b.Operation == operation:
+		return true
+	case b.Permission != aclAllow:
+		return false
+	case operation == aclOpDescribe:
+		return slices.Contains([]string{aclOpRead, aclOpWrite, aclOpDelete, aclOpAlter}, b.Operation)
+	case operation == aclOpDescribeConfigs:
+		return b.Operation == aclOpAlterConfigs
+	}
+	return false
+}
+
+// aclAuthorizer authorizes with ACL bindings, as Kafka's StandardAuthorizer
+// does with allow.everyone.if.no.acl.found off: a request needs a binding
+// allowing it and none denying it.
+type aclAuthorizer struct {
+	mu   sync.RWMutex
+	dir  string // where aclsFileName is saved; "" keeps ACLs in memory
+	acls []aclBinding
+}
+
+// openACLAuthorizer returns an aclAuthorizer with the bindings saved in
+// dir, if any. dir is "" for a store held in memory, which starts with
+// none.
+func openACLAuthorizer(dir string) (*aclAuthorizer, error) {
+	a := &aclAuthorizer{dir: dir}
+	if dir == "" {
+		return a, nil
+	}
+	b, err := os.ReadFile(filepath.Join(dir, aclsFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f aclsFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("load %s: %w", aclsFileName, err)
+	}
+	for i := range f.ACLs {
+		if err := f.ACLs[i].validate(); err != nil {
+			return nil, fmt.Errorf("load %s: acl %d: %w", aclsFileName, i, err)
+		}
+	}
+	a.acls = f.ACLs
+	return a, nil
+}
+
+func (a *aclAuthorizer) authorize(principal, operation, resourceType, resourceName string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	allowed := false
+	for i := range a.acls {
+		b := &a.acls[i]
+		if !b.matches(principal, operation, resourceType, resourceName) {
+			continue
+		}
+		if b.Permission == aclDeny {
+			return false
+		}
+		allowed = true
+	}
+	return allowed
+}
+
+// add adds bindings, all validated, leaving out those already there, and
+// saves the result.
+func (a *aclAuthorizer) add(bindings []aclBinding) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	acls := slices.Clone(a.acls)
+	for _, b := range bindings {
+		if !slices.Contains(acls, b) {
+			acls = append(acls, b)
+		}
+	}
+	if err := a.saveLocked(acls); err != nil {
+		return err
+	}
+	a.acls = acls
+	return nil
+}
+
+// find returns the bindings f matches.
+func (a *aclAuthorizer) find(f aclFilter) []aclBinding {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	var out []aclBinding
+	for _, b := range a.acls {
+		if f.matches(b) {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// remove deletes the bindings matching any of filters and saves the
+// result. It returns those each filter matched, in filters order.
+func (a *aclAuthorizer) remove(filters []aclFilter) ([][]aclBinding, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	removed := make([][]aclBinding, len(filters))
+	var kept []aclBinding
+	for _, b := range a.acls {
+		matched := false
+		for i, f := range filters {
+			if f.matches(b) {
+				removed[i] = append(removed[i], b)
+				matched = true
+			}
+		}
+		if !matched {
+			kept = append(kept, b)
+		}
+	}
+	if err := a.saveLocked(kept); err != nil {
+		return nil, err
+	}
+	a.acls = kept
+	return removed, nil
+}
+
+// saveLocked writes acls to the data directory, if there is one. Like
+// configsFileName, the file is small and rewritten whole. Caller holds mu.
+func (a *aclAuthorizer) saveLocked(acls []aclBinding) error {
+	if a.dir == "" {
+		return nil
+	}
+	b, err := json.Marshal(aclsFile{ACLs: acls})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(a.dir, aclsFileName)
+	if err := os.WriteFile(path+".tmp", b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// aclFilter selects bindings, as DescribeAcls and DeleteAcls requests do.
+// Empty fields match anything. A MATCH pattern type matches the bindings
+// that apply to resource name: literal ones for it or "*", and prefixed ones
+// it starts with.
+type aclFilter struct {
+	resourceType, resourceName, patternType string
+	principal, operation, permission        string
+}
+
+const aclPatternMatch = "MATCH"
+
+func (f aclFilter) matches(b aclBinding) bool {
+	switch {
+	case f.resourceType != "" && f.resourceType != b.ResourceType,
+		f.principal != "" && f.principal != b.Principal,
+		f.operation != "" && f.operation != b.Operation,
+		f.permission != "" && f.permission != b.Permission:
+		return false
+	case f.patternType == aclPatternMatch:
+		if f.resourceName == "" {
+			return true
+		}
+		if b.PatternType == aclPatternPrefixed {
+			return strings.HasPrefix(f.resourceName, b.ResourceName)
+		}
+		return b.ResourceName == f.resourceName || b.ResourceName == aclWildcard
+	}
+	return (f.patternType == "" || f.patternType == b.PatternType) &&
+		(f.resourceName == "" || f.resourceName == b.ResourceName)
+}
+
+// checkAuthorizer reports whether name is "" or "acl".
+func checkAuthorizer(name string) error {
+	if name == "" || name == "acl" {
+		return nil
+	}
+	return fmt.Errorf("unknown authorizer %q; want acl", name)
+}
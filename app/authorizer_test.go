@@ -0,0 +1,424 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// dialWithACLs starts a test server authorizing with bindings alone, so
+// anything they don't allow is denied, and connects to it as
+// User:ANONYMOUS.
+func dialWithACLs(t *testing.T, bindings ...aclBinding) *testConn {
+	t.Helper()
+	c := newTestServer(t).dial()
+	useACLs(t, bindings...)
+	return c
+}
+
+// useACLs makes the broker authorize with bindings alone for the rest of
+// the test.
+func useACLs(t *testing.T, bindings ...aclBinding) {
+	t.Helper()
+	a, err := openACLAuthorizer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.add(bindings); err != nil {
+		t.Fatal(err)
+	}
+	oldAuthz := authz
+	authz = a
+	t.Cleanup(func() { authz = oldAuthz })
+}
+
+// allowAnonymous allows User:ANONYMOUS operation on the named resource.
+func allowAnonymous(operation, resourceType, resourceName string) aclBinding {
+	return aclBinding{
+		ResourceType: resourceType,
+		ResourceName: resourceName,
+		PatternType:  aclPatternLiteral,
+		Principal:    anonymousPrincipal,
+		Operation:    operation,
+		Permission:   aclAllow,
+	}
+}
+
+func checkErrCode(t *testing.T, what string, got, want int16) {
+	t.Helper()
+	if got != want {
+		t.Errorf("%s: error code %d, want %d", what, got, want)
+	}
+}
+
+// describeTopicConfigs sends a v4 DescribeConfigs request for topic and
+// returns the error code of its one result.
+func (c *testConn) describeTopicConfigs(topic string) int16 {
+	c.t.Helper()
+	var req respBuf
+	req.putCompactArrayLen(1)
+	req.putI8(resourceTopic)
+	req.putCompactString(topic)
+	req.putUvarint(0) // configuration_keys: null
+	req.putTags()
+	req.putBool(false) // include_synonyms
+	req.putBool(false) // include_documentation
+	req.putTags()
+	r := c.call(apiKeyDescribeConfigs, 4, req.b)
+	r.i32() // throttle_time_ms
+	if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+		c.t.Fatalf("%d results (%v), want 1", n, err)
+	}
+	errCode, _ := r.i16()
+	return errCode
+}
+
+func TestDescribeConfigsDenied(t *testing.T) {
+	c := dialWithACLs(t)
+	var req respBuf
+	req.putCompactArrayLen(2)
+	for _, res := range []struct {
+		typ  int8
+		name string
+	}{{resourceTopic, "orders"}, {resourceBroker, ""}} {
+		req.putI8(res.typ)
+		req.putCompactString(res.name)
+		req.putUvarint(0) // configuration_keys: null
+		req.putTags()
+	}
+	req.putBool(false) // include_synonyms
+	req.putBool(false) // include_documentation
+	req.putTags()
+	r := c.call(apiKeyDescribeConfigs, 4, req.b)
+	r.i32() // throttle_time_ms
+	if n, _, err := r.compactArrayLen(); err != nil || n != 2 {
+		t.Fatalf("%d results (%v), want 2", n, err)
+	}
+	for _, want := range []int16{errTopicAuthorizationFailed, errClusterAuthorizationFailed} {
+		errCode, _ := r.i16()
+		r.compactNullableString() // error_message
+		r.i8()                    // resource_type
+		name, _ := r.compactNullableString()
+		r.compactArrayLen() // configs
+		if err := r.skipTagged(); err != nil {
+			t.Fatal(err)
+		}
+		checkErrCode(t, "DescribeConfigs of "+name, errCode, want)
+	}
+}
+
+func TestAlterConfigsDenied(t *testing.T) {
+	c := dialWithACLs(t)
+	for _, tc := range []struct {
+		apiKey, apiVer int16
+	}{{apiKeyAlterConfigs, 2}, {apiKeyIncrementalAlterConfigs, 1}} {
+		var req respBuf
+		req.putCompactArrayLen(2)
+		for _, res := range []struct {
+			typ  int8
+			name string
+		}{{resourceTopic, "orders"}, {resourceBroker, ""}} {
+			req.putI8(res.typ)
+			req.putCompactString(res.name)
+			req.putCompactArrayLen(1)
+			req.putCompactString("retention.ms")
+			if tc.apiKey == apiKeyIncrementalAlterConfigs {
+				req.putI8(configOpSet)
+			}
+			req.putCompactString("1000")
+			req.putTags()
+			req.putTags()
+		}
+		req.putBool(false) // validate_only
+		req.putTags()
+		r := c.call(tc.apiKey, tc.apiVer, req.b)
+		r.i32() // throttle_time_ms
+		if n, _, err := r.compactArrayLen(); err != nil || n != 2 {
+			t.Fatalf("api key %d: %d results (%v), want 2", tc.apiKey, n, err)
+		}
+		for _, want := range []int16{errTopicAuthorizationFailed, errClusterAuthorizationFailed} {
+			errCode, _ := r.i16()
+			r.compactNullableString() // error_message
+			r.i8()                    // resource_type
+			r.compactNullableString() // resource_name
+			if err := r.skipTagged(); err != nil {
+				t.Fatal(err)
+			}
+			checkErrCode(t, "AlterConfigs", errCode, want)
+		}
+	}
+}
+
+func TestDeleteRecordsDenied(t *testing.T) {
+	c := dialWithACLs(t, allowAnonymous(aclOpDescribe, aclResourceTopic, "orders"))
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	var req respBuf
+	req.putCompactArrayLen(1)
+	req.putCompactString("orders")
+	req.putCompactArrayLen(1)
+	req.putI32(0)  // partition_index
+	req.putI64(-1) // offset: the high watermark
+	req.putTags()
+	req.putTags()
+	req.putI32(1000) // timeout_ms
+	req.putTags()
+	r := c.call(apiKeyDeleteRecords, 2, req.b)
+	r.i32()             // throttle_time_ms
+	r.compactArrayLen() // topics
+	r.compactNullableString()
+	r.compactArrayLen() // partitions
+	r.i32()             // partition_index
+	r.i64()             // low_watermark
+	errCode, _ := r.i16()
+	checkErrCode(t, "DeleteRecords", errCode, errTopicAuthorizationFailed)
+}
+
+func TestCreatePartitionsDenied(t *testing.T) {
+	c := dialWithACLs(t, allowAnonymous(aclOpDescribe, aclResourceTopic, "orders"))
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	var req respBuf
+	req.putCompactArrayLen(1)
+	req.putCompactString("orders")
+	req.putI32(3)     // count
+	req.putUvarint(0) // assignments: null
+	req.putTags()
+	req.putI32(1000)   // timeout_ms
+	req.putBool(false) // validate_only
+	req.putTags()
+	r := c.call(apiKeyCreatePartitions, 3, req.b)
+	r.i32()             // throttle_time_ms
+	r.compactArrayLen() // results
+	r.compactNullableString()
+	errCode, _ := r.i16()
+	checkErrCode(t, "CreatePartitions", errCode, errTopicAuthorizationFailed)
+	if got := store.partitions("orders"); len(got) != 1 {
+		t.Errorf("orders has partitions %v after a denied CreatePartitions", got)
+	}
+}
+
+func TestDescribeGroupsDenied(t *testing.T) {
+	c := dialWithACLs(t)
+	coordinator.commitOffsets("hidden", "", "", -1, nil)
+	var req respBuf
+	req.putCompactArrayLen(1)
+	req.putCompactString("hidden")
+	req.putBool(false) // include_authorized_operations
+	req.putTags()
+	r := c.call(apiKeyDescribeGroups, 5, req.b)
+	r.i32()             // throttle_time_ms
+	r.compactArrayLen() // groups
+	errCode, _ := r.i16()
+	checkErrCode(t, "DescribeGroups", errCode, errGroupAuthorizationFailed)
+}
+
+func TestListGroupsOnlyDescribable(t *testing.T) {
+	c := dialWithACLs(t, allowAnonymous(aclOpDescribe, aclResourceGroup, "visible"))
+	for _, id := range []string{"hidden", "visible"} {
+		coordinator.commitOffsets(id, "", "", -1, nil)
+	}
+	r := c.call(apiKeyListGroups, 4, []byte{1, 0}) // states_filter: [], TAGS
+	r.i32()                                        // throttle_time_ms
+	errCode, _ := r.i16()
+	checkErrCode(t, "ListGroups", errCode, errNone)
+	n, _, _ := r.compactArrayLen()
+	var ids []string
+	for range n {
+		id, _ := r.compactNullableString()
+		r.compactNullableString() // protocol_type
+		r.compactNullableString() // group_state
+		if err := r.skipTagged(); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if want := []string{"visible"}; !slices.Equal(ids, want) {
+		t.Errorf("listed groups %q, want %q", ids, want)
+	}
+}
+
+func TestDeleteGroupsDenied(t *testing.T) {
+	c := dialWithACLs(t, allowAnonymous(aclOpDescribe, aclResourceGroup, "kept"))
+	coordinator.commitOffsets("kept", "", "", -1, nil)
+	var req respBuf
+	req.putCompactArrayLen(1)
+	req.putCompactString("kept")
+	req.putTags()
+	r := c.call(apiKeyDeleteGroups, 2, req.b)
+	r.i32()             // throttle_time_ms
+	r.compactArrayLen() // results
+	r.compactNullableString()
+	errCode, _ := r.i16()
+	checkErrCode(t, "DeleteGroups", errCode, errGroupAuthorizationFailed)
+	if groups := coordinator.describeGroups([]string{"kept"}); groups[0].state == "Dead" {
+		t.Error("group deleted by a principal without DELETE on it")
+	}
+}
+
+// txnRequest encodes the transactional_id, producer_id and producer_epoch
+// every transactional request starts with.
+func txnRequest(txnID string) *respBuf {
+	var req respBuf
+	req.putCompactString(txnID)
+	req.putI64(1000) // producer_id
+	req.putI16(0)    // producer_epoch
+	return &req
+}
+
+func TestInitProducerIdDenied(t *testing.T) {
+	c := dialWithACLs(t)
+	var req respBuf
+	req.putCompactString("tx")
+	req.putI32(60000) // transaction_timeout_ms
+	req.putI64(-1)    // producer_id
+	req.putI16(-1)    // producer_epoch
+	req.putTags()
+	r := c.call(apiKeyInitProducerId, 4, req.b)
+	r.i32() // throttle_time_ms
+	errCode, _ := r.i16()
+	checkErrCode(t, "InitProducerId", errCode, errTxnIDAuthorizationFailed)
+}
+
+func TestAddPartitionsToTxnDenied(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		bindings []aclBinding
+		want     map[string]int16
+	}{
+		{
+			name: "transactional id",
+			bindings: []aclBinding{
+				allowAnonymous(aclOpWrite, aclResourceTopic, "allowed"),
+				allowAnonymous(aclOpWrite, aclResourceTopic, "denied"),
+			},
+			want: map[string]int16{"allowed": errTxnIDAuthorizationFailed, "denied": errTxnIDAuthorizationFailed},
+		},
+		{
+			name: "topic",
+			bindings: []aclBinding{
+				allowAnonymous(aclOpWrite, aclResourceTransactionalID, "tx"),
+				allowAnonymous(aclOpWrite, aclResourceTopic, "allowed"),
+			},
+			want: map[string]int16{"allowed": errOperationNotAttempted, "denied": errTopicAuthorizationFailed},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := dialWithACLs(t, tc.bindings...)
+			req := txnRequest("tx")
+			req.putCompactArrayLen(2)
+			for _, topic := range []string{"allowed", "denied"} {
+				req.putCompactString(topic)
+				req.putCompactArrayLen(1)
+				req.putI32(0)
+				req.putTags()
+			}
+			req.putTags()
+			r := c.call(apiKeyAddPartitionsToTxn, 3, req.b)
+			r.i32() // throttle_time_ms
+			n, _, _ := r.compactArrayLen()
+			if n != 2 {
+				t.Fatalf("%d topics, want 2", n)
+			}
+			for range n {
+				topic, _ := r.compactNullableString()
+				r.compactArrayLen() // results
+				r.i32()             // partition_index
+				errCode, _ := r.i16()
+				r.skipTagged() // partition tags
+				if err := r.skipTagged(); err != nil {
+					t.Fatal(err)
+				}
+				checkErrCode(t, topic, errCode, tc.want[topic])
+			}
+		})
+	}
+}
+
+func TestAddOffsetsToTxnDenied(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		bindings []aclBinding
+		want     int16
+	}{
+		{"transactional id", []aclBinding{allowAnonymous(aclOpRead, aclResourceGroup, "g")}, errTxnIDAuthorizationFailed},
+		{"group", []aclBinding{allowAnonymous(aclOpWrite, aclResourceTransactionalID, "tx")}, errGroupAuthorizationFailed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := dialWithACLs(t, tc.bindings...)
+			req := txnRequest("tx")
+			req.putCompactString("g")
+			req.putTags()
+			r := c.call(apiKeyAddOffsetsToTxn, 3, req.b)
+			r.i32() // throttle_time_ms
+			errCode, _ := r.i16()
+			checkErrCode(t, "AddOffsetsToTxn", errCode, tc.want)
+		})
+	}
+}
+
+func TestEndTxnDenied(t *testing.T) {
+	c := dialWithACLs(t)
+	req := txnRequest("tx")
+	req.putBool(true) // committed
+	req.putTags()
+	r := c.call(apiKeyEndTxn, 3, req.b)
+	r.i32() // throttle_time_ms
+	errCode, _ := r.i16()
+	checkErrCode(t, "EndTxn", errCode, errTxnIDAuthorizationFailed)
+}
+
+func TestOffsetForLeaderEpochDenied(t *testing.T) {
+	c := dialWithACLs(t)
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	var req respBuf
+	req.putI32(-1) // replica_id
+	req.putCompactArrayLen(1)
+	req.putCompactString("orders")
+	req.putCompactArrayLen(1)
+	req.putI32(0)  // partition
+	req.putI32(-1) // current_leader_epoch
+	req.putI32(0)  // leader_epoch
+	req.putTags()
+	req.putTags()
+	req.putTags()
+	r := c.call(apiKeyOffsetForLeaderEpoch, 4, req.b)
+	r.i32()             // throttle_time_ms
+	r.compactArrayLen() // topics
+	r.compactNullableString()
+	r.compactArrayLen() // partitions
+	errCode, _ := r.i16()
+	checkErrCode(t, "OffsetForLeaderEpoch", errCode, errTopicAuthorizationFailed)
+}
+
+// A producer allowed to write a topic but not to create it can't have it
+// auto-created; like Metadata, it is told the topic doesn't exist.
+func TestProduceAutoCreateNeedsCreate(t *testing.T) {
+	c := dialWithACLs(t, allowAnonymous(aclOpWrite, aclResourceTopic, "new"))
+	batch := encodeRecordBatch(recordBatch{producerID: -1, baseSequence: -1, records: []record{{value: []byte("v")}}})
+	var req respBuf
+	req.putCompactNullableString("") // transactional_id
+	req.putI16(1)                    // acks
+	req.putI32(1000)                 // timeout_ms
+	req.putCompactArrayLen(1)
+	req.putCompactString("new")
+	req.putCompactArrayLen(1)
+	req.putI32(0)
+	req.putCompactRecords([][]byte{batch})
+	req.putTags()
+	req.putTags()
+	req.putTags()
+	r := c.call(apiKeyProduce, 9, req.b)
+	r.compactArrayLen() // responses
+	r.compactNullableString()
+	r.compactArrayLen() // partition_responses
+	r.i32()             // index
+	errCode, _ := r.i16()
+	checkErrCode(t, "Produce", errCode, errUnknownTopicOrPartition)
+	if store.partitions("new") != nil {
+		t.Error("topic auto-created for a principal without CREATE")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// ----- request buffer pool -----
+
+// Request payloads are borrowed from pools of power-of-two sized buffers,
+// from 512 bytes up to 16 MiB (above the 10 MiB frame cap), instead of being
+// allocated per request.
+const (
+	minPayloadShift = 9
+	maxPayloadShift = 24
+)
+
+var payloadPools [maxPayloadShift - minPayloadShift + 1]sync.Pool
+
+// payloadClass returns the index of the smallest pool whose buffers hold n
+// bytes.
+func payloadClass(n int) int {
+	return max(bits.Len(uint(n-1)), minPayloadShift) - minPayloadShift
+}
+
+// getPayload returns a buffer of length n. Hand it back with putPayload once
+// nothing refers to it any more.
+func getPayload(n int) []byte {
+	if n > 1<<maxPayloadShift {
+		return make([]byte, n)
+	}
+	class := payloadClass(n)
+	if bp, ok := payloadPools[class].Get().(*[]byte); ok {
+		return (*bp)[:n]
+	}
+	return make([]byte, n, 1<<(class+minPayloadShift))
+}
+
+// putPayload returns a buffer from getPayload to its pool. Buffers of other
+// sizes are left to the garbage collector.
+func putPayload(b []byte) {
+	c := cap(b)
+	if c < 1<<minPayloadShift || c > 1<<maxPayloadShift || c&(c-1) != 0 {
+		return
+	}
+	payloadPools[payloadClass(c)].Put(&b)
+}
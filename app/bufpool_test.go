@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+var payloadSink []byte
+
+// BenchmarkPayloadBuffers borrows and returns request payloads of the sizes
+// handleConn sees, from a small Metadata to a large Produce, against
+// allocating each one.
+func BenchmarkPayloadBuffers(b *testing.B) {
+	sizes := []int{300, 4 << 10, 64 << 10, 1 << 20}
+	b.Run("pool", func(b *testing.B) {
+		b.ReportAllocs()
+		i := 0
+		for b.Loop() {
+			p := getPayload(sizes[i%len(sizes)])
+			p[len(p)-1] = 1
+			putPayload(p)
+			i++
+		}
+	})
+	b.Run("make", func(b *testing.B) {
+		b.ReportAllocs()
+		i := 0
+		for b.Loop() {
+			p := make([]byte, sizes[i%len(sizes)])
+			p[len(p)-1] = 1
+			payloadSink = p
+			i++
+		}
+	})
+}
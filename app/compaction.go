@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// ----- log compaction -----
+
+// compact rewrites pl's segments to keep only the latest record for each
+// key, returning how many records it dropped. Tombstones (records with a
+// null value) are kept, so consumers that are behind still see the delete,
+// until their batch is more than deleteRetentionMs old. Records without a
+// key are always kept.
+//
+// As in Kafka, the active segment is never rewritten, and neither is any
+// segment holding records newer than minLagMs, though their keys still
+// supersede older records. Offsets don't change: a rewritten batch keeps its
+// base offset and last offset delta, just with fewer records. Rewritten
+// batches are stored uncompressed.
+//
+// Transaction markers are never removed, since reopening the log rebuilds
+// the aborted transactions from them, and neither are records of open or
+// aborted transactions. Those records don't supersede older ones either.
+func (pl *partitionLog) compact(minLagMs, deleteRetentionMs int64, now time.Time) (int, error) {
+	cleanable := 0
+	for cleanable+1 < len(pl.segments) && pl.segments[cleanable].maxTime <= now.UnixMilli()-minLagMs {
+		cleanable++
+	}
+	if cleanable == 0 {
+		return 0, nil
+	}
+
+	latest := map[string]int64{}
+	for _, sg := range pl.segments {
+		if err := sg.forEachBatch(func(_ []byte, rb recordBatch) {
+			if rb.attributes&batchControl != 0 || pl.uncommittedTxn(rb) {
+				return
+			}
+			for _, r := range rb.records {
+				if r.key != nil {
+					latest[string(r.key)] = rb.baseOffset + int64(r.offsetDelta)
+				}
+			}
+		}); err != nil {
+			return 0, err
+		}
+	}
+
+	tombstoneCutoff := now.UnixMilli() - deleteRetentionMs
+	removed := 0
+	for i, sg := range pl.segments[:cleanable] {
+		var (
+			data    []byte
+			dropped int
+		)
+		if err := sg.forEachBatch(func(raw []byte, rb recordBatch) {
+			if rb.attributes&batchControl != 0 || pl.uncommittedTxn(rb) {
+				data = append(data, raw...)
+				return
+			}
+			kept := rb.records[:0:0]
+			for _, r := range rb.records {
+				if r.key == nil {
+					kept = append(kept, r)
+					continue
+				}
+				if latest[string(r.key)] != rb.baseOffset+int64(r.offsetDelta) {
+					continue
+				}
+				if r.value == nil && rb.maxTimestamp < tombstoneCutoff {
+					continue
+				}
+				kept = append(kept, r)
+			}
+			dropped += len(rb.records) - len(kept)
+			switch {
+			case len(kept) == len(rb.records):
+				data = append(data, raw...)
+			case len(kept) > 0:
+				rb.records = kept
+				data = append(data, encodeRecordBatch(rb)...)
+			}
+		}); err != nil {
+			return removed, err
+		}
+		if dropped == 0 {
+			continue
+		}
+		if err := pl.rewriteSegment(i, data); err != nil {
+			return removed, err
+		}
+		removed += dropped
+	}
+	return removed, nil
+}
+
+// forEachBatch decodes every batch in sg, calling fn with its bytes and
+// decoded form.
+func (sg *segment) forEachBatch(fn func(raw []byte, rb recordBatch)) error {
+	var loopErr error
+	_, err := sg.scan(0, func(bi batchInfo) bool {
+		raw := make([]byte, bi.size)
+		if _, loopErr = sg.data.ReadAt(raw, bi.pos); loopErr != nil {
+			return false
+		}
+		var rb recordBatch
+		if rb, loopErr = decodeRecordBatch(raw); loopErr != nil {
+			return false
+		}
+		fn(raw, rb)
+		return true
+	})
+	if err == nil {
+		err = loopErr
+	}
+	return err
+}
+
+// compactLogs compacts every partition of the topics whose cleanup.policy
+// includes compact.
+func (s *logStore) compactLogs(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for topic, parts := range s.topics {
+		if !s.cleanupPolicyLocked(topic, "compact") {
+			continue
+		}
+		minLagMs, _ := strconv.ParseInt(s.topicConfigValueLocked(topic, "min.compaction.lag.ms"), 10, 64)
+		deleteRetentionMs, _ := strconv.ParseInt(s.topicConfigValueLocked(topic, "delete.retention.ms"), 10, 64)
+		for partition, pl := range parts {
+			n, err := pl.compact(minLagMs, deleteRetentionMs, now)
+			if err != nil {
+				logger.Warn("failed to compact log", "topic", topic, "partition", partition, "err", err)
+				continue
+			}
+			if n > 0 {
+				logger.Info("compacted log", "topic", topic, "partition", partition, "records_removed", n)
+			}
+		}
+	}
+}
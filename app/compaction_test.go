@@ -0,0 +1,212 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func txnRecordBatch(producerID int64, seq int32, key, value string) []byte {
+	return encodeRecordBatch(recordBatch{
+		attributes:    batchTransactional,
+		producerID:    producerID,
+		baseSequence:  seq,
+		baseTimestamp: time.Now().UnixMilli(),
+		maxTimestamp:  time.Now().UnixMilli(),
+		records:       []record{{key: []byte(key), value: []byte(value)}},
+	})
+}
+
+func TestCompactKeepsTransactionMarkers(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openLogStore(dir, 1, 0) // a segment per batch
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs := map[string]string{"cleanup.policy": "compact", "min.compaction.lag.ms": "0"}
+	if _, err := s.createTopic("txns", 1, configs); err != nil {
+		t.Fatal(err)
+	}
+	seqs := map[int64]int32{}
+	for _, step := range []struct {
+		producerID int64
+		key        string // "" writes a marker
+		commit     bool
+	}{
+		{producerID: 7, key: "k"},         // 0
+		{producerID: 7},                   // 1: abort
+		{producerID: 7, key: "k"},         // 2
+		{producerID: 7, commit: true},     // 3
+		{producerID: 8, key: "k"},         // 4
+		{producerID: 8},                   // 5: abort
+		{producerID: 9, key: "k"},         // 6: still open
+		{producerID: -1, key: "trailing"}, // 7: the active segment
+	} {
+		var err error
+		switch {
+		case step.producerID < 0:
+			_, err = s.append("txns", 0, encodeRecordBatch(recordBatch{producerID: -1, baseSequence: -1, records: []record{{key: []byte(step.key), value: []byte("v")}}}))
+		case step.key == "":
+			err = s.writeTxnMarker("txns", 0, step.producerID, 0, step.commit, 0)
+		default:
+			_, err = s.append("txns", 0, txnRecordBatch(step.producerID, seqs[step.producerID], step.key, "v"))
+			seqs[step.producerID]++
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []abortedTxn{{7, 0, 1}, {8, 4, 5}}
+	if got := s.topics["txns"][0].abortedTxns; !slices.Equal(got, want) {
+		t.Fatalf("aborted transactions before compaction = %v, want %v", got, want)
+	}
+
+	s.compactLogs(time.Now())
+	pr, err := s.readBatches("txns", 0, 0, 1<<20, readOptions{epochs: noFetchEpochs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsets []int64
+	for _, b := range pr.batches {
+		rb, err := decodeRecordBatch(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, rb.baseOffset)
+	}
+	// Offset 2 holds the only committed record for k; the rest are markers
+	// and records of aborted or open transactions, so nothing is removed.
+	if wantOffsets := []int64{0, 1, 2, 3, 4, 5, 6, 7}; !slices.Equal(offsets, wantOffsets) {
+		t.Errorf("batches after compaction at %v, want %v", offsets, wantOffsets)
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = openLogStore(dir, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	// Reopening aborts producer 9's open transaction.
+	want = append(want, abortedTxn{9, 6, 8})
+	if got := s.topics["txns"][0].abortedTxns; !slices.Equal(got, want) {
+		t.Errorf("aborted transactions after compaction and reopen = %v, want %v", got, want)
+	}
+}
+
+func TestCompactDropsSupersededCommittedRecords(t *testing.T) {
+	s, err := openLogStore(t.TempDir(), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	configs := map[string]string{"cleanup.policy": "compact", "min.compaction.lag.ms": "0"}
+	if _, err := s.createTopic("txns", 1, configs); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range [][]byte{
+		txnRecordBatch(7, 0, "k", "old"),     // 0
+		txnMarker(7, 0, true, 0),             // 1: commit
+		txnRecordBatch(8, 0, "k", "aborted"), // 2
+		txnMarker(8, 0, false, 0),            // 3: abort
+		txnRecordBatch(7, 1, "k", "new"),     // 4
+		txnMarker(7, 0, true, 0),             // 5: commit
+		encodeRecordBatch(recordBatch{baseSequence: -1, producerID: -1, records: []record{{value: []byte("x")}}}), // 6
+	} {
+		if _, err := s.append("txns", 0, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.compactLogs(time.Now())
+
+	pr, err := s.readBatches("txns", 0, 0, 1<<20, readOptions{epochs: noFetchEpochs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for _, b := range pr.batches {
+		rb, err := decodeRecordBatch(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rb.attributes&batchControl != 0 {
+			continue
+		}
+		for _, r := range rb.records {
+			values = append(values, string(r.value))
+		}
+	}
+	// The aborted record neither survives as the latest value nor removes
+	// the commit before it; it stays for read_committed consumers to skip.
+	if want := []string{"aborted", "new", "x"}; !slices.Equal(values, want) {
+		t.Errorf("values after compaction = %q, want %q", values, want)
+	}
+}
+
+// keyedBatch encodes a batch holding one record for key, with a null value
+// (a tombstone) if value is nil.
+func keyedBatch(ts int64, key string, value []byte) []byte {
+	return encodeRecordBatch(recordBatch{
+		producerID:    -1,
+		baseSequence:  -1,
+		baseTimestamp: ts,
+		maxTimestamp:  ts,
+		records:       []record{{key: []byte(key), value: value}},
+	})
+}
+
+func TestCompactKeepsLatestValuePerKey(t *testing.T) {
+	s, err := openLogStore(t.TempDir(), 1, 0) // a segment per batch
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	configs := map[string]string{"cleanup.policy": "compact", "min.compaction.lag.ms": "0", "delete.retention.ms": "60000"}
+	if _, err := s.createTopic("users", 1, configs); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	recent, old := now.Add(-time.Second).UnixMilli(), now.Add(-time.Hour).UnixMilli()
+	for _, b := range [][]byte{
+		keyedBatch(old, "k1", []byte("a")),    // 0
+		keyedBatch(old, "k2", []byte("b")),    // 1
+		keyedBatch(recent, "k1", []byte("c")), // 2
+		keyedBatch(recent, "k2", nil),         // 3: a tombstone consumers may not have seen yet
+		keyedBatch(old, "k3", []byte("x")),    // 4
+		keyedBatch(old, "k3", nil),            // 5: a tombstone past delete.retention.ms
+		testBatch("trailing"),                 // 6: the active segment
+	} {
+		if _, err := s.append("users", 0, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.compactLogs(now)
+
+	pr, err := s.readBatches("users", 0, 0, 1<<20, readOptions{epochs: noFetchEpochs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type kept struct {
+		offset     int64
+		key, value string
+		tombstone  bool
+	}
+	var got []kept
+	for _, b := range pr.batches {
+		rb, err := decodeRecordBatch(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range rb.records {
+			got = append(got, kept{rb.baseOffset + int64(r.offsetDelta), string(r.key), string(r.value), r.value == nil})
+		}
+	}
+	want := []kept{{2, "k1", "c", false}, {3, "k2", "", true}, {6, "", "trailing", false}}
+	if !slices.Equal(got, want) {
+		t.Errorf("records after compaction = %+v, want %+v", got, want)
+	}
+	if pr.hwm != 7 {
+		t.Errorf("high watermark after compaction = %d, want 7", pr.hwm)
+	}
+}
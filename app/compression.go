@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// ----- record compression -----
+
+// Compression codecs, from the low bits of the batch attributes.
+const (
+	codecNone   = int8(0)
+	codecGzip   = int8(1)
+	codecSnappy = int8(2)
+	codecLZ4    = int8(3)
+	codecZstd   = int8(4)
+)
+
+// maxDecompressedBytes caps what a single batch may inflate to, so a small
+// hostile batch can't exhaust memory.
+const maxDecompressedBytes = 64 << 20
+
+var errUnsupportedCodec = errors.New("unsupported compression codec")
+
+// zstdDecoder is shared by every connection; DecodeAll is safe for
+// concurrent use.
+var zstdDecoder, _ = zstd.NewReader(nil,
+	zstd.WithDecoderConcurrency(0),
+	zstd.WithDecoderMaxMemory(maxDecompressedBytes))
+
+// decompressRecords inflates the records section of a batch compressed with
+// codec.
+func decompressRecords(codec int8, compressed []byte) ([]byte, error) {
+	var r io.Reader
+	switch codec {
+	case codecNone:
+		return compressed, nil
+	case codecGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, fmt.Errorf("%w: gzip: %v", errBadBatch, err)
+		}
+		defer zr.Close()
+		r = zr
+	case codecSnappy:
+		return decompressSnappy(compressed)
+	case codecLZ4:
+		// Kafka uses the LZ4 frame format, not raw blocks.
+		r = lz4.NewReader(bytes.NewReader(compressed))
+	case codecZstd:
+		out, err := zstdDecoder.DecodeAll(compressed, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: zstd: %v", errBadBatch, err)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("%w %d", errUnsupportedCodec, codec)
+	}
+
+	out, err := io.ReadAll(io.LimitReader(r, maxDecompressedBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadBatch, err)
+	}
+	if len(out) > maxDecompressedBytes {
+		return nil, fmt.Errorf("%w: decompressed records exceed %d bytes", errBadBatch, maxDecompressedBytes)
+	}
+	return out, nil
+}
+
+// zstdEncoder is shared like zstdDecoder; EncodeAll is safe for concurrent
+// use too.
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+
+// compressRecords compresses the records section of a batch with codec.
+// Snappy is written as a raw block, as Kafka's clients write it.
+func compressRecords(codec int8, records []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch codec {
+	case codecNone:
+		return records, nil
+	case codecGzip:
+		w = gzip.NewWriter(&buf)
+	case codecSnappy:
+		return snappy.Encode(nil, records), nil
+	case codecLZ4:
+		w = lz4.NewWriter(&buf)
+	case codecZstd:
+		return zstdEncoder.EncodeAll(records, nil), nil
+	default:
+		return nil, fmt.Errorf("%w %d", errUnsupportedCodec, codec)
+	}
+	if _, err := w.Write(records); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// xerialMagic opens the snappy-java stream framing that older Java producers
+// used; it is followed by two int32s (version, min compatible version) and
+// then [int32 length][raw snappy block] chunks.
+var xerialMagic = []byte{0x82, 'S', 'N', 'A', 'P', 'P', 'Y', 0}
+
+const xerialHeaderSize = 16
+
+// decompressSnappy inflates either a raw snappy block or xerial-framed
+// snappy chunks.
+func decompressSnappy(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, xerialMagic) {
+		return decodeSnappyBlock(nil, b)
+	}
+	if len(b) < xerialHeaderSize {
+		return nil, fmt.Errorf("%w: short xerial snappy header", errBadBatch)
+	}
+	var out []byte
+	for b = b[xerialHeaderSize:]; len(b) > 0; {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("%w: truncated xerial snappy chunk", errBadBatch)
+		}
+		n := binary.BigEndian.Uint32(b)
+		if uint64(n) > uint64(len(b)-4) {
+			return nil, fmt.Errorf("%w: truncated xerial snappy chunk", errBadBatch)
+		}
+		var err error
+		if out, err = decodeSnappyBlock(out, b[4:4+n]); err != nil {
+			return nil, err
+		}
+		b = b[4+n:]
+	}
+	return out, nil
+}
+
+// decodeSnappyBlock appends the decoding of one raw snappy block to dst.
+func decodeSnappyBlock(dst, block []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(block)
+	if err != nil {
+		return nil, fmt.Errorf("%w: snappy: %v", errBadBatch, err)
+	}
+	if len(dst)+n > maxDecompressedBytes {
+		return nil, fmt.Errorf("%w: decompressed records exceed %d bytes", errBadBatch, maxDecompressedBytes)
+	}
+	out, err := snappy.Decode(nil, block)
+	if err != nil {
+		return nil, fmt.Errorf("%w: snappy: %v", errBadBatch, err)
+	}
+	return append(dst, out...), nil
+}
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerHandler(apiKeyDescribeConfigs, handleDescribeConfigs)
+	registerHandler(apiKeyAlterConfigs, handleAlterConfigs)
+	registerHandler(apiKeyIncrementalAlterConfigs, handleIncrementalAlterConfigs)
+}
+
+// ----- topic and broker configs -----
+
+// Config resource types.
+const (
+	resourceTopic  = int8(2)
+	resourceBroker = int8(4)
+)
+
+// Kafka config sources, as DescribeConfigs reports them.
+const (
+	configSourceTopic                = int8(1) // TOPIC_CONFIG
+	configSourceDynamicBroker        = int8(2) // DYNAMIC_BROKER_CONFIG
+	configSourceDynamicDefaultBroker = int8(3) // DYNAMIC_DEFAULT_BROKER_CONFIG
+	configSourceStaticBroker         = int8(4) // STATIC_BROKER_CONFIG
+	configSourceDefault              = int8(5) // DEFAULT_CONFIG
+)
+
+// Kafka config types, as DescribeConfigs reports them.
+const (
+	configTypeBoolean = int8(1)
+	configTypeString  = int8(2)
+	configTypeInt     = int8(3)
+	configTypeLong    = int8(5)
+	configTypeList    = int8(7)
+)
+
+// topicConfigDef is a config a topic may override. Topics that don't
+// override it fall back to brokerName, the broker-wide default.
+type topicConfigDef struct {
+	name         string
+	brokerName   string
+	typ          int8
+	defaultValue string
+	valid        []string // allowed values (each list element for LIST); nil allows any
+	min          int64    // smallest allowed INT/LONG
+	doc          string
+}
+
+// topicConfigDefs are the topic configs the broker knows, sorted by name.
+// Any other name is rejected with INVALID_CONFIG.
+var topicConfigDefs = []topicConfigDef{
+	{name: "cleanup.policy", brokerName: "log.cleanup.policy", typ: configTypeList, defaultValue: "delete",
+		valid: []string{"delete", "compact"}, doc: "What to do with old log segments: delete or compact them."},
+	{name: "compression.type", brokerName: "compression.type", typ: configTypeString, defaultValue: "producer",
+		valid: []string{"producer", "uncompressed", "gzip", "snappy", "lz4", "zstd"}, doc: "Compression of stored batches; producer keeps what the producer sent."},
+	{name: "delete.retention.ms", brokerName: "log.cleaner.delete.retention.ms", typ: configTypeLong, defaultValue: "86400000",
+		doc: "How long delete tombstones are kept in compacted topics."},
+	{name: "index.interval.bytes", brokerName: "log.index.interval.bytes", typ: configTypeInt, defaultValue: strconv.Itoa(defaultIndexIntervalBytes),
+		doc: "Bytes of log between offset index entries."},
+	{name: "max.message.bytes", brokerName: "message.max.bytes", typ: configTypeInt, defaultValue: "1048588",
+		doc: "Largest record batch size allowed."},
+	{name: "message.timestamp.type", brokerName: "log.message.timestamp.type", typ: configTypeString, defaultValue: "CreateTime",
+		valid: []string{"CreateTime", "LogAppendTime"}, doc: "Whether record timestamps are set by the producer or the broker."},
+	{name: "min.compaction.lag.ms", brokerName: "log.cleaner.min.compaction.lag.ms", typ: configTypeLong, defaultValue: "0",
+		doc: "How long a record stays uncompacted."},
+	{name: "min.insync.replicas", brokerName: "min.insync.replicas", typ: configTypeInt, defaultValue: "1", min: 1,
+		doc: "Replicas that must acknowledge an acks=all write."},
+	{name: "retention.bytes", brokerName: "log.retention.bytes", typ: configTypeLong, defaultValue: "-1", min: -1,
+		doc: "Largest size a partition may grow to before old segments are deleted; -1 for no limit."},
+	{name: "retention.ms", brokerName: "log.retention.ms", typ: configTypeLong, defaultValue: "604800000", min: -1,
+		doc: "How long a segment is kept before it is deleted; -1 for no limit."},
+	{name: "segment.bytes", brokerName: "log.segment.bytes", typ: configTypeInt, defaultValue: strconv.Itoa(defaultSegmentBytes), min: 14,
+		doc: "Size at which a new log segment is rolled."},
+	{name: "segment.ms", brokerName: "log.roll.ms", typ: configTypeLong, defaultValue: "604800000", min: 1,
+		doc: "Age at which a new log segment is rolled."},
+}
+
+func findTopicConfigDef(name string) (topicConfigDef, bool) {
+	i := slices.IndexFunc(topicConfigDefs, func(d topicConfigDef) bool { return d.name == name })
+	if i < 0 {
+		return topicConfigDef{}, false
+	}
+	return topicConfigDefs[i], true
+}
+
+// findBrokerConfigDef returns the topic config that falls back to the broker
+// config name.
+func findBrokerConfigDef(name string) (topicConfigDef, bool) {
+	i := slices.IndexFunc(topicConfigDefs, func(d topicConfigDef) bool { return d.brokerName == name })
+	if i < 0 {
+		return topicConfigDef{}, false
+	}
+	return topicConfigDefs[i], true
+}
+
+// configError is a config change rejected with INVALID_CONFIG.
+type configError struct{ msg string }
+
+func (e *configError) Error() string { return e.msg }
+
+// validateConfig checks a value for a config defined by d, set as name
+// (d's topic or broker name).
+func validateConfig(d topicConfigDef, name, value string) error {
+	invalid := func(reason string) error {
+		return &configError{fmt.Sprintf("Invalid value %s for configuration %s: %s", value, name, reason)}
+	}
+	switch d.typ {
+	case configTypeInt, configTypeLong:
+		bits, typeName := 64, "LONG"
+		if d.typ == configTypeInt {
+			bits, typeName = 32, "INT"
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, bits)
+		if err != nil {
+			return invalid("Not a number of type " + typeName)
+		}
+		if n < d.min {
+			return invalid(fmt.Sprintf("Value must be at least %d", d.min))
+		}
+	case configTypeList:
+		for _, v := range strings.Split(value, ",") {
+			if !slices.Contains(d.valid, strings.TrimSpace(v)) {
+				return invalid("String must be one of: " + strings.Join(d.valid, ", "))
+			}
+		}
+	default:
+		if d.valid != nil && !slices.Contains(d.valid, value) {
+			return invalid("String must be one of: " + strings.Join(d.valid, ", "))
+		}
+	}
+	return nil
+}
+
+// validateTopicConfig checks that name is a known topic config and value
+// fits it. Errors are worded like Kafka's, for the error_message.
+func validateTopicConfig(name, value string) error {
+	d, ok := findTopicConfigDef(name)
+	if !ok {
+		return &configError{"Unknown topic config name: " + name}
+	}
+	return validateConfig(d, name, value)
+}
+
+// configDef returns the definition of name for a topic or broker resource.
+// Only the broker configs topics fall back to can be changed at runtime.
+func configDef(resourceType int8, name string) (topicConfigDef, error) {
+	if resourceType == resourceTopic {
+		if d, ok := findTopicConfigDef(name); ok {
+			return d, nil
+		}
+		return topicConfigDef{}, &configError{"Unknown topic config name: " + name}
+	}
+	if d, ok := findBrokerConfigDef(name); ok {
+		return d, nil
+	}
+	return topicConfigDef{}, &configError{"Cannot update broker config dynamically: " + name}
+}
+
+// brokerName is this broker's resource name in config requests; "" names
+// the cluster-wide defaults. main sets it once brokerID is known.
+var brokerName = strconv.Itoa(int(brokerID))
+
+// staticConfigs are the broker configs set at startup that differ from
+// Kafka's defaults.
+func (s *logStore) staticConfigs() map[string]string {
+	configs := map[string]string{}
+	if s.segmentBytes != defaultSegmentBytes {
+		configs["log.segment.bytes"] = strconv.FormatInt(s.segmentBytes, 10)
+	}
+	if s.indexIntervalBytes != defaultIndexIntervalBytes {
+		configs["log.index.interval.bytes"] = strconv.FormatInt(s.indexIntervalBytes, 10)
+	}
+	return configs
+}
+
+// configEntry is one config as DescribeConfigs reports it.
+type configEntry struct {
+	name     string
+	value    string
+	readOnly bool
+	source   int8
+	typ      int8
+	doc      string
+	synonyms []configSynonym
+}
+
+// configSynonym is a setting a config's value may come from, in the order
+// they take precedence.
+type configSynonym struct {
+	name   string
+	value  string
+	source int8
+}
+
+// brokerSynonymsLocked returns the broker-level settings of d, highest
+// precedence first; the last is always Kafka's default. Caller holds mu.
+func (s *logStore) brokerSynonymsLocked(d topicConfigDef) []configSynonym {
+	var syns []configSynonym
+	if v, ok := s.brokerConfigs[brokerName][d.brokerName]; ok {
+		syns = append(syns, configSynonym{d.brokerName, v, configSourceDynamicBroker})
+	}
+	if v, ok := s.brokerConfigs[""][d.brokerName]; ok {
+		syns = append(syns, configSynonym{d.brokerName, v, configSourceDynamicDefaultBroker})
+	}
+	if v, ok := s.staticConfigs()[d.brokerName]; ok {
+		syns = append(syns, configSynonym{d.brokerName, v, configSourceStaticBroker})
+	}
+	return append(syns, configSynonym{d.brokerName, d.defaultValue, configSourceDefault})
+}
+
+// topicConfigValueLocked returns the value of config name in effect for
+// topic. Caller holds mu.
+func (s *logStore) topicConfigValueLocked(topic, name string) string {
+	if v, ok := s.configs[topic][name]; ok {
+		return v
+	}
+	d, _ := findTopicConfigDef(name)
+	return s.brokerSynonymsLocked(d)[0].value
+}
+
+// cleanupPolicyLocked reports whether topic's cleanup.policy includes
+// policy, delete or compact. Caller holds mu.
+func (s *logStore) cleanupPolicyLocked(topic, policy string) bool {
+	return slices.Contains(strings.Split(s.topicConfigValueLocked(topic, "cleanup.policy"), ","), policy)
+}
+
+// compressionCodecs are the codecs compression.type values other than
+// producer name.
+var compressionCodecs = map[string]int8{
+	"uncompressed": codecNone,
+	"gzip":         codecGzip,
+	"snappy":       codecSnappy,
+	"lz4":          codecLZ4,
+	"zstd":         codecZstd,
+}
+
+// compressionCodec returns the codec topic's compression.type stores
+// batches in, or false for producer, which stores them as they were sent.
+func (s *logStore) compressionCodec(topic string) (int8, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	codec, ok := compressionCodecs[s.topicConfigValueLocked(topic, "compression.type")]
+	return codec, ok
+}
+
+// segmentBytesLocked returns the size at which topic's segments roll.
+// Caller holds mu.
+func (s *logStore) segmentBytesLocked(topic string) int64 {
+	n, err := strconv.ParseInt(s.topicConfigValueLocked(topic, "segment.bytes"), 10, 64)
+	if err != nil {
+		return s.segmentBytes
+	}
+	return n
+}
+
+// topicConfigEntries describes every config of a topic with the given
+// overrides, or only those named in keys when keys isn't nil.
+func (s *logStore) topicConfigEntries(overrides map[string]string, keys []string) []configEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var entries []configEntry
+	for _, d := range topicConfigDefs {
+		if keys != nil && !slices.Contains(keys, d.name) {
+			continue
+		}
+		e := configEntry{name: d.name, typ: d.typ, doc: d.doc}
+		if v, ok := overrides[d.name]; ok {
+			e.synonyms = append(e.synonyms, configSynonym{d.name, v, configSourceTopic})
+		}
+		e.synonyms = append(e.synonyms, s.brokerSynonymsLocked(d)...)
+		e.value, e.source = e.synonyms[0].value, e.synonyms[0].source
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// brokerConfigEntries describes the configs of broker resource name, or
+// only those named in keys when keys isn't nil. This broker has the
+// defaults topics fall back to and a few read-only settings; the
+// cluster-wide resource, "", only has the defaults set on it.
+func (s *logStore) brokerConfigEntries(name string, keys []string) []configEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var entries []configEntry
+	for _, d := range topicConfigDefs {
+		e := configEntry{name: d.brokerName, typ: d.typ, doc: d.doc}
+		e.synonyms = s.brokerSynonymsLocked(d)
+		if name == "" {
+			if e.synonyms[0].source == configSourceDynamicBroker {
+				e.synonyms = e.synonyms[1:]
+			}
+			if e.synonyms[0].source != configSourceDynamicDefaultBroker {
+				continue
+			}
+		}
+		e.value, e.source = e.synonyms[0].value, e.synonyms[0].source
+		entries = append(entries, e)
+	}
+	readOnly := func(name, value string, typ int8, doc string) {
+		entries = append(entries, configEntry{name: name, value: value, readOnly: true, source: configSourceStaticBroker, typ: typ, doc: doc,
+			synonyms: []configSynonym{{name, value, configSourceStaticBroker}}})
+	}
+	if name != "" {
+		readOnly("advertised.listeners", advertisedListener, configTypeString, "Address clients are told to connect to.")
+		readOnly("auto.create.topics.enable", strconv.FormatBool(autoCreateTopics), configTypeBoolean, "Whether producing to or asking for metadata of an unknown topic creates it.")
+		readOnly("broker.id", brokerName, configTypeInt, "Id of this broker.")
+		readOnly("log.dirs", s.dir, configTypeString, "Directory holding the logs; empty when they are kept in memory.")
+		readOnly("num.partitions", strconv.Itoa(int(defaultPartitions)), configTypeInt, "Partition count of topics created without one.")
+		readOnly("socket.request.max.bytes", strconv.Itoa(maxRequestBytes), configTypeInt, "Largest request accepted.")
+	}
+
+	slices.SortFunc(entries, func(a, b configEntry) int { return strings.Compare(a.name, b.name) })
+	if keys != nil {
+		entries = slices.DeleteFunc(entries, func(e configEntry) bool { return !slices.Contains(keys, e.name) })
+	}
+	return entries
+}
+
+// configsFileName lives in the data directory next to the partition
+// directories and holds the config overrides of every topic and broker
+// resource. It is small, so it is rewritten whole on each change.
+const configsFileName = "__configs.json"
+
+type configsFile struct {
+	Topics  map[string]map[string]string `json:"topics"`
+	Brokers map[string]map[string]string `json:"brokers"`
+}
+
+// loadConfigs reads the overrides saved in dir, keeping those of topics that
+// still exist. Caller holds mu or owns s.
+func (s *logStore) loadConfigs() error {
+	b, err := os.ReadFile(filepath.Join(s.dir, configsFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var f configsFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("load %s: %w", configsFileName, err)
+	}
+	for topic, c := range f.Topics {
+		if _, ok := s.topics[topic]; ok && len(c) > 0 {
+			s.configs[topic] = c
+		}
+	}
+	for name, c := range f.Brokers {
+		if len(c) > 0 {
+			s.brokerConfigs[name] = c
+		}
+	}
+	return nil
+}
+
+// saveConfigsLocked writes every override to the data directory, if the
+// store has one. Caller holds mu.
+func (s *logStore) saveConfigsLocked() error {
+	if s.dir == "" {
+		return nil
+	}
+	b, err := json.Marshal(configsFile{Topics: s.configs, Brokers: s.brokerConfigs})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, configsFileName)
+	if err := os.WriteFile(path+".tmp", b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// topicConfig returns a copy of topic's config overrides, and whether the
+// topic exists.
+func (s *logStore) topicConfig(topic string) (map[string]string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.topics[topic]; !ok {
+		return nil, false
+	}
+	return maps.Clone(s.configs[topic]), true
+}
+
+// Config operations of IncrementalAlterConfigs.
+const (
+	configOpSet      = int8(0)
+	configOpDelete   = int8(1)
+	configOpAppend   = int8(2)
+	configOpSubtract = int8(3)
+)
+
+// configOp is one change to a config. AlterConfigs only ever sets.
+type configOp struct {
+	name  string
+	op    int8
+	value string
+}
+
+// alterConfigs applies ops, in order, to the overrides of a topic or broker
+// resource. With replace set the overrides are first cleared, as
+// AlterConfigs replaces the whole set. Nothing changes if any op is invalid,
+// or with validateOnly. The topic must exist.
+func (s *logStore) alterConfigs(resourceType int8, name string, ops []configOp, replace, validateOnly bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all := s.brokerConfigs
+	if resourceType == resourceTopic {
+		if _, ok := s.topics[name]; !ok {
+			return errNoSuchPartition
+		}
+		all = s.configs
+	}
+	configs := maps.Clone(all[name])
+	if configs == nil || replace {
+		configs = map[string]string{}
+	}
+	for _, op := range ops {
+		d, err := configDef(resourceType, op.name)
+		if err != nil {
+			return err
+		}
+		value := op.value
+		switch op.op {
+		case configOpSet:
+		case configOpDelete:
+			delete(configs, op.name)
+			continue
+		case configOpAppend, configOpSubtract:
+			if d.typ != configTypeList {
+				return &configError{fmt.Sprintf("Config value append or subtract is not allowed for config key: %s", op.name)}
+			}
+			current, ok := configs[op.name]
+			if !ok {
+				current = s.brokerSynonymsLocked(d)[0].value
+			}
+			list := strings.Split(current, ",")
+			for _, v := range strings.Split(op.value, ",") {
+				if op.op == configOpSubtract {
+					list = slices.DeleteFunc(list, func(item string) bool { return item == v })
+				} else if !slices.Contains(list, v) {
+					list = append(list, v)
+				}
+			}
+			value = strings.Join(list, ",")
+		default:
+			return &configError{fmt.Sprintf("Unknown config operation %d for config key: %s", op.op, op.name)}
+		}
+		if err := validateConfig(d, op.name, value); err != nil {
+			return err
+		}
+		configs[op.name] = value
+	}
+	if validateOnly {
+		return nil
+	}
+	if len(configs) == 0 {
+		delete(all, name)
+	} else {
+		all[name] = configs
+	}
+	return s.saveConfigsLocked()
+}
+
+// alterConfigsError maps an alterConfigs error to its Kafka error code and
+// message.
+func alterConfigsError(resourceName string, err error) (int16, string) {
+	var ce *configError
+	switch {
+	case err == nil:
+		return errNone, ""
+	case errors.Is(err, errNoSuchPartition):
+		return errUnknownTopicOrPartition, fmt.Sprintf("Topic '%s' does not exist", resourceName)
+	case errors.As(err, &ce):
+		return errInvalidConfig, ce.msg
+	default:
+		return errUnknownServerError, err.Error()
+	}
+}
+
+// checkConfigResource returns the error for a config request naming a
+// resource other than a topic, this broker or the cluster-wide defaults.
+func checkConfigResource(resourceType int8, name string) (int16, string) {
+	switch {
+	case resourceType == resourceTopic:
+		return errNone, ""
+	case resourceType != resourceBroker:
+		return errInvalidRequest, fmt.Sprintf("Unsupported resource type %d", resourceType)
+	case name != "" && name != brokerName:
+		return errInvalidRequest, fmt.Sprintf("Unexpected broker id, expected %s or empty string, but received %s", brokerName, name)
+	}
+	return errNone, ""
+}
+
+// authorizeConfigResource returns the error for a principal that may not
+// perform operation, DESCRIBE_CONFIGS or ALTER_CONFIGS, on a config
+// resource: a topic's configs are authorized on the topic, a broker's on
+// the cluster.
+func authorizeConfigResource(sess *session, operation string, resourceType int8, name string) (int16, string) {
+	if resourceType == resourceTopic {
+		if !sess.authorized(operation, aclResourceTopic, name) {
+			return errTopicAuthorizationFailed, "Authorization failed."
+		}
+		return errNone, ""
+	}
+	if !sess.authorized(operation, aclResourceCluster, clusterResourceName) {
+		return errClusterAuthorizationFailed, "Authorization failed."
+	}
+	return errNone, ""
+}
+
+// ----- DescribeConfigs (api key 32) -----
+
+type describeConfigsResult struct {
+	errCode      int16
+	errMessage   string
+	resourceType int8
+	resourceName string
+	configs      []configEntry
+}
+
+// handleDescribeConfigs parses a v4 DescribeConfigs request and describes
+// the configs of each topic or broker resource the principal may
+// DESCRIBE_CONFIGS.
+func handleDescribeConfigs(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	nResources, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]describeConfigsResult, 0, nResources)
+	keys := make([][]string, 0, nResources)
+	for i := 0; i < nResources; i++ {
+		var res describeConfigsResult
+		if res.resourceType, err = c.i8(); err != nil {
+			return nil, err
+		}
+		if res.resourceName, err = c.compactNullableString(); err != nil {
+			return nil, err
+		}
+		// configuration_keys: null asks for every config
+		nKeys, isNull, err := c.compactArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		var k []string
+		if !isNull {
+			k = make([]string, 0, nKeys)
+		}
+		for j := 0; j < nKeys; j++ {
+			key, err := c.compactNullableString()
+			if err != nil {
+				return nil, err
+			}
+			k = append(k, key)
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+		keys = append(keys, k)
+	}
+	includeSynonyms, err := c.boolean()
+	if err != nil {
+		return nil, err
+	}
+	includeDocs, err := c.boolean()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		res := &results[i]
+		if res.errCode, res.errMessage = checkConfigResource(res.resourceType, res.resourceName); res.errCode != errNone {
+			continue
+		}
+		if res.errCode, res.errMessage = authorizeConfigResource(sess, aclOpDescribeConfigs, res.resourceType, res.resourceName); res.errCode != errNone {
+			continue
+		}
+		if res.resourceType == resourceBroker {
+			res.configs = store.brokerConfigEntries(res.resourceName, keys[i])
+			continue
+		}
+		overrides, ok := store.topicConfig(res.resourceName)
+		if !ok {
+			res.errCode, res.errMessage = errUnknownTopicOrPartition, fmt.Sprintf("Topic '%s' does not exist", res.resourceName)
+			continue
+		}
+		res.configs = store.topicConfigEntries(overrides, keys[i])
+	}
+	return buildDescribeConfigsResponse(corrID, apiVer, results, includeSynonyms, includeDocs), nil
+}
+
+func buildDescribeConfigsResponse(corrID int32, apiVer int16, results []describeConfigsResult, includeSynonyms, includeDocs bool) []byte {
+	// Body (flex v4):
+	// throttle_time_ms (INT32)
+	// results (COMPACT_ARRAY) -> {error_code, error_message, resource_type,
+	//                             resource_name, configs (COMPACT_ARRAY), TAGS}
+	//   configs -> {name, value, read_only, config_source, is_sensitive,
+	//               synonyms (COMPACT_ARRAY), config_type, documentation, TAGS}
+	//     synonyms -> {name, value, source, TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putCompactArrayLen(len(results))
+	for _, res := range results {
+		r.putI16(res.errCode)
+		r.putCompactNullableString(res.errMessage)
+		r.putI8(res.resourceType)
+		r.putCompactString(res.resourceName)
+		r.putCompactArrayLen(len(res.configs))
+		for _, e := range res.configs {
+			r.putCompactString(e.name)
+			r.putCompactNullableString(e.value)
+			r.putBool(e.readOnly)
+			r.putI8(e.source)
+			r.putBool(false) // is_sensitive
+			if includeSynonyms {
+				r.putCompactArrayLen(len(e.synonyms))
+				for _, s := range e.synonyms {
+					r.putCompactString(s.name)
+					r.putCompactNullableString(s.value)
+					r.putI8(s.source)
+					r.putTags()
+				}
+			} else {
+				r.putCompactArrayLen(0)
+			}
+			r.putI8(e.typ)
+			if includeDocs {
+				r.putCompactNullableString(e.doc)
+			} else {
+				r.putCompactNullableString("")
+			}
+			r.putTags()
+		}
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyDescribeConfigs, apiVer))
+}
+
+// ----- AlterConfigs (api key 33) -----
+
+// alterConfigsResource is one resource of an AlterConfigs or
+// IncrementalAlterConfigs request, and its result.
+type alterConfigsResource struct {
+	resourceType int8
+	resourceName string
+	ops          []configOp
+	errCode      int16
+	errMessage   string
+}
+
+// handleAlterConfigs parses a v2 AlterConfigs request and replaces the whole
+// set of overrides of each resource.
+func handleAlterConfigs(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	return alterConfigs(c, corrID, apiKeyAlterConfigs, apiVer, sess, false)
+}
+
+// ----- IncrementalAlterConfigs (api key 44) -----
+
+// handleIncrementalAlterConfigs parses a v1 IncrementalAlterConfigs request
+// and applies each SET, DELETE, APPEND or SUBTRACT to the resource's
+// overrides.
+func handleIncrementalAlterConfigs(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	return alterConfigs(c, corrID, apiKeyIncrementalAlterConfigs, apiVer, sess, true)
+}
+
+// alterConfigs handles both AlterConfigs and IncrementalAlterConfigs, which
+// differ only in config_operation, present when incremental. Each resource
+// takes ALTER_CONFIGS on its topic, or on the cluster for a broker.
+func alterConfigs(c *cursor, corrID int32, apiKey, apiVer int16, sess *session, incremental bool) ([]byte, error) {
+	nResources, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	resources := make([]alterConfigsResource, 0, nResources)
+	for i := 0; i < nResources; i++ {
+		var res alterConfigsResource
+		if res.resourceType, err = c.i8(); err != nil {
+			return nil, err
+		}
+		if res.resourceName, err = c.compactNullableString(); err != nil {
+			return nil, err
+		}
+		// configs: {name, config_operation (incremental only), value, TAGS}
+		nConfigs, _, err := c.compactArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < nConfigs; j++ {
+			var op configOp
+			if op.name, err = c.compactNullableString(); err != nil {
+				return nil, err
+			}
+			if incremental {
+				if op.op, err = c.i8(); err != nil {
+					return nil, err
+				}
+			}
+			if op.value, err = c.compactNullableString(); err != nil {
+				return nil, err
+			}
+			if err := c.skipTagged(); err != nil {
+				return nil, err
+			}
+			res.ops = append(res.ops, op)
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+		resources = append(resources, res)
+	}
+	validateOnly, err := c.boolean()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+
+	for i := range resources {
+		res := &resources[i]
+		if res.errCode, res.errMessage = checkConfigResource(res.resourceType, res.resourceName); res.errCode != errNone {
+			continue
+		}
+		if res.errCode, res.errMessage = authorizeConfigResource(sess, aclOpAlterConfigs, res.resourceType, res.resourceName); res.errCode != errNone {
+			continue
+		}
+		err := store.alterConfigs(res.resourceType, res.resourceName, res.ops, !incremental, validateOnly)
+		res.errCode, res.errMessage = alterConfigsError(res.resourceName, err)
+		if res.errCode == errUnknownServerError {
+			sess.log.Error("failed to alter configs", "resource", res.resourceName, "correlation_id", corrID, "err", err)
+		}
+	}
+	return buildAlterConfigsResponse(corrID, apiKey, apiVer, resources), nil
+}
+
+func buildAlterConfigsResponse(corrID int32, apiKey, apiVer int16, resources []alterConfigsResource) []byte {
+	// Body (flex AlterConfigs v2, IncrementalAlterConfigs v1):
+	// throttle_time_ms (INT32)
+	// responses (COMPACT_ARRAY) -> {error_code, error_message, resource_type,
+	//                               resource_name, TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putCompactArrayLen(len(resources))
+	for _, res := range resources {
+		r.putI16(res.errCode)
+		r.putCompactNullableString(res.errMessage)
+		r.putI8(res.resourceType)
+		r.putCompactString(res.resourceName)
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKey, apiVer))
+}
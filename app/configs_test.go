@@ -0,0 +1,206 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+// createTopic sends a v7 CreateTopics request for one topic with configs
+// and returns its error code.
+func (c *testConn) createTopic(name string, partitions int32, configs map[string]string) int16 {
+	c.t.Helper()
+	var req respBuf
+	req.putCompactArrayLen(1)
+	req.putCompactString(name)
+	req.putI32(partitions)
+	req.putI16(-1)            // replication_factor: the default
+	req.putCompactArrayLen(0) // assignments
+	keys := slices.Sorted(maps.Keys(configs))
+	req.putCompactArrayLen(len(keys))
+	for _, k := range keys {
+		req.putCompactString(k)
+		req.putCompactString(configs[k])
+		req.putTags()
+	}
+	req.putTags()
+	req.putI32(1000)   // timeout_ms
+	req.putBool(false) // validate_only
+	req.putTags()
+	r := c.call(apiKeyCreateTopics, 7, req.b)
+	r.i32() // throttle_time_ms
+	if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+		c.t.Fatalf("%d topics (%v), want 1", n, err)
+	}
+	r.compactNullableString() // name
+	r.uuid()                  // topic_id
+	errCode, _ := r.i16()
+	return errCode
+}
+
+// describeConfigs sends a v4 DescribeConfigs request, with synonyms, for
+// one resource and returns its error code and configs, or only those named
+// in keys if keys isn't nil.
+func (c *testConn) describeConfigs(resourceType int8, name string, keys []string) (int16, []configEntry) {
+	c.t.Helper()
+	var req respBuf
+	req.putCompactArrayLen(1)
+	req.putI8(resourceType)
+	req.putCompactString(name)
+	if keys == nil {
+		req.putUvarint(0) // null
+	} else {
+		req.putCompactArrayLen(len(keys))
+		for _, k := range keys {
+			req.putCompactString(k)
+		}
+	}
+	req.putTags()
+	req.putBool(true)  // include_synonyms
+	req.putBool(false) // include_documentation
+	req.putTags()
+	r := c.call(apiKeyDescribeConfigs, 4, req.b)
+	r.i32() // throttle_time_ms
+	if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+		c.t.Fatalf("%d results (%v), want 1", n, err)
+	}
+	errCode, _ := r.i16()
+	r.compactNullableString() // error_message
+	r.i8()                    // resource_type
+	r.compactNullableString() // resource_name
+	n, _, _ := r.compactArrayLen()
+	var entries []configEntry
+	for range n {
+		var e configEntry
+		e.name, _ = r.compactNullableString()
+		e.value, _ = r.compactNullableString()
+		e.readOnly, _ = r.boolean()
+		e.source, _ = r.i8()
+		r.boolean() // is_sensitive
+		nSyns, _, _ := r.compactArrayLen()
+		for range nSyns {
+			var s configSynonym
+			s.name, _ = r.compactNullableString()
+			s.value, _ = r.compactNullableString()
+			s.source, _ = r.i8()
+			r.skipTagged()
+			e.synonyms = append(e.synonyms, s)
+		}
+		e.typ, _ = r.i8()
+		r.compactNullableString() // documentation
+		r.skipTagged()
+		entries = append(entries, e)
+	}
+	r.skipTagged()
+	if err := r.skipTagged(); err != nil {
+		c.t.Fatal(err)
+	}
+	checkConsumed(c.t, r)
+	return errCode, entries
+}
+
+// findConfig returns the entry for name in entries.
+func findConfig(t *testing.T, entries []configEntry, name string) configEntry {
+	t.Helper()
+	i := slices.IndexFunc(entries, func(e configEntry) bool { return e.name == name })
+	if i < 0 {
+		t.Fatalf("no %s config described", name)
+	}
+	return entries[i]
+}
+
+// A topic's configs are the overrides it was created with, falling back to
+// the broker's defaults.
+func TestDescribeConfigsOfCreatedTopic(t *testing.T) {
+	c := newTestServer(t).dial()
+	if errCode := c.createTopic("orders", 1, map[string]string{"retention.ms": "1000", "cleanup.policy": "compact"}); errCode != errNone {
+		t.Fatalf("CreateTopics = error %d", errCode)
+	}
+
+	errCode, entries := c.describeConfigs(resourceTopic, "orders", nil)
+	if errCode != errNone || len(entries) != len(topicConfigDefs) {
+		t.Fatalf("DescribeConfigs = error %d, %d configs; want all %d", errCode, len(entries), len(topicConfigDefs))
+	}
+	retention := findConfig(t, entries, "retention.ms")
+	wantSyns := []configSynonym{
+		{"retention.ms", "1000", configSourceTopic},
+		{"log.retention.ms", "604800000", configSourceDefault},
+	}
+	if retention.value != "1000" || retention.source != configSourceTopic || retention.typ != configTypeLong || !slices.Equal(retention.synonyms, wantSyns) {
+		t.Errorf("retention.ms = %+v, want 1000 from the topic config with synonyms %+v", retention, wantSyns)
+	}
+	if e := findConfig(t, entries, "cleanup.policy"); e.value != "compact" || e.source != configSourceTopic {
+		t.Errorf("cleanup.policy = %q from source %d, want compact from the topic config", e.value, e.source)
+	}
+	if e := findConfig(t, entries, "max.message.bytes"); e.value != "1048588" || e.source != configSourceDefault {
+		t.Errorf("max.message.bytes = %q from source %d, want the default", e.value, e.source)
+	}
+
+	// Asking for keys returns only those.
+	_, entries = c.describeConfigs(resourceTopic, "orders", []string{"retention.ms"})
+	if len(entries) != 1 || entries[0].name != "retention.ms" || entries[0].value != "1000" {
+		t.Errorf("DescribeConfigs of retention.ms = %+v, want just retention.ms=1000", entries)
+	}
+}
+
+// incrementalAlterConfigs sends a v1 IncrementalAlterConfigs request
+// applying ops to one resource and returns its error code.
+func (c *testConn) incrementalAlterConfigs(resourceType int8, name string, ops ...configOp) int16 {
+	c.t.Helper()
+	var req respBuf
+	req.putCompactArrayLen(1)
+	req.putI8(resourceType)
+	req.putCompactString(name)
+	req.putCompactArrayLen(len(ops))
+	for _, op := range ops {
+		req.putCompactString(op.name)
+		req.putI8(op.op)
+		req.putCompactNullableString(op.value)
+		req.putTags()
+	}
+	req.putTags()
+	req.putBool(false) // validate_only
+	req.putTags()
+	r := c.call(apiKeyIncrementalAlterConfigs, 1, req.b)
+	r.i32() // throttle_time_ms
+	if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+		c.t.Fatalf("%d results (%v), want 1", n, err)
+	}
+	errCode, _ := r.i16()
+	return errCode
+}
+
+func TestIncrementalAlterConfigs(t *testing.T) {
+	c := newTestServer(t).dial()
+	if errCode := c.createTopic("orders", 1, nil); errCode != errNone {
+		t.Fatalf("CreateTopics = error %d", errCode)
+	}
+	retention := func() configEntry {
+		t.Helper()
+		_, entries := c.describeConfigs(resourceTopic, "orders", []string{"retention.ms"})
+		return findConfig(t, entries, "retention.ms")
+	}
+
+	if errCode := c.incrementalAlterConfigs(resourceTopic, "orders", configOp{"retention.ms", configOpSet, "5000"}); errCode != errNone {
+		t.Fatalf("setting retention.ms = error %d", errCode)
+	}
+	if e := retention(); e.value != "5000" || e.source != configSourceTopic {
+		t.Errorf("retention.ms after setting it = %q from source %d, want 5000 from the topic config", e.value, e.source)
+	}
+
+	// An invalid value changes nothing.
+	if errCode := c.incrementalAlterConfigs(resourceTopic, "orders", configOp{"retention.ms", configOpSet, "soon"}); errCode != errInvalidConfig {
+		t.Errorf("setting retention.ms to soon = error %d, want %d", errCode, errInvalidConfig)
+	}
+	if e := retention(); e.value != "5000" {
+		t.Errorf("retention.ms after an invalid change = %q, want 5000", e.value)
+	}
+
+	// Deleting the override falls back to the default.
+	if errCode := c.incrementalAlterConfigs(resourceTopic, "orders", configOp{"retention.ms", configOpDelete, ""}); errCode != errNone {
+		t.Fatalf("deleting retention.ms = error %d", errCode)
+	}
+	if e := retention(); e.value != "604800000" || e.source != configSourceDefault {
+		t.Errorf("retention.ms after deleting it = %q from source %d, want the default", e.value, e.source)
+	}
+}
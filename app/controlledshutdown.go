@@ -0,0 +1,44 @@
+package main
+
+// ----- ControlledShutdown (api key 7) -----
+
+func init() {
+	registerHandler(apiKeyControlledShutdown, handleControlledShutdown)
+}
+
+// handleControlledShutdown parses a v3 ControlledShutdown request, in which
+// a broker asks the controller to move its partition leaders elsewhere
+// before it stops. We are the only broker, so there is nowhere to move them:
+// we answer that none remain to be moved and let the broker be stopped the
+// usual way, with SIGTERM. Another broker id gets BROKER_NOT_AVAILABLE.
+func handleControlledShutdown(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	id, err := c.i32()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.i64(); err != nil { // broker_epoch
+		return nil, err
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+
+	errCode := errNone
+	if id != brokerID {
+		errCode = errBrokerNotAvailable
+	}
+	sess.log.Info("controlled shutdown requested", "broker_id", id)
+	return buildControlledShutdownResponse(corrID, apiVer, errCode), nil
+}
+
+func buildControlledShutdownResponse(corrID int32, apiVer int16, errCode int16) []byte {
+	// Body (flex v3):
+	// error_code (INT16)
+	// remaining_partitions (COMPACT_ARRAY) -> {topic_name, partition_index, TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI16(errCode)
+	r.putCompactArrayLen(0) // remaining_partitions: none to move
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyControlledShutdown, apiVer))
+}
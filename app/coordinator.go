@@ -0,0 +1,723 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----- consumer group coordinator -----
+
+// Kafka's group.min.session.timeout.ms and group.max.session.timeout.ms
+// defaults.
+const (
+	minSessionTimeout = 6 * time.Second
+	maxSessionTimeout = 30 * time.Minute
+)
+
+type groupState int
+
+const (
+	groupEmpty               groupState = iota // no members
+	groupPreparingRebalance                    // waiting for every member to rejoin
+	groupCompletingRebalance                   // waiting for the leader's assignment
+	groupStable                                // assignment handed out
+)
+
+// String returns the state name Kafka uses in ListGroups and DescribeGroups.
+func (s groupState) String() string {
+	switch s {
+	case groupPreparingRebalance:
+		return "PreparingRebalance"
+	case groupCompletingRebalance:
+		return "CompletingRebalance"
+	case groupStable:
+		return "Stable"
+	default:
+		return "Empty"
+	}
+}
+
+type memberProtocol struct {
+	name     string
+	metadata []byte
+}
+
+type groupMember struct {
+	id               string
+	instanceID       string // group.instance.id of a static member, "" otherwise
+	clientID         string
+	clientHost       string
+	protocols        []memberProtocol
+	sessionTimeout   time.Duration
+	rebalanceTimeout time.Duration
+	joined           bool // has rejoined during the current rebalance
+	assignment       []byte
+	lastHeartbeat    time.Time
+}
+
+// metadata returns the member's metadata for protocol name.
+func (m *groupMember) metadata(name string) []byte {
+	for _, p := range m.protocols {
+		if p.name == name {
+			return p.metadata
+		}
+	}
+	return nil
+}
+
+func (m *groupMember) supports(name string) bool {
+	for _, p := range m.protocols {
+		if p.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// group is one consumer group. A rebalance runs like Kafka's: once it starts,
+// JoinGroup calls wait until every member has rejoined (or the rebalance
+// timeout evicts the stragglers), then all of them get the new generation at
+// once and the leader's SyncGroup hands out the assignment.
+type group struct {
+	id           string
+	state        groupState
+	protocolType string
+	protocolName string
+	generation   int32
+	leader       string
+	members      map[string]*groupMember
+	order        []string             // member ids in join order
+	pending      map[string]time.Time // ids handed out with MEMBER_ID_REQUIRED, until they expire
+	joinDone     chan struct{}        // closed when the current rebalance's join phase ends
+	joinDeadline time.Time            // when stragglers get evicted from it
+	synced       chan struct{}        // closed when the leader's assignment arrives
+	offsets      map[topicPartition]committedOffset
+}
+
+func newGroup(id string) *group {
+	return &group{
+		id:       id,
+		members:  map[string]*groupMember{},
+		pending:  map[string]time.Time{},
+		offsets:  map[topicPartition]committedOffset{},
+		joinDone: make(chan struct{}),
+		synced:   make(chan struct{}),
+	}
+}
+
+// prepareRebalance starts a rebalance unless one is already collecting
+// members. Followers waiting for an assignment are woken to rejoin.
+func (g *group) prepareRebalance() {
+	if g.state == groupPreparingRebalance {
+		return
+	}
+	if g.state == groupCompletingRebalance {
+		close(g.synced)
+	}
+	g.state = groupPreparingRebalance
+	g.joinDone = make(chan struct{})
+	g.synced = make(chan struct{})
+	var timeout time.Duration
+	for _, m := range g.members {
+		m.joined = false
+		m.assignment = nil
+		timeout = max(timeout, m.rebalanceTimeout)
+	}
+	g.joinDeadline = time.Now().Add(timeout)
+}
+
+// maybeCompleteJoin ends the join phase once every member has rejoined, or
+// regardless when force is set (the rebalance timed out), dropping members
+// that never came back.
+func (g *group) maybeCompleteJoin(force bool) {
+	if g.state != groupPreparingRebalance {
+		return
+	}
+	for id, m := range g.members {
+		if m.joined {
+			continue
+		}
+		if !force {
+			return
+		}
+		g.removeMember(id)
+	}
+
+	g.generation++
+	if _, ok := g.members[g.leader]; !ok {
+		g.leader = ""
+		if len(g.order) > 0 {
+			g.leader = g.order[0]
+		}
+	}
+	g.protocolName = g.selectProtocol()
+	g.state = groupCompletingRebalance
+	if len(g.members) == 0 {
+		g.state = groupEmpty
+		g.protocolType, g.protocolName = "", ""
+	}
+	now := time.Now()
+	for _, m := range g.members {
+		// Members were blocked in JoinGroup, unable to heartbeat.
+		m.lastHeartbeat = now
+	}
+	close(g.joinDone)
+}
+
+// selectProtocol picks the leader's most preferred protocol that every
+// member supports.
+func (g *group) selectProtocol() string {
+	leader := g.members[g.leader]
+	if leader == nil {
+		return ""
+	}
+	for _, p := range leader.protocols {
+		all := true
+		for _, m := range g.members {
+			all = all && m.supports(p.name)
+		}
+		if all {
+			return p.name
+		}
+	}
+	return ""
+}
+
+// acceptsProtocols reports whether a member offering protocols could join
+// without leaving the group with no protocol in common.
+func (g *group) acceptsProtocols(protocolType string, protocols []memberProtocol, self string) bool {
+	if len(protocols) == 0 {
+		return false
+	}
+	if len(g.members) == 0 {
+		return true
+	}
+	if protocolType != g.protocolType {
+		return false
+	}
+	for _, p := range protocols {
+		all := true
+		for id, m := range g.members {
+			all = all && (id == self || m.supports(p.name))
+		}
+		if all {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *group) addMember(m *groupMember) {
+	g.members[m.id] = m
+	g.order = append(g.order, m.id)
+	delete(g.pending, m.id)
+}
+
+func (g *group) removeMember(id string) {
+	delete(g.members, id)
+	for i, mid := range g.order {
+		if mid == id {
+			g.order = append(g.order[:i], g.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// staticMember returns the member holding group.instance.id instanceID, or
+// nil if there is none.
+func (g *group) staticMember(instanceID string) *groupMember {
+	for _, m := range g.members {
+		if m.instanceID == instanceID {
+			return m
+		}
+	}
+	return nil
+}
+
+// fenced reports whether instanceID now belongs to a member other than
+// memberID: a newer instance of that static member has taken its place.
+func (g *group) fenced(memberID, instanceID string) bool {
+	if instanceID == "" {
+		return false
+	}
+	m := g.staticMember(instanceID)
+	return m != nil && m.id != memberID
+}
+
+// replaceMember gives m the member id id, keeping its place in the join
+// order, its assignment and, if it leads the group, the leadership.
+func (g *group) replaceMember(m *groupMember, id string) {
+	delete(g.members, m.id)
+	for i, mid := range g.order {
+		if mid == m.id {
+			g.order[i] = id
+		}
+	}
+	if g.leader == m.id {
+		g.leader = id
+	}
+	m.id = id
+	g.members[id] = m
+}
+
+// membersLeft rebalances the group after removeMember calls.
+func (g *group) membersLeft() {
+	if g.state == groupEmpty && len(g.members) == 0 {
+		return
+	}
+	g.prepareRebalance()
+	g.maybeCompleteJoin(false)
+}
+
+// groupCoordinator holds every consumer group. As the only broker we
+// coordinate all of them.
+type groupCoordinator struct {
+	mu     sync.Mutex
+	groups map[string]*group
+
+	offsetsLog *logStore // holds offsetsTopic; nil keeps offsets in memory only
+}
+
+func newGroupCoordinator() *groupCoordinator {
+	return &groupCoordinator{groups: map[string]*group{}}
+}
+
+var coordinator = newGroupCoordinator()
+
+// newMemberID returns a member id in Kafka's "clientId-uuid" form.
+func newMemberID(clientID string) string {
+	return clientID + "-" + uuidString(randomUUID())
+}
+
+type joinGroupRequest struct {
+	groupID          string
+	memberID         string
+	instanceID       string
+	protocolType     string
+	protocols        []memberProtocol
+	sessionTimeout   time.Duration
+	rebalanceTimeout time.Duration
+	clientID         string
+	clientHost       string
+}
+
+type joinGroupMember struct {
+	id         string
+	instanceID string
+	metadata   []byte
+}
+
+type joinGroupResult struct {
+	errCode        int16
+	generation     int32
+	protocolType   string
+	protocolName   string
+	leader         string
+	skipAssignment bool // the leader is to keep the current assignment
+	memberID       string
+	members        []joinGroupMember // only for the leader
+}
+
+// joinGroup adds or refreshes a member. A new member first gets
+// MEMBER_ID_REQUIRED with a freshly minted id to rejoin with, as modern
+// clients expect; static members (group.instance.id set) skip that step.
+// During a rebalance the call waits for the join phase to end.
+//
+// A static member that restarts rejoins without a member id. It takes over
+// its previous instance's slot under a new id, fencing the old one, and
+// while the group is stable keeps its assignment without a rebalance.
+func (gc *groupCoordinator) joinGroup(req joinGroupRequest) joinGroupResult {
+	res := joinGroupResult{generation: -1, memberID: req.memberID}
+	switch {
+	case req.groupID == "":
+		res.errCode = errInvalidGroupID
+		return res
+	case req.sessionTimeout < minSessionTimeout || req.sessionTimeout > maxSessionTimeout:
+		res.errCode = errInvalidSessionTimeout
+		return res
+	}
+
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	g := gc.groups[req.groupID]
+	if g == nil {
+		if req.memberID != "" {
+			res.errCode = errUnknownMemberID
+			return res
+		}
+		g = newGroup(req.groupID)
+		gc.groups[req.groupID] = g
+	}
+	if !g.acceptsProtocols(req.protocolType, req.protocols, req.memberID) {
+		res.errCode = errInconsistentGroupProtocol
+		return res
+	}
+
+	replaced := false
+	switch {
+	case req.memberID == "":
+		res.memberID = newMemberID(req.clientID)
+		if req.instanceID == "" {
+			g.pending[res.memberID] = time.Now().Add(req.sessionTimeout)
+			res.errCode = errMemberIDRequired
+			return res
+		}
+		if old := g.staticMember(req.instanceID); old != nil {
+			g.replaceMember(old, res.memberID)
+			replaced = true
+		}
+	case g.fenced(req.memberID, req.instanceID):
+		res.errCode = errFencedInstanceID
+		return res
+	}
+
+	m := g.members[res.memberID]
+	rebalance := false
+	switch {
+	case m != nil && replaced:
+		rebalance = !sameProtocols(m.protocols, req.protocols) ||
+			// A rebalance under way may have handed the old id to the
+			// leader to assign.
+			g.state != groupStable
+	case m != nil:
+		rebalance = !sameProtocols(m.protocols, req.protocols) ||
+			// The leader rejoining asks for a new assignment, e.g. because
+			// partitions were added to a subscribed topic.
+			m.id == g.leader
+	case req.memberID == "" && req.instanceID != "":
+		m = &groupMember{id: res.memberID}
+		g.addMember(m)
+		rebalance = true
+	default:
+		if _, ok := g.pending[res.memberID]; !ok {
+			res.errCode = errUnknownMemberID
+			return res
+		}
+		m = &groupMember{id: res.memberID}
+		g.addMember(m)
+		rebalance = true
+	}
+	m.instanceID = req.instanceID
+	m.clientID = req.clientID
+	m.clientHost = req.clientHost
+	m.protocols = req.protocols
+	m.sessionTimeout = req.sessionTimeout
+	m.rebalanceTimeout = req.rebalanceTimeout
+	m.lastHeartbeat = time.Now()
+	if len(g.members) == 1 {
+		g.protocolType = req.protocolType
+	}
+
+	if rebalance || g.state == groupPreparingRebalance {
+		g.prepareRebalance()
+		m.joined = true
+		g.maybeCompleteJoin(false)
+		// Wait for the other members; expireMembers ends the join phase at
+		// the rebalance timeout.
+		done := g.joinDone
+		gc.mu.Unlock()
+		<-done
+		gc.mu.Lock()
+		if gc.groups[req.groupID] != g || g.members[m.id] != m {
+			res.errCode = errUnknownMemberID
+			return res
+		}
+		if m.id != res.memberID {
+			res.errCode = errFencedInstanceID
+			return res
+		}
+	}
+	// A follower rejoining with nothing new just gets the current generation.
+
+	res.generation = g.generation
+	res.protocolType = g.protocolType
+	res.protocolName = g.protocolName
+	res.leader = g.leader
+	if m.id == g.leader {
+		res.skipAssignment = replaced && !rebalance
+		for _, id := range g.order {
+			mm := g.members[id]
+			res.members = append(res.members, joinGroupMember{id: mm.id, instanceID: mm.instanceID, metadata: mm.metadata(g.protocolName)})
+		}
+	}
+	return res
+}
+
+func sameProtocols(a, b []memberProtocol) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].name != b[i].name || string(a[i].metadata) != string(b[i].metadata) {
+			return false
+		}
+	}
+	return true
+}
+
+type syncGroupResult struct {
+	errCode      int16
+	protocolType string
+	protocolName string
+	assignment   []byte
+}
+
+// syncGroup stores the leader's assignments, or with -group-assignor our
+// own, and hands each member its own. A follower that syncs before the
+// leader waits for it, up to its rebalance timeout.
+func (gc *groupCoordinator) syncGroup(groupID, memberID, instanceID string, generation int32, assignments map[string][]byte) syncGroupResult {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	g := gc.groups[groupID]
+	if g != nil && g.fenced(memberID, instanceID) {
+		return syncGroupResult{errCode: errFencedInstanceID}
+	}
+	if g == nil || g.members[memberID] == nil {
+		return syncGroupResult{errCode: errUnknownMemberID}
+	}
+	m := g.members[memberID]
+	switch {
+	case g.state == groupPreparingRebalance:
+		return syncGroupResult{errCode: errRebalanceInProgress}
+	case generation != g.generation:
+		return syncGroupResult{errCode: errIllegalGeneration}
+	}
+
+	if memberID == g.leader && g.state == groupCompletingRebalance {
+		if groupAssignor != "" && g.protocolType == "consumer" {
+			assignments = g.assignLocked(groupAssignor)
+		}
+		for id, mm := range g.members {
+			mm.assignment = assignments[id]
+		}
+		g.state = groupStable
+		close(g.synced)
+	}
+	if g.state != groupStable {
+		synced := g.synced
+		gc.mu.Unlock()
+		timer := time.NewTimer(m.rebalanceTimeout)
+		select {
+		case <-synced:
+		case <-timer.C:
+		}
+		timer.Stop()
+		gc.mu.Lock()
+		// The group may have moved on, or dropped us, while we waited.
+		if gc.groups[groupID] != g || g.members[memberID] != m || g.generation != generation || g.state != groupStable {
+			return syncGroupResult{errCode: errRebalanceInProgress}
+		}
+	}
+	m.lastHeartbeat = time.Now()
+	return syncGroupResult{
+		protocolType: g.protocolType,
+		protocolName: g.protocolName,
+		assignment:   m.assignment,
+	}
+}
+
+// heartbeat records that a member is alive. During a rebalance the member is
+// told to rejoin with REBALANCE_IN_PROGRESS.
+func (gc *groupCoordinator) heartbeat(groupID, memberID, instanceID string, generation int32) int16 {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	g := gc.groups[groupID]
+	if g != nil && g.fenced(memberID, instanceID) {
+		return errFencedInstanceID
+	}
+	if g == nil || g.members[memberID] == nil {
+		return errUnknownMemberID
+	}
+	g.members[memberID].lastHeartbeat = time.Now()
+	switch {
+	case g.state == groupPreparingRebalance:
+		return errRebalanceInProgress
+	case generation != g.generation:
+		return errIllegalGeneration
+	}
+	return errNone
+}
+
+type leavingMember struct {
+	id         string
+	instanceID string
+	errCode    int16
+}
+
+// leaveGroup removes members from a group, rebalancing whoever remains.
+// Each member's errCode is set to NONE, UNKNOWN_MEMBER_ID or
+// FENCED_INSTANCE_ID.
+//
+// A static member leaving by itself keeps its slot, so that it can come
+// back without a rebalance; its session timeout still applies. Removing it
+// takes naming it by group.instance.id alone, as admin clients do.
+func (gc *groupCoordinator) leaveGroup(groupID string, leaving []leavingMember) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	g := gc.groups[groupID]
+	left := false
+	for i := range leaving {
+		lm := &leaving[i]
+		lm.errCode = errUnknownMemberID
+		if g == nil {
+			continue
+		}
+		id := lm.id
+		if id == "" && lm.instanceID != "" {
+			for mid, m := range g.members {
+				if m.instanceID == lm.instanceID {
+					id = mid
+				}
+			}
+		}
+		switch {
+		case g.fenced(id, lm.instanceID):
+			lm.errCode = errFencedInstanceID
+			continue
+		case g.members[id] == nil:
+			continue
+		case lm.id != "" && lm.instanceID != "":
+			lm.errCode = errNone
+			continue
+		}
+		g.removeMember(id)
+		lm.errCode = errNone
+		left = true
+	}
+	if left {
+		g.membersLeft()
+	}
+}
+
+type groupListing struct {
+	id           string
+	protocolType string
+	state        string
+}
+
+// listGroups returns every group, sorted by id. A non-empty states keeps only
+// groups in one of them, compared case-insensitively as Kafka does.
+func (gc *groupCoordinator) listGroups(states []string) []groupListing {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	var out []groupListing
+	for id, g := range gc.groups {
+		state := g.state.String()
+		keep := len(states) == 0
+		for _, s := range states {
+			keep = keep || strings.EqualFold(s, state)
+		}
+		if keep {
+			out = append(out, groupListing{id: id, protocolType: g.protocolType, state: state})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].id < out[j].id })
+	return out
+}
+
+type groupDescription struct {
+	errCode      int16
+	id           string
+	state        string
+	protocolType string
+	protocolName string
+	members      []memberDescription
+}
+
+type memberDescription struct {
+	id         string
+	instanceID string
+	clientID   string
+	clientHost string
+	metadata   []byte
+	assignment []byte
+}
+
+// describeGroups reports the state and membership of each group in ids, in
+// order. An unknown group is described as "Dead" with no members, like a
+// v5 DescribeGroups from Kafka.
+func (gc *groupCoordinator) describeGroups(ids []string) []groupDescription {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	out := make([]groupDescription, 0, len(ids))
+	for _, id := range ids {
+		d := groupDescription{id: id, state: "Dead"}
+		g := gc.groups[id]
+		switch {
+		case id == "":
+			d.errCode = errInvalidGroupID
+		case g != nil:
+			d.state = g.state.String()
+			d.protocolType = g.protocolType
+			// Protocol, metadata and assignment are only settled once the
+			// group is Stable.
+			stable := g.state == groupStable
+			if stable {
+				d.protocolName = g.protocolName
+			}
+			for _, mid := range g.order {
+				m := g.members[mid]
+				md := memberDescription{id: m.id, instanceID: m.instanceID, clientID: m.clientID, clientHost: m.clientHost}
+				if stable {
+					md.metadata = m.metadata(g.protocolName)
+					md.assignment = m.assignment
+				}
+				d.members = append(d.members, md)
+			}
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+// expireMembers drops members whose session timed out before now and
+// rebalances the rest of their group, ends join phases that ran past their
+// rebalance timeout, and forgets member ids handed out with
+// MEMBER_ID_REQUIRED that never came back.
+func (gc *groupCoordinator) expireMembers(now time.Time) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	for _, g := range gc.groups {
+		expired := false
+		for id, m := range g.members {
+			// Members blocked in JoinGroup can't heartbeat.
+			if m.joined && g.state == groupPreparingRebalance {
+				continue
+			}
+			if now.Sub(m.lastHeartbeat) > m.sessionTimeout {
+				g.removeMember(id)
+				expired = true
+			}
+		}
+		if expired {
+			g.membersLeft()
+		}
+		if g.state == groupPreparingRebalance && now.After(g.joinDeadline) {
+			g.maybeCompleteJoin(true)
+		}
+		for id, deadline := range g.pending {
+			if now.After(deadline) {
+				delete(g.pending, id)
+			}
+		}
+	}
+}
+
+// expireLoop runs expireMembers every interval, so a consumer that dies
+// without leaving can't wedge its group forever.
+func (gc *groupCoordinator) expireLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		gc.expireMembers(now)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+// ----- DeleteRecords (api key 21) -----
+
+func init() {
+	registerHandler(apiKeyDeleteRecords, handleDeleteRecords)
+}
+
+type deleteRecordsPartitionResult struct {
+	index        int32
+	lowWatermark int64
+	errCode      int16
+}
+
+type deleteRecordsTopicResult struct {
+	name       string
+	partitions []deleteRecordsPartitionResult
+}
+
+// handleDeleteRecords parses a v2 DeleteRecords request and moves each
+// partition's log start offset (its low watermark) up to the given offset,
+// -1 meaning the high watermark. Whole segments below it are deleted. It
+// takes DELETE on the topic.
+func handleDeleteRecords(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	nTopics, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]deleteRecordsTopicResult, 0, nTopics)
+	for i := 0; i < nTopics; i++ {
+		name, err := c.compactNullableString()
+		if err != nil {
+			return nil, err
+		}
+		nParts, _, err := c.compactArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		tr := deleteRecordsTopicResult{name: name}
+		allowed := sess.authorized(aclOpDelete, aclResourceTopic, name)
+		for j := 0; j < nParts; j++ {
+			index, err := c.i32()
+			if err != nil {
+				return nil, err
+			}
+			offset, err := c.i64()
+			if err != nil {
+				return nil, err
+			}
+			if err := c.skipTagged(); err != nil {
+				return nil, err
+			}
+
+			pr := deleteRecordsPartitionResult{index: index}
+			if !allowed {
+				pr.errCode, pr.lowWatermark = errTopicAuthorizationFailed, -1
+				tr.partitions = append(tr.partitions, pr)
+				continue
+			}
+			pr.lowWatermark, err = store.deleteRecords(name, index, offset)
+			pr.errCode = kafkaErrorCode(err)
+			if pr.errCode == errUnknownServerError {
+				sess.log.Error("failed to delete records", "topic", name, "partition", index, "correlation_id", corrID, "err", err)
+			}
+			tr.partitions = append(tr.partitions, pr)
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+		results = append(results, tr)
+	}
+	if _, err := c.i32(); err != nil { // timeout_ms
+		return nil, err
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+	return buildDeleteRecordsResponse(corrID, apiVer, results), nil
+}
+
+func buildDeleteRecordsResponse(corrID int32, apiVer int16, results []deleteRecordsTopicResult) []byte {
+	// Body (flex v2):
+	// throttle_time_ms (INT32)
+	// topics (COMPACT_ARRAY) -> {name, partitions (COMPACT_ARRAY), TAGS}
+	//   partitions -> {partition_index, low_watermark, error_code, TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putCompactArrayLen(len(results))
+	for _, tr := range results {
+		r.putCompactString(tr.name)
+		r.putCompactArrayLen(len(tr.partitions))
+		for _, pr := range tr.partitions {
+			r.putI32(pr.index)
+			r.putI64(pr.lowWatermark)
+			r.putI16(pr.errCode)
+			r.putTags()
+		}
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyDeleteRecords, apiVer))
+}
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+// deleteRecords sends a v2 DeleteRecords request for topic/partition up to
+// offset and returns the partition's error code and low watermark.
+func (c *testConn) deleteRecords(topic string, partition int32, offset int64) (int16, int64) {
+	c.t.Helper()
+	var req respBuf
+	req.putCompactArrayLen(1)
+	req.putCompactString(topic)
+	req.putCompactArrayLen(1)
+	req.putI32(partition)
+	req.putI64(offset)
+	req.putTags()
+	req.putTags()
+	req.putI32(1000) // timeout_ms
+	req.putTags()
+	r := c.call(apiKeyDeleteRecords, 2, req.b)
+	r.i32() // throttle_time_ms
+	if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+		c.t.Fatalf("%d topics (%v), want 1", n, err)
+	}
+	r.compactNullableString() // name
+	if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+		c.t.Fatalf("%d partitions (%v), want 1", n, err)
+	}
+	r.i32() // partition_index
+	lowWatermark, _ := r.i64()
+	errCode, _ := r.i16()
+	return errCode, lowWatermark
+}
+
+func TestDeleteRecords(t *testing.T) {
+	c := newTestServer(t).dial()
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	c.produce("orders", 0, testBatch("a", "b"))
+	c.produce("orders", 0, testBatch("c"))
+	c.produce("orders", 0, testBatch("d"))
+
+	if errCode, low := c.deleteRecords("orders", 0, 2); errCode != errNone || low != 2 {
+		t.Fatalf("DeleteRecords up to 2 = error %d, low watermark %d; want 2", errCode, low)
+	}
+	if pr := c.fetchOne("orders", 0, 0); pr.errCode != errOffsetOutOfRange {
+		t.Errorf("fetch from 0 = error %d, want %d", pr.errCode, errOffsetOutOfRange)
+	}
+	pr := c.fetchOne("orders", 0, 2)
+	if pr.errCode != errNone || pr.logStart != 2 || len(pr.records) != 2 ||
+		peekBatch(pr.records[0]).baseOffset != 2 || peekBatch(pr.records[1]).baseOffset != 3 {
+		t.Errorf("fetch from 2 = error %d, log start %d, %d batches; want the batches at 2 and 3", pr.errCode, pr.logStart, len(pr.records))
+	}
+
+	// Past the high watermark is out of range; -1 means the high watermark.
+	if errCode, _ := c.deleteRecords("orders", 0, 5); errCode != errOffsetOutOfRange {
+		t.Errorf("DeleteRecords up to 5 = error %d, want %d", errCode, errOffsetOutOfRange)
+	}
+	if errCode, low := c.deleteRecords("orders", 0, -1); errCode != errNone || low != 4 {
+		t.Errorf("DeleteRecords up to -1 = error %d, low watermark %d; want 4", errCode, low)
+	}
+}
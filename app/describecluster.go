@@ -0,0 +1,68 @@
+package main
+
+// ----- DescribeCluster (api key 60) -----
+
+func init() {
+	registerHandler(apiKeyDescribeCluster, handleDescribeCluster)
+}
+
+// endpointTypeBroker asks DescribeCluster for brokers; 2 asks a KRaft
+// controller for controllers (KIP-919).
+const endpointTypeBroker = int8(1)
+
+// clusterAuthorizedOperationsOmitted is the authorized operations bitfield
+// of a response that doesn't report them (Integer.MIN_VALUE in Kafka).
+const clusterAuthorizedOperationsOmitted = int32(-2147483648)
+
+// handleDescribeCluster parses a v1 DescribeCluster request and describes
+// this one-broker cluster: its id, us as controller and our advertised
+// listener as the only broker. Asking for controller endpoints gets
+// MISMATCHED_ENDPOINT_TYPE, as from any Kafka broker.
+func handleDescribeCluster(c *cursor, corrID int32, apiVer int16, _ *session) ([]byte, error) {
+	if _, err := c.boolean(); err != nil { // include_cluster_authorized_operations
+		return nil, err
+	}
+	endpointType, err := c.i8()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+
+	errCode, errMessage := errNone, ""
+	if endpointType != endpointTypeBroker {
+		errCode, errMessage = errMismatchedEndpointType, "The request was sent to a broker endpoint, not a controller"
+	}
+	return buildDescribeClusterResponse(corrID, apiVer, errCode, errMessage, endpointType), nil
+}
+
+func buildDescribeClusterResponse(corrID int32, apiVer int16, errCode int16, errMessage string, endpointType int8) []byte {
+	// Body (flex v1):
+	// throttle_time_ms (INT32), error_code (INT16), error_message (COMPACT_NULLABLE_STRING)
+	// endpoint_type (INT8), cluster_id (COMPACT_STRING), controller_id (INT32)
+	// brokers (COMPACT_ARRAY) -> {broker_id, host, port, rack, TAGS}
+	// cluster_authorized_operations (INT32)
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putI16(errCode)
+	r.putCompactNullableString(errMessage)
+	r.putI8(endpointType)
+	r.putCompactString(clusterID)
+	r.putI32(brokerID) // controller_id
+	if errCode != errNone {
+		r.putCompactArrayLen(0)
+	} else {
+		host, port := advertisedHostPort()
+		r.putCompactArrayLen(1)
+		r.putI32(brokerID)
+		r.putCompactString(host)
+		r.putI32(port)
+		r.putCompactNullableString("") // rack: null
+		r.putTags()
+	}
+	r.putI32(clusterAuthorizedOperationsOmitted)
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyDescribeCluster, apiVer))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"sort"
+	"syscall"
+)
+
+// ----- DescribeLogDirs (api key 35) -----
+
+func init() {
+	registerHandler(apiKeyDescribeLogDirs, handleDescribeLogDirs)
+}
+
+// memoryLogDir is the log directory reported for a store without one.
+const memoryLogDir = "(in-memory)"
+
+type logDirPartition struct {
+	index int32
+	size  int64
+}
+
+type logDirTopic struct {
+	name       string
+	partitions []logDirPartition
+}
+
+// size returns the bytes held by pl's segments.
+func (pl *partitionLog) size() int64 {
+	var n int64
+	for _, sg := range pl.segments {
+		n += sg.size
+	}
+	return n
+}
+
+// logDirUsage returns the size of each partition in topics, or of every
+// partition when topics is nil, sorted by topic and partition. Unknown
+// topics and partitions are left out.
+func (s *logStore) logDirUsage(topics map[string][]int32) []logDirTopic {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var usage []logDirTopic
+	for name, parts := range s.topics {
+		want, ok := topics[name]
+		if topics != nil && !ok {
+			continue
+		}
+		if topics == nil {
+			want = make([]int32, 0, len(parts))
+			for p := range parts {
+				want = append(want, p)
+			}
+		}
+		t := logDirTopic{name: name}
+		for _, p := range want {
+			if pl := parts[p]; pl != nil {
+				t.partitions = append(t.partitions, logDirPartition{p, pl.size()})
+			}
+		}
+		if len(t.partitions) == 0 {
+			continue
+		}
+		sort.Slice(t.partitions, func(i, j int) bool { return t.partitions[i].index < t.partitions[j].index })
+		usage = append(usage, t)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].name < usage[j].name })
+	return usage
+}
+
+// diskSpace returns the total and available bytes of the file system
+// holding dir, or -1s if they can't be read.
+func diskSpace(dir string) (total, usable int64) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return -1, -1
+	}
+	return int64(st.Blocks) * int64(st.Bsize), int64(st.Bavail) * int64(st.Bsize)
+}
+
+// handleDescribeLogDirs parses a v4 DescribeLogDirs request and reports our
+// one log directory: its disk space and the size of each requested
+// partition in it, a null topic list meaning all of them.
+func handleDescribeLogDirs(c *cursor, corrID int32, apiVer int16, _ *session) ([]byte, error) {
+	nTopics, isNull, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	var topics map[string][]int32
+	if !isNull {
+		topics = make(map[string][]int32, nTopics)
+	}
+	for i := 0; i < nTopics; i++ {
+		name, err := c.compactNullableString()
+		if err != nil {
+			return nil, err
+		}
+		nParts, _, err := c.compactArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < nParts; j++ {
+			index, err := c.i32()
+			if err != nil {
+				return nil, err
+			}
+			topics[name] = append(topics[name], index)
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+
+	dir, total, usable := memoryLogDir, int64(-1), int64(-1)
+	if store.dir != "" {
+		dir = store.dir
+		total, usable = diskSpace(dir)
+	}
+	return buildDescribeLogDirsResponse(corrID, apiVer, dir, total, usable, store.logDirUsage(topics)), nil
+}
+
+func buildDescribeLogDirsResponse(corrID int32, apiVer int16, dir string, total, usable int64, usage []logDirTopic) []byte {
+	// Body (flex v4):
+	// throttle_time_ms (INT32), error_code (INT16)
+	// results (COMPACT_ARRAY) -> {error_code, log_dir, topics (COMPACT_ARRAY), total_bytes, usable_bytes, TAGS}
+	//   topics -> {name, partitions (COMPACT_ARRAY), TAGS}
+	//   partitions -> {partition_index, partition_size, offset_lag, is_future_key, TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putI16(errNone)
+	r.putCompactArrayLen(1)
+	r.putI16(errNone)
+	r.putCompactString(dir)
+	r.putCompactArrayLen(len(usage))
+	for _, t := range usage {
+		r.putCompactString(t.name)
+		r.putCompactArrayLen(len(t.partitions))
+		for _, p := range t.partitions {
+			r.putI32(p.index)
+			r.putI64(p.size)
+			r.putI64(0) // offset_lag: we are the only replica
+			r.putI8(0)  // is_future_key
+			r.putTags()
+		}
+		r.putTags()
+	}
+	r.putI64(total)
+	r.putI64(usable)
+	r.putTags()
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyDescribeLogDirs, apiVer))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+)
+
+// ----- api dispatch -----
+
+// session is the state of one client connection that handlers may need
+// beyond the request itself.
+type session struct {
+	remote     string // remote address, e.g. "127.0.0.1:52814"
+	clientID   string // from the first request header that carries one
+	clientHost string // as Kafka reports it, e.g. "/127.0.0.1"
+	auth       authState
+	mechanism  string // SASL mechanism picked in SaslHandshake
+	principal  string // authenticated SASL user
+	scram      *scramConversation
+	tlsSubject string       // client certificate subject, e.g. "CN=alice,O=Acme"
+	log        *slog.Logger // logger with the remote address attached
+}
+
+// apiHandler decodes a request body from req and returns the framed
+// response. A nil response with a nil error means the request expects no
+// reply (e.g. Produce with acks=0). An error means the body was malformed.
+type apiHandler func(req *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error)
+
+var handlers = map[int16]apiHandler{}
+
+// blockingAPIs may wait on other clients before answering: a long-polling
+// Fetch, or a JoinGroup or SyncGroup waiting for the rest of the group.
+// handleConn runs them beside, not in line with, the connection's other
+// requests.
+var blockingAPIs = map[int16]bool{
+	apiKeyFetch:     true,
+	apiKeyJoinGroup: true,
+	apiKeySyncGroup: true,
+}
+
+// clusterOperations are the operations on the cluster that requests with
+// these api keys need, checked here before they reach their handler. Other
+// requests act on topics and groups, which their handlers authorize one by
+// one.
+var clusterOperations = map[int16]string{
+	apiKeyControlledShutdown: aclOpClusterAction,
+	apiKeyWriteTxnMarkers:    aclOpClusterAction,
+	apiKeyDescribeAcls:       aclOpDescribe,
+	apiKeyDescribeLogDirs:    aclOpDescribe,
+	apiKeyElectLeaders:       aclOpAlter,
+	apiKeyAlterReassignments: aclOpAlter,
+	apiKeyListReassignments:  aclOpDescribe,
+}
+
+// registerHandler installs h as the handler for api key key. Handlers
+// register themselves from init functions next to their implementation.
+func registerHandler(key int16, h apiHandler) {
+	handlers[key] = h
+}
+
+// dispatch routes a request whose header has already been consumed from c.
+// Unknown api keys, and versions outside supportedAPIs, are answered with
+// UNSUPPORTED_VERSION instead of reaching a handler; requests the SASL
+// exchange doesn't allow yet, with ILLEGAL_SASL_STATE; and requests whose
+// clusterOperations the principal may not perform, with
+// CLUSTER_AUTHORIZATION_FAILED. A handler leaving part of the body unread is
+// logged.
+func dispatch(c *cursor, apiKey, apiVer int16, corrID int32, sess *session) ([]byte, error) {
+	if !sess.allows(apiKey) {
+		sess.log.Warn("request out of order with SASL authentication", "api_key", apiKey, "correlation_id", corrID)
+		return buildRequestErrorResponse(c, corrID, apiKey, apiVer, errIllegalSaslState), nil
+	}
+	h, ok := handlers[apiKey]
+	// ApiVersions answers unsupported versions itself with the full table.
+	if !ok || (apiKey != apiKeyApiVersions && !versionSupported(apiKey, apiVer)) {
+		return buildErrorResponse(corrID, apiKey, apiVer, errUnsupportedVer), nil
+	}
+	if op, ok := clusterOperations[apiKey]; ok && !sess.authorized(op, aclResourceCluster, clusterResourceName) {
+		return buildRequestErrorResponse(c, corrID, apiKey, apiVer, errClusterAuthorizationFailed), nil
+	}
+	resp, err := h(c, corrID, apiVer, sess)
+	// Handlers read every field, tagged fields included, so bytes left over
+	// almost always mean we decoded the version wrong.
+	if err == nil && c.remaining() > 0 {
+		sess.log.Debug("request body has unread bytes", "api_key", apiKey, "api_version", apiVer,
+			"correlation_id", corrID, "unread", c.remaining())
+	}
+	return resp, err
+}
+
+// buildErrorResponse returns the response to a request we can't hand to a
+// real handler, shaped as errorResponses has it for the api key. For a
+// version we don't support, the body takes the shape of the closest version
+// we do, under the header the client's version expects; an api key we
+// don't know gets just error_code.
+func buildErrorResponse(corrID int32, apiKey, apiVer int16, errCode int16) []byte {
+	build, ok := errorResponses[apiKey]
+	if !ok {
+		var r respBuf
+		r.putI16(errCode)
+		return r.finish(corrID, responseHeaderVersion(apiKey, apiVer))
+	}
+	bodyVer := apiVer
+	for _, a := range supportedAPIs {
+		if a.apiKey == apiKey {
+			bodyVer = min(max(apiVer, a.minVer), a.maxVer)
+		}
+	}
+	resp := build(corrID, bodyVer, errCode)
+	from, to := responseHeaderVersion(apiKey, bodyVer), responseHeaderVersion(apiKey, apiVer)
+	switch {
+	case from == 1 && to == 0: // drop the header's TAG_BUFFER
+		resp = append(resp[:8], resp[9:]...)
+	case from == 0 && to == 1:
+		resp = append(resp[:8], append([]byte{0}, resp[8:]...)...)
+	}
+	binary.BigEndian.PutUint32(resp, uint32(len(resp)-4))
+	return resp
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime"
+	"strings"
+)
+
+// ----- request dump -----
+
+// apiNames names the api keys in firstFlexibleVersion.
+var apiNames = map[int16]string{
+	0:  "Produce",
+	1:  "Fetch",
+	2:  "ListOffsets",
+	3:  "Metadata",
+	7:  "ControlledShutdown",
+	8:  "OffsetCommit",
+	9:  "OffsetFetch",
+	10: "FindCoordinator",
+	11: "JoinGroup",
+	12: "Heartbeat",
+	13: "LeaveGroup",
+	14: "SyncGroup",
+	15: "DescribeGroups",
+	16: "ListGroups",
+	17: "SaslHandshake",
+	18: "ApiVersions",
+	19: "CreateTopics",
+	20: "DeleteTopics",
+	21: "DeleteRecords",
+	22: "InitProducerId",
+	23: "OffsetForLeaderEpoch",
+	24: "AddPartitionsToTxn",
+	25: "AddOffsetsToTxn",
+	26: "EndTxn",
+	27: "WriteTxnMarkers",
+	28: "TxnOffsetCommit",
+	29: "DescribeAcls",
+	30: "CreateAcls",
+	31: "DeleteAcls",
+	32: "DescribeConfigs",
+	33: "AlterConfigs",
+	34: "AlterReplicaLogDirs",
+	35: "DescribeLogDirs",
+	36: "SaslAuthenticate",
+	37: "CreatePartitions",
+	42: "DeleteGroups",
+	43: "ElectLeaders",
+	44: "IncrementalAlterConfigs",
+	45: "AlterPartitionReassignments",
+	46: "ListPartitionReassignments",
+	60: "DescribeCluster",
+}
+
+func apiName(apiKey int16) string {
+	if name, ok := apiNames[apiKey]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// dumpRequests decodes the Kafka requests in in and writes what they hold
+// to out, field by field. in is either raw bytes, such as a TCP stream
+// saved from Wireshark, or the same bytes in hex; it holds size-prefixed
+// frames as sent on the wire, or a single request without its size.
+func dumpRequests(in io.Reader, out io.Writer) error {
+	b, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	if h, err := hex.DecodeString(strings.Join(strings.Fields(string(b)), "")); err == nil && len(h) > 0 {
+		b = h
+	}
+	if !sizeFramed(b) {
+		dumpRequest(b, out)
+		return nil
+	}
+	for len(b) > 0 {
+		n := int(binary.BigEndian.Uint32(b))
+		dumpRequest(b[4:4+n], out)
+		b = b[4+n:]
+	}
+	return nil
+}
+
+// sizeFramed reports whether b is a run of size-prefixed frames ending
+// exactly at its end. A bare request can start like a size too: Produce's
+// api key is 0, so its first four bytes read as the version.
+func sizeFramed(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for len(b) >= 4 {
+		n := int(binary.BigEndian.Uint32(b))
+		if n > len(b)-4 {
+			return false
+		}
+		b = b[4+n:]
+	}
+	return len(b) == 0
+}
+
+// dumpRequest writes one request's header and body fields to out. The body
+// is decoded by the api key's handler with a tracing cursor, which stops the
+// handler once the body is read so that it never acts on the request.
+func dumpRequest(payload []byte, out io.Writer) {
+	c := &cursor{b: payload}
+	apiKey, apiVer, corrID, clientID, err := parseHeader(c)
+	if errors.Is(err, errShortHeader) {
+		fmt.Fprintf(out, "bad request header: % x\n\n", payload)
+		return
+	}
+	fmt.Fprintf(out, "%s (api key %d) v%d, request header v%d, response header v%d\n",
+		apiName(apiKey), apiKey, apiVer, requestHeaderVersion(apiKey, apiVer), responseHeaderVersion(apiKey, apiVer))
+	fmt.Fprintf(out, "  correlation_id: %d\n", corrID)
+	if err != nil {
+		fmt.Fprintf(out, "  malformed header at byte %d: %v\n\n", c.off, err)
+		return
+	}
+	fmt.Fprintf(out, "  client_id: %q\n", clientID)
+
+	h, ok := handlers[apiKey]
+	if !ok || (apiKey != apiKeyApiVersions && !versionSupported(apiKey, apiVer)) {
+		fmt.Fprintf(out, "  body: no decoder for this version: % x\n\n", payload[c.off:])
+		return
+	}
+	body := &cursor{b: payload[c.off:]}
+	if len(body.b) == 0 {
+		fmt.Fprintf(out, "  body: empty\n\n")
+		return
+	}
+	fmt.Fprintf(out, "  body (%d bytes):\n", len(body.b))
+	body.trace = func(off int, typ string, v any) {
+		fmt.Fprintf(out, "    %5d  %-23s %s\n", off, typ, dumpValue(v))
+		if b, ok := v.([]byte); ok && typ == "COMPACT_RECORDS" {
+			dumpRecords(b, out)
+		}
+		if body.off == len(body.b) {
+			runtime.Goexit()
+		}
+	}
+	var decodeErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sess := &session{clientID: clientID, log: slog.New(slog.DiscardHandler)}
+		_, decodeErr = h(body, corrID, apiVer, sess)
+	}()
+	<-done
+	switch {
+	case decodeErr != nil:
+		fmt.Fprintf(out, "  malformed at byte %d: %v\n", body.off, decodeErr)
+	case body.off < len(body.b):
+		fmt.Fprintf(out, "  %d bytes not read: % x\n", len(body.b)-body.off, body.b[body.off:])
+	}
+	fmt.Fprintln(out)
+}
+
+// dumpRecords writes the record batches in b, each record with its key,
+// value and headers, below the field holding them.
+func dumpRecords(b []byte, out io.Writer) {
+	const indent = "             "
+	for len(b) > 0 {
+		batch, err := splitBatch(b)
+		if err != nil {
+			fmt.Fprintf(out, "%sbad record batch: %v\n", indent, err)
+			return
+		}
+		b = b[len(batch):]
+		rb, err := decodeRecordBatch(batch)
+		if err != nil {
+			fmt.Fprintf(out, "%sbad record batch: %v\n", indent, err)
+			return
+		}
+		fmt.Fprintf(out, "%sbatch: %d records, codec %d, producer_id %d, producer_epoch %d, base_sequence %d\n",
+			indent, len(rb.records), rb.codec(), rb.producerID, rb.producerEpoch, rb.baseSequence)
+		for _, r := range rb.records {
+			fmt.Fprintf(out, "%s  record %d: timestamp %d, key %s, value %s\n",
+				indent, r.offsetDelta, rb.timestamp(r), dumpBytes(r.key), dumpBytes(r.value))
+			for _, h := range r.headers {
+				fmt.Fprintf(out, "%s    header %q: %s\n", indent, h.key, dumpBytes(h.value))
+			}
+		}
+	}
+}
+
+// dumpBytes formats a nullable bytes field.
+func dumpBytes(b []byte) string {
+	if b == nil {
+		return "null"
+	}
+	return dumpValue(b)
+}
+
+// dumpValue formats a traced field's value.
+func dumpValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return fmt.Sprintf("%q", v)
+	case [16]byte:
+		return uuidString(v)
+	case []byte:
+		if len(v) > 64 {
+			return fmt.Sprintf("%d bytes: % x ...", len(v), v[:64])
+		}
+		if bytes.ContainsFunc(v, func(r rune) bool { return r < ' ' || r > '~' }) {
+			return fmt.Sprintf("%d bytes: % x", len(v), v)
+		}
+		return fmt.Sprintf("%d bytes: %q", len(v), v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
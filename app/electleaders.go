@@ -0,0 +1,88 @@
+package main
+
+// ----- ElectLeaders (api key 43) -----
+
+func init() {
+	registerHandler(apiKeyElectLeaders, handleElectLeaders)
+}
+
+// handleElectLeaders parses a v2 ElectLeaders request. We are the only
+// replica, and so already the preferred leader, of every partition: each one
+// asked for, or every partition for a null list, gets ELECTION_NOT_NEEDED.
+func handleElectLeaders(c *cursor, corrID int32, apiVer int16, _ *session) ([]byte, error) {
+	if _, err := c.i8(); err != nil { // election_type: 0 preferred, 1 unclean
+		return nil, err
+	}
+	nTopics, isNull, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	var parts []partitionOffset
+	for i := 0; i < nTopics; i++ {
+		name, err := c.compactNullableString()
+		if err != nil {
+			return nil, err
+		}
+		nParts, _, err := c.compactArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < nParts; j++ {
+			index, err := c.i32()
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, partitionOffset{topic: name, partition: index})
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := c.i32(); err != nil { // timeout_ms
+		return nil, err
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+
+	if isNull {
+		for _, name := range store.topicNames() {
+			for _, p := range store.partitions(name) {
+				parts = append(parts, partitionOffset{topic: name, partition: p})
+			}
+		}
+	}
+	for i := range parts {
+		parts[i].errCode = errElectionNotNeeded
+		if !store.hasPartition(parts[i].topic, parts[i].partition) {
+			parts[i].errCode = errUnknownTopicOrPartition
+		}
+	}
+	return buildElectLeadersResponse(corrID, apiVer, parts), nil
+}
+
+func buildElectLeadersResponse(corrID int32, apiVer int16, parts []partitionOffset) []byte {
+	// Body (flex v2):
+	// throttle_time_ms (INT32), error_code (INT16)
+	// replica_election_results (COMPACT_ARRAY) -> {topic, partition_result (COMPACT_ARRAY), TAGS}
+	//   partition_result -> {partition_id, error_code, error_message, TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putI16(errNone)
+	topics := groupByTopic(parts)
+	r.putCompactArrayLen(len(topics))
+	for _, tp := range topics {
+		r.putCompactString(tp[0].topic)
+		r.putCompactArrayLen(len(tp))
+		for _, p := range tp {
+			r.putI32(p.partition)
+			r.putI16(p.errCode)
+			r.putCompactNullableString("") // error_message: null
+			r.putTags()
+		}
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyElectLeaders, apiVer))
+}
@@ -0,0 +1,294 @@
+package main
+
+// ----- error responses -----
+
+// errorResponses build, for each api key, a response in the shape of that
+// version with no results and errCode in its top-level error_code, for
+// responses that have one. It is what a request gets when it can't be
+// handled (malformed, too large, an unsupported version): a response the
+// client can parse and match to its request, rather than one it chokes on.
+// Responses with no top-level error_code can only carry errCode in their
+// entries; topicErrorResponses fills those in when the request is readable.
+var errorResponses = map[int16]func(corrID int32, apiVer, errCode int16) []byte{
+	apiKeyProduce: func(corrID int32, apiVer, _ int16) []byte {
+		return buildProduceResponse(corrID, apiVer, nil)
+	},
+	apiKeyFetch: func(corrID int32, apiVer, errCode int16) []byte {
+		return buildFetchResponse(corrID, apiVer, errCode, 0, nil)
+	},
+	apiKeyListOffsets: func(corrID int32, apiVer, _ int16) []byte {
+		return buildListOffsetsResponse(corrID, apiVer, nil)
+	},
+	apiKeyMetadata: func(corrID int32, apiVer, _ int16) []byte {
+		return buildMetadataResponse(corrID, apiVer, nil)
+	},
+	apiKeyControlledShutdown: buildControlledShutdownResponse,
+	apiKeyOffsetCommit: func(corrID int32, apiVer, _ int16) []byte {
+		return buildOffsetCommitResponse(corrID, apiKeyOffsetCommit, apiVer, nil)
+	},
+	apiKeyOffsetFetch: func(corrID int32, apiVer, _ int16) []byte {
+		return buildOffsetFetchResponse(corrID, apiVer, nil)
+	},
+	apiKeyFindCoordinator: func(corrID int32, apiVer, _ int16) []byte {
+		return buildFindCoordinatorResponse(corrID, apiVer, nil)
+	},
+	apiKeyJoinGroup: func(corrID int32, apiVer, errCode int16) []byte {
+		return buildJoinGroupResponse(corrID, apiVer, joinGroupResult{errCode: errCode, generation: -1})
+	},
+	apiKeyHeartbeat:  buildThrottleErrorResponse(apiKeyHeartbeat, true, 0),
+	apiKeyLeaveGroup: buildThrottleErrorResponse(apiKeyLeaveGroup, true, 1), // members
+	apiKeySyncGroup: func(corrID int32, apiVer, errCode int16) []byte {
+		return buildSyncGroupResponse(corrID, apiVer, syncGroupResult{errCode: errCode})
+	},
+	apiKeyDescribeGroups: func(corrID int32, apiVer, _ int16) []byte {
+		return buildDescribeGroupsResponse(corrID, apiVer, nil)
+	},
+	apiKeyListGroups: buildThrottleErrorResponse(apiKeyListGroups, true, 1), // groups
+	apiKeySaslHandshake: func(corrID int32, apiVer, errCode int16) []byte {
+		// Body (v1): error_code (INT16), mechanisms (ARRAY of STRING)
+		var r respBuf
+		r.putI16(errCode)
+		r.putI32(0)
+		return r.finish(corrID, responseHeaderVersion(apiKeySaslHandshake, apiVer))
+	},
+	apiKeyApiVersions: buildApiVersionsResponse,
+	apiKeyCreateTopics: func(corrID int32, apiVer, _ int16) []byte {
+		return buildCreateTopicsResponse(corrID, apiVer, nil)
+	},
+	apiKeyDeleteTopics: func(corrID int32, apiVer, _ int16) []byte {
+		return buildDeleteTopicsResponse(corrID, apiVer, nil)
+	},
+	apiKeyDeleteRecords: func(corrID int32, apiVer, _ int16) []byte {
+		return buildDeleteRecordsResponse(corrID, apiVer, nil)
+	},
+	apiKeyInitProducerId: func(corrID int32, apiVer, errCode int16) []byte {
+		return buildInitProducerIdResponse(corrID, apiVer, errCode, -1, -1)
+	},
+	apiKeyOffsetForLeaderEpoch: func(corrID int32, apiVer, _ int16) []byte {
+		return buildOffsetForLeaderEpochResponse(corrID, apiVer, nil)
+	},
+	apiKeyAddPartitionsToTxn: func(corrID int32, apiVer, _ int16) []byte {
+		return buildAddPartitionsToTxnResponse(corrID, apiVer, nil)
+	},
+	apiKeyAddOffsetsToTxn: func(corrID int32, apiVer, errCode int16) []byte {
+		return buildTxnResponse(corrID, apiKeyAddOffsetsToTxn, apiVer, errCode)
+	},
+	apiKeyEndTxn: func(corrID int32, apiVer, errCode int16) []byte {
+		return buildTxnResponse(corrID, apiKeyEndTxn, apiVer, errCode)
+	},
+	apiKeyWriteTxnMarkers: func(corrID int32, apiVer, _ int16) []byte {
+		return buildWriteTxnMarkersResponse(corrID, apiVer, nil)
+	},
+	apiKeyTxnOffsetCommit: func(corrID int32, apiVer, _ int16) []byte {
+		return buildOffsetCommitResponse(corrID, apiKeyTxnOffsetCommit, apiVer, nil)
+	},
+	apiKeyDescribeAcls: func(corrID int32, apiVer, errCode int16) []byte {
+		return buildDescribeAclsResponse(corrID, apiVer, errCode, "", nil)
+	},
+	apiKeyCreateAcls: func(corrID int32, apiVer, _ int16) []byte {
+		return buildCreateAclsResponse(corrID, apiVer, nil)
+	},
+	apiKeyDeleteAcls: func(corrID int32, apiVer, _ int16) []byte {
+		return buildDeleteAclsResponse(corrID, apiVer, nil)
+	},
+	apiKeyDescribeConfigs: func(corrID int32, apiVer, _ int16) []byte {
+		return buildDescribeConfigsResponse(corrID, apiVer, nil, false, false)
+	},
+	apiKeyAlterConfigs: func(corrID int32, apiVer, _ int16) []byte {
+		return buildAlterConfigsResponse(corrID, apiKeyAlterConfigs, apiVer, nil)
+	},
+	apiKeyDescribeLogDirs: buildThrottleErrorResponse(apiKeyDescribeLogDirs, true, 1), // results
+	apiKeySaslAuthenticate: func(corrID int32, apiVer, errCode int16) []byte {
+		// Body (flex v2):
+		// error_code (INT16), error_message (COMPACT_NULLABLE_STRING),
+		// auth_bytes (COMPACT_BYTES), session_lifetime_ms (INT64)
+		// response TAG_BUFFER count = 0
+		var r respBuf
+		r.putI16(errCode)
+		r.putCompactNullableString("")
+		r.putCompactBytes([]byte{})
+		r.putI64(0)
+		r.putTags()
+		return r.finish(corrID, responseHeaderVersion(apiKeySaslAuthenticate, apiVer))
+	},
+	apiKeyCreatePartitions: func(corrID int32, apiVer, _ int16) []byte {
+		return buildCreatePartitionsResponse(corrID, apiVer, nil)
+	},
+	apiKeyDeleteGroups: buildThrottleErrorResponse(apiKeyDeleteGroups, false, 1), // results
+	apiKeyElectLeaders: buildThrottleErrorResponse(apiKeyElectLeaders, true, 1),  // replica_election_results
+	apiKeyIncrementalAlterConfigs: func(corrID int32, apiVer, _ int16) []byte {
+		return buildAlterConfigsResponse(corrID, apiKeyIncrementalAlterConfigs, apiVer, nil)
+	},
+	apiKeyAlterReassignments: func(corrID int32, apiVer, errCode int16) []byte {
+		return buildAlterPartitionReassignmentsResponse(corrID, apiVer, errCode, nil)
+	},
+	apiKeyListReassignments: buildListPartitionReassignmentsResponse,
+	apiKeyDescribeCluster: func(corrID int32, apiVer, errCode int16) []byte {
+		return buildDescribeClusterResponse(corrID, apiVer, errCode, "", endpointTypeBroker)
+	},
+}
+
+// buildThrottleErrorResponse returns an errorResponses builder for the many
+// flexible responses laid out as throttle_time_ms, error_code if
+// hasErrorCode, then arrays empty arrays.
+func buildThrottleErrorResponse(apiKey int16, hasErrorCode bool, arrays int) func(corrID int32, apiVer, errCode int16) []byte {
+	return func(corrID int32, apiVer, errCode int16) []byte {
+		var r respBuf
+		r.putI32(0) // throttle_time_ms
+		if hasErrorCode {
+			r.putI16(errCode)
+		}
+		for range arrays {
+			r.putCompactArrayLen(0)
+		}
+		r.putTags()
+		return r.finish(corrID, responseHeaderVersion(apiKey, apiVer))
+	}
+}
+
+// topicErrorResponses build, for the api keys whose errors live only in
+// their topic or partition entries, a response with an entry for every
+// topic and partition the request in c names, each carrying errCode. The
+// request must be of a supported version; a nil response means the client
+// expects none.
+var topicErrorResponses = map[int16]func(c *cursor, corrID int32, apiVer, errCode int16) ([]byte, error){
+	apiKeyProduce:     buildProduceErrorResponse,
+	apiKeyListOffsets: buildListOffsetsErrorResponse,
+	apiKeyMetadata:    buildMetadataErrorResponse,
+}
+
+// buildRequestErrorResponse is buildErrorResponse for a request whose body
+// is still unread in c, with errCode set on every topic or partition it
+// names for the api keys in topicErrorResponses.
+func buildRequestErrorResponse(c *cursor, corrID int32, apiKey, apiVer int16, errCode int16) []byte {
+	if build, ok := topicErrorResponses[apiKey]; ok && versionSupported(apiKey, apiVer) {
+		if resp, err := build(c, corrID, apiVer, errCode); err == nil {
+			return resp
+		}
+	}
+	return buildErrorResponse(corrID, apiKey, apiVer, errCode)
+}
+
+func buildProduceErrorResponse(c *cursor, corrID int32, apiVer, errCode int16) ([]byte, error) {
+	flexible := isFlexible(apiKeyProduce, apiVer)
+	if _, err := c.stringFor(flexible); err != nil { // transactional_id
+		return nil, err
+	}
+	acks, err := c.i16()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.i32(); err != nil { // timeout_ms
+		return nil, err
+	}
+	nTopics, _, err := c.arrayLenFor(flexible)
+	if err != nil {
+		return nil, err
+	}
+	var results []produceTopicResult
+	for i := 0; i < nTopics; i++ {
+		name, err := c.stringFor(flexible)
+		if err != nil {
+			return nil, err
+		}
+		nParts, _, err := c.arrayLenFor(flexible)
+		if err != nil {
+			return nil, err
+		}
+		tr := produceTopicResult{name: name}
+		for j := 0; j < nParts; j++ {
+			index, err := c.i32()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := c.recordsFor(flexible); err != nil {
+				return nil, err
+			}
+			if err := c.tagsFor(flexible); err != nil {
+				return nil, err
+			}
+			tr.partitions = append(tr.partitions, producePartitionResult{index: index, errCode: errCode, baseOffset: -1, logStart: -1})
+		}
+		if err := c.tagsFor(flexible); err != nil {
+			return nil, err
+		}
+		results = append(results, tr)
+	}
+	if acks == 0 {
+		return nil, nil
+	}
+	return buildProduceResponse(corrID, apiVer, results), nil
+}
+
+func buildListOffsetsErrorResponse(c *cursor, corrID int32, apiVer, errCode int16) ([]byte, error) {
+	if _, err := c.i32(); err != nil { // replica_id
+		return nil, err
+	}
+	if _, err := c.i8(); err != nil { // isolation_level
+		return nil, err
+	}
+	nTopics, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]listOffsetsTopicResult, 0, nTopics)
+	for i := 0; i < nTopics; i++ {
+		name, err := c.compactNullableString()
+		if err != nil {
+			return nil, err
+		}
+		nParts, _, err := c.compactArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		tr := listOffsetsTopicResult{name: name}
+		for j := 0; j < nParts; j++ {
+			index, err := c.i32()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := c.i32(); err != nil { // current_leader_epoch
+				return nil, err
+			}
+			if _, err := c.i64(); err != nil { // timestamp
+				return nil, err
+			}
+			if err := c.skipTagged(); err != nil {
+				return nil, err
+			}
+			tr.partitions = append(tr.partitions, listOffsetsPartitionResult{index: index, errCode: errCode, timestamp: -1, offset: -1, leaderEpoch: -1})
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+		results = append(results, tr)
+	}
+	return buildListOffsetsResponse(corrID, apiVer, results), nil
+}
+
+// buildMetadataErrorResponse answers only the topics the request names; one
+// asking for every topic gets none.
+func buildMetadataErrorResponse(c *cursor, corrID int32, apiVer, errCode int16) ([]byte, error) {
+	flexible := isFlexible(apiKeyMetadata, apiVer)
+	nTopics, _, err := c.arrayLenFor(flexible)
+	if err != nil {
+		return nil, err
+	}
+	var topics []metadataTopic
+	for i := 0; i < nTopics; i++ {
+		t := metadataTopic{errCode: errCode}
+		if apiVer >= 10 {
+			if t.topicID, err = c.uuid(); err != nil {
+				return nil, err
+			}
+		}
+		if t.name, err = c.stringFor(flexible); err != nil {
+			return nil, err
+		}
+		if err := c.tagsFor(flexible); err != nil {
+			return nil, err
+		}
+		topics = append(topics, t)
+	}
+	return buildMetadataResponse(corrID, apiVer, topics), nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import "testing"
+
+// Before a SASL client authenticates, requests are refused with
+// ILLEGAL_SASL_STATE. Produce, ListOffsets and Metadata have no top-level
+// error_code, so the error has to be on each topic or partition asked for.
+func TestErrorResponsesCarryErrCodePerEntry(t *testing.T) {
+	oldUsers := plainUsers
+	plainUsers = map[string]string{"alice": "secret"}
+	t.Cleanup(func() { plainUsers = oldUsers })
+	c := newTestServer(t).dial()
+
+	t.Run("Metadata", func(t *testing.T) {
+		var req respBuf
+		req.putCompactArrayLen(1)
+		req.putUUID([16]byte{})
+		req.putCompactString("orders")
+		req.putTags()
+		req.putBool(false) // allow_auto_topic_creation
+		req.putBool(false) // include_topic_authorized_operations
+		req.putTags()
+		r := c.call(apiKeyMetadata, 12, req.b)
+		r.i32() // throttle_time_ms
+		if n, _, _ := r.compactArrayLen(); n != 1 {
+			t.Fatalf("%d brokers, want 1", n)
+		}
+		r.i32()                   // node_id
+		r.compactNullableString() // host
+		r.i32()                   // port
+		r.compactNullableString() // rack
+		r.skipTagged()            // broker tags
+		r.compactNullableString() // cluster_id
+		r.i32()                   // controller_id
+		if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+			t.Fatalf("%d topics (%v), want 1", n, err)
+		}
+		errCode, _ := r.i16()
+		name, _ := r.compactNullableString()
+		if errCode != errIllegalSaslState || name != "orders" {
+			t.Errorf("topic %q error %d, want %q error %d", name, errCode, "orders", errIllegalSaslState)
+		}
+	})
+
+	t.Run("Produce", func(t *testing.T) {
+		var req respBuf
+		req.putCompactNullableString("") // transactional_id
+		req.putI16(-1)                   // acks
+		req.putI32(1000)                 // timeout_ms
+		req.putCompactArrayLen(1)
+		req.putCompactString("orders")
+		req.putCompactArrayLen(2)
+		for _, index := range []int32{0, 3} {
+			req.putI32(index)
+			req.putUvarint(0) // records: null
+			req.putTags()
+		}
+		req.putTags()
+		req.putTags()
+		r := c.call(apiKeyProduce, 9, req.b)
+		if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+			t.Fatalf("%d topics (%v), want 1", n, err)
+		}
+		if name, _ := r.compactNullableString(); name != "orders" {
+			t.Fatalf("topic %q, want orders", name)
+		}
+		if n, _, err := r.compactArrayLen(); err != nil || n != 2 {
+			t.Fatalf("%d partitions (%v), want 2", n, err)
+		}
+		for _, want := range []int32{0, 3} {
+			index, _ := r.i32()
+			errCode, _ := r.i16()
+			baseOffset, _ := r.i64()
+			r.i64()                   // log_append_time_ms
+			r.i64()                   // log_start_offset
+			r.compactArrayLen()       // record_errors
+			r.compactNullableString() // error_message
+			if err := r.skipTagged(); err != nil {
+				t.Fatal(err)
+			}
+			if index != want || errCode != errIllegalSaslState || baseOffset != -1 {
+				t.Errorf("partition %d error %d at %d, want %d error %d at -1", index, errCode, baseOffset, want, errIllegalSaslState)
+			}
+		}
+	})
+
+	t.Run("ListOffsets", func(t *testing.T) {
+		var req respBuf
+		req.putI32(-1) // replica_id
+		req.putI8(0)   // isolation_level
+		req.putCompactArrayLen(1)
+		req.putCompactString("orders")
+		req.putCompactArrayLen(1)
+		req.putI32(2)  // partition_index
+		req.putI32(-1) // current_leader_epoch
+		req.putI64(-1) // timestamp: latest
+		req.putTags()
+		req.putTags()
+		req.putTags()
+		r := c.call(apiKeyListOffsets, 7, req.b)
+		r.i32() // throttle_time_ms
+		if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+			t.Fatalf("%d topics (%v), want 1", n, err)
+		}
+		if name, _ := r.compactNullableString(); name != "orders" {
+			t.Fatalf("topic %q, want orders", name)
+		}
+		if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+			t.Fatalf("%d partitions (%v), want 1", n, err)
+		}
+		index, _ := r.i32()
+		errCode, _ := r.i16()
+		if index != 2 || errCode != errIllegalSaslState {
+			t.Errorf("partition %d error %d, want 2 error %d", index, errCode, errIllegalSaslState)
+		}
+	})
+}
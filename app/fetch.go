@@ -0,0 +1,362 @@
+package main
+
+import "time"
+
+// ----- Fetch (api key 1) -----
+
+type fetchPartitionRequest struct {
+	index       int32
+	fetchOffset int64
+	epochs      fetchEpochs
+	maxBytes    int32
+}
+
+type fetchTopicRequest struct {
+	name       string
+	topicID    [16]byte // v13+; name is "" if no topic has it
+	partitions []fetchPartitionRequest
+	denied     bool // the client may not read the topic
+}
+
+type fetchPartitionResult struct {
+	index       int32
+	errCode     int16
+	hwm         int64
+	lastStable  int64
+	logStart    int64
+	aborted     []abortedTxn // nil for read_uncommitted
+	records     [][]byte
+	diverging   *epochEnd // set when the client must truncate its log first
+	leaderEpoch int32     // reported with epoch errors
+}
+
+type fetchTopicResult struct {
+	name       string
+	topicID    [16]byte
+	partitions []fetchPartitionResult
+}
+
+func init() {
+	registerHandler(apiKeyFetch, handleFetch)
+}
+
+// handleFetch parses a v11-v13 Fetch request and answers it from the log. v12
+// is flexible and adds last_fetched_epoch; v13 names topics by topic id. Like
+// Kafka it long-polls: while fewer than min_bytes are available it waits,
+// up to max_wait_ms, for a Produce to one of the requested partitions. A
+// request in an incremental fetch session reads every partition in the
+// session; see fetchSessionCache.begin.
+func handleFetch(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	flexible := isFlexible(apiKeyFetch, apiVer)
+	if _, err := c.i32(); err != nil { // replica_id
+		return nil, err
+	}
+	maxWait, err := c.i32()
+	if err != nil {
+		return nil, err
+	}
+	minBytes, err := c.i32()
+	if err != nil {
+		return nil, err
+	}
+	maxBytes, err := c.i32()
+	if err != nil {
+		return nil, err
+	}
+	isolation, err := c.i8()
+	if err != nil {
+		return nil, err
+	}
+	sessionID, err := c.i32()
+	if err != nil {
+		return nil, err
+	}
+	sessionEpoch, err := c.i32()
+	if err != nil {
+		return nil, err
+	}
+
+	nTopics, _, err := c.arrayLenFor(flexible)
+	if err != nil {
+		return nil, err
+	}
+	topics := make([]fetchTopicRequest, 0, nTopics)
+	for i := 0; i < nTopics; i++ {
+		var tr fetchTopicRequest
+		if apiVer >= 13 {
+			if tr.topicID, err = c.uuid(); err != nil {
+				return nil, err
+			}
+			tr.name = store.topicByID(tr.topicID)
+		} else if tr.name, err = c.stringFor(flexible); err != nil {
+			return nil, err
+		}
+		nParts, _, err := c.arrayLenFor(flexible)
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < nParts; j++ {
+			var pr fetchPartitionRequest
+			if pr.index, err = c.i32(); err != nil {
+				return nil, err
+			}
+			if pr.epochs.current, err = c.i32(); err != nil {
+				return nil, err
+			}
+			if pr.fetchOffset, err = c.i64(); err != nil {
+				return nil, err
+			}
+			pr.epochs.lastFetched = -1
+			if apiVer >= 12 {
+				if pr.epochs.lastFetched, err = c.i32(); err != nil {
+					return nil, err
+				}
+			}
+			if _, err := c.i64(); err != nil { // log_start_offset
+				return nil, err
+			}
+			if pr.maxBytes, err = c.i32(); err != nil {
+				return nil, err
+			}
+			if err := c.tagsFor(flexible); err != nil {
+				return nil, err
+			}
+			tr.partitions = append(tr.partitions, pr)
+		}
+		if err := c.tagsFor(flexible); err != nil {
+			return nil, err
+		}
+		topics = append(topics, tr)
+	}
+
+	// forgotten_topics_data: {topic (topic_id in v13), partitions []int32, TAGS}
+	nForgotten, _, err := c.arrayLenFor(flexible)
+	if err != nil {
+		return nil, err
+	}
+	var forgotten []fetchSessionKey
+	for i := 0; i < nForgotten; i++ {
+		var name string
+		var topicID [16]byte
+		if apiVer >= 13 {
+			if topicID, err = c.uuid(); err != nil {
+				return nil, err
+			}
+		} else if name, err = c.stringFor(flexible); err != nil {
+			return nil, err
+		}
+		nParts, _, err := c.arrayLenFor(flexible)
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < nParts; j++ {
+			index, err := c.i32()
+			if err != nil {
+				return nil, err
+			}
+			forgotten = append(forgotten, newFetchSessionKey(apiVer, name, topicID, index))
+		}
+		if err := c.tagsFor(flexible); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := c.stringFor(flexible); err != nil { // rack_id
+		return nil, err
+	}
+	if err := c.tagsFor(flexible); err != nil {
+		return nil, err
+	}
+
+	fctx := fetchSessions.begin(apiVer, sessionID, sessionEpoch, topics, forgotten)
+	if fctx.errCode != errNone {
+		return buildFetchResponse(corrID, apiVer, fctx.errCode, 0, nil), nil
+	}
+	topics = fctx.topics
+	for i := range topics {
+		topics[i].denied = topics[i].name != "" && !sess.authorized(aclOpRead, aclResourceTopic, topics[i].name)
+	}
+
+	deadline := time.Now().Add(time.Duration(maxWait) * time.Millisecond)
+	for {
+		// Subscribe before reading so an append in between isn't missed.
+		var signals []<-chan struct{}
+		if time.Now().Before(deadline) {
+			for _, tr := range topics {
+				for _, pr := range tr.partitions {
+					if ch := store.appendSignal(tr.name, pr.index); ch != nil {
+						signals = append(signals, ch)
+					}
+				}
+			}
+		}
+		results, sent, failed := readFetch(topics, int(maxBytes), isolation == readCommitted)
+		// Errors are reported right away, as Kafka does.
+		if failed || sent >= int(minBytes) || !waitForAppend(signals, time.Until(deadline)) {
+			results = fetchSessions.finish(apiVer, fctx, results)
+			return buildFetchResponse(corrID, apiVer, errNone, fctx.sessionID, results), nil
+		}
+	}
+}
+
+// Fetch and ListOffsets isolation levels.
+const (
+	readUncommitted = int8(0)
+	readCommitted   = int8(1)
+)
+
+// readFetch reads every requested partition within maxBytes in total,
+// returning the results, how many bytes of records they hold, and whether
+// any partition failed. With committedOnly set, reads stop at each
+// partition's last stable offset.
+func readFetch(topics []fetchTopicRequest, maxBytes int, committedOnly bool) ([]fetchTopicResult, int, bool) {
+	sent := 0
+	failed := false
+	results := make([]fetchTopicResult, 0, len(topics))
+	for _, t := range topics {
+		tr := fetchTopicResult{name: t.name, topicID: t.topicID}
+		for _, p := range t.partitions {
+			limit := min(int(p.maxBytes), maxBytes-sent)
+			pr := fetchPartitionResult{index: p.index}
+			if t.name == "" && t.topicID != ([16]byte{}) {
+				pr.errCode, pr.hwm, pr.lastStable, pr.logStart = errUnknownTopicID, -1, -1, -1
+				failed = true
+				tr.partitions = append(tr.partitions, pr)
+				continue
+			}
+			if t.denied {
+				pr.errCode, pr.hwm, pr.lastStable, pr.logStart = errTopicAuthorizationFailed, -1, -1, -1
+				failed = true
+				tr.partitions = append(tr.partitions, pr)
+				continue
+			}
+			read, err := store.readBatches(t.name, p.index, p.fetchOffset, limit,
+				readOptions{minOne: sent == 0, readCommitted: committedOnly, epochs: p.epochs})
+			pr.records, pr.hwm, pr.logStart, pr.diverging, pr.errCode = read.batches, read.hwm, read.logStart, read.diverging, kafkaErrorCode(err)
+			// read_uncommitted consumers don't care where transactions stand.
+			pr.lastStable = read.hwm
+			if committedOnly {
+				pr.lastStable, pr.aborted = read.lastStable, read.aborted
+			}
+			if pr.errCode == errFencedLeaderEpoch || pr.errCode == errUnknownLeaderEpoch {
+				pr.leaderEpoch = store.leaderEpoch(t.name, p.index)
+			}
+			for _, b := range pr.records {
+				sent += len(b)
+			}
+			failed = failed || pr.errCode != errNone || pr.diverging != nil
+			tr.partitions = append(tr.partitions, pr)
+		}
+		results = append(results, tr)
+	}
+	return results, sent, failed
+}
+
+// waitForAppend blocks until one of signals fires or timeout elapses, and
+// reports whether it was woken by a signal.
+func waitForAppend(signals []<-chan struct{}, timeout time.Duration) bool {
+	if len(signals) == 0 || timeout <= 0 {
+		return false
+	}
+	woken := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	for _, ch := range signals {
+		go func() {
+			select {
+			case <-ch:
+				select {
+				case woken <- struct{}{}:
+				default:
+				}
+			case <-stop:
+			}
+		}()
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-woken:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func buildFetchResponse(corrID int32, apiVer int16, errCode int16, sessionID int32, results []fetchTopicResult) []byte {
+	// Body (v11, flex v12-v13):
+	// throttle_time_ms (INT32), error_code (INT16), session_id (INT32)
+	// responses (ARRAY) -> {topic (topic_id in v13), partitions (ARRAY), TAGS}
+	//   partitions -> {partition_index, error_code, high_watermark, last_stable_offset,
+	//                  log_start_offset, aborted_transactions (ARRAY), preferred_read_replica,
+	//                  records (RECORDS), TAGS}
+	//     aborted_transactions -> {producer_id, first_offset, TAGS}
+	//     tagged: 0 diverging_epoch {epoch, end_offset, TAGS},
+	//             1 current_leader {leader_id, leader_epoch, TAGS}
+	// response TAG_BUFFER count = 0
+	// Arrays, strings and records are compact, and TAGS present, in flexible
+	// versions.
+	flexible := isFlexible(apiKeyFetch, apiVer)
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putI16(errCode)
+	r.putI32(sessionID)
+	r.putArrayLenFor(flexible, len(results))
+	for _, tr := range results {
+		if apiVer >= 13 {
+			r.putUUID(tr.topicID)
+		} else {
+			r.putStringFor(flexible, tr.name)
+		}
+		r.putArrayLenFor(flexible, len(tr.partitions))
+		for _, pr := range tr.partitions {
+			r.putI32(pr.index)
+			r.putI16(pr.errCode)
+			r.putI64(pr.hwm)
+			r.putI64(pr.lastStable)
+			r.putI64(pr.logStart)
+			r.putArrayLenFor(flexible, len(pr.aborted))
+			for _, t := range pr.aborted {
+				r.putI64(t.producerID)
+				r.putI64(t.firstOffset)
+				r.putTagsFor(flexible)
+			}
+			r.putI32(-1) // preferred_read_replica
+			r.putRecordsFor(flexible, pr.records)
+			if flexible {
+				putFetchPartitionTags(&r, pr)
+			}
+		}
+		r.putTagsFor(flexible)
+	}
+	r.putTagsFor(flexible)
+	return r.finish(corrID, responseHeaderVersion(apiKeyFetch, apiVer))
+}
+
+// putFetchPartitionTags writes a Fetch partition's TAG_BUFFER: the epoch to
+// truncate to when the client's log has diverged, and who leads the
+// partition at which epoch after an epoch error.
+func putFetchPartitionTags(r *respBuf, pr fetchPartitionResult) {
+	var tags []int
+	if pr.diverging != nil {
+		tags = append(tags, 0)
+	}
+	if pr.errCode == errFencedLeaderEpoch || pr.errCode == errUnknownLeaderEpoch {
+		tags = append(tags, 1)
+	}
+	r.putUvarint(uint64(len(tags)))
+	for _, tag := range tags {
+		var field respBuf
+		switch tag {
+		case 0:
+			field.putI32(pr.diverging.epoch)
+			field.putI64(pr.diverging.endOffset)
+		case 1:
+			field.putI32(brokerID)
+			field.putI32(pr.leaderEpoch)
+		}
+		field.putTags()
+		r.putUvarint(uint64(tag))
+		r.putUvarint(uint64(len(field.b)))
+		r.b = append(r.b, field.b...)
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fetchOptions are the request-level fields of a test Fetch. The zero
+// value asks for nothing and doesn't wait; sessionEpoch -1 fetches outside
+// any fetch session.
+type fetchOptions struct {
+	maxWaitMs, minBytes, maxBytes int32
+	isolation                     int8
+	sessionID, sessionEpoch       int32
+	forgotten                     []fetchTopicRequest // only name/topicID and partition indexes are sent
+}
+
+// fetchRequest encodes a flexible (v12+) Fetch request for topics, naming
+// them by topic id from v13.
+func fetchRequest(apiVer int16, opts fetchOptions, topics ...fetchTopicRequest) []byte {
+	var req respBuf
+	req.putI32(-1) // replica_id
+	req.putI32(opts.maxWaitMs)
+	req.putI32(opts.minBytes)
+	req.putI32(opts.maxBytes)
+	req.putI8(opts.isolation)
+	req.putI32(opts.sessionID)
+	req.putI32(opts.sessionEpoch)
+	putTopic := func(tr fetchTopicRequest) {
+		if apiVer >= 13 {
+			req.putUUID(tr.topicID)
+		} else {
+			req.putCompactString(tr.name)
+		}
+	}
+	req.putCompactArrayLen(len(topics))
+	for _, tr := range topics {
+		putTopic(tr)
+		req.putCompactArrayLen(len(tr.partitions))
+		for _, pr := range tr.partitions {
+			req.putI32(pr.index)
+			req.putI32(pr.epochs.current)
+			req.putI64(pr.fetchOffset)
+			req.putI32(pr.epochs.lastFetched)
+			req.putI64(-1) // log_start_offset
+			req.putI32(pr.maxBytes)
+			req.putTags()
+		}
+		req.putTags()
+	}
+	req.putCompactArrayLen(len(opts.forgotten))
+	for _, tr := range opts.forgotten {
+		putTopic(tr)
+		req.putCompactArrayLen(len(tr.partitions))
+		for _, pr := range tr.partitions {
+			req.putI32(pr.index)
+		}
+		req.putTags()
+	}
+	req.putCompactString("") // rack_id
+	req.putTags()
+	return req.b
+}
+
+// fetchPartition asks for partition from offset with no leader epochs and
+// up to 1 MiB.
+func fetchPartition(partition int32, offset int64) fetchPartitionRequest {
+	return fetchPartitionRequest{index: partition, fetchOffset: offset, epochs: noFetchEpochs, maxBytes: 1 << 20}
+}
+
+// fetchResponse is a parsed Fetch response. Each partition's records are
+// split into batches.
+type fetchResponse struct {
+	errCode   int16
+	sessionID int32
+	topics    []fetchTopicResult
+}
+
+// fetch sends a flexible Fetch request and parses the response.
+func (c *testConn) fetch(apiVer int16, opts fetchOptions, topics ...fetchTopicRequest) fetchResponse {
+	c.t.Helper()
+	return parseFetchResponse(c.t, apiVer, c.call(apiKeyFetch, apiVer, fetchRequest(apiVer, opts, topics...)))
+}
+
+// fetchOne fetches topic/partition from offset, outside any session and
+// without waiting, and returns the partition's result.
+func (c *testConn) fetchOne(topic string, partition int32, offset int64) fetchPartitionResult {
+	c.t.Helper()
+	resp := c.fetch(12, fetchOptions{maxBytes: 1 << 20, sessionEpoch: -1},
+		fetchTopicRequest{name: topic, partitions: []fetchPartitionRequest{fetchPartition(partition, offset)}})
+	if resp.errCode != errNone || len(resp.topics) != 1 || len(resp.topics[0].partitions) != 1 {
+		c.t.Fatalf("fetch = error %d with %d topics, want one partition", resp.errCode, len(resp.topics))
+	}
+	return resp.topics[0].partitions[0]
+}
+
+func parseFetchResponse(t testing.TB, apiVer int16, r *cursor) fetchResponse {
+	t.Helper()
+	var resp fetchResponse
+	r.i32() // throttle_time_ms
+	resp.errCode, _ = r.i16()
+	resp.sessionID, _ = r.i32()
+	nTopics, _, _ := r.compactArrayLen()
+	for range nTopics {
+		var tr fetchTopicResult
+		if apiVer >= 13 {
+			tr.topicID, _ = r.uuid()
+		} else {
+			tr.name, _ = r.compactNullableString()
+		}
+		nParts, _, _ := r.compactArrayLen()
+		for range nParts {
+			var pr fetchPartitionResult
+			pr.index, _ = r.i32()
+			pr.errCode, _ = r.i16()
+			pr.hwm, _ = r.i64()
+			pr.lastStable, _ = r.i64()
+			pr.logStart, _ = r.i64()
+			if n, _, _ := r.compactArrayLen(); n >= 0 {
+				pr.aborted = []abortedTxn{}
+				for range n {
+					var a abortedTxn
+					a.producerID, _ = r.i64()
+					a.firstOffset, _ = r.i64()
+					r.skipTagged()
+					pr.aborted = append(pr.aborted, a)
+				}
+			}
+			r.i32() // preferred_read_replica
+			records, err := r.compactRecords()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for len(records) > 0 {
+				batch, err := splitBatch(records)
+				if err != nil {
+					t.Fatal(err)
+				}
+				pr.records = append(pr.records, batch)
+				records = records[len(batch):]
+			}
+			parseFetchPartitionTags(t, r, &pr)
+			tr.partitions = append(tr.partitions, pr)
+		}
+		r.skipTagged()
+		resp.topics = append(resp.topics, tr)
+	}
+	if err := r.skipTagged(); err != nil {
+		t.Fatal(err)
+	}
+	checkConsumed(t, r)
+	return resp
+}
+
+// parseFetchPartitionTags reads the tags putFetchPartitionTags writes.
+func parseFetchPartitionTags(t testing.TB, r *cursor, pr *fetchPartitionResult) {
+	t.Helper()
+	n, err := r.uvarint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range n {
+		tag, _ := r.uvarint()
+		r.uvarint() // size
+		switch tag {
+		case 0:
+			pr.diverging = &epochEnd{}
+			pr.diverging.epoch, _ = r.i32()
+			pr.diverging.endOffset, _ = r.i64()
+		case 1:
+			if id, _ := r.i32(); id != brokerID {
+				t.Errorf("current leader %d, want %d", id, brokerID)
+			}
+			pr.leaderEpoch, _ = r.i32()
+		default:
+			t.Fatalf("unexpected partition tag %d", tag)
+		}
+		if err := r.skipTagged(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFetch(t *testing.T) {
+	c := newTestServer(t).dial()
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	batches := [][]byte{testBatch("a", "b"), testBatch("c"), testBatch("d")}
+	for _, b := range batches {
+		c.produce("orders", 0, b)
+	}
+
+	pr := c.fetchOne("orders", 0, 0)
+	if pr.errCode != errNone || pr.hwm != 4 || pr.lastStable != 4 || pr.logStart != 0 || len(pr.records) != 3 {
+		t.Fatalf("fetch from 0 = error %d, hwm %d, last stable %d, log start %d, %d batches; want hwm 4 and 3 batches",
+			pr.errCode, pr.hwm, pr.lastStable, pr.logStart, len(pr.records))
+	}
+	// The broker assigns the base offset and leader epoch; the rest of each
+	// batch, which the CRC covers, comes back as it was produced.
+	for i, want := range []int64{0, 2, 3} {
+		b := pr.records[i]
+		if got := peekBatch(b).baseOffset; got != want {
+			t.Errorf("batch %d at offset %d, want %d", i, got, want)
+		}
+		if string(b[batchCRCOffset:]) != string(batches[i][batchCRCOffset:]) {
+			t.Errorf("batch %d differs from the one produced", i)
+		}
+	}
+
+	// A fetch from the middle of a batch returns that whole batch.
+	if pr := c.fetchOne("orders", 0, 1); len(pr.records) != 3 {
+		t.Errorf("fetch from 1 = %d batches, want 3", len(pr.records))
+	}
+
+	// max_bytes cuts the records at a batch boundary, but the first batch is
+	// returned even if it alone is over the limit.
+	limit := int32(len(batches[0]) + len(batches[1]) + 1)
+	for _, tc := range []struct {
+		maxBytes, partitionMaxBytes int32
+		want                        int
+	}{
+		{limit, 1 << 20, 2},
+		{1 << 20, limit, 2},
+		{1, 1 << 20, 1},
+	} {
+		fp := fetchPartition(0, 0)
+		fp.maxBytes = tc.partitionMaxBytes
+		resp := c.fetch(12, fetchOptions{maxBytes: tc.maxBytes, sessionEpoch: -1},
+			fetchTopicRequest{name: "orders", partitions: []fetchPartitionRequest{fp}})
+		pr := resp.topics[0].partitions[0]
+		if pr.errCode != errNone || len(pr.records) != tc.want || pr.hwm != 4 {
+			t.Errorf("fetch with max_bytes %d, partition max_bytes %d = error %d, %d batches, hwm %d; want %d batches",
+				tc.maxBytes, tc.partitionMaxBytes, pr.errCode, len(pr.records), pr.hwm, tc.want)
+		}
+	}
+
+	// Past the log end there is nothing to return yet, but no error.
+	if pr := c.fetchOne("orders", 0, 10); pr.errCode != errNone || len(pr.records) != 0 || pr.hwm != 4 {
+		t.Errorf("fetch past the log end = error %d, %d batches, hwm %d; want nothing and hwm 4", pr.errCode, len(pr.records), pr.hwm)
+	}
+
+	// Below the log start offset is out of range.
+	if _, err := store.deleteRecords("orders", 0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if pr := c.fetchOne("orders", 0, 1); pr.errCode != errOffsetOutOfRange || len(pr.records) != 0 {
+		t.Errorf("fetch below the log start = error %d, %d batches; want %d", pr.errCode, len(pr.records), errOffsetOutOfRange)
+	}
+}
+
+// A Fetch at the high watermark has nothing to return, and one just below
+// it returns the last batch.
+func TestFetchAtHighWatermark(t *testing.T) {
+	c := newTestServer(t).dial()
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	c.produce("orders", 0, testBatch("a", "b"))
+	c.produce("orders", 0, testBatch("c"))
+
+	hwm, err := store.highWatermark("orders", 0)
+	if err != nil || hwm != 3 {
+		t.Fatalf("high watermark = %d (%v), want 3", hwm, err)
+	}
+	if pr := c.fetchOne("orders", 0, hwm); pr.errCode != errNone || len(pr.records) != 0 || pr.hwm != hwm {
+		t.Errorf("fetch at the high watermark = error %d, %d batches, hwm %d; want nothing and hwm %d", pr.errCode, len(pr.records), pr.hwm, hwm)
+	}
+	if pr := c.fetchOne("orders", 0, hwm-1); len(pr.records) != 1 || peekBatch(pr.records[0]).baseOffset != 2 {
+		t.Errorf("fetch below the high watermark = %d batches, want the batch at 2", len(pr.records))
+	}
+}
+
+// topicID asks Metadata v12 about topic and returns its topic id.
+func (c *testConn) topicID(topic string) [16]byte {
+	c.t.Helper()
+	var req respBuf
+	req.putCompactArrayLen(1)
+	req.putUUID([16]byte{})
+	req.putCompactString(topic)
+	req.putTags()
+	req.putBool(false) // allow_auto_topic_creation
+	req.putBool(false) // include_topic_authorized_operations
+	req.putTags()
+	r := c.call(apiKeyMetadata, 12, req.b)
+	r.i32() // throttle_time_ms
+	if n, _, _ := r.compactArrayLen(); n != 1 {
+		c.t.Fatalf("%d brokers, want 1", n)
+	}
+	r.i32()                   // node_id
+	r.compactNullableString() // host
+	r.i32()                   // port
+	r.compactNullableString() // rack
+	r.skipTagged()            // broker tags
+	r.compactNullableString() // cluster_id
+	r.i32()                   // controller_id
+	if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+		c.t.Fatalf("%d topics (%v), want 1", n, err)
+	}
+	errCode, _ := r.i16()
+	r.compactNullableString() // name
+	id, err := r.uuid()
+	if errCode != errNone || err != nil {
+		c.t.Fatalf("Metadata for %q = error %d (%v)", topic, errCode, err)
+	}
+	return id
+}
+
+// Fetch v13 names topics by the id Metadata gives them; an id no topic has
+// is UNKNOWN_TOPIC_ID.
+func TestFetchByTopicID(t *testing.T) {
+	c := newTestServer(t).dial()
+	if errCode := c.createTopic("orders", 1, nil); errCode != errNone {
+		t.Fatalf("CreateTopics = error %d", errCode)
+	}
+	c.produce("orders", 0, testBatch("a"))
+	id := c.topicID("orders")
+	if id == ([16]byte{}) {
+		t.Fatal("Metadata gave orders the zero topic id")
+	}
+
+	unknown := id
+	unknown[0] ^= 0xff
+	resp := c.fetch(13, fetchOptions{maxBytes: 1 << 20, sessionEpoch: -1},
+		fetchTopicRequest{topicID: id, partitions: []fetchPartitionRequest{fetchPartition(0, 0)}},
+		fetchTopicRequest{topicID: unknown, partitions: []fetchPartitionRequest{fetchPartition(0, 0)}})
+	if resp.errCode != errNone || len(resp.topics) != 2 {
+		t.Fatalf("fetch = error %d with %d topics, want 2", resp.errCode, len(resp.topics))
+	}
+	known, missing := resp.topics[0], resp.topics[1]
+	if pr := known.partitions[0]; known.topicID != id || pr.errCode != errNone || len(pr.records) != 1 {
+		t.Errorf("fetch by orders' id = topic id %x, error %d, %d batches; want its batch", known.topicID, pr.errCode, len(pr.records))
+	}
+	if pr := missing.partitions[0]; missing.topicID != unknown || pr.errCode != errUnknownTopicID {
+		t.Errorf("fetch by an unknown id = topic id %x, error %d; want %d", missing.topicID, pr.errCode, errUnknownTopicID)
+	}
+}
+
+// A full fetch at session epoch 0 opens a session; incremental fetches
+// then list only the partitions whose fetch offset moved, or that are to
+// be forgotten, and get back only the partitions with something new.
+func TestFetchSession(t *testing.T) {
+	c := newTestServer(t).dial()
+	if _, err := store.createTopic("orders", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	c.produce("orders", 0, testBatch("a"))
+	c.produce("orders", 1, testBatch("b"))
+	orders := func(parts ...fetchPartitionRequest) []fetchTopicRequest {
+		if len(parts) == 0 {
+			return nil
+		}
+		return []fetchTopicRequest{{name: "orders", partitions: parts}}
+	}
+	// partitions returns the batches each partition in resp returned.
+	partitions := func(resp fetchResponse) map[int32]int {
+		got := map[int32]int{}
+		for _, tr := range resp.topics {
+			for _, pr := range tr.partitions {
+				if pr.errCode != errNone {
+					t.Errorf("partition %d: error %d", pr.index, pr.errCode)
+				}
+				got[pr.index] = len(pr.records)
+			}
+		}
+		return got
+	}
+
+	resp := c.fetch(12, fetchOptions{maxBytes: 1 << 20}, orders(fetchPartition(0, 0), fetchPartition(1, 0))...)
+	id := resp.sessionID
+	if got := partitions(resp); resp.errCode != errNone || id == 0 || !maps.Equal(got, map[int32]int{0: 1, 1: 1}) {
+		t.Fatalf("full fetch = error %d, session %d, batches %v; want a session and a batch from each partition", resp.errCode, id, got)
+	}
+
+	c.produce("orders", 1, testBatch("c"))
+	for _, tc := range []struct {
+		name      string
+		epoch     int32
+		topics    []fetchTopicRequest
+		forgotten []fetchTopicRequest
+		want      map[int32]int
+	}{
+		// Partition 0 has moved past its batch and has nothing new, so only
+		// partition 1, still fetched from 0, comes back.
+		{"partition 0 moved on", 1, orders(fetchPartition(0, 1)), nil, map[int32]int{1: 2}},
+		{"partition 1 moved on", 2, orders(fetchPartition(1, 2)), nil, map[int32]int{}},
+		{"partition 1 forgotten", 3, nil, orders(fetchPartition(1, 0)), map[int32]int{}},
+	} {
+		resp := c.fetch(12, fetchOptions{maxBytes: 1 << 20, sessionID: id, sessionEpoch: tc.epoch, forgotten: tc.forgotten}, tc.topics...)
+		if got := partitions(resp); resp.errCode != errNone || resp.sessionID != id || !maps.Equal(got, tc.want) {
+			t.Errorf("%s: fetch = error %d, session %d, batches %v; want session %d, batches %v", tc.name, resp.errCode, resp.sessionID, got, id, tc.want)
+		}
+	}
+
+	// Partition 1 has left the session, so its new batch isn't fetched.
+	c.produce("orders", 1, testBatch("d"))
+	c.produce("orders", 0, testBatch("e"))
+	resp = c.fetch(12, fetchOptions{maxBytes: 1 << 20, sessionID: id, sessionEpoch: 4})
+	if got := partitions(resp); !maps.Equal(got, map[int32]int{0: 1}) {
+		t.Errorf("fetch after forgetting partition 1 = batches %v, want the new batch of partition 0", got)
+	}
+
+	if resp := c.fetch(12, fetchOptions{maxBytes: 1 << 20, sessionID: id, sessionEpoch: 4}); resp.errCode != errInvalidFetchSessionEpoch {
+		t.Errorf("fetch repeating epoch 4 = error %d, want %d", resp.errCode, errInvalidFetchSessionEpoch)
+	}
+	if resp := c.fetch(12, fetchOptions{maxBytes: 1 << 20, sessionID: id ^ 1<<30, sessionEpoch: 1}); resp.errCode != errFetchSessionIDNotFound {
+		t.Errorf("fetch in an unknown session = error %d, want %d", resp.errCode, errFetchSessionIDNotFound)
+	}
+}
+
+// A Fetch with nothing to return waits up to max_wait_ms for a Produce to
+// one of its partitions, and answers with the produced records as soon as
+// one comes.
+func TestFetchLongPoll(t *testing.T) {
+	s := newTestServer(t)
+	consumer, producer := s.dial(), s.dial()
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	consumer.sendRequest(apiKeyFetch, 12, fetchRequest(12, fetchOptions{maxWaitMs: 10000, minBytes: 1, maxBytes: 1 << 20, sessionEpoch: -1},
+		fetchTopicRequest{name: "orders", partitions: []fetchPartitionRequest{fetchPartition(0, 0)}}))
+	consumer.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := consumer.conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read %d bytes (%v) before anything was produced, want the fetch to wait", n, err)
+	}
+	consumer.conn.SetReadDeadline(time.Time{})
+
+	batch := testBatch("a")
+	if res := producer.produce("orders", 0, batch); res.errCode != errNone {
+		t.Fatalf("produce = error %d", res.errCode)
+	}
+	resp := parseFetchResponse(t, 12, consumer.readResponse(apiKeyFetch, 12))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("fetch answered after %v, want it woken by the produce", elapsed)
+	}
+	pr := resp.topics[0].partitions[0]
+	if pr.errCode != errNone || pr.hwm != 1 || len(pr.records) != 1 || string(pr.records[0][batchCRCOffset:]) != string(batch[batchCRCOffset:]) {
+		t.Errorf("woken fetch = error %d, hwm %d, %d batches; want the produced batch", pr.errCode, pr.hwm, len(pr.records))
+	}
+}
+
+// read_committed consumers see an open transaction's records only once it
+// commits. An aborted transaction's batches are still sent, as Kafka does,
+// but aborted_transactions tells the consumer to skip them.
+func TestFetchReadCommitted(t *testing.T) {
+	c := newTestServer(t).dial()
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	fetch := func(isolation int8) fetchPartitionResult {
+		t.Helper()
+		resp := c.fetch(12, fetchOptions{maxBytes: 1 << 20, isolation: isolation, sessionEpoch: -1},
+			fetchTopicRequest{name: "orders", partitions: []fetchPartitionRequest{fetchPartition(0, 0)}})
+		return resp.topics[0].partitions[0]
+	}
+
+	c.produce("orders", 0, testBatch("plain-1"))
+	p := c.initTxnProducer("tx")
+	if errCode := c.addPartitionsToTxn(p, "orders", 0); errCode != errNone {
+		t.Fatalf("AddPartitionsToTxn = error %d", errCode)
+	}
+	if res := c.produce("orders", 0, txnBatch(p, 0, "aborted-1", "aborted-2")); res.errCode != errNone {
+		t.Fatalf("transactional produce = error %d", res.errCode)
+	}
+
+	pr := fetch(readCommitted)
+	if got := consumedValues(t, pr); pr.errCode != errNone || pr.lastStable != 1 || len(pr.aborted) != 0 || !slices.Equal(got, []string{"plain-1"}) {
+		t.Errorf("read_committed fetch during the transaction = error %d, last stable %d, aborted %v, values %q; want last stable 1 and just plain-1",
+			pr.errCode, pr.lastStable, pr.aborted, got)
+	}
+	if got := consumedValues(t, fetch(readUncommitted)); !slices.Equal(got, []string{"plain-1", "aborted-1", "aborted-2"}) {
+		t.Errorf("read_uncommitted fetch during the transaction = %q, want every record", got)
+	}
+
+	if errCode := c.endTxn(p, false); errCode != errNone {
+		t.Fatalf("EndTxn(abort) = error %d", errCode)
+	}
+	c.produce("orders", 0, testBatch("plain-2"))
+	pr = fetch(readCommitted)
+	wantAborted := []abortedTxn{{producerID: p.producerID, firstOffset: 1}}
+	if got := consumedValues(t, pr); pr.errCode != errNone || pr.lastStable != 5 || !slices.Equal(pr.aborted, wantAborted) || !slices.Equal(got, []string{"plain-1", "plain-2"}) {
+		t.Errorf("read_committed fetch after the abort = error %d, last stable %d, aborted %v, values %q; want last stable 5, aborted %v and the plain records",
+			pr.errCode, pr.lastStable, pr.aborted, got, wantAborted)
+	}
+}
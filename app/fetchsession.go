@@ -0,0 +1,253 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// ----- incremental fetch sessions (KIP-227) -----
+
+// Kafka's max.incremental.fetch.session.cache.slots and
+// min.incremental.fetch.session.eviction.ms defaults. Sessions left idle
+// that long are dropped; a client whose session is gone gets
+// FETCH_SESSION_ID_NOT_FOUND and starts a new one with a full fetch.
+const (
+	fetchSessionSlots       = 1000
+	fetchSessionIdleTimeout = 2 * time.Minute
+)
+
+// Session epochs with a special meaning in a Fetch request.
+const (
+	fetchInitialEpoch = int32(0)  // full fetch, opening a new session
+	fetchFinalEpoch   = int32(-1) // full fetch without a session, closing any
+)
+
+// fetchSessionKey names a partition in a session: by topic id from Fetch
+// v13, by topic name before.
+type fetchSessionKey struct {
+	topicID   [16]byte
+	topic     string
+	partition int32
+}
+
+func newFetchSessionKey(apiVer int16, topic string, topicID [16]byte, partition int32) fetchSessionKey {
+	if apiVer >= 13 {
+		return fetchSessionKey{topicID: topicID, partition: partition}
+	}
+	return fetchSessionKey{topic: topic, partition: partition}
+}
+
+// fetchSessionPartition is a partition in a session: what the client last
+// asked of it, and what we last told the client about it.
+type fetchSessionPartition struct {
+	key                       fetchSessionKey
+	req                       fetchPartitionRequest
+	hwm, lastStable, logStart int64
+}
+
+// fetchSession remembers the partitions a client fetches, so that each
+// incremental Fetch need only list the ones whose fetch offset changed, and
+// its response only the ones with something new.
+type fetchSession struct {
+	id         int32
+	epoch      int32 // the epoch the next request must carry
+	partitions []*fetchSessionPartition
+	byKey      map[fetchSessionKey]*fetchSessionPartition
+	lastUsed   time.Time
+}
+
+type fetchSessionCache struct {
+	mu       sync.Mutex
+	sessions map[int32]*fetchSession
+}
+
+func newFetchSessionCache() *fetchSessionCache {
+	return &fetchSessionCache{sessions: map[int32]*fetchSession{}}
+}
+
+var fetchSessions = newFetchSessionCache()
+
+// fetchContext is what a Fetch request does with sessions: which
+// partitions to read, and how to shape the response.
+type fetchContext struct {
+	errCode   int16
+	sessionID int32 // 0: no session
+	full      bool  // answer every partition, not just the changed ones
+	topics    []fetchTopicRequest
+}
+
+// begin applies a Fetch request's session fields, its partitions topics
+// and the partitions it asks to forget, as Kafka does: epoch 0 opens a new
+// session holding topics, -1 fetches without one, and any other epoch
+// updates session id with topics and forgotten and reads everything it
+// holds. Opening one or fetching without one closes session id, if the
+// client names one.
+func (fc *fetchSessionCache) begin(apiVer int16, id, epoch int32, topics []fetchTopicRequest, forgotten []fetchSessionKey) fetchContext {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	now := time.Now()
+	if epoch == fetchInitialEpoch || epoch == fetchFinalEpoch {
+		delete(fc.sessions, id)
+		ctx := fetchContext{full: true, topics: topics}
+		if epoch == fetchInitialEpoch {
+			if s := fc.newSessionLocked(now); s != nil {
+				s.update(apiVer, topics, nil)
+				ctx.sessionID = s.id
+			}
+		}
+		return ctx
+	}
+
+	s := fc.sessions[id]
+	switch {
+	case s == nil:
+		return fetchContext{errCode: errFetchSessionIDNotFound}
+	case epoch != s.epoch:
+		return fetchContext{errCode: errInvalidFetchSessionEpoch}
+	}
+	s.update(apiVer, topics, forgotten)
+	s.epoch = nextFetchEpoch(s.epoch)
+	s.lastUsed = now
+	return fetchContext{sessionID: s.id, topics: s.topics(apiVer)}
+}
+
+// newSessionLocked adds a session with a fresh id, making room by dropping
+// idle sessions if the cache is full. It returns nil if it is still full.
+// Caller holds mu.
+func (fc *fetchSessionCache) newSessionLocked(now time.Time) *fetchSession {
+	if len(fc.sessions) >= fetchSessionSlots {
+		fc.evictLocked(now)
+	}
+	if len(fc.sessions) >= fetchSessionSlots {
+		return nil
+	}
+	id := rand.Int32N(math.MaxInt32) + 1
+	for fc.sessions[id] != nil {
+		id = rand.Int32N(math.MaxInt32) + 1
+	}
+	s := &fetchSession{id: id, epoch: 1, byKey: map[fetchSessionKey]*fetchSessionPartition{}, lastUsed: now}
+	fc.sessions[id] = s
+	return s
+}
+
+// evictLocked drops sessions idle for fetchSessionIdleTimeout. Caller holds
+// mu.
+func (fc *fetchSessionCache) evictLocked(now time.Time) {
+	for id, s := range fc.sessions {
+		if now.Sub(s.lastUsed) > fetchSessionIdleTimeout {
+			delete(fc.sessions, id)
+		}
+	}
+}
+
+// expireLoop runs evictLocked every interval, so that sessions of clients
+// that went away don't pile up.
+func (fc *fetchSessionCache) expireLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		fc.mu.Lock()
+		fc.evictLocked(now)
+		fc.mu.Unlock()
+	}
+}
+
+// nextFetchEpoch returns the epoch after epoch, wrapping past the largest
+// back to 1.
+func nextFetchEpoch(epoch int32) int32 {
+	if epoch == math.MaxInt32 {
+		return 1
+	}
+	return epoch + 1
+}
+
+// update adds the partitions in topics to s, or refreshes what the client
+// asks of them, and drops the ones in forgotten.
+func (s *fetchSession) update(apiVer int16, topics []fetchTopicRequest, forgotten []fetchSessionKey) {
+	for _, tr := range topics {
+		for _, pr := range tr.partitions {
+			key := newFetchSessionKey(apiVer, tr.name, tr.topicID, pr.index)
+			if sp := s.byKey[key]; sp != nil {
+				sp.req = pr
+				continue
+			}
+			sp := &fetchSessionPartition{key: key, req: pr, hwm: -1, lastStable: -1, logStart: -1}
+			s.byKey[key] = sp
+			s.partitions = append(s.partitions, sp)
+		}
+	}
+	if len(forgotten) == 0 {
+		return
+	}
+	for _, key := range forgotten {
+		delete(s.byKey, key)
+	}
+	kept := s.partitions[:0]
+	for _, sp := range s.partitions {
+		if s.byKey[sp.key] == sp {
+			kept = append(kept, sp)
+		}
+	}
+	s.partitions = kept
+}
+
+// topics returns every partition in s as a Fetch request would list them.
+func (s *fetchSession) topics(apiVer int16) []fetchTopicRequest {
+	var topics []fetchTopicRequest
+	index := map[fetchSessionKey]int{} // topic's position in topics, by its key with partition 0
+	for _, sp := range s.partitions {
+		tk := sp.key
+		tk.partition = 0
+		i, ok := index[tk]
+		if !ok {
+			tr := fetchTopicRequest{name: tk.topic, topicID: tk.topicID}
+			if apiVer >= 13 {
+				tr.name = store.topicByID(tk.topicID)
+			}
+			i = len(topics)
+			index[tk] = i
+			topics = append(topics, tr)
+		}
+		topics[i].partitions = append(topics[i].partitions, sp.req)
+	}
+	return topics
+}
+
+// finish records what results tell the client about each partition in
+// session id and, for an incremental fetch, leaves out the partitions with
+// nothing new: no records, no error and the same offsets as last time.
+func (fc *fetchSessionCache) finish(apiVer int16, ctx fetchContext, results []fetchTopicResult) []fetchTopicResult {
+	if ctx.sessionID == 0 {
+		return results
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	s := fc.sessions[ctx.sessionID]
+	if s == nil {
+		return results
+	}
+	out := results[:0]
+	for _, tr := range results {
+		parts := tr.partitions[:0]
+		for _, pr := range tr.partitions {
+			sp := s.byKey[newFetchSessionKey(apiVer, tr.name, tr.topicID, pr.index)]
+			changed := sp == nil || len(pr.records) > 0 || pr.errCode != errNone || pr.diverging != nil ||
+				pr.hwm != sp.hwm || pr.lastStable != sp.lastStable || pr.logStart != sp.logStart
+			if sp != nil {
+				sp.hwm, sp.lastStable, sp.logStart = pr.hwm, pr.lastStable, pr.logStart
+			}
+			if changed || ctx.full {
+				parts = append(parts, pr)
+			}
+		}
+		if len(parts) > 0 {
+			tr.partitions = parts
+			out = append(out, tr)
+		}
+	}
+	return out
+}
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+func init() {
+	registerHandler(apiKeyOffsetCommit, handleOffsetCommit)
+	registerHandler(apiKeyOffsetFetch, handleOffsetFetch)
+	registerHandler(apiKeyFindCoordinator, handleFindCoordinator)
+	registerHandler(apiKeyJoinGroup, handleJoinGroup)
+	registerHandler(apiKeyHeartbeat, handleHeartbeat)
+	registerHandler(apiKeyLeaveGroup, handleLeaveGroup)
+	registerHandler(apiKeySyncGroup, handleSyncGroup)
+	registerHandler(apiKeyDescribeGroups, handleDescribeGroups)
+	registerHandler(apiKeyListGroups, handleListGroups)
+	registerHandler(apiKeyDeleteGroups, handleDeleteGroups)
+}
+
+// ----- OffsetCommit (api key 8) -----
+
+// handleOffsetCommit parses a v8 OffsetCommit request and stores the
+// offsets with the coordinator.
+func handleOffsetCommit(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	groupID, err := c.compactNullableString()
+	if err != nil {
+		return nil, err
+	}
+	generation, err := c.i32()
+	if err != nil {
+		return nil, err
+	}
+	memberID, err := c.compactNullableString()
+	if err != nil {
+		return nil, err
+	}
+	instanceID, err := c.compactNullableString()
+	if err != nil {
+		return nil, err
+	}
+	nTopics, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	var parts []partitionOffset
+	for i := 0; i < nTopics; i++ {
+		name, err := c.compactNullableString()
+		if err != nil {
+			return nil, err
+		}
+		nParts, _, err := c.compactArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < nParts; j++ {
+			p := partitionOffset{topic: name}
+			if p.partition, err = c.i32(); err != nil {
+				return nil, err
+			}
+			if p.offset, err = c.i64(); err != nil {
+				return nil, err
+			}
+			if p.leaderEpoch, err = c.i32(); err != nil {
+				return nil, err
+			}
+			if p.metadata, err = c.compactNullableString(); err != nil {
+				return nil, err
+			}
+			if err := c.skipTagged(); err != nil {
+				return nil, err
+			}
+			parts = append(parts, p)
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+	if !sess.authorized(aclOpRead, aclResourceGroup, groupID) {
+		for i := range parts {
+			parts[i].errCode = errGroupAuthorizationFailed
+		}
+		return buildOffsetCommitResponse(corrID, apiKeyOffsetCommit, apiVer, parts), nil
+	}
+	for i := range parts {
+		if !sess.authorized(aclOpRead, aclResourceTopic, parts[i].topic) {
+			parts[i].errCode = errTopicAuthorizationFailed
+		}
+	}
+	coordinator.commitOffsets(groupID, memberID, instanceID, generation, parts)
+	return buildOffsetCommitResponse(corrID, apiKeyOffsetCommit, apiVer, parts), nil
+}
+
+// buildOffsetCommitResponse encodes the OffsetCommit and TxnOffsetCommit
+// responses, which share a layout.
+func buildOffsetCommitResponse(corrID int32, apiKey, apiVer int16, parts []partitionOffset) []byte {
+	// Body (flex v8, TxnOffsetCommit flex v3):
+	// throttle_time_ms (INT32)
+	// topics (COMPACT_ARRAY) -> {name, partitions (COMPACT_ARRAY), TAGS}
+	//   partitions -> {partition_index, error_code, TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	topics := groupByTopic(parts)
+	r.putCompactArrayLen(len(topics))
+	for _, tp := range topics {
+		r.putCompactString(tp[0].topic)
+		r.putCompactArrayLen(len(tp))
+		for _, p := range tp {
+			r.putI32(p.partition)
+			r.putI16(p.errCode)
+			r.putTags()
+		}
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKey, apiVer))
+}
+
+// ----- OffsetFetch (api key 9) -----
+
+type offsetFetchGroup struct {
+	id      string
+	parts   []partitionOffset
+	errCode int16
+}
+
+// handleOffsetFetch parses a v8 OffsetFetch request and looks up each
+// group's committed offsets. A null topics array asks for all of them.
+// Commits are applied immediately, so require_stable needs no waiting.
+func handleOffsetFetch(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	nGroups, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]offsetFetchGroup, 0, nGroups)
+	for i := 0; i < nGroups; i++ {
+		var g offsetFetchGroup
+		if g.id, err = c.compactNullableString(); err != nil {
+			return nil, err
+		}
+		nTopics, allTopics, err := c.compactArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		if !allTopics {
+			g.parts = []partitionOffset{}
+		}
+		for j := 0; j < nTopics; j++ {
+			name, err := c.compactNullableString()
+			if err != nil {
+				return nil, err
+			}
+			nParts, _, err := c.compactArrayLen()
+			if err != nil {
+				return nil, err
+			}
+			for k := 0; k < nParts; k++ {
+				index, err := c.i32()
+				if err != nil {
+					return nil, err
+				}
+				g.parts = append(g.parts, partitionOffset{topic: name, partition: index})
+			}
+			if err := c.skipTagged(); err != nil {
+				return nil, err
+			}
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	if _, err := c.boolean(); err != nil { // require_stable
+		return nil, err
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+
+	for i := range groups {
+		g := &groups[i]
+		if !sess.authorized(aclOpDescribe, aclResourceGroup, g.id) {
+			g.parts, g.errCode = nil, errGroupAuthorizationFailed
+			continue
+		}
+		allTopics := g.parts == nil
+		g.parts = coordinator.fetchOffsets(g.id, g.parts)
+		// Topics the client may not describe are left out of all of the
+		// group's offsets, and refused when asked for by name.
+		kept := g.parts[:0]
+		for _, p := range g.parts {
+			if !sess.authorized(aclOpDescribe, aclResourceTopic, p.topic) {
+				if allTopics {
+					continue
+				}
+				p.offset, p.leaderEpoch, p.metadata, p.errCode = -1, -1, "", errTopicAuthorizationFailed
+			}
+			kept = append(kept, p)
+		}
+		g.parts = kept
+	}
+	return buildOffsetFetchResponse(corrID, apiVer, groups), nil
+}
+
+func buildOffsetFetchResponse(corrID int32, apiVer int16, groups []offsetFetchGroup) []byte {
+	// Body (flex v8):
+	// throttle_time_ms (INT32)
+	// groups (COMPACT_ARRAY) -> {group_id, topics (COMPACT_ARRAY), error_code, TAGS}
+	//   topics -> {name, partitions (COMPACT_ARRAY), TAGS}
+	//     partitions -> {partition_index, committed_offset, committed_leader_epoch,
+	//                    metadata, error_code, TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putCompactArrayLen(len(groups))
+	for _, g := range groups {
+		r.putCompactString(g.id)
+		topics := groupByTopic(g.parts)
+		r.putCompactArrayLen(len(topics))
+		for _, tp := range topics {
+			r.putCompactString(tp[0].topic)
+			r.putCompactArrayLen(len(tp))
+			for _, p := range tp {
+				r.putI32(p.partition)
+				r.putI64(p.offset)
+				r.putI32(p.leaderEpoch)
+				r.putCompactString(p.metadata)
+				r.putI16(p.errCode)
+				r.putTags()
+			}
+			r.putTags()
+		}
+		r.putI16(g.errCode)
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyOffsetFetch, apiVer))
+}
+
+// groupByTopic splits parts into runs of consecutive entries for the same
+// topic, which is how requests list them.
+func groupByTopic(parts []partitionOffset) [][]partitionOffset {
+	var topics [][]partitionOffset
+	for i := 0; i < len(parts); {
+		j := i + 1
+		for j < len(parts) && parts[j].topic == parts[i].topic {
+			j++
+		}
+		topics = append(topics, parts[i:j])
+		i = j
+	}
+	return topics
+}
+
+// ----- FindCoordinator (api key 10) -----
+
+// handleFindCoordinator parses a v4 FindCoordinator request. As the only
+// broker we coordinate every group and transaction, so each key gets us.
+func handleFindCoordinator(c *cursor, corrID int32, apiVer int16, _ *session) ([]byte, error) {
+	if _, err := c.i8(); err != nil { // key_type: 0 group, 1 transaction
+		return nil, err
+	}
+	nKeys, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, nKeys)
+	for i := 0; i < nKeys; i++ {
+		key, err := c.compactNullableString()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+	return buildFindCoordinatorResponse(corrID, apiVer, keys), nil
+}
+
+func buildFindCoordinatorResponse(corrID int32, apiVer int16, keys []string) []byte {
+	// Body (flex v4):
+	// throttle_time_ms (INT32)
+	// coordinators (COMPACT_ARRAY) -> {key, node_id, host, port, error_code, error_message, TAGS}
+	// response TAG_BUFFER count = 0
+	host, port := advertisedHostPort()
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putCompactArrayLen(len(keys))
+	for _, key := range keys {
+		r.putCompactString(key)
+		r.putI32(brokerID)
+		r.putCompactString(host)
+		r.putI32(port)
+		r.putI16(errNone)
+		r.putCompactNullableString("") // error_message: null
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyFindCoordinator, apiVer))
+}
+
+// ----- JoinGroup (api key 11) -----
+
+// handleJoinGroup parses a v9 JoinGroup request and adds the member to its
+// group through the coordinator.
+func handleJoinGroup(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	req := joinGroupRequest{clientID: sess.clientID, clientHost: sess.clientHost}
+	var err error
+	if req.groupID, err = c.compactNullableString(); err != nil {
+		return nil, err
+	}
+	sessionTimeout, err := c.i32()
+	if err != nil {
+		return nil, err
+	}
+	rebalanceTimeout, err := c.i32()
+	if err != nil {
+		return nil, err
+	}
+	req.sessionTimeout = time.Duration(sessionTimeout) * time.Millisecond
+	req.rebalanceTimeout = time.Duration(rebalanceTimeout) * time.Millisecond
+	if req.memberID, err = c.compactNullableString(); err != nil {
+		return nil, err
+	}
+	if req.instanceID, err = c.compactNullableString(); err != nil {
+		return nil, err
+	}
+	if req.protocolType, err = c.compactNullableString(); err != nil {
+		return nil, err
+	}
+	nProtocols, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < nProtocols; i++ {
+		var p memberProtocol
+		if p.name, err = c.compactNullableString(); err != nil {
+			return nil, err
+		}
+		if p.metadata, err = c.compactBytes(); err != nil {
+			return nil, err
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+		req.protocols = append(req.protocols, p)
+	}
+	if _, err := c.compactNullableString(); err != nil { // reason
+		return nil, err
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+	if !sess.authorized(aclOpRead, aclResourceGroup, req.groupID) {
+		return buildErrorResponse(corrID, apiKeyJoinGroup, apiVer, errGroupAuthorizationFailed), nil
+	}
+	return buildJoinGroupResponse(corrID, apiVer, coordinator.joinGroup(req)), nil
+}
+
+func buildJoinGroupResponse(corrID int32, apiVer int16, res joinGroupResult) []byte {
+	// Body (flex v9):
+	// throttle_time_ms (INT32), error_code (INT16), generation_id (INT32),
+	// protocol_type, protocol_name, leader, skip_assignment (BOOLEAN), member_id,
+	// members (COMPACT_ARRAY) -> {member_id, group_instance_id, metadata, TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putI16(res.errCode)
+	r.putI32(res.generation)
+	r.putCompactNullableString(res.protocolType)
+	r.putCompactNullableString(res.protocolName)
+	r.putCompactString(res.leader)
+	r.putBool(res.skipAssignment)
+	r.putCompactString(res.memberID)
+	r.putCompactArrayLen(len(res.members))
+	for _, m := range res.members {
+		r.putCompactString(m.id)
+		r.putCompactNullableString(m.instanceID)
+		r.putCompactBytes(m.metadata)
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyJoinGroup, apiVer))
+}
+
+// ----- Heartbeat (api key 12) -----
+
+// handleHeartbeat parses a v4 Heartbeat request and checks the member in
+// with the coordinator.
+func handleHeartbeat(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	groupID, err := c.compactNullableString()
+	if err != nil {
+		return nil, err
+	}
+	generation, err := c.i32()
+	if err != nil {
+		return nil, err
+	}
+	memberID, err := c.compactNullableString()
+	if err != nil {
+		return nil, err
+	}
+	instanceID, err := c.compactNullableString()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+
+	if !sess.authorized(aclOpRead, aclResourceGroup, groupID) {
+		return buildErrorResponse(corrID, apiKeyHeartbeat, apiVer, errGroupAuthorizationFailed), nil
+	}
+
+	// Body (flex v4): throttle_time_ms (INT32), error_code (INT16), TAGS
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putI16(coordinator.heartbeat(groupID, memberID, instanceID, generation))
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyHeartbeat, apiVer)), nil
+}
+
+// ----- LeaveGroup (api key 13) -----
+
+// handleLeaveGroup parses a v5 LeaveGroup request and removes each listed
+// member from its group.
+func handleLeaveGroup(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	groupID, err := c.compactNullableString()
+	if err != nil {
+		return nil, err
+	}
+	nMembers, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	members := make([]leavingMember, 0, nMembers)
+	for i := 0; i < nMembers; i++ {
+		var m leavingMember
+		if m.id, err = c.compactNullableString(); err != nil {
+			return nil, err
+		}
+		if m.instanceID, err = c.compactNullableString(); err != nil {
+			return nil, err
+		}
+		if _, err := c.compactNullableString(); err != nil { // reason
+			return nil, err
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+	if !sess.authorized(aclOpRead, aclResourceGroup, groupID) {
+		return buildErrorResponse(corrID, apiKeyLeaveGroup, apiVer, errGroupAuthorizationFailed), nil
+	}
+	coordinator.leaveGroup(groupID, members)
+
+	// Body (flex v5):
+	// throttle_time_ms (INT32), error_code (INT16),
+	// members (COMPACT_ARRAY) -> {member_id, group_instance_id, error_code, TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putI16(errNone)
+	r.putCompactArrayLen(len(members))
+	for _, m := range members {
+		r.putCompactString(m.id)
+		r.putCompactNullableString(m.instanceID)
+		r.putI16(m.errCode)
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyLeaveGroup, apiVer)), nil
+}
+
+// ----- SyncGroup (api key 14) -----
+
+// handleSyncGroup parses a v5 SyncGroup request. The leader's request
+// carries everyone's assignment; every member gets its own back.
+func handleSyncGroup(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	groupID, err := c.compactNullableString()
+	if err != nil {
+		return nil, err
+	}
+	generation, err := c.i32()
+	if err != nil {
+		return nil, err
+	}
+	memberID, err := c.compactNullableString()
+	if err != nil {
+		return nil, err
+	}
+	instanceID, err := c.compactNullableString()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.compactNullableString(); err != nil { // protocol_type
+		return nil, err
+	}
+	if _, err := c.compactNullableString(); err != nil { // protocol_name
+		return nil, err
+	}
+	nAssignments, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	assignments := make(map[string][]byte, nAssignments)
+	for i := 0; i < nAssignments; i++ {
+		id, err := c.compactNullableString()
+		if err != nil {
+			return nil, err
+		}
+		if assignments[id], err = c.compactBytes(); err != nil {
+			return nil, err
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+	if !sess.authorized(aclOpRead, aclResourceGroup, groupID) {
+		return buildErrorResponse(corrID, apiKeySyncGroup, apiVer, errGroupAuthorizationFailed), nil
+	}
+	res := coordinator.syncGroup(groupID, memberID, instanceID, generation, assignments)
+	return buildSyncGroupResponse(corrID, apiVer, res), nil
+}
+
+func buildSyncGroupResponse(corrID int32, apiVer int16, res syncGroupResult) []byte {
+	// Body (flex v5):
+	// throttle_time_ms (INT32), error_code (INT16), protocol_type, protocol_name,
+	// assignment (COMPACT_BYTES)
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putI16(res.errCode)
+	r.putCompactNullableString(res.protocolType)
+	r.putCompactNullableString(res.protocolName)
+	r.putCompactBytes(res.assignment)
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeySyncGroup, apiVer))
+}
+
+// ----- DescribeGroups (api key 15) -----
+
+// handleDescribeGroups parses a v5 DescribeGroups request and reports the
+// state and members of each named group the principal may DESCRIBE.
+func handleDescribeGroups(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	nGroups, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, nGroups)
+	for i := 0; i < nGroups; i++ {
+		id, err := c.compactNullableString()
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if _, err := c.boolean(); err != nil { // include_authorized_operations
+		return nil, err
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+	groups := coordinator.describeGroups(ids)
+	for i, g := range groups {
+		if !sess.authorized(aclOpDescribe, aclResourceGroup, g.id) {
+			groups[i] = groupDescription{errCode: errGroupAuthorizationFailed, id: g.id}
+		}
+	}
+	return buildDescribeGroupsResponse(corrID, apiVer, groups), nil
+}
+
+func buildDescribeGroupsResponse(corrID int32, apiVer int16, groups []groupDescription) []byte {
+	// Body (flex v5):
+	// throttle_time_ms (INT32),
+	// groups (COMPACT_ARRAY) -> {error_code, group_id, group_state, protocol_type,
+	//   protocol_data,
+	//   members (COMPACT_ARRAY) -> {member_id, group_instance_id, client_id,
+	//     client_host, member_metadata (COMPACT_BYTES),
+	//     member_assignment (COMPACT_BYTES), TAGS},
+	//   authorized_operations (INT32), TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putCompactArrayLen(len(groups))
+	for _, g := range groups {
+		r.putI16(g.errCode)
+		r.putCompactString(g.id)
+		r.putCompactString(g.state)
+		r.putCompactString(g.protocolType)
+		r.putCompactString(g.protocolName)
+		r.putCompactArrayLen(len(g.members))
+		for _, m := range g.members {
+			r.putCompactString(m.id)
+			r.putCompactNullableString(m.instanceID)
+			r.putCompactString(m.clientID)
+			r.putCompactString(m.clientHost)
+			r.putCompactBytes(m.metadata)
+			r.putCompactBytes(m.assignment)
+			r.putTags()
+		}
+		r.putI32(-2147483648) // authorized_operations: unknown
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyDescribeGroups, apiVer))
+}
+
+// ----- ListGroups (api key 16) -----
+
+// handleListGroups parses a v4 ListGroups request and lists every group,
+// optionally only those in the states of states_filter. Without DESCRIBE on
+// the cluster, the principal sees only the groups it may DESCRIBE.
+func handleListGroups(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	nStates, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	states := make([]string, 0, nStates)
+	for i := 0; i < nStates; i++ {
+		s, err := c.compactNullableString()
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, s)
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+
+	// Body (flex v4):
+	// throttle_time_ms (INT32), error_code (INT16),
+	// groups (COMPACT_ARRAY) -> {group_id, protocol_type, group_state, TAGS}
+	// response TAG_BUFFER count = 0
+	groups := coordinator.listGroups(states)
+	principal := sess.kafkaPrincipal()
+	if !authz.authorize(principal, aclOpDescribe, aclResourceCluster, clusterResourceName) {
+		groups = slices.DeleteFunc(groups, func(g groupListing) bool {
+			return !authz.authorize(principal, aclOpDescribe, aclResourceGroup, g.id)
+		})
+	}
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putI16(errNone)
+	r.putCompactArrayLen(len(groups))
+	for _, g := range groups {
+		r.putCompactString(g.id)
+		r.putCompactString(g.protocolType)
+		r.putCompactString(g.state)
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyListGroups, apiVer)), nil
+}
+
+// ----- DeleteGroups (api key 42) -----
+
+// handleDeleteGroups parses a v2 DeleteGroups request and deletes each empty
+// group the principal may DELETE, along with its committed offsets.
+func handleDeleteGroups(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	nGroups, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, nGroups)
+	for i := 0; i < nGroups; i++ {
+		id, err := c.compactNullableString()
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+
+	// Body (flex v2):
+	// throttle_time_ms (INT32),
+	// results (COMPACT_ARRAY) -> {group_id, error_code, TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putCompactArrayLen(len(ids))
+	for _, id := range ids {
+		r.putCompactString(id)
+		if sess.authorized(aclOpDelete, aclResourceGroup, id) {
+			r.putI16(coordinator.deleteGroup(id))
+		} else {
+			r.putI16(errGroupAuthorizationFailed)
+		}
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyDeleteGroups, apiVer)), nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+// Every group and transaction is coordinated by this broker, at the
+// address it advertises rather than the one it listens on.
+func TestFindCoordinator(t *testing.T) {
+	c := newTestServer(t).dial()
+	advertisedListener = "kafka.example:29092"
+
+	for _, keyType := range []int8{0, 1} { // group, transaction
+		var req respBuf
+		req.putI8(keyType)
+		req.putCompactArrayLen(2)
+		req.putCompactString("first")
+		req.putCompactString("second")
+		req.putTags()
+		r := c.call(apiKeyFindCoordinator, 4, req.b)
+		r.i32() // throttle_time_ms
+		if n, _, err := r.compactArrayLen(); err != nil || n != 2 {
+			t.Fatalf("%d coordinators (%v), want 2", n, err)
+		}
+		for _, want := range []string{"first", "second"} {
+			key, _ := r.compactNullableString()
+			nodeID, _ := r.i32()
+			host, _ := r.compactNullableString()
+			port, _ := r.i32()
+			errCode, _ := r.i16()
+			r.compactNullableString() // error_message
+			r.skipTagged()
+			if key != want || nodeID != brokerID || host != "kafka.example" || port != 29092 || errCode != errNone {
+				t.Errorf("key type %d: coordinator for %q = node %d at %s:%d, error %d; want %q at node %d, kafka.example:29092",
+					keyType, key, nodeID, host, port, errCode, want, brokerID)
+			}
+		}
+		if err := r.skipTagged(); err != nil {
+			t.Fatal(err)
+		}
+		checkConsumed(t, r)
+	}
+}
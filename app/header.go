@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ----- request/response headers -----
+
+// firstFlexibleVersion maps an api key to the first version that uses the
+// flexible encoding (compact strings/arrays and tagged fields). Keys that
+// never became flexible map to -1; unknown keys are treated the same.
+var firstFlexibleVersion = map[int16]int16{
+	0:  9,  // Produce
+	1:  12, // Fetch
+	2:  6,  // ListOffsets
+	3:  9,  // Metadata
+	7:  3,  // ControlledShutdown
+	8:  8,  // OffsetCommit
+	9:  6,  // OffsetFetch
+	10: 3,  // FindCoordinator
+	11: 6,  // JoinGroup
+	12: 4,  // Heartbeat
+	13: 4,  // LeaveGroup
+	14: 4,  // SyncGroup
+	15: 5,  // DescribeGroups
+	16: 3,  // ListGroups
+	17: -1, // SaslHandshake
+	18: 3,  // ApiVersions (request only; see responseHeaderVersion)
+	19: 5,  // CreateTopics
+	20: 4,  // DeleteTopics
+	21: 2,  // DeleteRecords
+	22: 2,  // InitProducerId
+	23: 4,  // OffsetForLeaderEpoch
+	24: 3,  // AddPartitionsToTxn
+	25: 3,  // AddOffsetsToTxn
+	26: 3,  // EndTxn
+	27: 1,  // WriteTxnMarkers
+	28: 3,  // TxnOffsetCommit
+	29: 2,  // DescribeAcls
+	30: 2,  // CreateAcls
+	31: 2,  // DeleteAcls
+	32: 4,  // DescribeConfigs
+	33: 2,  // AlterConfigs
+	34: 2,  // AlterReplicaLogDirs
+	35: 2,  // DescribeLogDirs
+	36: 2,  // SaslAuthenticate
+	37: 2,  // CreatePartitions
+	42: 2,  // DeleteGroups
+	43: 2,  // ElectLeaders
+	44: 1,  // IncrementalAlterConfigs
+	45: 0,  // AlterPartitionReassignments
+	46: 0,  // ListPartitionReassignments
+	60: 0,  // DescribeCluster
+}
+
+func isFlexible(apiKey, apiVer int16) bool {
+	first, ok := firstFlexibleVersion[apiKey]
+	return ok && first >= 0 && apiVer >= first
+}
+
+// requestHeaderVersion returns the request header version used by the given
+// api key and version:
+//
+//	0: api_key, api_version, correlation_id
+//	1: v0 + client_id (nullable STRING)
+//	2: v1 + tagged fields
+//
+// Note client_id stays a legacy int16-length STRING even in v2.
+func requestHeaderVersion(apiKey, apiVer int16) int {
+	// ControlledShutdown v0 predates client_id.
+	if apiKey == 7 && apiVer == 0 {
+		return 0
+	}
+	if isFlexible(apiKey, apiVer) {
+		return 2
+	}
+	return 1
+}
+
+// errShortHeader means a request ended before its correlation id, so it
+// can't be answered.
+var errShortHeader = errors.New("request too short for a header")
+
+// parseHeader reads a request header off c. Once the correlation id has been
+// read it is returned along with any later error, so that a request whose
+// header goes wrong after it can still be answered.
+func parseHeader(c *cursor) (apiKey int16, apiVer int16, corrID int32, clientID string, err error) {
+	// Kafka request payload starts with:
+	// api_key (int16), api_version (int16), correlation_id (int32), then
+	// whatever the header version for this api key/version adds.
+	if c.need(8) != nil {
+		return 0, 0, 0, "", errShortHeader
+	}
+	apiKey, _ = c.i16()
+	apiVer, _ = c.i16()
+	corrID, _ = c.i32()
+
+	switch requestHeaderVersion(apiKey, apiVer) {
+	case 1:
+		clientID, err = parseHeaderV1(c)
+	case 2:
+		clientID, err = parseHeaderV2(c)
+	}
+	return apiKey, apiVer, corrID, clientID, err
+}
+
+// parseHeaderV1 reads the rest of a v1 request header: just client_id. It
+// must not look for tagged fields, which would eat into the body.
+func parseHeaderV1(c *cursor) (clientID string, err error) {
+	return c.str16()
+}
+
+// parseHeaderV2 reads the rest of a v2 request header: client_id, still a
+// legacy STRING, then tagged fields.
+func parseHeaderV2(c *cursor) (clientID string, err error) {
+	if clientID, err = c.str16(); err != nil {
+		return "", err
+	}
+	return clientID, c.skipTagged()
+}
+
+// responseHeaderVersion returns the response header version for the given
+// api key and version: 0 is just the correlation id, 1 adds tagged fields.
+func responseHeaderVersion(apiKey, apiVer int16) int {
+	// ApiVersions always answers with header v0, even for flexible request
+	// versions, so that a client can parse the reply before it knows which
+	// versions the broker supports.
+	if apiKey == apiKeyApiVersions {
+		return 0
+	}
+	if isFlexible(apiKey, apiVer) {
+		return 1
+	}
+	return 0
+}
+
+// writeResponseHeader appends a response header of the given version to buf.
+func writeResponseHeader(buf []byte, corrID int32, version int) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(corrID))
+	if version >= 1 {
+		buf = append(buf, 0x00) // empty TAG_BUFFER
+	}
+	return buf
+}
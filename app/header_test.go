@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func FuzzParseHeader(f *testing.F) {
+	f.Add([]byte{0, 18, 0, 4, 0, 0, 0, 7, 0, 3, 'k', 'g', 'o', 0})                                  // ApiVersions v4, header v2
+	f.Add([]byte{0, 3, 0, 12, 0, 0, 0, 7, 0, 3, 'k', 'g', 'o', 1, 0, 0xff, 0xff, 0xff, 0xff, 0x0f}) // a tag claiming 4GiB
+	f.Add([]byte{0, 1, 0, 4, 0, 0, 0, 7, 0xff, 0xff})                                               // header v1, null client id
+	f.Add([]byte{0, 0, 0, 9, 0, 0, 0, 7, 0x80, 0x00})                                               // negative client id length
+	f.Add([]byte{0, 18, 0})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		c := &cursor{b: b}
+		_, _, _, _, err := parseHeader(c)
+		if c.off < 0 || c.off > len(b) {
+			t.Fatalf("cursor at %d of %d bytes (err %v)", c.off, len(b), err)
+		}
+		if len(b) < 8 && err != errShortHeader {
+			t.Fatalf("%d-byte header: err = %v, want errShortHeader", len(b), err)
+		}
+	})
+}
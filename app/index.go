@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"sort"
+)
+
+// ----- sparse offset index -----
+
+// Kafka's log.index.interval.bytes default.
+const defaultIndexIntervalBytes = 4096
+
+const indexEntrySize = 8
+
+// indexEntry maps a batch's base offset, relative to the segment base
+// offset, to the batch's byte position in the segment.
+type indexEntry struct {
+	relOffset uint32
+	pos       uint32
+}
+
+// offsetIndex is a segment's sparse .index: one entry roughly every interval
+// bytes of log, so finding an offset is a binary search plus a short scan
+// instead of a walk over the whole segment.
+type offsetIndex struct {
+	entries    []indexEntry
+	file       *os.File // nil for in-memory segments
+	interval   int64
+	bytesSince int64 // log bytes appended since the last entry
+}
+
+// add is called for every batch appended at pos; it records an index entry
+// once more than interval bytes have gone by since the previous one.
+func (ix *offsetIndex) add(relOffset, pos, size int64) error {
+	if ix.bytesSince > ix.interval {
+		e := indexEntry{relOffset: uint32(relOffset), pos: uint32(pos)}
+		if ix.file != nil {
+			var b [indexEntrySize]byte
+			binary.BigEndian.PutUint32(b[0:], e.relOffset)
+			binary.BigEndian.PutUint32(b[4:], e.pos)
+			if _, err := ix.file.Write(b[:]); err != nil {
+				return err
+			}
+		}
+		ix.entries = append(ix.entries, e)
+		ix.bytesSince = 0
+	}
+	ix.bytesSince += size
+	return nil
+}
+
+// lookup returns the position of the last indexed batch starting at or
+// before relOffset, or 0 when there is none. Scanning forward from there
+// finds the batch holding relOffset.
+func (ix *offsetIndex) lookup(relOffset int64) int64 {
+	i := sort.Search(len(ix.entries), func(i int) bool {
+		return int64(ix.entries[i].relOffset) > relOffset
+	})
+	if i == 0 {
+		return 0
+	}
+	return int64(ix.entries[i-1].pos)
+}
+
+// decodeIndex parses .index file contents, rejecting anything that can't
+// belong to a log of logSize bytes.
+func decodeIndex(b []byte, logSize int64) ([]indexEntry, bool) {
+	if len(b)%indexEntrySize != 0 {
+		return nil, false
+	}
+	entries := make([]indexEntry, 0, len(b)/indexEntrySize)
+	for off := 0; off < len(b); off += indexEntrySize {
+		e := indexEntry{
+			relOffset: binary.BigEndian.Uint32(b[off:]),
+			pos:       binary.BigEndian.Uint32(b[off+4:]),
+		}
+		if int64(e.pos) >= logSize {
+			return nil, false
+		}
+		if n := len(entries); n > 0 && (e.relOffset <= entries[n-1].relOffset || e.pos <= entries[n-1].pos) {
+			return nil, false
+		}
+		entries = append(entries, e)
+	}
+	return entries, true
+}
+
+// openIndex opens the .index file at path for a segment of logSize bytes. If
+// the file is missing or corrupt it is rewritten from rebuilt, the entries
+// derived from replaying the log.
+func openIndex(path string, logSize int64, rebuilt []indexEntry, interval int64) (offsetIndex, error) {
+	ix := offsetIndex{interval: interval}
+	b, err := os.ReadFile(path)
+	entries, ok := decodeIndex(b, logSize)
+	if err != nil || !ok {
+		entries = rebuilt
+		buf := make([]byte, 0, len(entries)*indexEntrySize)
+		for _, e := range entries {
+			buf = binary.BigEndian.AppendUint32(buf, e.relOffset)
+			buf = binary.BigEndian.AppendUint32(buf, e.pos)
+		}
+		if err := os.WriteFile(path, buf, 0o644); err != nil {
+			return ix, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return ix, err
+	}
+	ix.file = f
+	ix.entries = entries
+	ix.bytesSince = logSize
+	if n := len(entries); n > 0 {
+		ix.bytesSince = logSize - int64(entries[n-1].pos)
+	}
+	return ix, nil
+}
+
+func (ix *offsetIndex) close() error {
+	if ix.file == nil {
+		return nil
+	}
+	return ix.file.Close()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// BenchmarkFetchSegment fetches 64 KiB at offsets spread over a single
+// 100k-record segment, finding each fetch offset through the sparse .index
+// or, with an interval no batch reaches, by scanning from the segment start.
+func BenchmarkFetchSegment(b *testing.B) {
+	const records = 100_000
+	for _, bc := range []struct {
+		name     string
+		interval int64
+	}{
+		{"index", defaultIndexIntervalBytes},
+		{"linear", math.MaxInt64},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			s := newLogStore()
+			s.indexIntervalBytes = bc.interval
+			if _, err := s.createTopic("bench", 1, nil); err != nil {
+				b.Fatal(err)
+			}
+			for i := range records {
+				batch := encodeRecordBatch(recordBatch{producerID: -1, baseSequence: -1, records: []record{{value: fmt.Appendf(nil, "value-%d", i)}}})
+				if _, err := s.append("bench", 0, batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if n := len(s.topics["bench"][0].segments); n != 1 {
+				b.Fatalf("%d segments, want 1", n)
+			}
+			var offset int64
+			for b.Loop() {
+				offset = (offset + 7919) % records
+				pr, err := s.readBatches("bench", 0, offset, 64<<10, readOptions{minOne: true, epochs: noFetchEpochs})
+				if err != nil || len(pr.batches) == 0 {
+					b.Fatalf("fetch at %d: %d batches (%v)", offset, len(pr.batches), err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----- InitProducerId (api key 22) -----
+
+func init() {
+	registerHandler(apiKeyInitProducerId, handleInitProducerId)
+}
+
+// producerIDBlockSize is how many producer ids are reserved on disk at a
+// time, like the blocks Kafka's controller hands out.
+const producerIDBlockSize = 1000
+
+// producerIDsFileName holds the end of the last reserved block of producer
+// ids. A restart resumes there, so ids handed out before it are never reused
+// even though the ids left in the block are skipped.
+const producerIDsFileName = "__producer_ids"
+
+// producerIDManager hands out producer ids in increasing order.
+type producerIDManager struct {
+	mu       sync.Mutex
+	next     int64
+	blockEnd int64
+	path     string // reserved block end; "" keeps ids in memory
+}
+
+var producerIDs = &producerIDManager{}
+
+// openProducerIDManager returns a manager reserving its ids in dir.
+func openProducerIDManager(dir string) (*producerIDManager, error) {
+	m := &producerIDManager{path: filepath.Join(dir, producerIDsFileName)}
+	b, err := os.ReadFile(m.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if m.next, err = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err != nil {
+			return nil, err
+		}
+		m.blockEnd = m.next
+	}
+	return m, nil
+}
+
+// allocate returns a producer id no earlier call, in this run or a previous
+// one, has returned.
+func (m *producerIDManager) allocate() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.path != "" && m.next == m.blockEnd {
+		end := m.blockEnd + producerIDBlockSize
+		if err := os.WriteFile(m.path+".tmp", []byte(strconv.FormatInt(end, 10)), 0o644); err != nil {
+			return -1, err
+		}
+		if err := os.Rename(m.path+".tmp", m.path); err != nil {
+			return -1, err
+		}
+		m.blockEnd = end
+	}
+	id := m.next
+	m.next++
+	return id, nil
+}
+
+// handleInitProducerId parses a v4 InitProducerId request. An idempotent
+// producer gets a fresh producer id at epoch 0, which it stamps on its
+// batches so the broker can tell its retries from new records; a
+// transactional one, which takes WRITE on its transactional id, gets that
+// id's producer id and next epoch from the transaction coordinator.
+func handleInitProducerId(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	transactionalID, err := c.compactNullableString()
+	if err != nil {
+		return nil, err
+	}
+	timeoutMs, err := c.i32()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.i64(); err != nil { // producer_id
+		return nil, err
+	}
+	if _, err := c.i16(); err != nil { // producer_epoch
+		return nil, err
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+
+	if transactionalID != "" {
+		if !sess.authorized(aclOpWrite, aclResourceTransactionalID, transactionalID) {
+			return buildInitProducerIdResponse(corrID, apiVer, errTxnIDAuthorizationFailed, -1, -1), nil
+		}
+		id, epoch, err := txnCoordinator.initProducer(transactionalID, time.Duration(timeoutMs)*time.Millisecond)
+		if err != nil {
+			if kafkaErrorCode(err) == errUnknownServerError {
+				sess.log.Error("failed to init transactional producer", "transactional_id", transactionalID, "err", err)
+			}
+			return buildInitProducerIdResponse(corrID, apiVer, kafkaErrorCode(err), -1, -1), nil
+		}
+		sess.log.Debug("initialized transactional producer", "transactional_id", transactionalID, "producer_id", id, "epoch", epoch)
+		return buildInitProducerIdResponse(corrID, apiVer, errNone, id, epoch), nil
+	}
+
+	id, err := producerIDs.allocate()
+	if err != nil {
+		sess.log.Error("failed to allocate producer id", "correlation_id", corrID, "err", err)
+		return buildInitProducerIdResponse(corrID, apiVer, errUnknownServerError, -1, -1), nil
+	}
+	sess.log.Debug("allocated producer id", "producer_id", id)
+	return buildInitProducerIdResponse(corrID, apiVer, errNone, id, 0), nil
+}
+
+func buildInitProducerIdResponse(corrID int32, apiVer int16, errCode int16, producerID int64, epoch int16) []byte {
+	// Body (flex v4):
+	// throttle_time_ms (INT32), error_code (INT16), producer_id (INT64),
+	// producer_epoch (INT16), TAG_BUFFER
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putI16(errCode)
+	r.putI64(producerID)
+	r.putI16(epoch)
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyInitProducerId, apiVer))
+}
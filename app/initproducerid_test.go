@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+// initProducerID sends a v4 InitProducerId request, transactional if txnID
+// isn't "", and returns the error code, producer id and epoch.
+func (c *testConn) initProducerID(txnID string) (int16, int64, int16) {
+	c.t.Helper()
+	var req respBuf
+	req.putCompactNullableString(txnID)
+	req.putI32(60000) // transaction_timeout_ms
+	req.putI64(-1)    // producer_id
+	req.putI16(-1)    // producer_epoch
+	req.putTags()
+	r := c.call(apiKeyInitProducerId, 4, req.b)
+	r.i32() // throttle_time_ms
+	errCode, _ := r.i16()
+	id, _ := r.i64()
+	epoch, _ := r.i16()
+	if err := r.skipTagged(); err != nil {
+		c.t.Fatal(err)
+	}
+	checkConsumed(c.t, r)
+	return errCode, id, epoch
+}
+
+func TestInitProducerIdAllocatesDistinctIDs(t *testing.T) {
+	c := newTestServer(t).dial()
+	errCode1, id1, epoch1 := c.initProducerID("")
+	errCode2, id2, epoch2 := c.initProducerID("")
+	if errCode1 != errNone || errCode2 != errNone || id1 < 0 || id2 <= id1 || epoch1 != 0 || epoch2 != 0 {
+		t.Errorf("InitProducerId twice = error %d id %d epoch %d, error %d id %d epoch %d; want increasing ids at epoch 0",
+			errCode1, id1, epoch1, errCode2, id2, epoch2)
+	}
+}
+
+// Ids handed out before a restart are never handed out again.
+func TestProducerIDsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	m, err := openProducerIDManager(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last int64
+	for range 3 {
+		if last, err = m.allocate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err = openProducerIDManager(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := m.allocate(); err != nil || id <= last {
+		t.Errorf("first id after reopening = %d (%v), want one above %d", id, err, last)
+	}
+}
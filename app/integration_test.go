@@ -0,0 +1,71 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// TestKafkaGoRoundTrip produces a record with segmentio/kafka-go and fetches
+// it back, going through the versions kafka-go negotiates with ApiVersions
+// for Metadata, Produce and Fetch. Run it with -tags integration.
+func TestKafkaGoRoundTrip(t *testing.T) {
+	s := newTestServer(t)
+	if _, err := store.createTopic("kafka-go", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client := &kafka.Client{Addr: kafka.TCP(s.addr), Timeout: 10 * time.Second}
+
+	produced, err := client.Produce(ctx, &kafka.ProduceRequest{
+		Topic:        "kafka-go",
+		Partition:    0,
+		RequiredAcks: kafka.RequireAll,
+		Records:      kafka.NewRecordReader(kafka.Record{Key: kafka.NewBytes([]byte("k")), Value: kafka.NewBytes([]byte("hello from kafka-go"))}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if produced.Error != nil {
+		t.Fatal(produced.Error)
+	}
+
+	fetched, err := client.Fetch(ctx, &kafka.FetchRequest{
+		Topic:     "kafka-go",
+		Partition: 0,
+		Offset:    produced.BaseOffset,
+		MinBytes:  1,
+		MaxBytes:  1 << 20,
+		MaxWait:   time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched.Error != nil {
+		t.Fatal(fetched.Error)
+	}
+	if fetched.HighWatermark != produced.BaseOffset+1 {
+		t.Errorf("high watermark %d, want %d", fetched.HighWatermark, produced.BaseOffset+1)
+	}
+	rec, err := fetched.Records.ReadRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := io.ReadAll(rec.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Offset != produced.BaseOffset || string(value) != "hello from kafka-go" {
+		t.Errorf("fetched %q at offset %d, want %q at %d", value, rec.Offset, "hello from kafka-go", produced.BaseOffset)
+	}
+	if _, err := fetched.Records.ReadRecord(); !errors.Is(err, io.EOF) {
+		t.Errorf("more than one record fetched: %v", err)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ----- OffsetForLeaderEpoch (api key 23) -----
+
+func init() {
+	registerHandler(apiKeyOffsetForLeaderEpoch, handleOffsetForLeaderEpoch)
+}
+
+var (
+	errFencedEpoch  = errors.New("leader epoch is older than the broker's")
+	errUnknownEpoch = errors.New("leader epoch is newer than the broker's")
+)
+
+// leaderEpochFileName is the partition's leader epoch cache, in the format
+// of Kafka's file of the same name: a version line, a count line, then one
+// "epoch startOffset" line per epoch.
+const leaderEpochFileName = "leader-epoch-checkpoint"
+
+// epochEntry records the first offset written under a leader epoch.
+type epochEntry struct {
+	epoch       int32
+	startOffset int64
+}
+
+// epochEnd is where a leader epoch's records end.
+type epochEnd struct {
+	epoch     int32
+	endOffset int64
+}
+
+// readLeaderEpochCheckpoint returns the epoch entries saved in dir, oldest
+// first, or none if there is no checkpoint.
+func readLeaderEpochCheckpoint(dir string) ([]epochEntry, error) {
+	b, err := os.ReadFile(filepath.Join(dir, leaderEpochFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	var version, count int
+	if sc.Scan() {
+		version, err = strconv.Atoi(sc.Text())
+	}
+	if err == nil && sc.Scan() {
+		count, err = strconv.Atoi(sc.Text())
+	}
+	if err != nil || version != 0 {
+		return nil, fmt.Errorf("bad %s header", leaderEpochFileName)
+	}
+	entries := make([]epochEntry, 0, count)
+	for sc.Scan() {
+		var e epochEntry
+		if _, err := fmt.Sscan(sc.Text(), &e.epoch, &e.startOffset); err != nil {
+			return nil, fmt.Errorf("bad %s line %q", leaderEpochFileName, sc.Text())
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != count {
+		return nil, fmt.Errorf("bad %s: %d entries, want %d", leaderEpochFileName, len(entries), count)
+	}
+	return entries, nil
+}
+
+// assignEpoch records that records from offset on are written under
+// epoch, if epoch is newer than the latest one known.
+func (pl *partitionLog) assignEpoch(epoch int32, offset int64) error {
+	if n := len(pl.epochs); n > 0 && pl.epochs[n-1].epoch >= epoch {
+		return nil
+	}
+	pl.epochs = append(pl.epochs, epochEntry{epoch, offset})
+	if pl.dir == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "0\n%d\n", len(pl.epochs))
+	for _, e := range pl.epochs {
+		fmt.Fprintf(&buf, "%d %d\n", e.epoch, e.startOffset)
+	}
+	path := filepath.Join(pl.dir, leaderEpochFileName)
+	if err := os.WriteFile(path+".tmp", buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// rebuildEpochs recreates a missing leader epoch cache from the epochs
+// stamped on the batches in the log.
+func (pl *partitionLog) rebuildEpochs() error {
+	var assignErr error
+	for _, sg := range pl.segments {
+		if _, err := sg.scan(0, func(bi batchInfo) bool {
+			assignErr = pl.assignEpoch(bi.leaderEpoch, bi.baseOffset)
+			return assignErr == nil
+		}); err != nil {
+			return err
+		}
+		if assignErr != nil {
+			return assignErr
+		}
+	}
+	return nil
+}
+
+// endOffsetForEpoch returns the largest epoch up to epoch that pl has seen
+// and the offset where that epoch's records end, which is where a follower
+// or consumer that saw epoch should truncate its copy of the log to. Like
+// Kafka it answers -1, -1 for an epoch newer than any known.
+func (pl *partitionLog) endOffsetForEpoch(epoch int32) (int32, int64) {
+	n := len(pl.epochs)
+	if n == 0 || epoch < 0 || epoch > pl.epochs[n-1].epoch {
+		return -1, -1
+	}
+	if epoch == pl.epochs[n-1].epoch {
+		return epoch, pl.nextOffset
+	}
+	// The first epoch after the requested one starts where it ended.
+	i := 0
+	for pl.epochs[i].epoch <= epoch {
+		i++
+	}
+	if i == 0 {
+		return epoch, pl.epochs[0].startOffset
+	}
+	return pl.epochs[i-1].epoch, pl.epochs[i].startOffset
+}
+
+// leaderEpoch returns the partition's current leader epoch. It only moves
+// when this broker takes over the partition again, that is on a restart;
+// -1 means it hasn't yet.
+func (pl *partitionLog) leaderEpoch() int32 {
+	if len(pl.epochs) == 0 {
+		return -1
+	}
+	return pl.epochs[len(pl.epochs)-1].epoch
+}
+
+// epochForOffset returns the leader epoch offset was written in, or -1.
+func (pl *partitionLog) epochForOffset(offset int64) int32 {
+	epoch := int32(-1)
+	if offset < 0 {
+		return epoch
+	}
+	for _, e := range pl.epochs {
+		if e.startOffset > offset {
+			break
+		}
+		epoch = e.epoch
+	}
+	return epoch
+}
+
+// checkLeaderEpoch compares a client's idea of the partition's current
+// leader epoch, -1 meaning it has none, with ours. A client behind us has
+// missed a leader change; one ahead of us has heard of a change we haven't.
+func (pl *partitionLog) checkLeaderEpoch(current int32) error {
+	switch epoch := pl.leaderEpoch(); {
+	case current < 0 || current == epoch:
+		return nil
+	case current < epoch:
+		return errFencedEpoch
+	default:
+		return errUnknownEpoch
+	}
+}
+
+// leaderEpoch returns topic/partition's current leader epoch, or -1 if
+// there is no such partition.
+func (s *logStore) leaderEpoch(topic string, partition int32) int32 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pl := s.partitionLocked(topic, partition)
+	if pl == nil {
+		return -1
+	}
+	return pl.leaderEpoch()
+}
+
+// endOffsetForEpoch resolves an OffsetForLeaderEpoch query for
+// topic/partition.
+func (s *logStore) endOffsetForEpoch(topic string, partition int32, currentEpoch, epoch int32) (int32, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pl := s.partitionLocked(topic, partition)
+	if pl == nil {
+		return -1, -1, errNoSuchPartition
+	}
+	if err := pl.checkLeaderEpoch(currentEpoch); err != nil {
+		return -1, -1, err
+	}
+	e, off := pl.endOffsetForEpoch(epoch)
+	return e, off, nil
+}
+
+type epochEndPartitionResult struct {
+	index       int32
+	errCode     int16
+	leaderEpoch int32
+	endOffset   int64
+}
+
+type epochEndTopicResult struct {
+	name       string
+	partitions []epochEndPartitionResult
+}
+
+// handleOffsetForLeaderEpoch parses a v4 OffsetForLeaderEpoch request and
+// answers, for each partition, where the requested leader epoch's records
+// end. Consumers use it after a leader change to spot records they read
+// that the new leader no longer has. It takes DESCRIBE on the topic.
+func handleOffsetForLeaderEpoch(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	if _, err := c.i32(); err != nil { // replica_id
+		return nil, err
+	}
+	nTopics, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]epochEndTopicResult, 0, nTopics)
+	for i := 0; i < nTopics; i++ {
+		name, err := c.compactNullableString()
+		if err != nil {
+			return nil, err
+		}
+		nParts, _, err := c.compactArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		tr := epochEndTopicResult{name: name}
+		allowed := sess.authorized(aclOpDescribe, aclResourceTopic, name)
+		for j := 0; j < nParts; j++ {
+			index, err := c.i32()
+			if err != nil {
+				return nil, err
+			}
+			current, err := c.i32()
+			if err != nil {
+				return nil, err
+			}
+			epoch, err := c.i32()
+			if err != nil {
+				return nil, err
+			}
+			if err := c.skipTagged(); err != nil {
+				return nil, err
+			}
+
+			pr := epochEndPartitionResult{index: index}
+			if !allowed {
+				pr.errCode, pr.leaderEpoch, pr.endOffset = errTopicAuthorizationFailed, -1, -1
+				tr.partitions = append(tr.partitions, pr)
+				continue
+			}
+			pr.leaderEpoch, pr.endOffset, err = store.endOffsetForEpoch(name, index, current, epoch)
+			pr.errCode = kafkaErrorCode(err)
+			tr.partitions = append(tr.partitions, pr)
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+		results = append(results, tr)
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+	return buildOffsetForLeaderEpochResponse(corrID, apiVer, results), nil
+}
+
+func buildOffsetForLeaderEpochResponse(corrID int32, apiVer int16, results []epochEndTopicResult) []byte {
+	// Body (flex v4):
+	// throttle_time_ms (INT32)
+	// topics (COMPACT_ARRAY) -> {topic, partitions (COMPACT_ARRAY), TAGS}
+	//   partitions -> {error_code, partition, leader_epoch, end_offset, TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putCompactArrayLen(len(results))
+	for _, tr := range results {
+		r.putCompactString(tr.name)
+		r.putCompactArrayLen(len(tr.partitions))
+		for _, pr := range tr.partitions {
+			r.putI16(pr.errCode)
+			r.putI32(pr.index)
+			r.putI32(pr.leaderEpoch)
+			r.putI64(pr.endOffset)
+			r.putTags()
+		}
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyOffsetForLeaderEpoch, apiVer))
+}
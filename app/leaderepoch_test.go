@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+// A Fetch naming an older leader epoch than the partition's is fenced, and
+// one naming a newer epoch is unknown; both say which epoch leads now.
+func TestFetchChecksCurrentLeaderEpoch(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openLogStore(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.append("orders", 0, testBatch("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	// Reopening the log starts leader epoch 1.
+	if s, err = openLogStore(dir, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	c := newTestServer(t).dial()
+	store = s
+	for _, tc := range []struct {
+		current     int32
+		errCode     int16
+		leaderEpoch int32
+		records     int
+	}{
+		{-1, errNone, 0, 1},
+		{1, errNone, 0, 1},
+		{0, errFencedLeaderEpoch, 1, 0},
+		{2, errUnknownLeaderEpoch, 1, 0},
+	} {
+		fp := fetchPartition(0, 0)
+		fp.epochs.current = tc.current
+		resp := c.fetch(12, fetchOptions{maxBytes: 1 << 20, sessionEpoch: -1},
+			fetchTopicRequest{name: "orders", partitions: []fetchPartitionRequest{fp}})
+		pr := resp.topics[0].partitions[0]
+		if pr.errCode != tc.errCode || pr.leaderEpoch != tc.leaderEpoch || len(pr.records) != tc.records {
+			t.Errorf("fetch at current leader epoch %d = error %d, current leader epoch %d, %d batches; want error %d, epoch %d, %d batches",
+				tc.current, pr.errCode, pr.leaderEpoch, len(pr.records), tc.errCode, tc.leaderEpoch, tc.records)
+		}
+	}
+}
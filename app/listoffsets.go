@@ -0,0 +1,113 @@
+package main
+
+// ----- ListOffsets (api key 2) -----
+
+func init() {
+	registerHandler(apiKeyListOffsets, handleListOffsets)
+}
+
+type listOffsetsPartitionResult struct {
+	index       int32
+	errCode     int16
+	timestamp   int64
+	offset      int64
+	leaderEpoch int32
+}
+
+type listOffsetsTopicResult struct {
+	name       string
+	partitions []listOffsetsPartitionResult
+}
+
+// handleListOffsets parses a v7 ListOffsets request and resolves each
+// partition's timestamp (-2 earliest, -1 latest, -3 max timestamp, or a real
+// timestamp) to an offset. read_committed clients get the last stable
+// offset as the latest.
+func handleListOffsets(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	if _, err := c.i32(); err != nil { // replica_id
+		return nil, err
+	}
+	isolation, err := c.i8()
+	if err != nil {
+		return nil, err
+	}
+
+	nTopics, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]listOffsetsTopicResult, 0, nTopics)
+	for i := 0; i < nTopics; i++ {
+		name, err := c.compactNullableString()
+		if err != nil {
+			return nil, err
+		}
+		nParts, _, err := c.compactArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		tr := listOffsetsTopicResult{name: name}
+		allowed := sess.authorized(aclOpDescribe, aclResourceTopic, name)
+		for j := 0; j < nParts; j++ {
+			index, err := c.i32()
+			if err != nil {
+				return nil, err
+			}
+			current, err := c.i32() // current_leader_epoch
+			if err != nil {
+				return nil, err
+			}
+			ts, err := c.i64()
+			if err != nil {
+				return nil, err
+			}
+			if err := c.skipTagged(); err != nil {
+				return nil, err
+			}
+
+			pr := listOffsetsPartitionResult{index: index}
+			if !allowed {
+				pr.errCode, pr.timestamp, pr.offset, pr.leaderEpoch = errTopicAuthorizationFailed, -1, -1, -1
+				tr.partitions = append(tr.partitions, pr)
+				continue
+			}
+			offset, timestamp, epoch, err := store.offsetForTimestamp(name, index, current, ts, isolation == readCommitted)
+			pr.offset, pr.timestamp, pr.leaderEpoch, pr.errCode = offset, timestamp, epoch, kafkaErrorCode(err)
+			tr.partitions = append(tr.partitions, pr)
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+		results = append(results, tr)
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+	return buildListOffsetsResponse(corrID, apiVer, results), nil
+}
+
+func buildListOffsetsResponse(corrID int32, apiVer int16, results []listOffsetsTopicResult) []byte {
+	// Body (flex v7):
+	// throttle_time_ms (INT32)
+	// topics (COMPACT_ARRAY) -> {name, partitions (COMPACT_ARRAY), TAGS}
+	//   partitions -> {partition_index, error_code, timestamp, offset, leader_epoch, TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putCompactArrayLen(len(results))
+	for _, tr := range results {
+		r.putCompactString(tr.name)
+		r.putCompactArrayLen(len(tr.partitions))
+		for _, pr := range tr.partitions {
+			r.putI32(pr.index)
+			r.putI16(pr.errCode)
+			r.putI64(pr.timestamp)
+			r.putI64(pr.offset)
+			r.putI32(pr.leaderEpoch)
+			r.putTags()
+		}
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyListOffsets, apiVer))
+}
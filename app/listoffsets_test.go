@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+// timedBatch encodes a batch holding one record per timestamp.
+func timedBatch(timestamps ...int64) []byte {
+	rb := recordBatch{producerID: -1, baseSequence: -1, lastOffsetDelta: int32(len(timestamps) - 1),
+		baseTimestamp: timestamps[0], maxTimestamp: timestamps[len(timestamps)-1]}
+	for i, ts := range timestamps {
+		rb.records = append(rb.records, record{offsetDelta: int32(i), timestampDelta: ts - timestamps[0], value: []byte("v")})
+	}
+	return encodeRecordBatch(rb)
+}
+
+// listOffsets sends a v7 read_uncommitted ListOffsets request for
+// topic/partition at ts and returns the partition's result.
+func (c *testConn) listOffsets(topic string, partition int32, ts int64) listOffsetsPartitionResult {
+	c.t.Helper()
+	var req respBuf
+	req.putI32(-1) // replica_id
+	req.putI8(readUncommitted)
+	req.putCompactArrayLen(1)
+	req.putCompactString(topic)
+	req.putCompactArrayLen(1)
+	req.putI32(partition)
+	req.putI32(-1) // current_leader_epoch
+	req.putI64(ts)
+	req.putTags()
+	req.putTags()
+	req.putTags()
+	r := c.call(apiKeyListOffsets, 7, req.b)
+	r.i32() // throttle_time_ms
+	if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+		c.t.Fatalf("%d topics (%v), want 1", n, err)
+	}
+	if name, _ := r.compactNullableString(); name != topic {
+		c.t.Fatalf("topic %q, want %q", name, topic)
+	}
+	if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+		c.t.Fatalf("%d partitions (%v), want 1", n, err)
+	}
+	var pr listOffsetsPartitionResult
+	pr.index, _ = r.i32()
+	pr.errCode, _ = r.i16()
+	pr.timestamp, _ = r.i64()
+	pr.offset, _ = r.i64()
+	pr.leaderEpoch, _ = r.i32()
+	r.skipTagged()
+	r.skipTagged()
+	if err := r.skipTagged(); err != nil {
+		c.t.Fatal(err)
+	}
+	checkConsumed(c.t, r)
+	return pr
+}
+
+func TestListOffsets(t *testing.T) {
+	c := newTestServer(t).dial()
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	c.produce("orders", 0, timedBatch(1000, 1010))
+	c.produce("orders", 0, timedBatch(2000))
+	c.produce("orders", 0, timedBatch(3000))
+	if _, err := store.deleteRecords("orders", 0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		what              string
+		ts                int64
+		offset, timestamp int64
+	}{
+		{"earliest", earliestTimestamp, 1, -1},
+		{"latest", latestTimestamp, 4, -1},
+		{"a record's timestamp", 2000, 2, 2000},
+		{"a timestamp between records", 1005, 1, 1010},
+		{"a timestamp between batches", 1500, 2, 2000},
+		{"a timestamp after every record", 5000, -1, -1},
+	} {
+		pr := c.listOffsets("orders", 0, tc.ts)
+		if pr.errCode != errNone || pr.offset != tc.offset || pr.timestamp != tc.timestamp {
+			t.Errorf("%s (%d) = error %d, offset %d, timestamp %d; want offset %d, timestamp %d",
+				tc.what, tc.ts, pr.errCode, pr.offset, pr.timestamp, tc.offset, tc.timestamp)
+		}
+	}
+}
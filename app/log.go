@@ -0,0 +1,670 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ----- partition logs -----
+
+var (
+	errNoSuchPartition  = errors.New("unknown topic or partition")
+	errOffsetRange      = errors.New("offset out of range")
+	errPartitionsShrink = errors.New("partition count can only grow")
+	errInvalidTopicName = errors.New("topic name is illegal")
+)
+
+// kafkaErrorCode maps a logStore error to its Kafka error code.
+func kafkaErrorCode(err error) int16 {
+	switch {
+	case err == nil:
+		return errNone
+	case errors.Is(err, errNoSuchPartition):
+		return errUnknownTopicOrPartition
+	case errors.Is(err, errOffsetRange):
+		return errOffsetOutOfRange
+	case errors.Is(err, errPartitionsShrink):
+		return errInvalidPartitions
+	case errors.Is(err, errInvalidTopicName):
+		return errInvalidTopic
+	case errors.Is(err, errBadBatch), errors.Is(err, errBadCRC):
+		return errCorruptMessage
+	case errors.Is(err, errUnsupportedCodec):
+		return errUnsupportedCompressionType
+	case errors.Is(err, errFencedEpoch):
+		return errFencedLeaderEpoch
+	case errors.Is(err, errUnknownEpoch):
+		return errUnknownLeaderEpoch
+	case errors.Is(err, errOutOfOrderSequence):
+		return errOutOfOrderSequenceNumber
+	case errors.Is(err, errDuplicateSequence):
+		return errDuplicateSequenceNumber
+	case errors.Is(err, errStaleProducerEpoch):
+		return errInvalidProducerEpoch
+	case errors.Is(err, errFencedProducer):
+		return errProducerFenced
+	case errors.Is(err, errProducerIDMapping):
+		return errInvalidProducerIDMapping
+	case errors.Is(err, errTxnState):
+		return errInvalidTxnState
+	case errors.Is(err, errTransactionTimeout):
+		return errInvalidTransactionTimeout
+	default:
+		return errUnknownServerError
+	}
+}
+
+type partitionLog struct {
+	dir           string // "" when held in memory
+	indexInterval int64
+	segments      []*segment
+	logStart      int64
+	nextOffset    int64         // log end offset
+	highWatermark int64         // offsets below it are committed and may be fetched
+	appended      chan struct{} // closed by the next append; nil while no Fetch waits
+
+	producers map[int64]*producerState // idempotent producers, by producer id
+	epochs    []epochEntry             // leader epoch cache, oldest first
+
+	ongoingTxns map[int64]int64 // first offset of each producer's open transaction
+	abortedTxns []abortedTxn    // in the order they were aborted
+}
+
+// advanceHighWatermark moves the high watermark up to what has been
+// replicated. We are the only replica, so that is everything written: the
+// whole log is committed as soon as it is appended.
+func (pl *partitionLog) advanceHighWatermark() {
+	pl.highWatermark = pl.nextOffset
+}
+
+// wakeFetchers releases Fetch requests waiting for new data in pl.
+func (pl *partitionLog) wakeFetchers() {
+	if pl.appended != nil {
+		close(pl.appended)
+		pl.appended = nil
+	}
+}
+
+// logStore holds every topic's partition logs. handleConn runs one goroutine
+// per connection, so all access goes through mu.
+type logStore struct {
+	mu      sync.RWMutex
+	topics  map[string]map[int32]*partitionLog
+	configs map[string]map[string]string // per-topic config overrides
+
+	topicIDs   map[string][16]byte
+	topicsByID map[[16]byte]string
+
+	// brokerConfigs holds the broker config overrides set at runtime, by
+	// resource name: this broker's id, or "" for the cluster-wide defaults.
+	brokerConfigs map[string]map[string]string
+
+	dir                string // data directory; "" keeps everything in memory
+	segmentBytes       int64
+	indexIntervalBytes int64
+}
+
+// newLogStore returns an empty store that keeps logs in memory only.
+func newLogStore() *logStore {
+	return &logStore{
+		topics:             map[string]map[int32]*partitionLog{},
+		configs:            map[string]map[string]string{},
+		topicIDs:           map[string][16]byte{},
+		topicsByID:         map[[16]byte]string{},
+		brokerConfigs:      map[string]map[string]string{},
+		segmentBytes:       defaultSegmentBytes,
+		indexIntervalBytes: defaultIndexIntervalBytes,
+	}
+}
+
+// openLogStore returns a store persisting each partition as Kafka-style
+// segment files under dir (dir/topic-partition/<baseOffset>.log), reloading
+// whatever a previous run left there. Zero sizes select Kafka's defaults.
+func openLogStore(dir string, segmentBytes, indexIntervalBytes int64) (*logStore, error) {
+	s := newLogStore()
+	s.dir = dir
+	if segmentBytes > 0 {
+		s.segmentBytes = segmentBytes
+	}
+	if indexIntervalBytes > 0 {
+		s.indexIntervalBytes = indexIntervalBytes
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	unlabeled := map[string][]*partitionLog{} // partitions without a topic id
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		topic, partition, ok := parsePartitionDirName(e.Name())
+		if !ok {
+			continue
+		}
+		pl, err := openPartitionLog(filepath.Join(dir, e.Name()), s.indexIntervalBytes)
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("load %s: %w", e.Name(), err)
+		}
+		if s.topics[topic] == nil {
+			s.topics[topic] = map[int32]*partitionLog{}
+		}
+		s.topics[topic][partition] = pl
+		id, ok, err := readPartitionMetadata(pl.dir)
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("load %s: %w", e.Name(), err)
+		}
+		if _, seen := s.topicIDs[topic]; ok && !seen {
+			s.topicIDs[topic], s.topicsByID[id] = id, topic
+		} else if !ok {
+			unlabeled[topic] = append(unlabeled[topic], pl)
+		}
+	}
+	// Partitions written before topics had ids get one now.
+	for topic, pls := range unlabeled {
+		id := s.assignTopicIDLocked(topic)
+		for _, pl := range pls {
+			if err := writePartitionMetadata(pl.dir, id); err != nil {
+				s.close()
+				return nil, fmt.Errorf("write %s: %w", filepath.Base(pl.dir), err)
+			}
+		}
+	}
+	if err := s.loadConfigs(); err != nil {
+		s.close()
+		return nil, err
+	}
+	for topic, parts := range s.topics {
+		for partition, pl := range parts {
+			if err := pl.abortOpenTxns(s.segmentBytesLocked(topic)); err != nil {
+				s.close()
+				return nil, fmt.Errorf("abort open transactions in %s: %w", partitionDirName(topic, partition), err)
+			}
+		}
+	}
+	return s, nil
+}
+
+var store = newLogStore()
+
+// close flushes and releases every segment file. The store must not be used
+// afterwards.
+func (s *logStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	for _, parts := range s.topics {
+		for _, pl := range parts {
+			if err := pl.close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// newPartitionLogLocked creates an empty log for topic/partition, on disk
+// (with the topic's id) when the store has a data directory. Caller holds
+// mu.
+func (s *logStore) newPartitionLogLocked(topic string, partition int32) (*partitionLog, error) {
+	if s.dir == "" {
+		sg, _ := newSegment("", 0, s.indexIntervalBytes)
+		pl := &partitionLog{indexInterval: s.indexIntervalBytes, segments: []*segment{sg}}
+		pl.assignEpoch(0, 0)
+		return pl, nil
+	}
+	pl, err := openPartitionLog(filepath.Join(s.dir, partitionDirName(topic, partition)), s.indexIntervalBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := writePartitionMetadata(pl.dir, s.topicIDs[topic]); err != nil {
+		pl.close()
+		return nil, err
+	}
+	return pl, nil
+}
+
+// partitionLocked returns the log for topic/partition or nil. Caller holds mu.
+func (s *logStore) partitionLocked(topic string, partition int32) *partitionLog {
+	return s.topics[topic][partition]
+}
+
+// append stores batch at the end of the partition log, rewriting its
+// baseOffset, and returns the offset assigned to its first record. A batch
+// from an idempotent producer must carry the producer's next sequence
+// number; a retry fails with errDuplicateSequence and its original offset.
+func (s *logStore) append(topic string, partition int32, batch []byte) (baseOffset int64, err error) {
+	baseOffset, _, err = s.appendBatches(topic, partition, [][]byte{batch})
+	return baseOffset, err
+}
+
+// appendBatches appends batches, in order, as append does, and also returns
+// the partition's log start offset. All of them are written or, if one is
+// rejected, none: every batch's sequence number is checked before the first
+// is written, so a client retrying the request can't duplicate the batches
+// ahead of the one that failed. A retry fails as append's does, with the
+// first batch's original offset.
+func (s *logStore) appendBatches(topic string, partition int32, batches [][]byte) (baseOffset, logStart int64, err error) {
+	for _, b := range batches {
+		if len(b) < batchHeaderSize {
+			return -1, -1, errBadBatch
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pl := s.partitionLocked(topic, partition)
+	if pl == nil {
+		return -1, -1, errNoSuchPartition
+	}
+	if off, err := pl.checkSequences(batches); err != nil {
+		return off, -1, err
+	}
+	segmentBytes := s.segmentBytesLocked(topic)
+	baseOffset = -1
+	for i, b := range batches {
+		off, err := pl.append(b, segmentBytes)
+		if err != nil {
+			// Only a failed write gets here, after the batches before it
+			// were stored; those are committed all the same.
+			if i > 0 {
+				pl.advanceHighWatermark()
+				pl.wakeFetchers()
+			}
+			return baseOffset, -1, err
+		}
+		if i == 0 {
+			baseOffset = off
+		}
+	}
+	pl.advanceHighWatermark()
+	pl.wakeFetchers()
+	return baseOffset, pl.logStart, nil
+}
+
+// appendSignal returns a channel that is closed the next time
+// topic/partition is appended to or deleted, or nil if there is no such
+// partition.
+func (s *logStore) appendSignal(topic string, partition int32) <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pl := s.partitionLocked(topic, partition)
+	if pl == nil {
+		return nil
+	}
+	if pl.appended == nil {
+		pl.appended = make(chan struct{})
+	}
+	return pl.appended
+}
+
+// forEachRecord calls fn with every record of topic/partition from its log
+// start offset up to its high watermark, skipping control batches, and
+// stops at fn's first error.
+func (s *logStore) forEachRecord(topic string, partition int32, fn func(record) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pl := s.partitionLocked(topic, partition)
+	if pl == nil {
+		return errNoSuchPartition
+	}
+	var fnErr error
+	for _, sg := range pl.segments {
+		err := sg.forEachBatch(func(_ []byte, rb recordBatch) {
+			if fnErr != nil || rb.attributes&batchControl != 0 {
+				return
+			}
+			for _, r := range rb.records {
+				if off := rb.baseOffset + int64(r.offsetDelta); off < pl.logStart || off >= pl.highWatermark {
+					continue
+				}
+				if fnErr = fn(r); fnErr != nil {
+					return
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if fnErr != nil {
+			return fnErr
+		}
+	}
+	return nil
+}
+
+// highWatermark returns topic/partition's high watermark: Fetch returns
+// nothing at or above it.
+func (s *logStore) highWatermark(topic string, partition int32) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pl := s.partitionLocked(topic, partition)
+	if pl == nil {
+		return -1, errNoSuchPartition
+	}
+	return pl.highWatermark, nil
+}
+
+// read returns the batches holding offsets at or after fetchOffset, stopping
+// at the batch boundary before maxBytes would be exceeded, together with the
+// partition's high watermark. A fetchOffset at or past the high watermark
+// yields no batches and no error.
+func (s *logStore) read(topic string, partition int32, fetchOffset int64, maxBytes int) (batches [][]byte, hwm int64, err error) {
+	pr, err := s.readBatches(topic, partition, fetchOffset, maxBytes, readOptions{epochs: noFetchEpochs})
+	return pr.batches, pr.hwm, err
+}
+
+// readRaw is read returning the batches as one slice, their bytes back to
+// back as they lie in the log, so it never splits one. It is the cheapest
+// way to hand a partition's records on whole.
+func (s *logStore) readRaw(topic string, partition int32, fetchOffset int64, maxBytes int) (raw []byte, hwm int64, err error) {
+	pr, err := s.readBatches(topic, partition, fetchOffset, maxBytes, readOptions{epochs: noFetchEpochs})
+	return pr.raw, pr.hwm, err
+}
+
+// fetchEpochs are the leader epochs a Fetch sends with each partition: the
+// epoch the client thinks is current, and the epoch of the last batch it
+// fetched. -1 means the client didn't say.
+type fetchEpochs struct {
+	current, lastFetched int32
+}
+
+var noFetchEpochs = fetchEpochs{-1, -1}
+
+// readOptions are the Fetch extras readBatches supports.
+type readOptions struct {
+	// minOne returns the first batch even when that batch alone exceeds
+	// maxBytes, so consumers can always make progress.
+	minOne bool
+	// readCommitted stops at the last stable offset and reports the aborted
+	// transactions in what was read.
+	readCommitted bool
+	epochs        fetchEpochs
+}
+
+// partitionRead is what readBatches found.
+type partitionRead struct {
+	raw        []byte   // batches, back to back
+	batches    [][]byte // sharing raw's memory
+	hwm        int64
+	lastStable int64
+	logStart   int64
+	diverging  *epochEnd // set instead of batches when the client must truncate first
+	aborted    []abortedTxn
+}
+
+// readBatches is read with extras for Fetch, as set in opts. It checks the
+// client's epochs first; when the client's log has diverged from ours it
+// returns no batches but where the client's last epoch really ends, which
+// the client should truncate to.
+func (s *logStore) readBatches(topic string, partition int32, fetchOffset int64, maxBytes int, opts readOptions) (partitionRead, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pr := partitionRead{hwm: -1, lastStable: -1, logStart: -1}
+	pl := s.partitionLocked(topic, partition)
+	if pl == nil {
+		return pr, errNoSuchPartition
+	}
+	if err := pl.checkLeaderEpoch(opts.epochs.current); err != nil {
+		return pr, err
+	}
+	pr.hwm, pr.lastStable, pr.logStart = pl.highWatermark, pl.lastStableOffset(), pl.logStart
+	if lastFetched := opts.epochs.lastFetched; lastFetched >= 0 {
+		epoch, end := pl.endOffsetForEpoch(lastFetched)
+		if epoch < 0 {
+			return pr, errOffsetRange
+		}
+		if epoch < lastFetched || end < fetchOffset {
+			pr.diverging = &epochEnd{epoch, end}
+			return pr, nil
+		}
+	}
+	if fetchOffset < pl.logStart {
+		return pr, errOffsetRange
+	}
+	end := pl.highWatermark
+	if opts.readCommitted {
+		end = pr.lastStable
+		pr.aborted = pl.abortedTxnsBetween(fetchOffset, end)
+	}
+	if fetchOffset >= end {
+		return pr, nil
+	}
+	var err error
+	pr.raw, pr.batches, err = pl.read(fetchOffset, end, maxBytes, opts.minOne)
+	return pr, err
+}
+
+// deleteRecords advances topic/partition's log start offset to offset, or to
+// the high watermark when offset is -1, and returns the new log start
+// offset. Offsets below it can no longer be fetched.
+func (s *logStore) deleteRecords(topic string, partition int32, offset int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pl := s.partitionLocked(topic, partition)
+	if pl == nil {
+		return -1, errNoSuchPartition
+	}
+	if offset == -1 {
+		offset = pl.highWatermark
+	}
+	if err := pl.advanceLogStart(offset); err != nil {
+		return -1, err
+	}
+	return pl.logStart, nil
+}
+
+// Special ListOffsets timestamps.
+const (
+	latestTimestamp   = int64(-1)
+	earliestTimestamp = int64(-2)
+	maxTimestamp      = int64(-3)
+)
+
+// offsetForTimestamp resolves a ListOffsets timestamp for topic/partition:
+// earliestTimestamp gives the log start offset, latestTimestamp the high
+// watermark, maxTimestamp the offset holding the largest timestamp, and any
+// other value the first offset whose batch reaches that timestamp. offset is
+// -1 when nothing matches; epoch is the leader epoch offset was written in.
+// currentEpoch is checked as in readBatches, and with readCommitted the
+// latest offset is the last stable offset.
+func (s *logStore) offsetForTimestamp(topic string, partition int32, currentEpoch int32, ts int64, readCommitted bool) (offset, timestamp int64, epoch int32, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pl := s.partitionLocked(topic, partition)
+	if pl == nil {
+		return -1, -1, -1, errNoSuchPartition
+	}
+	if err := pl.checkLeaderEpoch(currentEpoch); err != nil {
+		return -1, -1, -1, err
+	}
+	switch ts {
+	case earliestTimestamp:
+		offset, timestamp = pl.logStart, -1
+	case latestTimestamp:
+		offset, timestamp = pl.highWatermark, -1
+		if readCommitted {
+			offset = pl.lastStableOffset()
+		}
+	case maxTimestamp:
+		offset, timestamp, err = pl.maxTimestampOffset()
+	default:
+		offset, timestamp, err = pl.offsetForTimestamp(ts)
+	}
+	// The first batch may still hold records below the log start offset.
+	if offset >= 0 && offset < pl.logStart {
+		offset = pl.logStart
+	}
+	return offset, timestamp, pl.epochForOffset(offset), err
+}
+
+// maxTopicNameLen is Kafka's limit on topic names.
+const maxTopicNameLen = 249
+
+// checkTopicName returns errInvalidTopicName, saying why, unless name is a
+// legal Kafka topic name. Names become directory names under the data
+// directory, so this also keeps partitions inside it.
+func checkTopicName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("%w: it can't be empty", errInvalidTopicName)
+	case name == "." || name == "..":
+		return fmt.Errorf("%w: it can't be \".\" or \"..\"", errInvalidTopicName)
+	case len(name) > maxTopicNameLen:
+		return fmt.Errorf("%w: it can't be longer than %d characters", errInvalidTopicName, maxTopicNameLen)
+	}
+	for _, r := range name {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '.' || r == '_' || r == '-') {
+			return fmt.Errorf("%w: %q contains a character other than ASCII alphanumerics, '.', '_' and '-'", errInvalidTopicName, name)
+		}
+	}
+	return nil
+}
+
+// createTopic registers topic with the given number of partitions and config
+// overrides (which may be nil). It returns false, leaving the store
+// untouched, when the topic already exists, and errInvalidTopicName when
+// topic isn't a legal name.
+func (s *logStore) createTopic(topic string, partitions int32, configs map[string]string) (bool, error) {
+	if err := checkTopicName(topic); err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.topics[topic]; ok {
+		return false, nil
+	}
+	s.assignTopicIDLocked(topic)
+	parts := make(map[int32]*partitionLog, partitions)
+	for p := int32(0); p < partitions; p++ {
+		pl, err := s.newPartitionLogLocked(topic, p)
+		if err != nil {
+			for _, pl := range parts {
+				pl.close()
+			}
+			s.forgetTopicIDLocked(topic)
+			return false, err
+		}
+		parts[p] = pl
+	}
+	s.topics[topic] = parts
+	if len(configs) > 0 {
+		s.configs[topic] = configs
+		if err := s.saveConfigsLocked(); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// addPartitions grows topic to count partitions; the new ones start empty.
+// A count no larger than the current one fails with errPartitionsShrink.
+func (s *logStore) addPartitions(topic string, count int32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parts, ok := s.topics[topic]
+	if !ok {
+		return errNoSuchPartition
+	}
+	if count <= int32(len(parts)) {
+		return errPartitionsShrink
+	}
+	for p := int32(len(parts)); p < count; p++ {
+		pl, err := s.newPartitionLogLocked(topic, p)
+		if err != nil {
+			return err
+		}
+		parts[p] = pl
+	}
+	return nil
+}
+
+// partitions returns the sorted partition ids of topic, or nil when the
+// topic is unknown.
+func (s *logStore) partitions(topic string) []int32 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	parts, ok := s.topics[topic]
+	if !ok {
+		return nil
+	}
+	ids := make([]int32, 0, len(parts))
+	for p := range parts {
+		ids = append(ids, p)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// hasPartition reports whether topic/partition exists.
+func (s *logStore) hasPartition(topic string, partition int32) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.partitionLocked(topic, partition) != nil
+}
+
+// topicNames returns the sorted names of every known topic.
+func (s *logStore) topicNames() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.topics))
+	for name := range s.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// deleteTopic removes topic and, for a file-backed store, its partition
+// directories. It holds the write lock throughout, so it never overlaps a
+// Fetch reading the same partitions.
+func (s *logStore) deleteTopic(topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parts, ok := s.topics[topic]
+	if !ok {
+		return errNoSuchPartition
+	}
+	delete(s.topics, topic)
+	s.forgetTopicIDLocked(topic)
+	var firstErr error
+	if _, ok := s.configs[topic]; ok {
+		delete(s.configs, topic)
+		firstErr = s.saveConfigsLocked()
+	}
+	for p, pl := range parts {
+		pl.wakeFetchers()
+		if err := pl.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if s.dir != "" {
+			if err := os.RemoveAll(filepath.Join(s.dir, partitionDirName(topic, p))); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCreateTopicRejectsIllegalNames(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "data")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	s, err := openLogStore(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	for _, name := range []string{"", ".", "..", "../escaped", "a/b", "a b", "tôpic", strings.Repeat("x", maxTopicNameLen+1)} {
+		created, err := s.createTopic(name, 1, nil)
+		if created || !errors.Is(err, errInvalidTopicName) {
+			t.Errorf("createTopic(%q) = %v, %v; want errInvalidTopicName", name, created, err)
+		}
+		if code := kafkaErrorCode(err); code != errInvalidTopic {
+			t.Errorf("createTopic(%q) maps to error code %d, want %d", name, code, errInvalidTopic)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "escaped-0")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partition directory created outside the data directory: %v", err)
+	}
+
+	for _, name := range []string{"orders", "a.b_c-d", "..a", strings.Repeat("x", maxTopicNameLen)} {
+		if created, err := s.createTopic(name, 1, nil); !created || err != nil {
+			t.Errorf("createTopic(%q) = %v, %v; want created", name, created, err)
+		}
+	}
+}
+
+// Appends racing on one partition each get their own run of offsets, and
+// the log holds the batches in offset order with no gaps.
+func TestConcurrentAppendsGetMonotonicOffsets(t *testing.T) {
+	s := newLogStore()
+	if _, err := s.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	const writers, perWriter = 8, 50
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		bases []int64
+	)
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				off, err := s.append("orders", 0, testBatch(fmt.Sprintf("w%d-%d", w, i), "second"))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				bases = append(bases, off)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	slices.Sort(bases)
+	for i, off := range bases {
+		if off != int64(2*i) {
+			t.Fatalf("batch %d appended at offset %d, want %d", i, off, 2*i)
+		}
+	}
+	raw, hwm, err := s.readRaw("orders", 0, 0, 1<<30)
+	if err != nil || hwm != 2*writers*perWriter {
+		t.Fatalf("readRaw = hwm %d (%v), want %d", hwm, err, 2*writers*perWriter)
+	}
+	next := int64(0)
+	for len(raw) > 0 {
+		batch, err := splitBatch(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bi := peekBatch(batch); bi.baseOffset != next {
+			t.Fatalf("batch at offset %d, want %d", bi.baseOffset, next)
+		}
+		next += 2
+		raw = raw[len(batch):]
+	}
+}
+
+// A store reopened on the same directory serves the batches it held and
+// appends after them.
+func TestLogStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openLogStore(dir, 256, 64) // small segments, so the log rolls
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.createTopic("orders", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 20 {
+		if _, err := s.append("orders", int32(i%2), testBatch(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var before [2][]byte
+	for p := range int32(2) {
+		if before[p], _, err = s.readRaw("orders", p, 0, 1<<20); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = openLogStore(dir, 256, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	for p := range int32(2) {
+		raw, hwm, err := s.readRaw("orders", p, 0, 1<<20)
+		if err != nil || hwm != 10 || string(raw) != string(before[p]) {
+			t.Errorf("partition %d after reopening = %d bytes, hwm %d (%v); want the %d bytes from before and hwm 10",
+				p, len(raw), hwm, err, len(before[p]))
+		}
+		// A read from the middle finds its segment and position again.
+		if raw, _, err := s.readRaw("orders", p, 7, 1<<20); err != nil || len(raw) == 0 || peekBatch(raw).baseOffset != 7 {
+			t.Errorf("partition %d read from 7 after reopening = %d bytes (%v)", p, len(raw), err)
+		}
+	}
+	if off, err := s.append("orders", 0, testBatch("after")); err != nil || off != 10 {
+		t.Errorf("append after reopening = %d (%v), want 10", off, err)
+	}
+}
+
+// readEachBatch reads what readRaw would from a single-segment partition
+// with an allocation and a read per batch, as partitionLog.read once did.
+func readEachBatch(pl *partitionLog, fetchOffset int64, maxBytes int) ([][]byte, error) {
+	sg := pl.segments[0]
+	var (
+		batches [][]byte
+		size    int
+		readErr error
+	)
+	_, err := sg.scan(sg.index.lookup(fetchOffset-sg.baseOffset), func(bi batchInfo) bool {
+		if bi.nextOffset <= fetchOffset {
+			return true
+		}
+		if size+bi.size > maxBytes {
+			return false
+		}
+		b := make([]byte, bi.size)
+		if _, readErr = sg.data.ReadAt(b, bi.pos); readErr != nil {
+			return false
+		}
+		batches = append(batches, b)
+		size += bi.size
+		return true
+	})
+	if err == nil {
+		err = readErr
+	}
+	return batches, err
+}
+
+// BenchmarkReadRaw fetches 500 small batches as readRaw does, in one read
+// into one buffer, and one batch at a time.
+func BenchmarkReadRaw(b *testing.B) {
+	s := newLogStore()
+	if _, err := s.createTopic("bench", 1, nil); err != nil {
+		b.Fatal(err)
+	}
+	size := 0
+	for i := range 500 {
+		batch := encodeRecordBatch(recordBatch{producerID: -1, baseSequence: -1, records: []record{{value: fmt.Appendf(nil, "value-%d", i)}}})
+		if _, err := s.append("bench", 0, batch); err != nil {
+			b.Fatal(err)
+		}
+		size += len(batch)
+	}
+
+	b.Run("raw", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			raw, _, err := s.readRaw("bench", 0, 0, 1<<20)
+			if err != nil || len(raw) != size {
+				b.Fatalf("read %d bytes (%v), want %d", len(raw), err, size)
+			}
+		}
+	})
+	b.Run("per-batch", func(b *testing.B) {
+		b.ReportAllocs()
+		pl := s.topics["bench"][0]
+		for b.Loop() {
+			batches, err := readEachBatch(pl, 0, 1<<20)
+			if err != nil || len(batches) != 500 {
+				b.Fatalf("read %d batches (%v), want 500", len(batches), err)
+			}
+		}
+	})
+}
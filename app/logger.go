@@ -0,0 +1,17 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// ----- logging -----
+
+// logLevel is the minimum level logged: debug, info (the default), warn or
+// error. Set with the -log-level flag. Each request is logged at debug.
+var logLevel = new(slog.LevelVar)
+
+// logger is the broker's one logger. Connections derive theirs from it with
+// the remote address attached (session.log); code that isn't serving a
+// particular connection logs here directly.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
@@ -1,34 +1,311 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 const (
-	apiKeyApiVersions  = int16(18)
-	maxSupportedAPIVer = int16(4)
+	apiKeyProduce                 = int16(0)
+	apiKeyFetch                   = int16(1)
+	apiKeyListOffsets             = int16(2)
+	apiKeyMetadata                = int16(3)
+	apiKeyControlledShutdown      = int16(7)
+	apiKeyOffsetCommit            = int16(8)
+	apiKeyOffsetFetch             = int16(9)
+	apiKeyFindCoordinator         = int16(10)
+	apiKeyJoinGroup               = int16(11)
+	apiKeyHeartbeat               = int16(12)
+	apiKeyLeaveGroup              = int16(13)
+	apiKeySyncGroup               = int16(14)
+	apiKeyDescribeGroups          = int16(15)
+	apiKeyListGroups              = int16(16)
+	apiKeySaslHandshake           = int16(17)
+	apiKeyApiVersions             = int16(18)
+	apiKeyCreateTopics            = int16(19)
+	apiKeyDeleteTopics            = int16(20)
+	apiKeyDeleteRecords           = int16(21)
+	apiKeyInitProducerId          = int16(22)
+	apiKeyOffsetForLeaderEpoch    = int16(23)
+	apiKeyAddPartitionsToTxn      = int16(24)
+	apiKeyAddOffsetsToTxn         = int16(25)
+	apiKeyEndTxn                  = int16(26)
+	apiKeyWriteTxnMarkers         = int16(27)
+	apiKeyTxnOffsetCommit         = int16(28)
+	apiKeyDescribeAcls            = int16(29)
+	apiKeyCreateAcls              = int16(30)
+	apiKeyDeleteAcls              = int16(31)
+	apiKeyDescribeConfigs         = int16(32)
+	apiKeyAlterConfigs            = int16(33)
+	apiKeyDescribeLogDirs         = int16(35)
+	apiKeySaslAuthenticate        = int16(36)
+	apiKeyCreatePartitions        = int16(37)
+	apiKeyDeleteGroups            = int16(42)
+	apiKeyElectLeaders            = int16(43)
+	apiKeyIncrementalAlterConfigs = int16(44)
+	apiKeyAlterReassignments      = int16(45) // AlterPartitionReassignments
+	apiKeyListReassignments       = int16(46) // ListPartitionReassignments
+	apiKeyDescribeCluster         = int16(60)
 
-	errNone           = int16(0)
-	errUnsupportedVer = int16(35) // Kafka UNSUPPORTED_VERSION
+	errUnknownServerError         = int16(-1) // Kafka UNKNOWN_SERVER_ERROR
+	errNone                       = int16(0)
+	errOffsetOutOfRange           = int16(1)   // Kafka OFFSET_OUT_OF_RANGE
+	errCorruptMessage             = int16(2)   // Kafka CORRUPT_MESSAGE
+	errUnknownTopicOrPartition    = int16(3)   // Kafka UNKNOWN_TOPIC_OR_PARTITION
+	errBrokerNotAvailable         = int16(8)   // Kafka BROKER_NOT_AVAILABLE
+	errMessageTooLarge            = int16(10)  // Kafka MESSAGE_TOO_LARGE
+	errOffsetMetadataTooLarge     = int16(12)  // Kafka OFFSET_METADATA_TOO_LARGE
+	errInvalidTopic               = int16(17)  // Kafka INVALID_TOPIC_EXCEPTION
+	errNotEnoughReplicasAppend    = int16(20)  // Kafka NOT_ENOUGH_REPLICAS_AFTER_APPEND
+	errIllegalGeneration          = int16(22)  // Kafka ILLEGAL_GENERATION
+	errInconsistentGroupProtocol  = int16(23)  // Kafka INCONSISTENT_GROUP_PROTOCOL
+	errInvalidGroupID             = int16(24)  // Kafka INVALID_GROUP_ID
+	errUnknownMemberID            = int16(25)  // Kafka UNKNOWN_MEMBER_ID
+	errInvalidSessionTimeout      = int16(26)  // Kafka INVALID_SESSION_TIMEOUT
+	errRebalanceInProgress        = int16(27)  // Kafka REBALANCE_IN_PROGRESS
+	errTopicAuthorizationFailed   = int16(29)  // Kafka TOPIC_AUTHORIZATION_FAILED
+	errGroupAuthorizationFailed   = int16(30)  // Kafka GROUP_AUTHORIZATION_FAILED
+	errClusterAuthorizationFailed = int16(31)  // Kafka CLUSTER_AUTHORIZATION_FAILED
+	errUnsupportedSaslMechanism   = int16(33)  // Kafka UNSUPPORTED_SASL_MECHANISM
+	errIllegalSaslState           = int16(34)  // Kafka ILLEGAL_SASL_STATE
+	errUnsupportedVer             = int16(35)  // Kafka UNSUPPORTED_VERSION
+	errTopicAlreadyExists         = int16(36)  // Kafka TOPIC_ALREADY_EXISTS
+	errInvalidPartitions          = int16(37)  // Kafka INVALID_PARTITIONS
+	errInvalidReplicationFactor   = int16(38)  // Kafka INVALID_REPLICATION_FACTOR
+	errInvalidReplicaAssignment   = int16(39)  // Kafka INVALID_REPLICA_ASSIGNMENT
+	errInvalidConfig              = int16(40)  // Kafka INVALID_CONFIG
+	errInvalidRequest             = int16(42)  // Kafka INVALID_REQUEST
+	errOutOfOrderSequenceNumber   = int16(45)  // Kafka OUT_OF_ORDER_SEQUENCE_NUMBER
+	errDuplicateSequenceNumber    = int16(46)  // Kafka DUPLICATE_SEQUENCE_NUMBER
+	errInvalidProducerEpoch       = int16(47)  // Kafka INVALID_PRODUCER_EPOCH
+	errInvalidTxnState            = int16(48)  // Kafka INVALID_TXN_STATE
+	errInvalidProducerIDMapping   = int16(49)  // Kafka INVALID_PRODUCER_ID_MAPPING
+	errInvalidTransactionTimeout  = int16(50)  // Kafka INVALID_TRANSACTION_TIMEOUT
+	errTxnIDAuthorizationFailed   = int16(53)  // Kafka TRANSACTIONAL_ID_AUTHORIZATION_FAILED
+	errSecurityDisabled           = int16(54)  // Kafka SECURITY_DISABLED
+	errOperationNotAttempted      = int16(55)  // Kafka OPERATION_NOT_ATTEMPTED
+	errSaslAuthenticationFailed   = int16(58)  // Kafka SASL_AUTHENTICATION_FAILED
+	errNonEmptyGroup              = int16(68)  // Kafka NON_EMPTY_GROUP
+	errGroupIDNotFound            = int16(69)  // Kafka GROUP_ID_NOT_FOUND
+	errFetchSessionIDNotFound     = int16(70)  // Kafka FETCH_SESSION_ID_NOT_FOUND
+	errInvalidFetchSessionEpoch   = int16(71)  // Kafka INVALID_FETCH_SESSION_EPOCH
+	errFencedLeaderEpoch          = int16(74)  // Kafka FENCED_LEADER_EPOCH
+	errUnknownLeaderEpoch         = int16(75)  // Kafka UNKNOWN_LEADER_EPOCH
+	errUnsupportedCompressionType = int16(76)  // Kafka UNSUPPORTED_COMPRESSION_TYPE
+	errMemberIDRequired           = int16(79)  // Kafka MEMBER_ID_REQUIRED
+	errFencedInstanceID           = int16(82)  // Kafka FENCED_INSTANCE_ID
+	errElectionNotNeeded          = int16(84)  // Kafka ELECTION_NOT_NEEDED
+	errNoReassignmentInProgress   = int16(85)  // Kafka NO_REASSIGNMENT_IN_PROGRESS
+	errInvalidRecord              = int16(87)  // Kafka INVALID_RECORD
+	errProducerFenced             = int16(90)  // Kafka PRODUCER_FENCED
+	errUnknownTopicID             = int16(100) // Kafka UNKNOWN_TOPIC_ID
+	errMismatchedEndpointType     = int16(114) // Kafka MISMATCHED_ENDPOINT_TYPE
 )
 
+type apiVersionRange struct {
+	apiKey, minVer, maxVer int16
+}
+
+// supportedAPIs lists every api key this broker handles with the versions it
+// understands. ApiVersions advertises exactly this table, so a new handler
+// only needs an entry here to become visible to clients.
+var supportedAPIs = []apiVersionRange{
+	{apiKeyProduce, 8, 9},
+	{apiKeyFetch, 11, 13},
+	{apiKeyListOffsets, 7, 7},
+	{apiKeyMetadata, 8, 12},
+	{apiKeyControlledShutdown, 3, 3},
+	{apiKeyOffsetCommit, 8, 8},
+	{apiKeyOffsetFetch, 8, 8},
+	{apiKeyFindCoordinator, 4, 4},
+	{apiKeyJoinGroup, 9, 9},
+	{apiKeyHeartbeat, 4, 4},
+	{apiKeyLeaveGroup, 5, 5},
+	{apiKeySyncGroup, 5, 5},
+	{apiKeyDescribeGroups, 5, 5},
+	{apiKeyListGroups, 4, 4},
+	{apiKeySaslHandshake, 1, 1},
+	{apiKeyApiVersions, 0, 4},
+	{apiKeyCreateTopics, 7, 7},
+	{apiKeyDeleteTopics, 6, 6},
+	{apiKeyDeleteRecords, 2, 2},
+	{apiKeyInitProducerId, 4, 4},
+	{apiKeyOffsetForLeaderEpoch, 4, 4},
+	{apiKeyAddPartitionsToTxn, 3, 3},
+	{apiKeyAddOffsetsToTxn, 3, 3},
+	{apiKeyEndTxn, 3, 3},
+	{apiKeyWriteTxnMarkers, 1, 1},
+	{apiKeyTxnOffsetCommit, 3, 3},
+	{apiKeyDescribeAcls, 3, 3},
+	{apiKeyCreateAcls, 3, 3},
+	{apiKeyDeleteAcls, 3, 3},
+	{apiKeyDescribeConfigs, 4, 4},
+	{apiKeyAlterConfigs, 2, 2},
+	{apiKeyDescribeLogDirs, 4, 4},
+	{apiKeySaslAuthenticate, 2, 2},
+	{apiKeyCreatePartitions, 3, 3},
+	{apiKeyDeleteGroups, 2, 2},
+	{apiKeyElectLeaders, 2, 2},
+	{apiKeyIncrementalAlterConfigs, 1, 1},
+	{apiKeyAlterReassignments, 0, 0},
+	{apiKeyListReassignments, 0, 0},
+	{apiKeyDescribeCluster, 1, 1},
+}
+
+// versionSupported reports whether apiVer of apiKey is in supportedAPIs.
+func versionSupported(apiKey, apiVer int16) bool {
+	for _, a := range supportedAPIs {
+		if a.apiKey == apiKey {
+			return apiVer >= a.minVer && apiVer <= a.maxVer
+		}
+	}
+	return false
+}
+
+// Identity of this single-node cluster.
+const clusterID = "MkU3OEVBNTcwNTJENDM2Qk"
+
+// brokerID is this broker's node id, set with the -broker-id flag. With
+// LOG_DIR it is recorded in the data directory, like Kafka's
+// meta.properties, so that it stays the same across restarts.
+var brokerID = int32(0)
+
+// metaPropertiesFileName records the broker id the data directory belongs
+// to, in Kafka's format.
+const metaPropertiesFileName = "meta.properties"
+
+// loadBrokerID reconciles id, the -broker-id flag, with the id recorded in
+// dir, writing it there if there is none. A directory written by another
+// broker id is refused unless the flag was left unset, in which case the
+// recorded id is used.
+func loadBrokerID(dir string, id int32, explicit bool) (int32, error) {
+	path := filepath.Join(dir, metaPropertiesFileName)
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		props := fmt.Sprintf("version=0\nbroker.id=%d\ncluster.id=%s\n", id, clusterID)
+		if err := os.WriteFile(path+".tmp", []byte(props), 0o644); err != nil {
+			return -1, err
+		}
+		return id, os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		return -1, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		v, ok := strings.CutPrefix(strings.TrimSpace(line), "broker.id=")
+		if !ok {
+			continue
+		}
+		stored, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return -1, fmt.Errorf("bad broker.id in %s: %w", path, err)
+		}
+		if explicit && int32(stored) != id {
+			return -1, fmt.Errorf("%s belongs to broker %d, not %d", dir, stored, id)
+		}
+		return int32(stored), nil
+	}
+	return -1, fmt.Errorf("no broker.id in %s", path)
+}
+
+// defaultPartitions is the partition count of topics created without one,
+// Kafka's num.partitions. Set with the -default-partitions flag.
+var defaultPartitions = int32(1)
+
+// autoCreateTopics makes Produce, and Metadata asking for it, create
+// unknown topics with defaultPartitions, like Kafka's
+// auto.create.topics.enable. Set with the -auto-create-topics flag.
+var autoCreateTopics = true
+
+// advertisedListener is the host:port handed to clients in Metadata and
+// FindCoordinator; they reconnect to it, so it must be reachable from the
+// client's side. Set with the -advertised-listener flag or the
+// ADVERTISED_LISTENER environment variable.
+var advertisedListener = "localhost:9092"
+
+// advertisedHostPort splits advertisedListener into host and port.
+func advertisedHostPort() (string, int32) {
+	host, port, err := net.SplitHostPort(advertisedListener)
+	if err != nil {
+		return advertisedListener, 9092
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return host, 9092
+	}
+	return host, int32(p)
+}
+
 // ----- cursor helpers -----
 type cursor struct {
 	b   []byte
 	off int
+
+	// trace, if set, is told about every field read: its offset, its
+	// protocol type and its value. Fields made of smaller ones, like a
+	// length-prefixed string, are reported once as a whole.
+	trace func(off int, typ string, v any)
 }
 
+// remaining returns how many bytes are left unread.
+func (c *cursor) remaining() int { return len(c.b) - c.off }
+
+// need checks that n more bytes are left; a negative n never fits.
 func (c *cursor) need(n int) error {
-	if c.off+n > len(c.b) {
+	if n < 0 || n > len(c.b)-c.off {
 		return io.ErrUnexpectedEOF
 	}
 	return nil
 }
+
+// length checks that a length read off the wire fits in what is left,
+// before it is converted to int.
+func (c *cursor) length(n uint64) (int, error) {
+	if n > uint64(len(c.b)-c.off) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return int(n), nil
+}
+func (c *cursor) i8() (int8, error) {
+	v, err := c.readI8()
+	if err == nil && c.trace != nil {
+		c.trace(c.off-1, "INT8", v)
+	}
+	return v, err
+}
+func (c *cursor) readI8() (int8, error) {
+	if err := c.need(1); err != nil {
+		return 0, err
+	}
+	v := int8(c.b[c.off])
+	c.off++
+	return v, nil
+}
 func (c *cursor) i16() (int16, error) {
+	v, err := c.readI16()
+	if err == nil && c.trace != nil {
+		c.trace(c.off-2, "INT16", v)
+	}
+	return v, err
+}
+func (c *cursor) readI16() (int16, error) {
 	if err := c.need(2); err != nil {
 		return 0, err
 	}
@@ -42,16 +319,65 @@ func (c *cursor) i32() (int32, error) {
 	}
 	v := int32(binary.BigEndian.Uint32(c.b[c.off:]))
 	c.off += 4
+	if c.trace != nil {
+		c.trace(c.off-4, "INT32", v)
+	}
+	return v, nil
+}
+func (c *cursor) i64() (int64, error) {
+	if err := c.need(8); err != nil {
+		return 0, err
+	}
+	v := int64(binary.BigEndian.Uint64(c.b[c.off:]))
+	c.off += 8
+	if c.trace != nil {
+		c.trace(c.off-8, "INT64", v)
+	}
 	return v, nil
 }
 
+// UUID: 16 raw bytes
+func (c *cursor) uuid() ([16]byte, error) {
+	var u [16]byte
+	if err := c.need(16); err != nil {
+		return u, err
+	}
+	copy(u[:], c.b[c.off:])
+	c.off += 16
+	if c.trace != nil {
+		c.trace(c.off-16, "UUID", u)
+	}
+	return u, nil
+}
+
+// uuidString formats u in the canonical 8-4-4-4-12 hex form.
+func uuidString(u [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// BOOLEAN: one byte; any nonzero value is true
+func (c *cursor) boolean() (bool, error) {
+	v, err := c.readI8()
+	if err != nil {
+		return false, err
+	}
+	if c.trace != nil {
+		c.trace(c.off-1, "BOOLEAN", v != 0)
+	}
+	return v != 0, nil
+}
+
 // Legacy STRING (nullable): int16 length; -1 = null
 func (c *cursor) str16() (string, error) {
-	l, err := c.i16()
+	start := c.off
+	l, err := c.readI16()
 	if err != nil {
 		return "", err
 	}
 	if l < 0 {
+		if c.trace != nil {
+			c.trace(start, "NULLABLE_STRING", nil)
+		}
 		return "", nil
 	}
 	if err := c.need(int(l)); err != nil {
@@ -59,198 +385,970 @@ func (c *cursor) str16() (string, error) {
 	}
 	s := string(c.b[c.off : c.off+int(l)])
 	c.off += int(l)
+	if c.trace != nil {
+		c.trace(start, "STRING", s)
+	}
 	return s, nil
 }
 
+// errVarintOverflow rejects a varint longer than a 64-bit value needs, which
+// no client sends.
+var errVarintOverflow = errors.New("varint overflows 64 bits")
+
 // Uvarint for compact (flexible) encodings
 func (c *cursor) uvarint() (uint64, error) {
+	start := c.off
+	v, err := c.readUvarint()
+	if err == nil && c.trace != nil {
+		c.trace(start, "UNSIGNED_VARINT", v)
+	}
+	return v, err
+}
+func (c *cursor) readUvarint() (uint64, error) {
 	v, n := binary.Uvarint(c.b[c.off:])
-	if n <= 0 {
+	if n < 0 {
+		return 0, errVarintOverflow
+	}
+	if n == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	c.off += n
+	return v, nil
+}
+
+// Zigzag varint, as used inside record batches
+func (c *cursor) varint() (int64, error) {
+	start := c.off
+	v, err := c.readVarint()
+	if err == nil && c.trace != nil {
+		c.trace(start, "VARINT", v)
+	}
+	return v, err
+}
+func (c *cursor) readVarint() (int64, error) {
+	v, n := binary.Varint(c.b[c.off:])
+	if n < 0 {
+		return 0, errVarintOverflow
+	}
+	if n == 0 {
 		return 0, io.ErrUnexpectedEOF
 	}
 	c.off += n
 	return v, nil
 }
 
+// Record VARBYTES: varint length then bytes; -1 = null. Returns a subslice of
+// the cursor's buffer.
+func (c *cursor) varBytes() ([]byte, error) {
+	start := c.off
+	n, err := c.readVarint()
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		if c.trace != nil {
+			c.trace(start, "VARBYTES", nil)
+		}
+		return nil, nil
+	}
+	if n > int64(len(c.b)-c.off) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := c.b[c.off : c.off+int(n)]
+	c.off += int(n)
+	if c.trace != nil {
+		c.trace(start, "VARBYTES", b)
+	}
+	return b, nil
+}
+
 // Flexible COMPACT_NULLABLE_STRING: uvarint(len+1); 0 = null
 func (c *cursor) compactNullableString() (string, error) {
-	n1, err := c.uvarint()
+	start := c.off
+	n1, err := c.readUvarint()
 	if err != nil {
 		return "", err
 	}
 	if n1 == 0 {
+		if c.trace != nil {
+			c.trace(start, "COMPACT_NULLABLE_STRING", nil)
+		}
 		return "", nil
 	}
-	n := int(n1 - 1)
-	if err := c.need(n); err != nil {
+	n, err := c.length(n1 - 1)
+	if err != nil {
 		return "", err
 	}
 	s := string(c.b[c.off : c.off+n])
 	c.off += n
+	if c.trace != nil {
+		c.trace(start, "COMPACT_STRING", s)
+	}
 	return s, nil
 }
 
+// Flexible COMPACT_ARRAY length: uvarint(len+1); 0 = null.
+// Every element takes at least one byte, so a length beyond what is left in
+// the buffer is rejected before any handler preallocates for it.
+func (c *cursor) compactArrayLen() (n int, isNull bool, err error) {
+	start := c.off
+	n1, err := c.readUvarint()
+	if err != nil {
+		return 0, false, err
+	}
+	if n1 == 0 {
+		if c.trace != nil {
+			c.trace(start, "COMPACT_ARRAY", nil)
+		}
+		return 0, true, nil
+	}
+	if _, err := c.length(n1 - 1); err != nil {
+		return 0, false, err
+	}
+	if c.trace != nil {
+		c.trace(start, "COMPACT_ARRAY", int(n1-1))
+	}
+	return int(n1 - 1), false, nil
+}
+
+// Flexible COMPACT_RECORDS: uvarint(len+1); 0 = null.
+// Returns a sub-slice of the payload (no copy).
+func (c *cursor) compactRecords() ([]byte, error) {
+	start := c.off
+	b, err := c.readCompactBytes()
+	if err == nil && c.trace != nil {
+		c.trace(start, "COMPACT_RECORDS", b)
+	}
+	return b, err
+}
+func (c *cursor) readCompactBytes() ([]byte, error) {
+	n1, err := c.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n1 == 0 {
+		return nil, nil
+	}
+	n, err := c.length(n1 - 1)
+	if err != nil {
+		return nil, err
+	}
+	b := c.b[c.off : c.off+n]
+	c.off += n
+	return b, nil
+}
+
+// Flexible COMPACT_BYTES: like compactRecords, but returns a copy so callers
+// may keep it after the request is done.
+func (c *cursor) compactBytes() ([]byte, error) {
+	start := c.off
+	b, err := c.readCompactBytes()
+	if err != nil {
+		return nil, err
+	}
+	if b != nil {
+		b = append([]byte{}, b...)
+	}
+	if c.trace != nil {
+		c.trace(start, "COMPACT_BYTES", b)
+	}
+	return b, nil
+}
+
+// Flexible COMPACT_NULLABLE_BYTES: like compactBytes, but reports null
+// apart from empty.
+func (c *cursor) compactNullableBytes() (b []byte, isNull bool, err error) {
+	start := c.off
+	if b, err = c.readCompactBytes(); err != nil {
+		return nil, false, err
+	}
+	if b != nil {
+		b = append([]byte{}, b...)
+	}
+	if c.trace != nil {
+		var v any = b
+		if b == nil {
+			v = nil
+		}
+		c.trace(start, "COMPACT_NULLABLE_BYTES", v)
+	}
+	return b, b == nil, nil
+}
+
 // Flexible tagged fields: count (uvarint), then {tagID uvarint, size uvarint, payload[size]}*
 func (c *cursor) skipTagged() error {
-	cnt, err := c.uvarint()
+	start := c.off
+	cnt, err := c.readUvarint()
 	if err != nil {
 		return err
 	}
+	// Each tagged field takes at least two bytes, so a count beyond what is
+	// left is malformed.
+	if _, err := c.length(cnt); err != nil {
+		return err
+	}
 	for i := uint64(0); i < cnt; i++ {
-		if _, err := c.uvarint(); err != nil { // tag id
+		if _, err := c.readUvarint(); err != nil { // tag id
 			return err
 		}
-		sz, err := c.uvarint()
+		sz, err := c.readUvarint()
 		if err != nil {
 			return err
 		}
-		if err := c.need(int(sz)); err != nil {
+		n, err := c.length(sz)
+		if err != nil {
 			return err
 		}
-		c.off += int(sz)
+		c.off += n
+	}
+	if c.trace != nil {
+		c.trace(start, "TAG_BUFFER", cnt)
 	}
 	return nil
 }
 
+// The methods below read the types whose encoding depends on whether the
+// request version is flexible, for handlers that serve both kinds.
+
+// arrayLenFor reads an array length: a COMPACT_ARRAY's when flexible, else
+// an ARRAY's INT32, -1 for null. Either way a length beyond what is left in
+// the buffer is rejected.
+func (c *cursor) arrayLenFor(flexible bool) (n int, isNull bool, err error) {
+	if flexible {
+		return c.compactArrayLen()
+	}
+	start := c.off
+	if err := c.need(4); err != nil {
+		return 0, false, err
+	}
+	l := int32(binary.BigEndian.Uint32(c.b[c.off:]))
+	c.off += 4
+	if l < 0 {
+		if c.trace != nil {
+			c.trace(start, "ARRAY", nil)
+		}
+		return 0, true, nil
+	}
+	if _, err := c.length(uint64(l)); err != nil {
+		return 0, false, err
+	}
+	if c.trace != nil {
+		c.trace(start, "ARRAY", int(l))
+	}
+	return int(l), false, nil
+}
+
+// stringFor reads a (nullable) string: COMPACT_STRING when flexible, else
+// STRING. Null reads as "".
+func (c *cursor) stringFor(flexible bool) (string, error) {
+	if flexible {
+		return c.compactNullableString()
+	}
+	return c.str16()
+}
+
+// recordsFor reads a record set: COMPACT_RECORDS when flexible, else
+// RECORDS, an INT32 length (-1 for null) then the bytes. Like
+// compactRecords it returns a sub-slice of the payload.
+func (c *cursor) recordsFor(flexible bool) ([]byte, error) {
+	if flexible {
+		return c.compactRecords()
+	}
+	start := c.off
+	if err := c.need(4); err != nil {
+		return nil, err
+	}
+	l := int32(binary.BigEndian.Uint32(c.b[c.off:]))
+	c.off += 4
+	var b []byte
+	if l >= 0 {
+		n, err := c.length(uint64(l))
+		if err != nil {
+			return nil, err
+		}
+		b = c.b[c.off : c.off+n]
+		c.off += n
+	}
+	if c.trace != nil {
+		c.trace(start, "RECORDS", b)
+	}
+	return b, nil
+}
+
+// tagsFor skips a TAG_BUFFER, which only flexible versions have.
+func (c *cursor) tagsFor(flexible bool) error {
+	if !flexible {
+		return nil
+	}
+	return c.skipTagged()
+}
+
 // ----- main server -----
 func main() {
-	fmt.Println("Listening on 0.0.0.0:9092 ...")
-	l, err := net.Listen("tcp", "0.0.0.0:9092")
+	listenAddr := flag.String("listen", "0.0.0.0:9092", "host:port to accept connections on")
+	flag.IntVar(&maxRequestBytes, "max-request-bytes", maxRequestBytes,
+		"largest request frame accepted; keep it above clients' max.request.size")
+	flag.IntVar(&maxConnections, "max-connections", maxConnections,
+		"most client connections open at once; further ones are closed on accept (0 for no limit)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second,
+		"how long to wait for open connections to finish on SIGINT/SIGTERM")
+	flag.StringVar(&advertisedListener, "advertised-listener", os.Getenv("ADVERTISED_LISTENER"),
+		"host:port clients are told to connect to (default localhost and the -listen port)")
+	flag.TextVar(logLevel, "log-level", logLevel, "minimum level to log: debug, info, warn or error")
+	flag.Float64Var(&requestRateQuota, "request-rate-quota", 0,
+		"requests per second each client id may send before being throttled (default off)")
+	flag.DurationVar(&retentionCheckInterval, "log-retention-check-interval", retentionCheckInterval,
+		"how often to delete log segments past their topic's retention.ms or retention.bytes and compact topics with cleanup.policy=compact")
+	flag.DurationVar(&readTimeout, "read-timeout", readTimeout,
+		"how long a client may take to send the rest of a request once started (0 for no limit)")
+	flag.DurationVar(&writeTimeout, "write-timeout", writeTimeout,
+		"how long a write of responses may block on a client not reading (0 for no limit)")
+	flag.DurationVar(&idleTimeout, "idle-timeout", idleTimeout,
+		"how long a connection may sit between requests before it is closed (0 for no limit)")
+	flag.BoolVar(&tcpNoDelay, "tcp-nodelay", tcpNoDelay, "send small responses at once, without waiting on Nagle's algorithm")
+	flag.DurationVar(&tcpKeepAlive, "tcp-keepalive", tcpKeepAlive, "period of TCP keepalive probes on client connections (0 to turn them off)")
+	metricsAddr := flag.String("metrics-listen", "", "host:port to serve Prometheus metrics on at /metrics (default off)")
+	flagBrokerID := flag.Int("broker-id", int(brokerID), "this broker's node id; must match the one recorded in LOG_DIR, if any")
+	flagDefaultPartitions := flag.Int("default-partitions", int(defaultPartitions), "partition count of auto-created topics and of CreateTopics asking for the default")
+	flag.BoolVar(&autoCreateTopics, "auto-create-topics", autoCreateTopics, "create unknown topics on Produce, or on Metadata allowing it; otherwise they get UNKNOWN_TOPIC_OR_PARTITION")
+	flag.StringVar(&groupAssignor, "group-assignor", groupAssignor,
+		"assign consumer group partitions on the broker with range or roundrobin, overriding the group leader (default: the leader assigns)")
+	authorizerName := flag.String("authorizer", "",
+		"authorize requests with acl, the ACLs in LOG_DIR's "+aclsFileName+", denying what no ACL allows (default: allow everything)")
+	seedFile := flag.String("seed", "", "before serving, append the records in this newline-delimited JSON file of {topic, partition, key, value, headers, timestamp}")
+	printVersion := flag.Bool("version", false, "print the version and build info and exit")
+	dump := flag.Bool("dump", false, "instead of serving, decode the requests read from stdin, raw or in hex, and print their fields")
+	flag.Parse()
+	if *printVersion {
+		fmt.Println(currentBuildInfo())
+		return
+	}
+	if *dump {
+		if err := dumpRequests(os.Stdin, os.Stdout); err != nil {
+			logger.Error("failed to dump requests", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if advertisedListener == "" {
+		_, port, err := net.SplitHostPort(*listenAddr)
+		if err != nil {
+			logger.Error("bad -listen address", "err", err)
+			os.Exit(2)
+		}
+		advertisedListener = net.JoinHostPort("localhost", port)
+	}
+	if retentionCheckInterval <= 0 {
+		logger.Error("-log-retention-check-interval must be positive")
+		os.Exit(2)
+	}
+	if *flagBrokerID < 0 || *flagBrokerID > math.MaxInt32 {
+		logger.Error("bad -broker-id", "broker_id", *flagBrokerID)
+		os.Exit(2)
+	}
+	brokerID = int32(*flagBrokerID)
+	if *flagDefaultPartitions < 1 || *flagDefaultPartitions > math.MaxInt32 {
+		logger.Error("-default-partitions must be positive")
+		os.Exit(2)
+	}
+	defaultPartitions = int32(*flagDefaultPartitions)
+	if err := checkGroupAssignor(groupAssignor); err != nil {
+		logger.Error("bad -group-assignor", "err", err)
+		os.Exit(2)
+	}
+	if err := checkAuthorizer(*authorizerName); err != nil {
+		logger.Error("bad -authorizer", "err", err)
+		os.Exit(2)
+	}
+	if v := os.Getenv("SASL_PLAIN_USERS"); v != "" {
+		users, err := parseUserPasswords(v)
+		if err != nil {
+			logger.Error("bad SASL_PLAIN_USERS", "err", err)
+			os.Exit(1)
+		}
+		plainUsers = users
+	}
+	if v := os.Getenv("SASL_SCRAM_SHA_256_USERS"); v != "" {
+		users, err := parseScramUsers(v)
+		if err != nil {
+			logger.Error("bad SASL_SCRAM_SHA_256_USERS", "err", err)
+			os.Exit(1)
+		}
+		scramUsers = users
+	}
+	if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+		cfg, err := loadTLSConfig(certFile, os.Getenv("TLS_KEY_FILE"), os.Getenv("TLS_CA_FILE"))
+		if err != nil {
+			logger.Error("failed to load TLS config", "err", err)
+			os.Exit(1)
+		}
+		tlsConfig = cfg
+	}
+	// LOG_DIR switches from in-memory logs and committed offsets to files on
+	// disk;
+	// LOG_SEGMENT_BYTES sets the size at which a new segment is rolled and
+	// LOG_INDEX_INTERVAL_BYTES how much log goes by between index entries.
+	if dir := os.Getenv("LOG_DIR"); dir != "" {
+		segmentBytes, _ := strconv.ParseInt(os.Getenv("LOG_SEGMENT_BYTES"), 10, 64)
+		indexInterval, _ := strconv.ParseInt(os.Getenv("LOG_INDEX_INTERVAL_BYTES"), 10, 64)
+		s, err := openLogStore(dir, segmentBytes, indexInterval)
+		if err != nil {
+			logger.Error("failed to open log dir", "dir", dir, "err", err)
+			os.Exit(1)
+		}
+		store = s
+		explicit := false
+		flag.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "broker-id" })
+		id, err := loadBrokerID(dir, brokerID, explicit)
+		if err != nil {
+			logger.Error("failed to load broker id", "dir", dir, "err", err)
+			os.Exit(1)
+		}
+		brokerID = id
+		pm, err := openProducerIDManager(dir)
+		if err != nil {
+			logger.Error("failed to open producer ids", "dir", dir, "err", err)
+			os.Exit(1)
+		}
+		producerIDs = pm
+	}
+	brokerName = strconv.Itoa(int(brokerID))
+	if err := coordinator.openOffsetsTopic(store, store.dir); err != nil {
+		logger.Error("failed to open committed offsets", "err", err)
+		os.Exit(1)
+	}
+	if *authorizerName == "acl" {
+		a, err := openACLAuthorizer(store.dir)
+		if err != nil {
+			logger.Error("failed to load ACLs", "err", err)
+			os.Exit(1)
+		}
+		authz = a
+	}
+	if *seedFile != "" {
+		n, err := seedTopics(store, *seedFile)
+		if err != nil {
+			logger.Error("failed to seed topics", "file", *seedFile, "err", err)
+			os.Exit(1)
+		}
+		logger.Info("seeded topics", "file", *seedFile, "records", n)
+	}
+	go coordinator.expireLoop(time.Second)
+	go txnCoordinator.expireLoop(time.Second)
+	go fetchSessions.expireLoop(10 * time.Second)
+	go store.cleanupLoop(retentionCheckInterval)
+	if *metricsAddr != "" {
+		go func() {
+			logger.Error("metrics server failed", "addr", *metricsAddr, "err", serveMetrics(*metricsAddr))
+		}()
+	}
+
+	l, err := net.Listen("tcp", *listenAddr)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Failed to bind:", err)
+		logger.Error("failed to bind", "addr", *listenAddr, "err", err)
 		os.Exit(1)
 	}
+	bi := currentBuildInfo()
+	logger.Info("listening", "addr", l.Addr().String(), "tls", tlsConfig != nil,
+		"advertised", advertisedListener, "version", bi.version, "commit", bi.commit)
+
+	// SIGINT/SIGTERM stop the accept loop and tell every connection to
+	// hang up once its in-flight request is answered.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	serve(ctx, l, *shutdownTimeout)
+	stop()
+
+	if err := store.close(); err != nil {
+		logger.Error("failed to close logs", "err", err)
+	}
+}
+
+// serve accepts connections on l and serves them until ctx is cancelled. It
+// then closes l and waits up to shutdownTimeout for the connections to
+// answer what they have read and close.
+func serve(ctx context.Context, l net.Listener, shutdownTimeout time.Duration) {
+	context.AfterFunc(ctx, func() { l.Close() })
+	var conns sync.WaitGroup
+	var slots chan struct{} // one per open connection, with -max-connections
+	if maxConnections > 0 {
+		slots = make(chan struct{}, maxConnections)
+	}
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Accept error:", err)
+			if ctx.Err() != nil {
+				break
+			}
+			logger.Warn("accept failed", "err", err)
 			continue
 		}
-		go handleConn(conn)
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			default:
+				metrics.rejectedConns.Add(1)
+				logger.Warn("too many connections; closing new one", "remote", conn.RemoteAddr().String(), "max", maxConnections)
+				conn.Close()
+				continue
+			}
+		}
+		if tlsConfig != nil {
+			conn = tls.Server(conn, tlsConfig)
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+			handleConn(ctx, conn)
+		}()
 	}
+
+	logger.Info("shutting down")
+	drained := make(chan struct{})
+	go func() {
+		conns.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(shutdownTimeout):
+		logger.Warn("timed out waiting for connections to close")
+	}
+}
+
+// maxRequestBytes caps the size of a request frame, like Kafka's
+// socket.request.max.bytes. Produce requests carry whole batches, so it must
+// stay above the producers' max.request.size (and so above the largest
+// batch, Kafka's message.max.bytes, a client may send), or their requests
+// are turned away. Set with the -max-request-bytes flag.
+var maxRequestBytes = 10 * 1024 * 1024
+
+// maxConnections caps how many client connections may be open at once, like
+// Kafka's max.connections; connections past it are closed as soon as they
+// are accepted. Zero means no limit. Set with the -max-connections flag.
+var maxConnections = 0
+
+// Socket timeouts, set with the -read-timeout, -write-timeout and
+// -idle-timeout flags; zero means none. A client gets idleTimeout to start
+// its next request (Kafka's connections.max.idle.ms) and readTimeout to send
+// the rest of it once started; each write of responses gets writeTimeout.
+var (
+	readTimeout  = 30 * time.Second
+	writeTimeout = 30 * time.Second
+	idleTimeout  = 10 * time.Minute
+)
+
+// Socket options of accepted connections, set with the -tcp-nodelay and
+// -tcp-keepalive flags. Requests and responses are mostly small frames, which
+// Nagle's algorithm can hold back for tens of milliseconds waiting on an ack;
+// keepalives find peers that vanished without closing. A zero keepalive
+// period turns keepalives off.
+var (
+	tcpNoDelay   = true
+	tcpKeepAlive = 15 * time.Second
+)
+
+// setSocketOptions applies tcpNoDelay and tcpKeepAlive to conn, or to the
+// TCP connection under it if it is TLS.
+func setSocketOptions(conn net.Conn) error {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tc.SetNoDelay(tcpNoDelay); err != nil {
+		return err
+	}
+	if tcpKeepAlive <= 0 {
+		return tc.SetKeepAlive(false)
+	}
+	if err := tc.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tc.SetKeepAlivePeriod(tcpKeepAlive)
 }
 
-func handleConn(conn net.Conn) {
+// setReadDeadline gives conn's next read d, or no deadline if d is zero.
+func setReadDeadline(conn net.Conn, d time.Duration) {
+	var t time.Time
+	if d > 0 {
+		t = time.Now().Add(d)
+	}
+	conn.SetReadDeadline(t)
+}
+
+// deadlineWriter gives each write to conn writeTimeout.
+type deadlineWriter struct{ conn net.Conn }
+
+func (w deadlineWriter) Write(b []byte) (int, error) {
+	if writeTimeout > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+	return w.conn.Write(b)
+}
+
+// maxInFlight bounds how many requests a connection may have read but not
+// yet answered; further reads wait until the oldest is written out.
+const maxInFlight = 64
+
+// pendingResponse is a request read off a connection and being handled.
+// done is closed once resp and err are set.
+type pendingResponse struct {
+	done           chan struct{}
+	apiKey, apiVer int16
+	corrID         int32
+	resp           []byte
+	err            error // the request was malformed
+}
+
+// handleConn serves requests on conn until the client hangs up or ctx is
+// cancelled, in which case requests already read are still answered.
+//
+// Clients pipeline requests and expect responses in request order. Requests
+// are read and decoded here, then handled in arrival order by one worker per
+// connection, except those that may wait on other clients (blockingAPIs),
+// which get their own goroutine so they don't hold up the rest. Responses
+// are queued in request order and written by writeResponses.
+func handleConn(ctx context.Context, conn net.Conn) {
 	defer conn.Close()
+	metrics.activeConns.Add(1)
+	defer metrics.activeConns.Add(-1)
 
+	r := bufio.NewReader(conn)
 	lenBuf := make([]byte, 4)
+	sess := &session{
+		remote: conn.RemoteAddr().String(),
+		auth:   initialAuthState(),
+	}
+	sess.log = logger.With("remote", sess.remote)
+	if host, _, err := net.SplitHostPort(sess.remote); err == nil {
+		sess.clientHost = "/" + host
+	}
+	if err := setSocketOptions(conn); err != nil {
+		sess.log.Warn("setting socket options failed", "err", err)
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tlsHandshake(tc, sess); err != nil {
+			if errors.As(err, new(tls.RecordHeaderError)) {
+				sess.log.Warn("plaintext request on TLS port; closing")
+				return
+			}
+			sess.log.Warn("TLS handshake failed", "err", err)
+			return
+		}
+	}
+	// Unblock the read waiting for the next request on shutdown, or once the
+	// writer gives up on the connection. (After the handshake, which clears
+	// deadlines when done.)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })()
+
+	pending := make(chan *pendingResponse, maxInFlight)
+	worker := make(chan func(), maxInFlight)
+	written := make(chan struct{})
+	// The writer keeps the logger it starts with: the read loop goes on to
+	// replace sess.log once the client_id is known.
+	go func(log *slog.Logger) {
+		defer close(written)
+		writeResponses(conn, pending, cancel, log)
+	}(sess.log)
+	go func() {
+		for handle := range worker {
+			handle()
+		}
+	}()
+	defer func() {
+		close(worker)
+		close(pending)
+		<-written
+	}()
 
 	for {
-		// 1) Read 4-byte frame length
-		if _, err := io.ReadFull(conn, lenBuf); err != nil {
-			// EOF ends the loop; other errors close the conn
-			if err != io.EOF && err != io.ErrUnexpectedEOF {
-				fmt.Fprintln(os.Stderr, "Read length error:", err)
+		// 1) Read 4-byte frame length: idleTimeout for the first byte,
+		// readTimeout for the rest of the request.
+		setReadDeadline(conn, idleTimeout)
+		if ctx.Err() != nil {
+			return // don't undo the shutdown's deadline
+		}
+		_, err := r.Peek(1)
+		if err == nil {
+			setReadDeadline(conn, readTimeout)
+			if ctx.Err() != nil {
+				return
 			}
+			_, err = io.ReadFull(r, lenBuf)
+		}
+		if err != nil {
+			// EOF, a timeout or shutdown ends the loop; other errors close the conn
+			switch {
+			case err == io.EOF || err == io.ErrUnexpectedEOF || ctx.Err() != nil:
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				sess.log.Debug("connection timed out; closing")
+			default:
+				sess.log.Warn("read failed", "err", err)
+			}
+			return
+		}
+		if _, isTLS := conn.(*tls.Conn); !isTLS && lenBuf[0] == tlsHandshakeRecord && lenBuf[1] == 3 {
+			// A TLS record header (type, version 3.x) where the frame size
+			// should be: the client has TLS turned on and we don't.
+			sess.log.Warn("TLS handshake on plaintext port; closing")
 			return
 		}
 		frameSize := int32(binary.BigEndian.Uint32(lenBuf))
 		if frameSize < 0 {
-			fmt.Fprintln(os.Stderr, "Negative frame size:", frameSize)
+			sess.log.Warn("negative frame size; closing", "size", frameSize)
 			return
 		}
-		// (Optional) sanity cap to avoid absurd allocations
-		if frameSize > 10*1024*1024 {
-			fmt.Fprintln(os.Stderr, "Frame too large:", frameSize)
+		if int(frameSize) > maxRequestBytes {
+			sess.log.Warn("frame too large; closing", "size", frameSize, "max", maxRequestBytes)
+			// If it looks like a real request, say why before hanging up;
+			// garbage (e.g. TLS or HTTP on the Kafka port) just gets closed.
+			if hdr, err := r.Peek(8); err == nil {
+				apiKey := int16(binary.BigEndian.Uint16(hdr))
+				apiVer := int16(binary.BigEndian.Uint16(hdr[2:]))
+				corrID := int32(binary.BigEndian.Uint32(hdr[4:]))
+				if _, ok := handlers[apiKey]; ok {
+					p := &pendingResponse{done: make(chan struct{})}
+					p.resp = buildErrorResponse(corrID, apiKey, apiVer, errMessageTooLarge)
+					close(p.done)
+					pending <- p
+				}
+			}
 			return
 		}
 
 		// 2) Read exactly 'frameSize' bytes of payload
-		payload := make([]byte, frameSize)
-		if _, err := io.ReadFull(conn, payload); err != nil {
-			fmt.Fprintln(os.Stderr, "Read payload error:", err)
+		payload := getPayload(int(frameSize))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			switch {
+			case ctx.Err() != nil:
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				sess.log.Debug("connection timed out; closing")
+			default:
+				sess.log.Warn("read failed", "err", err)
+			}
 			return
 		}
+		metrics.bytesIn.Add(uint64(len(lenBuf) + len(payload)))
 
 		// 3) Parse request header from payload
 		c := &cursor{b: payload}
-		apiKey, apiVer, corrID, clientID, ok := parseHeader(c)
-		if !ok {
-			// Malformed; close connection
-			fmt.Fprintln(os.Stderr, "Malformed header; closing")
+		apiKey, apiVer, corrID, clientID, err := parseHeader(c)
+		if errors.Is(err, errShortHeader) {
+			// Nothing to answer to; close connection
+			metrics.decodeErrors.Add(1)
+			sess.log.Warn("malformed request header; closing")
 			return
 		}
-		fmt.Println("API Key:", apiKey, "Version:", apiVer, "CorrelationID:", corrID, "ClientID:", clientID)
-
-		// 4) Decide error code for ApiVersions
-		errCode := errNone
-		if apiKey == apiKeyApiVersions && (apiVer > maxSupportedAPIVer || apiVer < 0) {
-			errCode = errUnsupportedVer
+		if err != nil {
+			p := &pendingResponse{done: make(chan struct{}), apiKey: apiKey, apiVer: apiVer, corrID: corrID, err: err}
+			close(p.done)
+			pending <- p
+			putPayload(payload)
+			continue
+		}
+		recordRequest(apiKey)
+		if sess.clientID == "" && clientID != "" {
+			// Clients send the same client_id on every request; keep the
+			// first so handlers and logs needn't go back to the header.
+			sess.clientID = clientID
+			sess.log = sess.log.With("client_id", clientID)
 		}
+		sess.log.Debug("request", "api_key", apiKey, "api_version", apiVer, "correlation_id", corrID)
 
-		// 5) Build and send flexible ApiVersions response (v3+ body),
-		//    but use legacy v0 response header (corrId only) as before.
-		resp := buildApiVersionsResponse(corrID, errCode)
-		if _, err := conn.Write(resp); err != nil {
-			fmt.Fprintln(os.Stderr, "Write error:", err)
-			return
+		// 4) Dispatch on api key
+		p := &pendingResponse{done: make(chan struct{}), apiKey: apiKey, apiVer: apiVer, corrID: corrID}
+		pending <- p // 5) its response goes out after those read before it
+		reqSess := sess
+		if sess.auth == authDone {
+			// Handlers run concurrently from here on; each gets its own view.
+			rs := *sess
+			reqSess = &rs
+		}
+		throttle := chargeRequest(clientID, apiKey)
+		handle := func() {
+			start := time.Now()
+			p.resp, p.err = dispatch(c, apiKey, apiVer, corrID, reqSess)
+			recordLatency(apiKey, time.Since(start))
+			// Handlers copy out whatever they keep, so the payload can be reused.
+			putPayload(payload)
+			if throttle > 0 && p.resp != nil && versionSupported(apiKey, apiVer) &&
+				setThrottleTime(p.resp, apiKey, apiVer, int32(throttle.Milliseconds())) {
+				// Hold the response back, as the client is told to.
+				select {
+				case <-time.After(throttle):
+				case <-ctx.Done():
+				}
+			}
+			close(p.done)
+		}
+		switch {
+		case reqSess == sess:
+			// SASL requests move the connection's auth state; nothing else
+			// is in flight until they are done.
+			handle()
+			if sess.auth == authFailed {
+				return
+			}
+		case blockingAPIs[apiKey]:
+			go handle()
+		default:
+			worker <- handle
 		}
 		// Loop to read the next request on the same connection.
 	}
 }
 
-func parseHeader(c *cursor) (apiKey int16, apiVer int16, corrID int32, clientID string, ok bool) {
-	var err error
-	// Kafka request payload starts with:
-	// api_key (int16), api_version (int16), correlation_id (int32), client_id (legacy STRING or compact nullable)
-	if apiKey, err = c.i16(); err != nil {
-		return
-	}
-	if apiVer, err = c.i16(); err != nil {
-		return
-	}
-	if corrID, err = c.i32(); err != nil {
-		return
+// writeResponses writes the responses queued on pending in order, flushing
+// whenever the queue runs dry or the next response isn't ready yet: one
+// write syscall per pipelined batch rather than per response. A nil
+// response means the request was fire-and-forget (e.g. Produce with
+// acks=0). A malformed request, its err set, is answered with
+// INVALID_REQUEST. After a write error it logs to log, calls hangUp and
+// only drains the queue.
+func writeResponses(conn net.Conn, pending <-chan *pendingResponse, hangUp func(), log *slog.Logger) {
+	w := bufio.NewWriter(deadlineWriter{conn})
+	defer w.Flush()
+	failed := false
+	for p := range pending {
+		select {
+		case <-p.done:
+		default:
+			if !failed {
+				w.Flush()
+			}
+			<-p.done
+		}
+		switch {
+		case failed || p.resp == nil && p.err == nil:
+			continue
+		case p.err != nil:
+			// The client still gets an answer to match up with its request.
+			log.Warn("malformed request", "api_key", p.apiKey, "api_version", p.apiVer, "correlation_id", p.corrID, "err", p.err)
+			metrics.decodeErrors.Add(1)
+			p.resp = buildErrorResponse(p.corrID, p.apiKey, p.apiVer, errInvalidRequest)
+			fallthrough
+		default:
+			if err := checkResponseFrame(p.resp, p.corrID); err != nil {
+				// A bug in a handler: answer with an error the client can
+				// still match up, rather than confuse it with a stray frame.
+				log.Error("bad response frame", "api_key", p.apiKey, "api_version", p.apiVer, "correlation_id", p.corrID, "err", err)
+				p.resp = buildErrorResponse(p.corrID, p.apiKey, p.apiVer, errUnknownServerError)
+			}
+			n, err := w.Write(p.resp)
+			metrics.bytesOut.Add(uint64(n))
+			if err == nil && len(pending) == 0 {
+				err = w.Flush()
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				log.Debug("write timed out; closing")
+			} else if err != nil {
+				log.Warn("write failed", "err", err)
+			}
+			failed = err != nil
+		}
+		if failed {
+			w.Flush()
+			hangUp()
+		}
 	}
+}
 
-	// Try legacy STRING clientId first
-	save := c.off
-	if clientID, err = c.str16(); err == nil {
-		return apiKey, apiVer, corrID, clientID, true
+// checkResponseFrame checks that resp is one whole frame answering the
+// request with correlation id corrID: its size covers exactly the rest, and
+// its header echoes corrID. It is cheap enough to run on every response.
+func checkResponseFrame(resp []byte, corrID int32) error {
+	if len(resp) < 8 {
+		return fmt.Errorf("frame of %d bytes is too short", len(resp))
 	}
-	// Try flexible compact nullable + tagged fields
-	c.off = save
-	if clientID, err = c.compactNullableString(); err != nil {
-		return
+	if size := binary.BigEndian.Uint32(resp); int64(size) != int64(len(resp)-4) {
+		return fmt.Errorf("frame size %d, but %d bytes follow it", size, len(resp)-4)
 	}
-	if err = c.skipTagged(); err != nil {
-		return
+	if got := int32(binary.BigEndian.Uint32(resp[4:])); got != corrID {
+		return fmt.Errorf("correlation id %d, want %d", got, corrID)
+	}
+	return nil
+}
+
+func init() {
+	registerHandler(apiKeyApiVersions, handleApiVersions)
+}
+
+// handleApiVersions answers with the supportedAPIs table. An unsupported
+// version still gets the full table, alongside UNSUPPORTED_VERSION, so the
+// client can retry with a version we do support.
+func handleApiVersions(c *cursor, corrID int32, apiVer int16, _ *session) ([]byte, error) {
+	errCode := errNone
+	if !versionSupported(apiKeyApiVersions, apiVer) {
+		errCode = errUnsupportedVer
+		// The body is in a layout we don't know; leave it unread.
+		c.off = len(c.b)
+	} else if apiVer >= 3 {
+		if _, err := c.compactNullableString(); err != nil { // client_software_name
+			return nil, err
+		}
+		if _, err := c.compactNullableString(); err != nil { // client_software_version
+			return nil, err
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
 	}
-	return apiKey, apiVer, corrID, clientID, true
+	return buildApiVersionsResponse(corrID, apiVer, errCode), nil
 }
 
-func buildApiVersionsResponse(corrID int32, errCode int16) []byte {
+// buildApiVersionsResponse encodes the supportedAPIs table in the body
+// layout of apiVer. The header is always v0 (see responseHeaderVersion), but
+// the body only turns flexible from v3.
+//
+// A client that sent a version we don't support can't know which layout we
+// would answer in, so, like Kafka, UNSUPPORTED_VERSION always gets the v0
+// body: clients parse it as v0 on that error and retry with the highest
+// ApiVersions version it lists.
+func buildApiVersionsResponse(corrID int32, apiVer int16, errCode int16) []byte {
+	if errCode == errUnsupportedVer {
+		apiVer = 0
+	}
+	flexible := isFlexible(apiKeyApiVersions, apiVer)
+
+	// Body (v0-v2):
+	// error_code (INT16)
+	// api_keys (ARRAY) -> {api_key, min_version, max_version} per supportedAPIs entry
+	// throttle_time_ms (INT32, v1+) = 0
+	//
 	// Body (flex v3+):
 	// error_code (INT16)
-	// api_keys (COMPACT_ARRAY) -> 1 element: {api_key=18, min=0, max=4, TAGS=0}
+	// api_keys (COMPACT_ARRAY) -> {api_key, min_version, max_version, TAGS} per supportedAPIs entry
 	// throttle_time_ms (INT32) = 0
 	// response TAG_BUFFER count = 0
-	body := make([]byte, 0, 32)
+	var r respBuf
+	r.putI16(errCode)
 
-	// error_code
-	body = append(body, byte(errCode>>8), byte(errCode))
-
-	// compact array length = N+1; we advertise one entry => 0x02
-	body = append(body, 0x02)
-
-	// element
-	body = append(body, 0x00, 0x12) // api_key = 18
-	body = append(body, 0x00, 0x00) // min_version = 0
-	body = append(body, 0x00, 0x04) // max_version = 4
-	body = append(body, 0x00)       // element TAG_BUFFER count = 0
-
-	// throttle_time_ms = 0
-	tmp := make([]byte, 4)
-	binary.BigEndian.PutUint32(tmp, 0)
-	body = append(body, tmp...)
+	if flexible {
+		r.putCompactArrayLen(len(supportedAPIs))
+	} else {
+		r.putI32(int32(len(supportedAPIs)))
+	}
+	for _, a := range supportedAPIs {
+		r.putI16(a.apiKey)
+		r.putI16(a.minVer)
+		r.putI16(a.maxVer)
+		if flexible {
+			r.putTags()
+		}
+	}
 
-	// response TAG_BUFFER count = 0
-	body = append(body, 0x00)
-
-	// Frame: [length][correlationId][body], where length = len(corrId)+len(body)
-	resp := make([]byte, 4+4+len(body))
-	binary.BigEndian.PutUint32(resp[0:4], uint32(4+len(body)))
-	binary.BigEndian.PutUint32(resp[4:8], uint32(corrID))
-	copy(resp[8:], body)
-	return resp
+	if apiVer >= 1 {
+		r.putI32(0) // throttle_time_ms
+	}
+	if flexible {
+		r.putTags()
+	}
+	return r.finish(corrID, responseHeaderVersion(apiKeyApiVersions, apiVer))
 }
@@ -0,0 +1,655 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func FuzzCompactNullableString(f *testing.F) {
+	f.Add([]byte{0})
+	f.Add([]byte{1})
+	f.Add([]byte{4, 'a', 'b', 'c'})
+	f.Add([]byte{9, 'a'})                                                           // longer than the buffer
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})       // 2^64-1: len+1 overflows
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}) // more than 64 bits
+	f.Fuzz(func(t *testing.T, b []byte) {
+		c := &cursor{b: b}
+		s, err := c.compactNullableString()
+		if c.off < 0 || c.off > len(b) {
+			t.Fatalf("cursor at %d of %d bytes (err %v)", c.off, len(b), err)
+		}
+		if err != nil {
+			return
+		}
+		// The bytes read are exactly a uvarint length and that many bytes.
+		n, size := binary.Uvarint(b)
+		if size <= 0 {
+			t.Fatalf("read %q from a malformed length", s)
+		}
+		if n == 0 {
+			if s != "" || c.off != size {
+				t.Fatalf("null string read as %q, %d bytes", s, c.off)
+			}
+			return
+		}
+		if uint64(len(s)) != n-1 || c.off != size+len(s) || s != string(b[size:c.off]) {
+			t.Fatalf("read %q (%d bytes) for length %d", s, c.off, n-1)
+		}
+	})
+}
+
+// ----- test harness -----
+
+// testServer is the broker serving on an ephemeral port for one test, with
+// its own in-memory store and group coordinator, advertising that port.
+// Logs are discarded.
+type testServer struct {
+	t      testing.TB
+	addr   string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newTestServer starts a testServer, which is shut down, and the globals it
+// replaced restored, when the test ends.
+func newTestServer(t testing.TB) *testServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestServerOn(t, l)
+}
+
+// newTestServerOn is newTestServer serving on l.
+func newTestServerOn(t testing.TB, l net.Listener) *testServer {
+	t.Helper()
+	oldStore, oldCoordinator, oldTxnCoordinator, oldLogger, oldListener := store, coordinator, txnCoordinator, logger, advertisedListener
+	store, coordinator, txnCoordinator = newLogStore(), newGroupCoordinator(), newTransactionCoordinator()
+	logger = slog.New(slog.DiscardHandler)
+	advertisedListener = l.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &testServer{t: t, addr: l.Addr().String(), cancel: cancel, done: make(chan struct{})}
+	go func() {
+		serve(ctx, l, time.Second)
+		close(s.done)
+	}()
+	t.Cleanup(func() {
+		s.close()
+		store, coordinator, txnCoordinator, logger, advertisedListener = oldStore, oldCoordinator, oldTxnCoordinator, oldLogger, oldListener
+	})
+	return s
+}
+
+// close stops the listener and waits for serve to return, which it does
+// once every connection has closed or a second has passed.
+func (s *testServer) close() {
+	s.cancel()
+	<-s.done
+}
+
+// testConn is a client connection to a testServer.
+type testConn struct {
+	t      testing.TB
+	conn   net.Conn
+	corrID int32
+}
+
+// dial connects to s. The connection is closed when the test ends.
+func (s *testServer) dial() *testConn {
+	s.t.Helper()
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &testConn{t: s.t, conn: conn}
+}
+
+// roundTrip sends req, a request header and body, in a frame and returns
+// the payload of the response frame: its header and body.
+func (c *testConn) roundTrip(req []byte) []byte {
+	c.t.Helper()
+	c.send(req)
+	return c.receive()
+}
+
+// send writes req in a frame without waiting for the response.
+func (c *testConn) send(req []byte) {
+	c.t.Helper()
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(req)))
+	if _, err := c.conn.Write(append(frame, req...)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// receive reads the next response frame and returns its payload.
+func (c *testConn) receive() []byte {
+	c.t.Helper()
+	var size [4]byte
+	if _, err := io.ReadFull(c.conn, size[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	resp := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		c.t.Fatal(err)
+	}
+	return resp
+}
+
+// call sends a request with the next correlation id and returns a cursor
+// over the response body, after checking the header echoes the id.
+func (c *testConn) call(apiKey, apiVer int16, body []byte) *cursor {
+	c.t.Helper()
+	c.sendRequest(apiKey, apiVer, body)
+	return c.readResponse(apiKey, apiVer)
+}
+
+// sendRequest sends a request with the next correlation id without waiting
+// for the response; readResponse reads it.
+func (c *testConn) sendRequest(apiKey, apiVer int16, body []byte) {
+	c.t.Helper()
+	c.corrID++
+	c.send(requestFrame(apiKey, apiVer, c.corrID, "test-client", body))
+}
+
+// readResponse reads the response to the last request sent, as call does.
+func (c *testConn) readResponse(apiKey, apiVer int16) *cursor {
+	c.t.Helper()
+	resp := &cursor{b: c.receive()}
+	if corrID, err := resp.i32(); err != nil || corrID != c.corrID {
+		c.t.Fatalf("response correlation id %d (%v), want %d", corrID, err, c.corrID)
+	}
+	if responseHeaderVersion(apiKey, apiVer) >= 1 {
+		if err := resp.skipTagged(); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	return resp
+}
+
+// requestFrame encodes a request header for apiKey and apiVer followed by
+// body.
+func requestFrame(apiKey, apiVer int16, corrID int32, clientID string, body []byte) []byte {
+	var b []byte
+	b = binary.BigEndian.AppendUint16(b, uint16(apiKey))
+	b = binary.BigEndian.AppendUint16(b, uint16(apiVer))
+	b = binary.BigEndian.AppendUint32(b, uint32(corrID))
+	switch requestHeaderVersion(apiKey, apiVer) {
+	case 1:
+		b = appendStr16(b, clientID)
+	case 2:
+		b = appendStr16(b, clientID)
+		b = append(b, 0) // no tagged fields
+	}
+	return append(b, body...)
+}
+
+func appendStr16(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// ----- ApiVersions over the wire -----
+
+func TestApiVersionsRoundTrip(t *testing.T) {
+	c := newTestServer(t).dial()
+	for _, apiVer := range []int16{0, 3, 4} {
+		body := []byte(nil)
+		if apiVer >= 3 {
+			body = []byte{5, 'k', 'g', 'o', 0, 4, '1', '.', '0', 0, 0} // client software name and version
+		}
+		r := c.call(apiKeyApiVersions, apiVer, body)
+		if errCode, _ := r.i16(); errCode != errNone {
+			t.Fatalf("v%d: error code %d", apiVer, errCode)
+		}
+		var n int
+		if apiVer >= 3 {
+			n, _, _ = r.compactArrayLen()
+		} else {
+			n32, _ := r.i32()
+			n = int(n32)
+		}
+		if n != len(supportedAPIs) {
+			t.Fatalf("v%d: %d api keys, want %d", apiVer, n, len(supportedAPIs))
+		}
+		for _, want := range supportedAPIs {
+			key, _ := r.i16()
+			minVer, _ := r.i16()
+			maxVer, err := r.i16()
+			if apiVer >= 3 {
+				err = r.skipTagged()
+			}
+			if err != nil || key != want.apiKey || minVer != want.minVer || maxVer != want.maxVer {
+				t.Fatalf("v%d: api key %d v%d-%d (%v), want %d v%d-%d", apiVer, key, minVer, maxVer, err, want.apiKey, want.minVer, want.maxVer)
+			}
+		}
+	}
+}
+
+// The ApiVersions v0 response is the old non-flexible layout: the error
+// code, an INT32 array count and the key/min/max triples, with no
+// throttle_time_ms and no tagged fields.
+func TestApiVersionsV0Golden(t *testing.T) {
+	c := newTestServer(t).dial()
+	got := c.roundTrip(requestFrame(apiKeyApiVersions, 0, 7, "test-client", nil))
+	want := []byte{
+		0, 0, 0, 7, // correlation_id
+		0, 0, // error_code
+		0, 0, 0, 40, // api_keys count
+		0, 0, 0, 8, 0, 9, // Produce v8-9
+		0, 1, 0, 11, 0, 13, // Fetch v11-13
+		0, 2, 0, 7, 0, 7, // ListOffsets v7
+		0, 3, 0, 8, 0, 12, // Metadata v8-12
+		0, 7, 0, 3, 0, 3, // ControlledShutdown v3
+		0, 8, 0, 8, 0, 8, // OffsetCommit v8
+		0, 9, 0, 8, 0, 8, // OffsetFetch v8
+		0, 10, 0, 4, 0, 4, // FindCoordinator v4
+		0, 11, 0, 9, 0, 9, // JoinGroup v9
+		0, 12, 0, 4, 0, 4, // Heartbeat v4
+		0, 13, 0, 5, 0, 5, // LeaveGroup v5
+		0, 14, 0, 5, 0, 5, // SyncGroup v5
+		0, 15, 0, 5, 0, 5, // DescribeGroups v5
+		0, 16, 0, 4, 0, 4, // ListGroups v4
+		0, 17, 0, 1, 0, 1, // SaslHandshake v1
+		0, 18, 0, 0, 0, 4, // ApiVersions v0-4
+		0, 19, 0, 7, 0, 7, // CreateTopics v7
+		0, 20, 0, 6, 0, 6, // DeleteTopics v6
+		0, 21, 0, 2, 0, 2, // DeleteRecords v2
+		0, 22, 0, 4, 0, 4, // InitProducerId v4
+		0, 23, 0, 4, 0, 4, // OffsetForLeaderEpoch v4
+		0, 24, 0, 3, 0, 3, // AddPartitionsToTxn v3
+		0, 25, 0, 3, 0, 3, // AddOffsetsToTxn v3
+		0, 26, 0, 3, 0, 3, // EndTxn v3
+		0, 27, 0, 1, 0, 1, // WriteTxnMarkers v1
+		0, 28, 0, 3, 0, 3, // TxnOffsetCommit v3
+		0, 29, 0, 3, 0, 3, // DescribeAcls v3
+		0, 30, 0, 3, 0, 3, // CreateAcls v3
+		0, 31, 0, 3, 0, 3, // DeleteAcls v3
+		0, 32, 0, 4, 0, 4, // DescribeConfigs v4
+		0, 33, 0, 2, 0, 2, // AlterConfigs v2
+		0, 35, 0, 4, 0, 4, // DescribeLogDirs v4
+		0, 36, 0, 2, 0, 2, // SaslAuthenticate v2
+		0, 37, 0, 3, 0, 3, // CreatePartitions v3
+		0, 42, 0, 2, 0, 2, // DeleteGroups v2
+		0, 43, 0, 2, 0, 2, // ElectLeaders v2
+		0, 44, 0, 1, 0, 1, // IncrementalAlterConfigs v1
+		0, 45, 0, 0, 0, 0, // AlterPartitionReassignments v0
+		0, 46, 0, 0, 0, 0, // ListPartitionReassignments v0
+		0, 60, 0, 1, 0, 1, // DescribeCluster v1
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("ApiVersions v0 response =\n% x\nwant\n% x", got, want)
+	}
+}
+
+func TestApiVersionsUnsupportedVersion(t *testing.T) {
+	c := newTestServer(t).dial()
+	// An unsupported version is answered as v0, so any client can read it.
+	r := &cursor{b: c.roundTrip(requestFrame(apiKeyApiVersions, 99, 42, "test-client", nil))}
+	if corrID, _ := r.i32(); corrID != 42 {
+		t.Fatalf("correlation id %d, want 42", corrID)
+	}
+	if errCode, _ := r.i16(); errCode != errUnsupportedVer {
+		t.Fatalf("error code %d, want %d", errCode, errUnsupportedVer)
+	}
+	if n, err := r.i32(); err != nil || int(n) != len(supportedAPIs) {
+		t.Fatalf("%d api keys (%v), want %d", n, err, len(supportedAPIs))
+	}
+}
+
+func TestCorrelationIDsEchoed(t *testing.T) {
+	c := newTestServer(t).dial()
+	rng := rand.New(rand.NewPCG(97, 97))
+	// All 100 requests go out before any response is read, so responses
+	// have to come back in order with their own ids.
+	ids := make([]int32, 100)
+	for i := range ids {
+		ids[i] = int32(rng.Uint32())
+		switch i % 3 {
+		case 0:
+			c.send(requestFrame(apiKeyApiVersions, 0, ids[i], "test-client", nil))
+		case 1:
+			c.send(requestFrame(apiKeyApiVersions, 4, ids[i], "test-client", []byte{0, 0, 0}))
+		case 2:
+			// Metadata v12 for no topics: a flexible response header.
+			c.send(requestFrame(apiKeyMetadata, 12, ids[i], "test-client", []byte{1, 0, 0, 0}))
+		}
+	}
+	for i, want := range ids {
+		resp := c.receive()
+		if got := int32(binary.BigEndian.Uint32(resp)); got != want {
+			t.Fatalf("response %d has correlation id %d, want %d", i, got, want)
+		}
+	}
+}
+
+// writeCountingListener counts the writes to the connections it accepts.
+type writeCountingListener struct {
+	net.Listener
+	writes atomic.Int64
+}
+
+func (l *writeCountingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return writeCountingConn{conn, &l.writes}, nil
+}
+
+type writeCountingConn struct {
+	net.Conn
+	writes *atomic.Int64
+}
+
+func (c writeCountingConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+// BenchmarkPipelinedRequests has a client write depth ApiVersions requests
+// at once and then read the responses. writes/req is how many writes the
+// broker made per response: 1 when every response is written on its own,
+// less as the buffered writer coalesces a pipelined batch.
+func BenchmarkPipelinedRequests(b *testing.B) {
+	for _, depth := range []int{1, 16, 64} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			cl := &writeCountingListener{Listener: l}
+			c := newTestServerOn(b, cl).dial()
+			c.conn.SetDeadline(time.Time{})
+			var batch []byte
+			for i := range depth {
+				req := requestFrame(apiKeyApiVersions, 4, int32(i), "bench-client", []byte{0, 0, 0})
+				batch = binary.BigEndian.AppendUint32(batch, uint32(len(req)))
+				batch = append(batch, req...)
+			}
+			var requests int64
+			for b.Loop() {
+				if _, err := c.conn.Write(batch); err != nil {
+					b.Fatal(err)
+				}
+				for range depth {
+					c.receive()
+				}
+				requests += int64(depth)
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(requests), "ns/req")
+			b.ReportMetric(float64(cl.writes.Load())/float64(requests), "writes/req")
+		})
+	}
+}
+
+func TestServerShutsDown(t *testing.T) {
+	s := newTestServer(t)
+	c := s.dial()
+	c.call(apiKeyApiVersions, 4, []byte{0, 0, 0})
+	s.close()
+	if _, err := net.Dial("tcp", s.addr); err == nil {
+		t.Fatal("listener still accepting after shutdown")
+	}
+	// Open connections are closed too.
+	if _, err := c.conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection still open after shutdown")
+	}
+}
+
+// ----- non-flexible Metadata, Produce and Fetch -----
+
+func appendI32(b []byte, v int32) []byte { return binary.BigEndian.AppendUint32(b, uint32(v)) }
+
+func appendI64(b []byte, v int64) []byte { return binary.BigEndian.AppendUint64(b, uint64(v)) }
+
+// checkConsumed fails the test unless r has been read to the end.
+func checkConsumed(t testing.TB, r *cursor) {
+	t.Helper()
+	if r.off != len(r.b) {
+		t.Fatalf("%d of %d response bytes read", r.off, len(r.b))
+	}
+}
+
+// acceptRecorder is a listener that hands each connection it accepts to
+// conns as well.
+type acceptRecorder struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l acceptRecorder) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.conns <- conn
+	}
+	return conn, err
+}
+
+// sockopt reads a socket option of conn.
+func sockopt(t *testing.T, conn net.Conn, level, opt int) int {
+	t.Helper()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var optErr error
+	if err := raw.Control(func(fd uintptr) { v, optErr = syscall.GetsockoptInt(int(fd), level, opt) }); err != nil {
+		t.Fatal(err)
+	}
+	if optErr != nil {
+		t.Fatal(optErr)
+	}
+	return v
+}
+
+// Accepted connections get TCP_NODELAY and keepalives as the -tcp-nodelay
+// and -tcp-keepalive flags say. Go turns both on for every TCP connection,
+// so turning each off shows the flags are applied.
+func TestSocketOptions(t *testing.T) {
+	oldNoDelay, oldKeepAlive := tcpNoDelay, tcpKeepAlive
+	t.Cleanup(func() { tcpNoDelay, tcpKeepAlive = oldNoDelay, oldKeepAlive })
+
+	for _, tc := range []struct {
+		noDelay   bool
+		keepAlive time.Duration
+	}{
+		{false, 30 * time.Second},
+		{true, 0},
+	} {
+		tcpNoDelay, tcpKeepAlive = tc.noDelay, tc.keepAlive
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := acceptRecorder{l, make(chan net.Conn, 1)}
+		newTestServerOn(t, rec).dial().call(apiKeyApiVersions, 0, nil) // the options are set before the first request is read
+		conn := <-rec.conns
+
+		noDelay := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0
+		keepAlive := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0
+		if noDelay != tc.noDelay || keepAlive != (tc.keepAlive > 0) {
+			t.Errorf("-tcp-nodelay=%v -tcp-keepalive=%v: TCP_NODELAY %v, SO_KEEPALIVE %v", tc.noDelay, tc.keepAlive, noDelay, keepAlive)
+		}
+	}
+}
+
+func TestMetadataV8RoundTrip(t *testing.T) {
+	s := newTestServer(t)
+	if _, err := store.createTopic("orders", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	body := appendI32(nil, 2)
+	body = appendStr16(body, "orders")
+	body = appendStr16(body, "missing")
+	body = append(body, 0, 0, 0) // allow_auto_topic_creation, include_cluster/topic_authorized_operations
+	r := s.dial().call(apiKeyMetadata, 8, body)
+
+	r.i32() // throttle_time_ms
+	if n, _, _ := r.arrayLenFor(false); n != 1 {
+		t.Fatalf("%d brokers, want 1", n)
+	}
+	r.i32() // node_id
+	host, _ := r.str16()
+	port, _ := r.i32()
+	if rack, _ := r.i16(); net.JoinHostPort(host, fmt.Sprint(port)) != s.addr || rack != -1 {
+		t.Fatalf("broker %s:%d rack length %d, want %s and a null rack", host, port, rack, s.addr)
+	}
+	if id, _ := r.str16(); id != clusterID {
+		t.Fatalf("cluster id %q, want %q", id, clusterID)
+	}
+	r.i32() // controller_id
+	if n, _, _ := r.arrayLenFor(false); n != 2 {
+		t.Fatalf("%d topics, want 2", n)
+	}
+	for _, want := range []struct {
+		name    string
+		errCode int16
+		parts   int
+	}{{"orders", errNone, 2}, {"missing", errUnknownTopicOrPartition, 0}} {
+		errCode, _ := r.i16()
+		name, _ := r.str16()
+		r.boolean() // is_internal
+		n, _, _ := r.arrayLenFor(false)
+		if name != want.name || errCode != want.errCode || n != want.parts {
+			t.Fatalf("topic %q: error %d, %d partitions; want %q: %d, %d", name, errCode, n, want.name, want.errCode, want.parts)
+		}
+		for i := 0; i < n; i++ {
+			r.i16() // error_code
+			if index, _ := r.i32(); index != int32(i) {
+				t.Fatalf("partition %d at position %d", index, i)
+			}
+			r.i32()       // leader_id
+			r.i32()       // leader_epoch
+			for range 3 { // replica_nodes, isr_nodes, offline_replicas
+				m, _, _ := r.arrayLenFor(false)
+				for range m {
+					r.i32()
+				}
+			}
+		}
+		r.i32() // topic_authorized_operations
+	}
+	if _, err := r.i32(); err != nil { // cluster_authorized_operations, v8-v10 only
+		t.Fatal(err)
+	}
+	checkConsumed(t, r)
+}
+
+func TestProduceV8FetchV11RoundTrip(t *testing.T) {
+	s := newTestServer(t)
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	c := s.dial()
+	batch := encodeRecordBatch(recordBatch{producerID: -1, baseSequence: -1, records: []record{
+		{key: []byte("k"), value: []byte("v8")},
+	}})
+
+	body := binary.BigEndian.AppendUint16(nil, 0xffff) // transactional_id: null
+	body = binary.BigEndian.AppendUint16(body, 1)      // acks
+	body = appendI32(body, 1000)                       // timeout_ms
+	body = appendI32(body, 1)
+	body = appendStr16(body, "orders")
+	body = appendI32(body, 1)
+	body = appendI32(body, 0) // index
+	body = appendI32(body, int32(len(batch)))
+	body = append(body, batch...)
+	r := c.call(apiKeyProduce, 8, body)
+	if n, _, _ := r.arrayLenFor(false); n != 1 {
+		t.Fatalf("%d topics, want 1", n)
+	}
+	if name, _ := r.str16(); name != "orders" {
+		t.Fatalf("topic %q, want orders", name)
+	}
+	if n, _, _ := r.arrayLenFor(false); n != 1 {
+		t.Fatalf("%d partitions, want 1", n)
+	}
+	r.i32() // index
+	errCode, _ := r.i16()
+	baseOffset, _ := r.i64()
+	if errCode != errNone || baseOffset != 0 {
+		t.Fatalf("produce: error %d, base offset %d", errCode, baseOffset)
+	}
+	r.i64() // log_append_time_ms
+	r.i64() // log_start_offset
+	if n, _, _ := r.arrayLenFor(false); n != 0 {
+		t.Fatalf("%d record errors", n)
+	}
+	if l, _ := r.i16(); l != -1 {
+		t.Fatalf("error message length %d, want null", l)
+	}
+	r.i32() // throttle_time_ms
+	checkConsumed(t, r)
+
+	body = appendI32(nil, -1) // replica_id
+	body = appendI32(body, 0) // max_wait_ms
+	body = appendI32(body, 0) // min_bytes
+	body = appendI32(body, 1<<20)
+	body = append(body, 0)    // isolation_level
+	body = appendI32(body, 0) // session_id
+	body = appendI32(body, -1)
+	body = appendI32(body, 1)
+	body = appendStr16(body, "orders")
+	body = appendI32(body, 1)
+	body = appendI32(body, 0)  // partition
+	body = appendI32(body, -1) // current_leader_epoch
+	body = appendI64(body, 0)  // fetch_offset
+	body = appendI64(body, -1) // log_start_offset
+	body = appendI32(body, 1<<20)
+	body = appendI32(body, 0)    // forgotten_topics_data
+	body = appendStr16(body, "") // rack_id
+	r = c.call(apiKeyFetch, 11, body)
+	r.i32() // throttle_time_ms
+	if errCode, _ := r.i16(); errCode != errNone {
+		t.Fatalf("fetch error %d", errCode)
+	}
+	r.i32() // session_id
+	if n, _, _ := r.arrayLenFor(false); n != 1 {
+		t.Fatalf("%d topics, want 1", n)
+	}
+	if name, _ := r.str16(); name != "orders" {
+		t.Fatalf("topic %q, want orders", name)
+	}
+	if n, _, _ := r.arrayLenFor(false); n != 1 {
+		t.Fatalf("%d partitions, want 1", n)
+	}
+	r.i32() // partition_index
+	errCode, _ = r.i16()
+	hwm, _ := r.i64()
+	if errCode != errNone || hwm != 1 {
+		t.Fatalf("fetch partition: error %d, high watermark %d", errCode, hwm)
+	}
+	r.i64() // last_stable_offset
+	r.i64() // log_start_offset
+	if n, _, _ := r.arrayLenFor(false); n > 0 {
+		t.Fatalf("%d aborted transactions", n)
+	}
+	r.i32() // preferred_read_replica
+	records, err := r.recordsFor(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkConsumed(t, r)
+	rb, err := decodeRecordBatch(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rb.records) != 1 || string(rb.records[0].value) != "v8" {
+		t.Fatalf("fetched %+v, want the produced record", rb.records)
+	}
+}
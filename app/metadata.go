@@ -0,0 +1,169 @@
+package main
+
+import "errors"
+
+// ----- Metadata (api key 3) -----
+
+type metadataTopic struct {
+	errCode      int16
+	name         string
+	topicID      [16]byte
+	partitions   []int32
+	leaderEpochs []int32 // by position in partitions
+}
+
+func init() {
+	registerHandler(apiKeyMetadata, handleMetadata)
+}
+
+// handleMetadata parses a v8-v12 Metadata request: v9 made it flexible,
+// v10 lets topics be named by id and v11 dropped
+// include_cluster_authorized_operations. A null topic array asks for every
+// known topic; unknown topics are auto-created with defaultPartitions when
+// the client allows it.
+func handleMetadata(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	flexible := isFlexible(apiKeyMetadata, apiVer)
+	nTopics, allTopicsRequested, err := c.arrayLenFor(flexible)
+	if err != nil {
+		return nil, err
+	}
+	var requested []metadataTopic
+	for i := 0; i < nTopics; i++ {
+		var id [16]byte
+		if apiVer >= 10 {
+			if id, err = c.uuid(); err != nil {
+				return nil, err
+			}
+		}
+		name, err := c.stringFor(flexible)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.tagsFor(flexible); err != nil {
+			return nil, err
+		}
+		requested = append(requested, metadataTopic{name: name, topicID: id})
+	}
+	autoCreate, err := c.boolean() // allow_auto_topic_creation
+	if err != nil {
+		return nil, err
+	}
+	if apiVer < 11 {
+		if _, err := c.boolean(); err != nil { // include_cluster_authorized_operations
+			return nil, err
+		}
+	}
+	if _, err := c.boolean(); err != nil { // include_topic_authorized_operations
+		return nil, err
+	}
+	if err := c.tagsFor(flexible); err != nil {
+		return nil, err
+	}
+
+	if allTopicsRequested {
+		// Topics the client may not describe are left out.
+		for _, name := range store.topicNames() {
+			if authz.authorize(sess.kafkaPrincipal(), aclOpDescribe, aclResourceTopic, name) {
+				requested = append(requested, metadataTopic{name: name})
+			}
+		}
+	}
+	topics := make([]metadataTopic, 0, len(requested))
+	for _, t := range requested {
+		// A topic may be asked for by id instead of by name.
+		if t.name == "" && t.topicID != ([16]byte{}) {
+			if t.name = store.topicByID(t.topicID); t.name == "" {
+				t.errCode = errUnknownTopicID
+				topics = append(topics, t)
+				continue
+			}
+		}
+		if !allTopicsRequested && !sess.authorized(aclOpDescribe, aclResourceTopic, t.name) {
+			t.errCode = errTopicAuthorizationFailed
+			topics = append(topics, t)
+			continue
+		}
+		parts := store.partitions(t.name)
+		if parts == nil && autoCreate && autoCreateTopics && t.name != "" && sess.canCreateTopic(t.name) {
+			if _, err := store.createTopic(t.name, defaultPartitions, nil); err != nil {
+				if !errors.Is(err, errInvalidTopicName) {
+					sess.log.Error("failed to create topic", "topic", t.name, "correlation_id", corrID, "err", err)
+				}
+				t.errCode = kafkaErrorCode(err)
+			}
+			parts = store.partitions(t.name)
+		}
+		t.partitions, t.topicID = parts, store.topicID(t.name)
+		for _, p := range parts {
+			t.leaderEpochs = append(t.leaderEpochs, store.leaderEpoch(t.name, p))
+		}
+		if parts == nil && t.errCode == errNone {
+			t.errCode = errUnknownTopicOrPartition
+		}
+		topics = append(topics, t)
+	}
+	return buildMetadataResponse(corrID, apiVer, topics), nil
+}
+
+func buildMetadataResponse(corrID int32, apiVer int16, topics []metadataTopic) []byte {
+	// Body (v8, flex v9+):
+	// throttle_time_ms (INT32)
+	// brokers (ARRAY) -> {node_id, host, port, rack, TAGS}
+	// cluster_id (NULLABLE_STRING), controller_id (INT32)
+	// topics (ARRAY) -> {error_code, name, topic_id (v10+), is_internal,
+	//                    partitions (ARRAY), topic_authorized_operations, TAGS}
+	//   partitions -> {error_code, partition_index, leader_id, leader_epoch,
+	//                  replica_nodes, isr_nodes, offline_replicas, TAGS}
+	// cluster_authorized_operations (INT32, v8-v10)
+	// response TAG_BUFFER count = 0
+	// Arrays and strings are compact, and TAGS present, in flexible versions.
+	flexible := isFlexible(apiKeyMetadata, apiVer)
+	host, port := advertisedHostPort()
+
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+
+	r.putArrayLenFor(flexible, 1) // this broker only
+	r.putI32(brokerID)
+	r.putStringFor(flexible, host)
+	r.putI32(port)
+	r.putNullableStringFor(flexible, "") // rack: null
+	r.putTagsFor(flexible)
+
+	r.putNullableStringFor(flexible, clusterID)
+	r.putI32(brokerID) // controller_id
+
+	r.putArrayLenFor(flexible, len(topics))
+	for _, t := range topics {
+		r.putI16(t.errCode)
+		if apiVer >= 12 {
+			r.putCompactNullableString(t.name)
+		} else {
+			r.putStringFor(flexible, t.name)
+		}
+		if apiVer >= 10 {
+			r.putUUID(t.topicID)
+		}
+		r.putBool(t.name == offsetsTopic) // is_internal
+		r.putArrayLenFor(flexible, len(t.partitions))
+		for i, p := range t.partitions {
+			r.putI16(errNone)
+			r.putI32(p)
+			r.putI32(brokerID) // leader_id
+			r.putI32(t.leaderEpochs[i])
+			r.putArrayLenFor(flexible, 1) // replica_nodes
+			r.putI32(brokerID)
+			r.putArrayLenFor(flexible, 1) // isr_nodes
+			r.putI32(brokerID)
+			r.putArrayLenFor(flexible, 0) // offline_replicas
+			r.putTagsFor(flexible)
+		}
+		r.putI32(-2147483648) // topic_authorized_operations: unknown
+		r.putTagsFor(flexible)
+	}
+	if apiVer < 11 {
+		r.putI32(-2147483648) // cluster_authorized_operations: unknown
+	}
+	r.putTagsFor(flexible)
+	return r.finish(corrID, responseHeaderVersion(apiKeyMetadata, apiVer))
+}
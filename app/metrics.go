@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ----- metrics -----
+
+// The broker counts what goes through handleConn and, when the
+// -metrics-listen flag is set, serves the counts over HTTP at /metrics in
+// Prometheus' text exposition format. They are served on their own port so
+// the Kafka port only ever speaks the Kafka protocol.
+
+// metricsAPIKeys is one more than the largest api key tracked per key;
+// requests with other keys are only counted in the totals.
+const metricsAPIKeys = 128
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram buckets. Blocking requests (a long-polling Fetch, a JoinGroup)
+// land in the top ones.
+var latencyBuckets = [...]float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30}
+
+// histogram counts observations into latencyBuckets, plus one bucket for
+// those above the last bound.
+type histogram struct {
+	buckets [len(latencyBuckets) + 1]atomic.Uint64
+	count   atomic.Uint64
+	sumNS   atomic.Uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	secs := d.Seconds()
+	i := 0
+	for i < len(latencyBuckets) && secs > latencyBuckets[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	h.sumNS.Add(uint64(d))
+}
+
+var metrics struct {
+	requests          [metricsAPIKeys]atomic.Uint64
+	latency           [metricsAPIKeys]histogram
+	decodeErrors      atomic.Uint64
+	bytesIn, bytesOut atomic.Uint64
+	activeConns       atomic.Int64
+	rejectedConns     atomic.Uint64
+}
+
+// recordRequest counts a request that has been read off a connection.
+func recordRequest(apiKey int16) {
+	if apiKey >= 0 && apiKey < metricsAPIKeys {
+		metrics.requests[apiKey].Add(1)
+	}
+}
+
+// recordLatency records how long a handler took to answer a request.
+func recordLatency(apiKey int16, d time.Duration) {
+	if apiKey >= 0 && apiKey < metricsAPIKeys {
+		metrics.latency[apiKey].observe(d)
+	}
+}
+
+// serveMetrics serves /metrics on addr until the listener fails.
+func serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w)
+	})
+	return http.ListenAndServe(addr, mux)
+}
+
+// writeMetrics writes every metric in the text exposition format.
+func writeMetrics(out io.Writer) {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "# HELP kafka_requests_total Requests read, by API key.")
+	fmt.Fprintln(w, "# TYPE kafka_requests_total counter")
+	for k := range metrics.requests {
+		if n := metrics.requests[k].Load(); n > 0 {
+			fmt.Fprintf(w, "kafka_requests_total{api_key=\"%d\"} %d\n", k, n)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP kafka_request_decode_errors_total Requests whose header or body could not be decoded.")
+	fmt.Fprintln(w, "# TYPE kafka_request_decode_errors_total counter")
+	fmt.Fprintln(w, "kafka_request_decode_errors_total", metrics.decodeErrors.Load())
+
+	fmt.Fprintln(w, "# HELP kafka_received_bytes_total Bytes of request frames read.")
+	fmt.Fprintln(w, "# TYPE kafka_received_bytes_total counter")
+	fmt.Fprintln(w, "kafka_received_bytes_total", metrics.bytesIn.Load())
+
+	fmt.Fprintln(w, "# HELP kafka_sent_bytes_total Bytes of response frames written.")
+	fmt.Fprintln(w, "# TYPE kafka_sent_bytes_total counter")
+	fmt.Fprintln(w, "kafka_sent_bytes_total", metrics.bytesOut.Load())
+
+	fmt.Fprintln(w, "# HELP kafka_active_connections Open client connections.")
+	fmt.Fprintln(w, "# TYPE kafka_active_connections gauge")
+	fmt.Fprintln(w, "kafka_active_connections", metrics.activeConns.Load())
+
+	fmt.Fprintln(w, "# HELP kafka_rejected_connections_total Connections closed on accept for exceeding -max-connections.")
+	fmt.Fprintln(w, "# TYPE kafka_rejected_connections_total counter")
+	fmt.Fprintln(w, "kafka_rejected_connections_total", metrics.rejectedConns.Load())
+
+	fmt.Fprintln(w, "# HELP kafka_request_duration_seconds Time from decoding a request to its response being ready, by API key.")
+	fmt.Fprintln(w, "# TYPE kafka_request_duration_seconds histogram")
+	for k := range metrics.latency {
+		h := &metrics.latency[k]
+		if h.count.Load() == 0 {
+			continue
+		}
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.buckets[i].Load()
+			fmt.Fprintf(w, "kafka_request_duration_seconds_bucket{api_key=\"%d\",le=\"%s\"} %d\n",
+				k, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		// The count comes from the buckets too, so it can't disagree with
+		// them when requests finish mid-scrape.
+		cumulative += h.buckets[len(latencyBuckets)].Load()
+		fmt.Fprintf(w, "kafka_request_duration_seconds_bucket{api_key=\"%d\",le=\"+Inf\"} %d\n", k, cumulative)
+		fmt.Fprintf(w, "kafka_request_duration_seconds_sum{api_key=\"%d\"} %s\n",
+			k, strconv.FormatFloat(time.Duration(h.sumNS.Load()).Seconds(), 'g', -1, 64))
+		fmt.Fprintf(w, "kafka_request_duration_seconds_count{api_key=\"%d\"} %d\n", k, cumulative)
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+	"unicode/utf16"
+)
+
+// ----- committed offsets -----
+
+// Kafka's offset.metadata.max.bytes default.
+const maxOffsetMetadata = 4096
+
+// offsetsTopic is the internal topic committed offsets are written to, as
+// in Kafka: one compacted record per group and partition, keyed by both, in
+// Kafka's own record format so that tools reading it directly understand
+// it. Each group's offsets go to one of its partitions (see
+// offsetsPartition). The coordinator keeps the latest offsets in memory and
+// only reads the topic back on start.
+const (
+	offsetsTopic           = "__consumer_offsets"
+	offsetsTopicPartitions = 50 // Kafka's offsets.topic.num.partitions default
+)
+
+// legacyOffsetsFileName is where committed offsets were kept, as JSON
+// lines, before they went to offsetsTopic. It is read once and removed.
+const legacyOffsetsFileName = "__consumer_offsets.jsonl"
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+type committedOffset struct {
+	offset      int64
+	leaderEpoch int32
+	metadata    string
+}
+
+// partitionOffset is one partition of an OffsetCommit or OffsetFetch.
+type partitionOffset struct {
+	topic       string
+	partition   int32
+	offset      int64
+	leaderEpoch int32
+	metadata    string
+	errCode     int16
+}
+
+// offsetsPartition returns the partition of offsetsTopic holding groupID's
+// offsets: like Kafka, the group id's Java hashCode modulo n.
+func offsetsPartition(groupID string, n int) int32 {
+	var h int32
+	for _, u := range utf16.Encode([]rune(groupID)) {
+		h = 31*h + int32(u)
+	}
+	return int32(int(h&0x7fffffff) % n)
+}
+
+// Offset commit record layouts: the key is {version int16 (0 or 1), group
+// STRING, topic STRING, partition int32}; the value, null for a deleted
+// offset, is {version int16, offset int64, leader_epoch int32 (v3),
+// metadata STRING, commit_timestamp int64, expire_timestamp int64 (v1)},
+// v0 having a timestamp where later versions have commit_timestamp. Key
+// version 2 is a group metadata record, which we don't write.
+const (
+	offsetCommitKeyVersion   = int16(1)
+	offsetCommitValueVersion = int16(3)
+)
+
+func encodeOffsetKey(groupID string, tp topicPartition) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(offsetCommitKeyVersion))
+	b = appendString(b, groupID)
+	b = appendString(b, tp.topic)
+	return binary.BigEndian.AppendUint32(b, uint32(tp.partition))
+}
+
+func encodeOffsetValue(co committedOffset, now time.Time) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(offsetCommitValueVersion))
+	b = binary.BigEndian.AppendUint64(b, uint64(co.offset))
+	b = binary.BigEndian.AppendUint32(b, uint32(co.leaderEpoch))
+	b = appendString(b, co.metadata)
+	return binary.BigEndian.AppendUint64(b, uint64(now.UnixMilli()))
+}
+
+// appendString appends a STRING: int16 length then bytes.
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// decodeOffsetKey parses an offset commit key; ok is false for the other
+// record types sharing the topic.
+func decodeOffsetKey(b []byte) (groupID string, tp topicPartition, ok bool, err error) {
+	c := &cursor{b: b}
+	version, err := c.i16()
+	if err != nil || version > 1 {
+		return "", tp, false, err
+	}
+	if groupID, err = c.str16(); err != nil {
+		return "", tp, false, err
+	}
+	if tp.topic, err = c.str16(); err != nil {
+		return "", tp, false, err
+	}
+	if tp.partition, err = c.i32(); err != nil {
+		return "", tp, false, err
+	}
+	return groupID, tp, true, nil
+}
+
+func decodeOffsetValue(b []byte) (committedOffset, error) {
+	co := committedOffset{leaderEpoch: -1}
+	c := &cursor{b: b}
+	version, err := c.i16()
+	if err != nil {
+		return co, err
+	}
+	if version < 0 || version > 3 {
+		return co, fmt.Errorf("offset commit value version %d", version)
+	}
+	if co.offset, err = c.i64(); err != nil {
+		return co, err
+	}
+	if version >= 3 {
+		if co.leaderEpoch, err = c.i32(); err != nil {
+			return co, err
+		}
+	}
+	co.metadata, err = c.str16()
+	return co, err
+}
+
+// openOffsetsTopic makes s hold gc's committed offsets, creating
+// offsetsTopic in it if need be and loading the offsets a previous run
+// committed there. dir is the data directory, if any, which may still hold
+// offsets in the legacy file; they are moved to the topic.
+func (gc *groupCoordinator) openOffsetsTopic(s *logStore, dir string) error {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	if _, err := s.createTopic(offsetsTopic, offsetsTopicPartitions, map[string]string{"cleanup.policy": "compact"}); err != nil {
+		return err
+	}
+	gc.offsetsLog = s
+	n := len(s.partitions(offsetsTopic))
+	for p := 0; p < n; p++ {
+		if err := s.forEachRecord(offsetsTopic, int32(p), gc.replayOffsetRecordLocked); err != nil {
+			return fmt.Errorf("load %s-%d: %w", offsetsTopic, p, err)
+		}
+	}
+	if dir == "" {
+		return nil
+	}
+	path := filepath.Join(dir, legacyOffsetsFileName)
+	legacy, err := readLegacyOffsets(path)
+	if err != nil {
+		return fmt.Errorf("load %s: %w", legacyOffsetsFileName, err)
+	}
+	for groupID, offsets := range legacy {
+		g := gc.groups[groupID]
+		if g == nil {
+			g = newGroup(groupID)
+			gc.groups[groupID] = g
+		}
+		var recs []record
+		for tp, co := range offsets {
+			g.offsets[tp] = co
+			recs = append(recs, record{key: encodeOffsetKey(groupID, tp), value: encodeOffsetValue(co, time.Now())})
+		}
+		if err := gc.writeOffsetRecordsLocked(groupID, recs); err != nil {
+			return err
+		}
+	}
+	if legacy != nil {
+		return os.Remove(path)
+	}
+	return nil
+}
+
+// replayOffsetRecordLocked applies one record read back from offsetsTopic.
+// Caller holds mu.
+func (gc *groupCoordinator) replayOffsetRecordLocked(r record) error {
+	groupID, tp, ok, err := decodeOffsetKey(r.key)
+	if err != nil || !ok {
+		return err
+	}
+	g := gc.groups[groupID]
+	if r.value == nil {
+		if g != nil {
+			delete(g.offsets, tp)
+			if len(g.offsets) == 0 {
+				delete(gc.groups, groupID)
+			}
+		}
+		return nil
+	}
+	co, err := decodeOffsetValue(r.value)
+	if err != nil {
+		return err
+	}
+	if g == nil {
+		g = newGroup(groupID)
+		gc.groups[groupID] = g
+	}
+	g.offsets[tp] = co
+	return nil
+}
+
+// readLegacyOffsets replays the legacy offsets file at path, returning nil
+// if there is none. A torn last line, e.g. from a crash mid-write, is
+// ignored.
+func readLegacyOffsets(path string) (map[string]map[topicPartition]committedOffset, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	groups := map[string]map[topicPartition]committedOffset{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var rec struct {
+			Group       string `json:"group"`
+			Topic       string `json:"topic,omitempty"`
+			Partition   int32  `json:"partition"`
+			Offset      int64  `json:"offset"`
+			LeaderEpoch int32  `json:"leader_epoch"`
+			Metadata    string `json:"metadata,omitempty"`
+			Delete      bool   `json:"delete,omitempty"` // drops every offset of Group
+		}
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			continue
+		}
+		if rec.Delete {
+			delete(groups, rec.Group)
+			continue
+		}
+		if groups[rec.Group] == nil {
+			groups[rec.Group] = map[topicPartition]committedOffset{}
+		}
+		groups[rec.Group][topicPartition{rec.Topic, rec.Partition}] = committedOffset{rec.Offset, rec.LeaderEpoch, rec.Metadata}
+	}
+	return groups, sc.Err()
+}
+
+// writeOffsetRecordsLocked appends recs, all for groupID, to groupID's
+// partition of offsetsTopic in one batch, when the coordinator has one.
+// Caller holds mu.
+func (gc *groupCoordinator) writeOffsetRecordsLocked(groupID string, recs []record) error {
+	if gc.offsetsLog == nil || len(recs) == 0 {
+		return nil
+	}
+	for i := range recs {
+		recs[i].offsetDelta = int32(i)
+	}
+	now := time.Now().UnixMilli()
+	batch := encodeRecordBatch(recordBatch{
+		partitionLeaderEpoch: -1,
+		lastOffsetDelta:      int32(len(recs) - 1),
+		baseTimestamp:        now,
+		maxTimestamp:         now,
+		producerID:           -1,
+		producerEpoch:        -1,
+		baseSequence:         -1,
+		records:              recs,
+	})
+	n := len(gc.offsetsLog.partitions(offsetsTopic))
+	if n == 0 {
+		return errNoSuchPartition
+	}
+	_, err := gc.offsetsLog.append(offsetsTopic, offsetsPartition(groupID, n), batch)
+	return err
+}
+
+// commitOffsets stores the offsets in parts for a group, setting each part's
+// errCode. Members commit within their current generation; a client not
+// using group management commits with generation -1 and no member id to a
+// group that has no members.
+func (gc *groupCoordinator) commitOffsets(groupID, memberID, instanceID string, generation int32, parts []partitionOffset) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	if gc.checkCommitLocked(groupID, memberID, instanceID, generation, parts) == errNone {
+		gc.storeOffsetsLocked(groupID, parts)
+	}
+}
+
+// checkCommit sets the errCode of each part commitOffsets would refuse,
+// without storing any. TxnOffsetCommit checks its offsets this way when
+// they arrive, and stores them only once the transaction commits.
+func (gc *groupCoordinator) checkCommit(groupID, memberID, instanceID string, generation int32, parts []partitionOffset) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	gc.checkCommitLocked(groupID, memberID, instanceID, generation, parts)
+}
+
+// checkCommitLocked is checkCommit, returning the error refusing the whole
+// commit, if any. Caller holds mu.
+func (gc *groupCoordinator) checkCommitLocked(groupID, memberID, instanceID string, generation int32, parts []partitionOffset) int16 {
+	g := gc.groups[groupID]
+	errCode := errNone
+	switch {
+	case groupID == "":
+		errCode = errInvalidGroupID
+	case g == nil && generation < 0 && memberID == "":
+		// Standalone commit; storeOffsetsLocked creates the group.
+	case g == nil:
+		errCode = errIllegalGeneration
+	case g.fenced(memberID, instanceID):
+		errCode = errFencedInstanceID
+	case generation < 0 && memberID == "" && len(g.members) == 0:
+		// Standalone commit to an empty group.
+	case g.members[memberID] == nil:
+		errCode = errUnknownMemberID
+	case generation != g.generation:
+		errCode = errIllegalGeneration
+	case g.state == groupCompletingRebalance:
+		errCode = errRebalanceInProgress
+	}
+
+	for i := range parts {
+		p := &parts[i]
+		switch {
+		case p.errCode != errNone:
+			// Refused by the handler, e.g. for authorization.
+		case errCode != errNone:
+			p.errCode = errCode
+		case len(p.metadata) > maxOffsetMetadata:
+			p.errCode = errOffsetMetadataTooLarge
+		case !store.hasPartition(p.topic, p.partition):
+			p.errCode = errUnknownTopicOrPartition
+		}
+	}
+	return errCode
+}
+
+// commitTxnOffsets stores the offsets a committed transaction holds for
+// groupID. They were checked by checkCommit when they arrived.
+func (gc *groupCoordinator) commitTxnOffsets(groupID string, parts []partitionOffset) error {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	return gc.storeOffsetsLocked(groupID, parts)
+}
+
+// storeOffsetsLocked stores the parts without an errCode as groupID's
+// committed offsets, creating the group if need be. If they can't be
+// persisted those parts fail with UNKNOWN_SERVER_ERROR. Caller holds mu.
+func (gc *groupCoordinator) storeOffsetsLocked(groupID string, parts []partitionOffset) error {
+	g := gc.groups[groupID]
+	if g == nil {
+		g = newGroup(groupID)
+		gc.groups[groupID] = g
+	}
+	var recs []record
+	for _, p := range parts {
+		if p.errCode != errNone {
+			continue
+		}
+		tp, co := topicPartition{p.topic, p.partition}, committedOffset{p.offset, p.leaderEpoch, p.metadata}
+		g.offsets[tp] = co
+		recs = append(recs, record{key: encodeOffsetKey(groupID, tp), value: encodeOffsetValue(co, time.Now())})
+	}
+	err := gc.writeOffsetRecordsLocked(groupID, recs)
+	if err != nil {
+		logger.Error("failed to persist offsets", "group", groupID, "err", err)
+		for i := range parts {
+			if parts[i].errCode == errNone {
+				parts[i].errCode = errUnknownServerError
+			}
+		}
+	}
+	return err
+}
+
+// fetchOffsets fills in the committed offset of each entry in parts, or -1
+// when there is none. A nil parts asks for every offset the group has
+// committed.
+func (gc *groupCoordinator) fetchOffsets(groupID string, parts []partitionOffset) []partitionOffset {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	g := gc.groups[groupID]
+	if parts == nil {
+		if g == nil {
+			return nil
+		}
+		for tp := range g.offsets {
+			parts = append(parts, partitionOffset{topic: tp.topic, partition: tp.partition})
+		}
+		sort.Slice(parts, func(i, j int) bool {
+			if parts[i].topic != parts[j].topic {
+				return parts[i].topic < parts[j].topic
+			}
+			return parts[i].partition < parts[j].partition
+		})
+	}
+	for i := range parts {
+		p := &parts[i]
+		p.offset, p.leaderEpoch, p.metadata = -1, -1, ""
+		if g == nil {
+			continue
+		}
+		if co, ok := g.offsets[topicPartition{p.topic, p.partition}]; ok {
+			p.offset, p.leaderEpoch, p.metadata = co.offset, co.leaderEpoch, co.metadata
+		}
+	}
+	return parts
+}
+
+// deleteGroup drops an empty group and its committed offsets, returning
+// NONE, NON_EMPTY_GROUP while it has members, or GROUP_ID_NOT_FOUND.
+func (gc *groupCoordinator) deleteGroup(groupID string) int16 {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	g := gc.groups[groupID]
+	switch {
+	case groupID == "":
+		return errInvalidGroupID
+	case g == nil:
+		return errGroupIDNotFound
+	case g.state != groupEmpty:
+		return errNonEmptyGroup
+	}
+	var tombstones []record
+	for tp := range g.offsets {
+		tombstones = append(tombstones, record{key: encodeOffsetKey(groupID, tp)})
+	}
+	if len(tombstones) > 0 {
+		if err := gc.writeOffsetRecordsLocked(groupID, tombstones); err != nil {
+			logger.Error("failed to persist offsets", "group", groupID, "err", err)
+			return errUnknownServerError
+		}
+	}
+	delete(gc.groups, groupID)
+	return errNone
+}
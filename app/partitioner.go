@@ -0,0 +1,45 @@
+package main
+
+// ----- key partitioning -----
+
+// murmur2 is the 32-bit MurmurHash2 Kafka's Java client hashes record keys
+// with (Utils.murmur2), seed included.
+func murmur2(data []byte) int32 {
+	const (
+		seed = uint32(0x9747b28c)
+		m    = uint32(0x5bd1e995)
+		r    = 24
+	)
+	h := seed ^ uint32(len(data))
+	n := len(data) / 4 * 4
+	for i := 0; i < n; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	switch len(data) % 4 {
+	case 3:
+		h ^= uint32(data[n+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[n+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[n])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// partitionForKey returns the partition of a topic with numPartitions
+// partitions that Kafka's default partitioner sends a record with key to,
+// so that records we route land where a client would have put them.
+func partitionForKey(key []byte, numPartitions int32) int32 {
+	return (murmur2(key) & 0x7fffffff) % numPartitions
+}
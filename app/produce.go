@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// ----- Produce (api key 0) -----
+
+// RecordBatch v2 header layout (offsets into the batch):
+//
+//	baseOffset int64 (0), batchLength int32 (8), partitionLeaderEpoch int32 (12),
+//	magic int8 (16), crc uint32 (17), attributes int16 (21), lastOffsetDelta int32 (23),
+//	baseTimestamp int64 (27), maxTimestamp int64 (35), producerId int64 (43),
+//	producerEpoch int16 (51), baseSequence int32 (53), recordsCount int32 (57)
+const (
+	batchLengthOffset        = 8
+	batchEpochOffset         = 12
+	batchMagicOffset         = 16
+	batchCRCOffset           = 17
+	batchAttrsOffset         = 21
+	batchLastDeltaOffset     = 23
+	batchMaxTimeOffset       = 35
+	batchProducerIDOffset    = 43
+	batchProducerEpochOffset = 51
+	batchBaseSequenceOffset  = 53
+	batchCountOffset         = 57
+	batchHeaderSize          = 61
+	batchLogOverhead         = 12 // baseOffset + batchLength
+	currentBatchMagic        = 2
+)
+
+var (
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+	errBadBatch = errors.New("malformed record batch")
+	errBadCRC   = errors.New("record batch crc mismatch")
+)
+
+type producePartitionResult struct {
+	index      int32
+	errCode    int16
+	baseOffset int64
+	logStart   int64
+}
+
+type produceTopicResult struct {
+	name       string
+	partitions []producePartitionResult
+}
+
+func init() {
+	registerHandler(apiKeyProduce, handleProduce)
+}
+
+// handleProduce parses a v8 or v9 Produce request (v9 is v8 made flexible)
+// and appends every partition's record batches to the log. It returns a nil
+// response for acks=0, where the client does not wait for a reply.
+func handleProduce(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	flexible := isFlexible(apiKeyProduce, apiVer)
+	if _, err := c.stringFor(flexible); err != nil { // transactional_id
+		return nil, err
+	}
+	acks, err := c.i16()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.i32(); err != nil { // timeout_ms
+		return nil, err
+	}
+
+	nTopics, _, err := c.arrayLenFor(flexible)
+	if err != nil {
+		return nil, err
+	}
+	var results []produceTopicResult
+	for i := 0; i < nTopics; i++ {
+		name, err := c.stringFor(flexible)
+		if err != nil {
+			return nil, err
+		}
+		nParts, _, err := c.arrayLenFor(flexible)
+		if err != nil {
+			return nil, err
+		}
+		tr := produceTopicResult{name: name}
+		allowed := sess.authorized(aclOpWrite, aclResourceTopic, name)
+		for j := 0; j < nParts; j++ {
+			index, err := c.i32()
+			if err != nil {
+				return nil, err
+			}
+			records, err := c.recordsFor(flexible)
+			if err != nil {
+				return nil, err
+			}
+			if err := c.tagsFor(flexible); err != nil {
+				return nil, err
+			}
+			if !allowed {
+				tr.partitions = append(tr.partitions, producePartitionResult{index: index, errCode: errTopicAuthorizationFailed, baseOffset: -1, logStart: -1})
+				continue
+			}
+			tr.partitions = append(tr.partitions, producePartition(name, index, acks, records, sess))
+		}
+		if err := c.tagsFor(flexible); err != nil {
+			return nil, err
+		}
+		results = append(results, tr)
+	}
+	if err := c.tagsFor(flexible); err != nil {
+		return nil, err
+	}
+
+	if acks == 0 {
+		return nil, nil
+	}
+	return buildProduceResponse(corrID, apiVer, results), nil
+}
+
+// producePartition validates every batch in records and, if all are intact,
+// appends them to the partition log, all or none. With acks=all (-1) they must also be
+// below the high watermark, i.e. replicated, before they are acknowledged.
+// An unknown topic is auto-created only if sess may create it. Store
+// failures are logged to sess's log.
+func producePartition(topic string, partition int32, acks int16, records []byte, sess *session) producePartitionResult {
+	res := producePartitionResult{index: partition, baseOffset: -1, logStart: -1}
+	if partition < 0 {
+		res.errCode = errUnknownTopicOrPartition
+		return res
+	}
+	// Only the group coordinator writes committed offsets.
+	if topic == offsetsTopic {
+		res.errCode = errInvalidTopic
+		return res
+	}
+
+	var batches [][]byte
+	var decoded []recordBatch
+	for len(records) > 0 {
+		batch, err := splitBatch(records)
+		if err != nil {
+			res.errCode = kafkaErrorCode(err)
+			return res
+		}
+		rb, err := decodeRecordBatch(batch)
+		if err != nil {
+			res.errCode = kafkaErrorCode(err)
+			return res
+		}
+		if n := len(rb.records); n == 0 || rb.records[n-1].offsetDelta != rb.lastOffsetDelta {
+			res.errCode = errInvalidRecord
+			return res
+		}
+		// Only the broker writes transaction markers.
+		if rb.attributes&batchControl != 0 {
+			res.errCode = errInvalidRecord
+			return res
+		}
+		batches = append(batches, batch)
+		decoded = append(decoded, rb)
+		records = records[len(batch):]
+	}
+
+	// With autoCreateTopics, producing to an unknown topic creates it with
+	// the default partition count; a partition past that is then unknown,
+	// as it is for any existing topic.
+	if store.partitions(topic) == nil {
+		if !autoCreateTopics || !sess.canCreateTopic(topic) {
+			res.errCode = errUnknownTopicOrPartition
+			return res
+		}
+		if _, err := store.createTopic(topic, defaultPartitions, nil); err != nil {
+			if !errors.Is(err, errInvalidTopicName) {
+				sess.log.Error("failed to create topic", "topic", topic, "err", err)
+			}
+			res.errCode = kafkaErrorCode(err)
+			return res
+		}
+	}
+	// A topic whose compression.type names a codec stores every batch in
+	// it, recompressing those the producer sent otherwise.
+	if codec, ok := store.compressionCodec(topic); ok {
+		for i, rb := range decoded {
+			if rb.codec() == codec {
+				continue
+			}
+			b, err := encodeCompressedRecordBatch(rb, codec)
+			if err != nil {
+				sess.log.Error("failed to recompress batch", "topic", topic, "codec", codec, "err", err)
+				res.errCode = errUnknownServerError
+				return res
+			}
+			batches[i] = b
+		}
+	}
+	base, logStart, err := store.appendBatches(topic, partition, batches)
+	if err != nil {
+		// A retried batch is answered with where it went the first time.
+		if errors.Is(err, errDuplicateSequence) {
+			res.baseOffset = base
+		}
+		res.errCode = kafkaErrorCode(err)
+		return res
+	}
+	res.baseOffset, res.logStart = base, logStart
+	end := base
+	for _, b := range batches {
+		end += int64(int32(binary.BigEndian.Uint32(b[batchLastDeltaOffset:]))) + 1
+	}
+	if acks == -1 {
+		if hwm, err := store.highWatermark(topic, partition); err != nil || hwm < end {
+			res.errCode = errNotEnoughReplicasAppend
+		}
+	}
+	return res
+}
+
+// splitBatch returns the first record batch in b, validating its length,
+// magic byte and CRC-32C.
+func splitBatch(b []byte) ([]byte, error) {
+	if len(b) < batchHeaderSize {
+		return nil, errBadBatch
+	}
+	length := int32(binary.BigEndian.Uint32(b[batchLengthOffset:]))
+	size := batchLogOverhead + int(length)
+	if length < 0 || size < batchHeaderSize || size > len(b) {
+		return nil, errBadBatch
+	}
+	batch := b[:size]
+	if batch[batchMagicOffset] != currentBatchMagic {
+		return nil, errBadBatch
+	}
+	if err := validateBatchCRC(batch); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// crc32c returns the CRC-32C (Castagnoli) checksum of b.
+func crc32c(b []byte) uint32 {
+	return crc32.Checksum(b, castagnoli)
+}
+
+// validateBatchCRC checks a batch's stored CRC, which covers everything from
+// attributes to the end of the batch.
+func validateBatchCRC(batch []byte) error {
+	if len(batch) < batchHeaderSize {
+		return errBadBatch
+	}
+	if crc32c(batch[batchAttrsOffset:]) != binary.BigEndian.Uint32(batch[batchCRCOffset:]) {
+		return errBadCRC
+	}
+	return nil
+}
+
+func buildProduceResponse(corrID int32, apiVer int16, results []produceTopicResult) []byte {
+	// Body (v8, flex v9):
+	// responses (ARRAY) -> {name, partition_responses (ARRAY), TAGS}
+	//   partition_responses -> {index, error_code, base_offset, log_append_time_ms,
+	//                           log_start_offset, record_errors, error_message, TAGS}
+	// throttle_time_ms (INT32) = 0
+	// response TAG_BUFFER count = 0
+	flexible := isFlexible(apiKeyProduce, apiVer)
+	var r respBuf
+	r.putArrayLenFor(flexible, len(results))
+	for _, tr := range results {
+		r.putStringFor(flexible, tr.name)
+		r.putArrayLenFor(flexible, len(tr.partitions))
+		for _, pr := range tr.partitions {
+			r.putI32(pr.index)
+			r.putI16(pr.errCode)
+			r.putI64(pr.baseOffset)
+			r.putI64(-1) // log_append_time_ms
+			r.putI64(pr.logStart)
+			r.putArrayLenFor(flexible, 0)        // record_errors
+			r.putNullableStringFor(flexible, "") // error_message: null
+			r.putTagsFor(flexible)
+		}
+		r.putTagsFor(flexible)
+	}
+	r.putI32(0) // throttle_time_ms
+	r.putTagsFor(flexible)
+	return r.finish(corrID, responseHeaderVersion(apiKeyProduce, apiVer))
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"testing"
+)
+
+// testBatch encodes an uncompressed batch holding one record per value,
+// from a producer without an id.
+func testBatch(values ...string) []byte {
+	return idempotentBatch(-1, -1, values...)
+}
+
+// idempotentBatch is testBatch from producerID, its first record numbered
+// seq.
+func idempotentBatch(producerID int64, seq int32, values ...string) []byte {
+	rb := recordBatch{producerID: producerID, baseSequence: seq, lastOffsetDelta: int32(len(values) - 1)}
+	for i, v := range values {
+		rb.records = append(rb.records, record{offsetDelta: int32(i), value: []byte(v)})
+	}
+	return encodeRecordBatch(rb)
+}
+
+// produceRequest encodes a v9 Produce request writing batches, back to back
+// in one record set, to topic/partition.
+func produceRequest(acks int16, topic string, partition int32, batches ...[]byte) []byte {
+	var req respBuf
+	req.putCompactNullableString("") // transactional_id
+	req.putI16(acks)
+	req.putI32(1000) // timeout_ms
+	req.putCompactArrayLen(1)
+	req.putCompactString(topic)
+	req.putCompactArrayLen(1)
+	req.putI32(partition)
+	req.putCompactRecords(batches)
+	req.putTags()
+	req.putTags()
+	req.putTags()
+	return req.b
+}
+
+// produce sends batches to topic/partition with acks=1 and returns what
+// the v9 response says about the partition.
+func (c *testConn) produce(topic string, partition int32, batches ...[]byte) producePartitionResult {
+	c.t.Helper()
+	res, _ := c.produceThrottled(topic, partition, batches...)
+	return res
+}
+
+// produceThrottled is produce, also returning the response's
+// throttle_time_ms.
+func (c *testConn) produceThrottled(topic string, partition int32, batches ...[]byte) (producePartitionResult, int32) {
+	c.t.Helper()
+	r := c.call(apiKeyProduce, 9, produceRequest(1, topic, partition, batches...))
+	if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+		c.t.Fatalf("%d topics (%v), want 1", n, err)
+	}
+	if name, _ := r.compactNullableString(); name != topic {
+		c.t.Fatalf("topic %q, want %q", name, topic)
+	}
+	if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+		c.t.Fatalf("%d partitions (%v), want 1", n, err)
+	}
+	var res producePartitionResult
+	res.index, _ = r.i32()
+	res.errCode, _ = r.i16()
+	res.baseOffset, _ = r.i64()
+	r.i64() // log_append_time_ms
+	res.logStart, _ = r.i64()
+	r.compactArrayLen()       // record_errors
+	r.compactNullableString() // error_message
+	r.skipTagged()
+	r.skipTagged()
+	throttleMs, _ := r.i32()
+	if err := r.skipTagged(); err != nil {
+		c.t.Fatal(err)
+	}
+	checkConsumed(c.t, r)
+	return res, throttleMs
+}
+
+func TestProduce(t *testing.T) {
+	c := newTestServer(t).dial()
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two batches in one record set go in back to back.
+	res := c.produce("orders", 0, testBatch("a", "b"), testBatch("c"))
+	if res.errCode != errNone || res.baseOffset != 0 || res.logStart != 0 {
+		t.Fatalf("produce = error %d at %d, log start %d; want offset 0, log start 0", res.errCode, res.baseOffset, res.logStart)
+	}
+	if res := c.produce("orders", 0, testBatch("d")); res.errCode != errNone || res.baseOffset != 3 {
+		t.Fatalf("second produce = error %d at %d, want offset 3", res.errCode, res.baseOffset)
+	}
+
+	// A batch whose CRC doesn't match is CORRUPT_MESSAGE, and not stored.
+	bad := testBatch("e")
+	bad[len(bad)-1] ^= 0xff
+	if res := c.produce("orders", 0, bad); res.errCode != errCorruptMessage || res.baseOffset != -1 {
+		t.Errorf("corrupt batch = error %d at %d, want %d", res.errCode, res.baseOffset, errCorruptMessage)
+	}
+
+	// acks=0 is never answered: the next response is the ApiVersions one.
+	c.send(requestFrame(apiKeyProduce, 9, 100, "test-client", produceRequest(0, "orders", 0, testBatch("f"))))
+	c.send(requestFrame(apiKeyApiVersions, 0, 101, "test-client", nil))
+	r := &cursor{b: c.receive()}
+	if corrID, _ := r.i32(); corrID != 101 {
+		t.Fatalf("response to correlation id %d, want the ApiVersions one (101)", corrID)
+	}
+	if hwm, _ := store.highWatermark("orders", 0); hwm != 5 {
+		t.Errorf("high watermark %d after the acks=0 produce, want 5", hwm)
+	}
+}
+
+// An idempotent producer's batches must come in sequence order. A retry of
+// one already stored is answered with its original offset and stored only
+// once.
+func TestProduceChecksSequenceNumbers(t *testing.T) {
+	c := newTestServer(t).dial()
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []struct {
+		what       string
+		seq        int32
+		values     []string
+		errCode    int16
+		baseOffset int64
+	}{
+		{"first batch", 0, []string{"a", "b"}, errNone, 0},
+		{"next batch", 2, []string{"c"}, errNone, 2},
+		{"retry of the first batch", 0, []string{"a", "b"}, errDuplicateSequenceNumber, 0},
+		{"retry of the last batch", 2, []string{"c"}, errDuplicateSequenceNumber, 2},
+		{"batch after a gap", 5, []string{"f"}, errOutOfOrderSequenceNumber, -1},
+		{"batch after the gap is filled", 3, []string{"d", "e"}, errNone, 3},
+	} {
+		res := c.produce("orders", 0, idempotentBatch(7, step.seq, step.values...))
+		if res.errCode != step.errCode || res.baseOffset != step.baseOffset {
+			t.Errorf("%s (sequence %d) = error %d at %d, want error %d at %d",
+				step.what, step.seq, res.errCode, res.baseOffset, step.errCode, step.baseOffset)
+		}
+	}
+	if hwm, _ := store.highWatermark("orders", 0); hwm != 5 {
+		t.Errorf("high watermark %d, want 5: each batch stored once", hwm)
+	}
+}
+
+// A rejected batch fails the partition's whole record set, so the batches
+// ahead of it aren't stored either and the client can retry all of them.
+func TestProduceIsAllOrNothing(t *testing.T) {
+	c := newTestServer(t).dial()
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if res := c.produce("orders", 0, idempotentBatch(7, 0, "a"), idempotentBatch(7, 2, "gap")); res.errCode != errOutOfOrderSequenceNumber {
+		t.Fatalf("produce with a sequence gap = error %d, want %d", res.errCode, errOutOfOrderSequenceNumber)
+	}
+	if hwm, _ := store.highWatermark("orders", 0); hwm != 0 {
+		t.Fatalf("high watermark %d after a rejected produce, want 0", hwm)
+	}
+	if res := c.produce("orders", 0, idempotentBatch(7, 0, "a"), idempotentBatch(7, 1, "b")); res.errCode != errNone || res.baseOffset != 0 {
+		t.Fatalf("retried produce = error %d at %d, want offset 0", res.errCode, res.baseOffset)
+	}
+}
+
+func TestProduceReturnsLogStartOffset(t *testing.T) {
+	c := newTestServer(t).dial()
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	c.produce("orders", 0, testBatch("a", "b", "c"))
+	if _, err := store.deleteRecords("orders", 0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if res := c.produce("orders", 0, testBatch("d")); res.errCode != errNone || res.logStart != 2 {
+		t.Errorf("produce after DeleteRecords = error %d, log start %d; want log start 2", res.errCode, res.logStart)
+	}
+}
+
+func TestProduceAutoCreatesDefaultPartitions(t *testing.T) {
+	newTestServer(t)
+	batch := testBatch("v")
+	sess := &session{log: slog.New(slog.DiscardHandler)}
+
+	// Producing to partition 5 of an unknown topic creates it with the
+	// default single partition, so partition 5 does not exist.
+	if res := producePartition("auto", 5, 1, batch, sess); res.errCode != errUnknownTopicOrPartition {
+		t.Errorf("produce to auto/5 = error %d, want %d", res.errCode, errUnknownTopicOrPartition)
+	}
+	if got := store.partitions("auto"); !slices.Equal(got, []int32{0}) {
+		t.Errorf("auto-created partitions = %v, want [0]", got)
+	}
+	if res := producePartition("auto", 0, 1, batch, sess); res.errCode != errNone || res.baseOffset != 0 {
+		t.Errorf("produce to auto/0 = error %d at %d, want offset 0", res.errCode, res.baseOffset)
+	}
+
+	// A negative partition is refused without creating anything.
+	if res := producePartition("negative", -1, 1, batch, sess); res.errCode != errUnknownTopicOrPartition {
+		t.Errorf("produce to negative/-1 = error %d, want %d", res.errCode, errUnknownTopicOrPartition)
+	}
+	if got := store.partitions("negative"); got != nil {
+		t.Errorf("topic created for a negative partition: %v", got)
+	}
+}
+
+// A topic with compression.type zstd stores a batch the producer sent gzip
+// compressed as zstd, holding the same records; with the default,
+// producer, the batch is stored as sent.
+func TestProduceRecompressesToTopicCodec(t *testing.T) {
+	c := newTestServer(t).dial()
+	if errCode := c.createTopic("zstd", 1, map[string]string{"compression.type": "zstd"}); errCode != errNone {
+		t.Fatalf("CreateTopics(zstd) = error %d", errCode)
+	}
+	if errCode := c.createTopic("asis", 1, nil); errCode != errNone {
+		t.Fatalf("CreateTopics(asis) = error %d", errCode)
+	}
+	sent, err := decodeRecordBatch(testBatch("a", "b", "c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzipped, err := encodeCompressedRecordBatch(sent, codecGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for topic, want := range map[string]int8{"zstd": codecZstd, "asis": codecGzip} {
+		if res := c.produce(topic, 0, gzipped); res.errCode != errNone {
+			t.Fatalf("%s: produce = error %d", topic, res.errCode)
+		}
+		pr := c.fetchOne(topic, 0, 0)
+		if pr.errCode != errNone || len(pr.records) != 1 {
+			t.Fatalf("%s: fetch = error %d, %d batches; want 1", topic, pr.errCode, len(pr.records))
+		}
+		stored, err := decodeRecordBatch(pr.records[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.codec() != want {
+			t.Errorf("%s: stored with codec %d, want %d", topic, stored.codec(), want)
+		}
+		var got []string
+		for _, r := range stored.records {
+			got = append(got, string(r.value))
+		}
+		if !slices.Equal(got, []string{"a", "b", "c"}) {
+			t.Errorf("%s: stored records %q, want a, b and c", topic, got)
+		}
+	}
+}
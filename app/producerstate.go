@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"slices"
+)
+
+// ----- idempotent producer state -----
+
+var (
+	errOutOfOrderSequence = errors.New("out of order sequence number")
+	errDuplicateSequence  = errors.New("duplicate sequence number")
+	errStaleProducerEpoch = errors.New("producer epoch is older than the current one")
+)
+
+// producerBatchesKept is how many of a producer's latest batches each
+// partition remembers to recognise retries. Like Kafka, it matches the
+// largest max.in.flight.requests.per.connection idempotence allows.
+const producerBatchesKept = 5
+
+// producerBatch is where one of a producer's batches landed.
+type producerBatch struct {
+	firstSeq, lastSeq int32
+	baseOffset        int64
+}
+
+// producerState is what a partition knows about one idempotent producer.
+type producerState struct {
+	epoch   int16
+	batches []producerBatch // oldest first
+}
+
+// lastSeq returns the sequence number of the producer's last record.
+func (ps *producerState) lastSeq() int32 {
+	return ps.batches[len(ps.batches)-1].lastSeq
+}
+
+// batchLastSeq returns the sequence number of bi's last record. Sequence
+// numbers wrap around to 0 after math.MaxInt32.
+func batchLastSeq(bi batchInfo) int32 {
+	delta := bi.nextOffset - bi.baseOffset - 1
+	return int32((int64(bi.baseSequence) + delta) % (math.MaxInt32 + 1))
+}
+
+// checkSequence decides whether bi, a batch about to be appended to pl, is
+// the next one from its producer. A retry of one of the producer's recent
+// batches fails with errDuplicateSequence and the offset the original was
+// given. Batches without a producer id aren't checked, and transaction
+// markers only for a stale epoch.
+func (pl *partitionLog) checkSequence(bi batchInfo) (int64, error) {
+	if bi.producerID < 0 {
+		return -1, nil
+	}
+	ps := pl.producers[bi.producerID]
+	if ps == nil {
+		// A producer we have no state for, e.g. because retention deleted
+		// all its batches, may continue from any sequence number.
+		return -1, nil
+	}
+	switch {
+	case bi.producerEpoch < ps.epoch:
+		return -1, errStaleProducerEpoch
+	case bi.attributes&batchControl != 0:
+		return -1, nil
+	case bi.producerEpoch > ps.epoch || len(ps.batches) == 0:
+		if bi.baseSequence != 0 {
+			return -1, errOutOfOrderSequence
+		}
+		return -1, nil
+	}
+	last := batchLastSeq(bi)
+	for _, b := range ps.batches {
+		if b.firstSeq == bi.baseSequence && b.lastSeq == last {
+			return b.baseOffset, errDuplicateSequence
+		}
+	}
+	if next := ps.lastSeq(); bi.baseSequence != int32((int64(next)+1)%(math.MaxInt32+1)) {
+		return -1, errOutOfOrderSequence
+	}
+	return -1, nil
+}
+
+// checkSequences runs checkSequence over batches as though each had been
+// appended after the one before it, leaving pl unchanged. It fails like
+// checkSequence for the first batch that would be rejected, though only
+// the first batch's duplicate offset is returned.
+func (pl *partitionLog) checkSequences(batches [][]byte) (int64, error) {
+	saved := pl.producers
+	defer func() { pl.producers = saved }()
+	pl.producers = map[int64]*producerState{}
+	for _, b := range batches {
+		id := peekBatch(b).producerID
+		if ps := saved[id]; ps != nil && pl.producers[id] == nil {
+			pl.producers[id] = &producerState{epoch: ps.epoch, batches: slices.Clone(ps.batches)}
+		}
+	}
+
+	next := pl.nextOffset
+	for i, b := range batches {
+		bi := peekBatch(b)
+		if off, err := pl.checkSequence(bi); err != nil {
+			if i > 0 {
+				off = -1
+			}
+			return off, err
+		}
+		bi.baseOffset, bi.nextOffset = next, next+bi.nextOffset-bi.baseOffset
+		next = bi.nextOffset
+		pl.trackProducer(bi)
+	}
+	return -1, nil
+}
+
+// trackProducer records that bi, a batch that passed checkSequence, was
+// stored at its base offset. A transaction marker carries no sequence
+// numbers but may move the producer to a newer epoch.
+func (pl *partitionLog) trackProducer(bi batchInfo) {
+	if bi.producerID < 0 {
+		return
+	}
+	if pl.producers == nil {
+		pl.producers = map[int64]*producerState{}
+	}
+	ps := pl.producers[bi.producerID]
+	if ps == nil || bi.producerEpoch != ps.epoch {
+		ps = &producerState{epoch: bi.producerEpoch}
+		pl.producers[bi.producerID] = ps
+	}
+	if bi.attributes&batchControl != 0 {
+		return
+	}
+	if len(ps.batches) == producerBatchesKept {
+		ps.batches = append(ps.batches[:0], ps.batches[1:]...)
+	}
+	ps.batches = append(ps.batches, producerBatch{bi.baseSequence, batchLastSeq(bi), bi.baseOffset})
+}
+
+// loadProducerState rebuilds the producer and transaction state from the
+// batches in the log, so retries that straddle a restart are still
+// recognised and open transactions still hold back the last stable offset.
+func (pl *partitionLog) loadProducerState() error {
+	for _, sg := range pl.segments {
+		var readErr error
+		if _, err := sg.scan(0, func(bi batchInfo) bool {
+			pl.trackProducer(bi)
+			marker := int16(-1)
+			if bi.attributes&batchControl != 0 {
+				b := make([]byte, bi.size)
+				if _, readErr = sg.data.ReadAt(b, bi.pos); readErr != nil {
+					return false
+				}
+				if marker, readErr = controlType(b); readErr != nil {
+					return false
+				}
+			}
+			pl.trackTxn(bi, marker)
+			return true
+		}); err != nil {
+			return err
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// ----- request rate quotas -----
+
+// requestRateQuota is how many requests per second each client id may send
+// before being throttled; 0 turns quotas off. Set with the
+// -request-rate-quota flag.
+//
+// Like Kafka's client quotas, going over the quota doesn't fail requests:
+// the broker reports how long the client should back off in the response's
+// throttle_time_ms and holds the response back for that long, which also
+// holds up the connection's later requests.
+var requestRateQuota float64
+
+// maxQuotaBuckets is how many client ids are tracked before buckets that
+// have refilled are swept away.
+const maxQuotaBuckets = 10000
+
+// tokenBucket holds up to one second's worth of requestRateQuota tokens,
+// refilled continuously. It goes negative when a client overruns its quota;
+// the debt is how far behind the client is.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var quotas = struct {
+	sync.Mutex
+	buckets map[string]*tokenBucket
+}{buckets: map[string]*tokenBucket{}}
+
+// unthrottledAPIs are neither charged to the quota nor throttled, as in
+// Kafka: clients probe a broker with a bare ApiVersions and expect a prompt
+// answer, throttled or not, and it is what they send first on every new
+// connection.
+var unthrottledAPIs = map[int16]bool{
+	apiKeyApiVersions: true,
+}
+
+// chargeRequest takes a token from clientID's bucket for a request with
+// apiKey and returns how long the client must be throttled for, if at all.
+func chargeRequest(clientID string, apiKey int16) time.Duration {
+	if requestRateQuota <= 0 || unthrottledAPIs[apiKey] {
+		return 0
+	}
+	now := time.Now()
+	quotas.Lock()
+	defer quotas.Unlock()
+	b := quotas.buckets[clientID]
+	if b == nil {
+		if len(quotas.buckets) >= maxQuotaBuckets {
+			sweepQuotaBuckets(now)
+		}
+		b = &tokenBucket{tokens: requestRateQuota, last: now}
+		quotas.buckets[clientID] = b
+	}
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*requestRateQuota, requestRateQuota)
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / requestRateQuota * float64(time.Second))
+}
+
+// sweepQuotaBuckets drops the buckets that have refilled by now: they are
+// no different from the fresh bucket a returning client would get.
+func sweepQuotaBuckets(now time.Time) {
+	for id, b := range quotas.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*requestRateQuota >= requestRateQuota {
+			delete(quotas.buckets, id)
+		}
+	}
+}
+
+// setThrottleTime fills in throttle_time_ms in resp, a response to a
+// supported version of apiKey, and reports whether it has the field. Most
+// responses start their body with it; Produce and ApiVersions end with it.
+func setThrottleTime(resp []byte, apiKey, apiVer int16, ms int32) bool {
+	off := 0
+	switch apiKey {
+	case apiKeyControlledShutdown, apiKeySaslHandshake, apiKeySaslAuthenticate, apiKeyWriteTxnMarkers:
+		return false
+	case apiKeyProduce, apiKeyApiVersions:
+		if apiKey == apiKeyApiVersions && apiVer == 0 {
+			return false
+		}
+		off = len(resp) - 4
+		if isFlexible(apiKey, apiVer) {
+			off-- // the empty top-level TAG_BUFFER after it
+		}
+	default:
+		off = 8 // size, correlation_id
+		if responseHeaderVersion(apiKey, apiVer) >= 1 {
+			off++ // the header's empty TAG_BUFFER
+		}
+	}
+	if off < 8 || off+4 > len(resp) {
+		return false
+	}
+	binary.BigEndian.PutUint32(resp[off:], uint32(ms))
+	return true
+}
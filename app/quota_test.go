@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// apiVersionsThrottle sends a v3 ApiVersions request and returns the
+// response's throttle_time_ms.
+func (c *testConn) apiVersionsThrottle() int32 {
+	c.t.Helper()
+	r := c.call(apiKeyApiVersions, 3, []byte{5, 'k', 'g', 'o', 0, 4, '1', '.', '0', 0, 0})
+	if errCode, _ := r.i16(); errCode != errNone {
+		c.t.Fatalf("ApiVersions = error %d", errCode)
+	}
+	n, _, _ := r.compactArrayLen()
+	for range n {
+		r.i16() // api_key
+		r.i16() // min_version
+		r.i16() // max_version
+		r.skipTagged()
+	}
+	throttleMs, _ := r.i32()
+	if err := r.skipTagged(); err != nil {
+		c.t.Fatal(err)
+	}
+	checkConsumed(c.t, r)
+	return throttleMs
+}
+
+// A client over its request rate quota has its Produce responses throttled,
+// but ApiVersions from the same client id never is, and doesn't count
+// against the quota either.
+func TestApiVersionsNotThrottled(t *testing.T) {
+	c := newTestServer(t).dial()
+	oldQuota := requestRateQuota
+	requestRateQuota = 10
+	t.Cleanup(func() {
+		requestRateQuota = oldQuota
+		quotas.Lock()
+		clear(quotas.buckets)
+		quotas.Unlock()
+	})
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bucket holds a second's worth of requests.
+	for i := range 10 {
+		if res, throttleMs := c.produceThrottled("orders", 0, testBatch("a")); res.errCode != errNone || throttleMs != 0 {
+			t.Fatalf("produce %d within the quota = error %d, throttled %dms; want no throttling", i, res.errCode, throttleMs)
+		}
+	}
+	for range 3 {
+		if throttleMs := c.apiVersionsThrottle(); throttleMs != 0 {
+			t.Errorf("ApiVersions from a client at its quota throttled %dms, want 0", throttleMs)
+		}
+	}
+	// The bucket refills as the test runs, so it may take more than one
+	// request to go over.
+	var start time.Time
+	var throttleMs int32
+	for range 10 {
+		start = time.Now()
+		if _, throttleMs = c.produceThrottled("orders", 0, testBatch("b")); throttleMs > 0 {
+			break
+		}
+	}
+	if throttleMs <= 0 {
+		t.Fatal("produce over the quota never throttled")
+	}
+	if held := time.Since(start); held < time.Duration(throttleMs)*time.Millisecond/2 {
+		t.Errorf("produce throttled %dms answered in %v, want it held back", throttleMs, held)
+	}
+	if throttleMs := c.apiVersionsThrottle(); throttleMs != 0 {
+		t.Errorf("ApiVersions from a throttled client throttled %dms, want 0", throttleMs)
+	}
+}
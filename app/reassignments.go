@@ -0,0 +1,163 @@
+package main
+
+import "fmt"
+
+// ----- AlterPartitionReassignments (api key 45), ListPartitionReassignments (api key 46) -----
+
+func init() {
+	registerHandler(apiKeyAlterReassignments, handleAlterPartitionReassignments)
+	registerHandler(apiKeyListReassignments, handleListPartitionReassignments)
+}
+
+type reassignmentTopicResult struct {
+	name       string
+	partitions []reassignmentPartitionResult
+}
+
+type reassignmentPartitionResult struct {
+	index      int32
+	errCode    int16
+	errMessage string
+}
+
+// handleAlterPartitionReassignments parses a v0 AlterPartitionReassignments
+// request. With one broker the only replica set a partition can have is
+// [brokerID], which it already has, so a reassignment to it completes at
+// once; any other is INVALID_REPLICA_ASSIGNMENT. Cancelling one (null
+// replicas) gets NO_REASSIGNMENT_IN_PROGRESS, as none ever is.
+func handleAlterPartitionReassignments(c *cursor, corrID int32, apiVer int16, _ *session) ([]byte, error) {
+	if _, err := c.i32(); err != nil { // timeout_ms
+		return nil, err
+	}
+	nTopics, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]reassignmentTopicResult, 0, nTopics)
+	for i := 0; i < nTopics; i++ {
+		name, err := c.compactNullableString()
+		if err != nil {
+			return nil, err
+		}
+		tr := reassignmentTopicResult{name: name}
+		nParts, _, err := c.compactArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < nParts; j++ {
+			index, err := c.i32()
+			if err != nil {
+				return nil, err
+			}
+			nReplicas, isNull, err := c.compactArrayLen()
+			if err != nil {
+				return nil, err
+			}
+			replicas := make([]int32, 0, nReplicas)
+			for k := 0; k < nReplicas; k++ {
+				id, err := c.i32()
+				if err != nil {
+					return nil, err
+				}
+				replicas = append(replicas, id)
+			}
+			if err := c.skipTagged(); err != nil {
+				return nil, err
+			}
+			res := reassignmentPartitionResult{index: index}
+			switch {
+			case !store.hasPartition(name, index):
+				res.errCode = errUnknownTopicOrPartition
+			case isNull:
+				res.errCode = errNoReassignmentInProgress
+			case len(replicas) == 0:
+				res.errCode, res.errMessage = errInvalidReplicaAssignment, "Empty replica list specified in partition reassignment."
+			case len(replicas) > 1 || replicas[0] != brokerID:
+				res.errCode, res.errMessage = errInvalidReplicaAssignment, fmt.Sprintf("Replica assignment %v names brokers other than %d.", replicas, brokerID)
+			}
+			tr.partitions = append(tr.partitions, res)
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+		results = append(results, tr)
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+	return buildAlterPartitionReassignmentsResponse(corrID, apiVer, errNone, results), nil
+}
+
+func buildAlterPartitionReassignmentsResponse(corrID int32, apiVer, errCode int16, results []reassignmentTopicResult) []byte {
+	// Body (flex v0):
+	// throttle_time_ms (INT32), error_code (INT16), error_message (COMPACT_NULLABLE_STRING)
+	// responses (COMPACT_ARRAY) -> {name, partitions (COMPACT_ARRAY), TAGS}
+	//   partitions -> {partition_index, error_code, error_message, TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putI16(errCode)
+	r.putCompactNullableString("") // error_message: null
+	r.putCompactArrayLen(len(results))
+	for _, tr := range results {
+		r.putCompactString(tr.name)
+		r.putCompactArrayLen(len(tr.partitions))
+		for _, p := range tr.partitions {
+			r.putI32(p.index)
+			r.putI16(p.errCode)
+			r.putCompactNullableString(p.errMessage)
+			r.putTags()
+		}
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyAlterReassignments, apiVer))
+}
+
+// handleListPartitionReassignments parses a v0 ListPartitionReassignments
+// request. Reassignments complete as soon as they are asked for, so none is
+// ever in progress to list.
+func handleListPartitionReassignments(c *cursor, corrID int32, apiVer int16, _ *session) ([]byte, error) {
+	if _, err := c.i32(); err != nil { // timeout_ms
+		return nil, err
+	}
+	nTopics, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < nTopics; i++ {
+		if _, err := c.compactNullableString(); err != nil {
+			return nil, err
+		}
+		nParts, _, err := c.compactArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < nParts; j++ {
+			if _, err := c.i32(); err != nil {
+				return nil, err
+			}
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+	return buildListPartitionReassignmentsResponse(corrID, apiVer, errNone), nil
+}
+
+func buildListPartitionReassignmentsResponse(corrID int32, apiVer, errCode int16) []byte {
+	// Body (flex v0):
+	// throttle_time_ms (INT32), error_code (INT16), error_message (COMPACT_NULLABLE_STRING)
+	// topics (COMPACT_ARRAY): always empty
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putI16(errCode)
+	r.putCompactNullableString("") // error_message: null
+	r.putCompactArrayLen(0)
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyListReassignments, apiVer))
+}
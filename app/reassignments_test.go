@@ -0,0 +1,76 @@
+package main
+
+import "testing"
+
+// alterReassignment sends a v0 AlterPartitionReassignments request moving
+// topic/partition to replicas and returns the partition's error code.
+func (c *testConn) alterReassignment(topic string, partition int32, replicas ...int32) int16 {
+	c.t.Helper()
+	var req respBuf
+	req.putI32(1000) // timeout_ms
+	req.putCompactArrayLen(1)
+	req.putCompactString(topic)
+	req.putCompactArrayLen(1)
+	req.putI32(partition)
+	req.putCompactArrayLen(len(replicas))
+	for _, id := range replicas {
+		req.putI32(id)
+	}
+	req.putTags()
+	req.putTags()
+	req.putTags()
+	r := c.call(apiKeyAlterReassignments, 0, req.b)
+	r.i32() // throttle_time_ms
+	if errCode, _ := r.i16(); errCode != errNone {
+		c.t.Fatalf("AlterPartitionReassignments = error %d", errCode)
+	}
+	r.compactNullableString() // error_message
+	if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+		c.t.Fatalf("%d topics (%v), want 1", n, err)
+	}
+	r.compactNullableString() // name
+	if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+		c.t.Fatalf("%d partitions (%v), want 1", n, err)
+	}
+	r.i32() // partition_index
+	errCode, _ := r.i16()
+	return errCode
+}
+
+// listReassignments sends a v0 ListPartitionReassignments request for
+// every partition and returns its error code and how many topics have a
+// reassignment in progress.
+func (c *testConn) listReassignments() (int16, int) {
+	c.t.Helper()
+	var req respBuf
+	req.putI32(1000)           // timeout_ms
+	req.putCompactArrayLen(-1) // topics: null, all of them
+	req.putTags()
+	r := c.call(apiKeyListReassignments, 0, req.b)
+	r.i32() // throttle_time_ms
+	errCode, _ := r.i16()
+	r.compactNullableString() // error_message
+	n, _, _ := r.compactArrayLen()
+	return errCode, n
+}
+
+// With one broker, reassigning a partition to it completes at once, so it
+// succeeds and ListPartitionReassignments has nothing in progress to show.
+func TestTrivialReassignment(t *testing.T) {
+	c := newTestServer(t).dial()
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if errCode := c.alterReassignment("orders", 0, brokerID); errCode != errNone {
+		t.Errorf("reassigning to [%d] = error %d, want none", brokerID, errCode)
+	}
+	if errCode, n := c.listReassignments(); errCode != errNone || n != 0 {
+		t.Errorf("ListPartitionReassignments = error %d, %d topics; want none in progress", errCode, n)
+	}
+	if errCode := c.alterReassignment("orders", 0, brokerID+1); errCode != errInvalidReplicaAssignment {
+		t.Errorf("reassigning to [%d] = error %d, want %d", brokerID+1, errCode, errInvalidReplicaAssignment)
+	}
+	if errCode := c.alterReassignment("missing", 0, brokerID); errCode != errUnknownTopicOrPartition {
+		t.Errorf("reassigning a missing topic = error %d, want %d", errCode, errUnknownTopicOrPartition)
+	}
+}
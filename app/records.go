@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ----- record batches -----
+
+// Batch attribute bits.
+const (
+	batchCodecMask     = 0x07 // compression codec, see codecNone etc.
+	batchLogAppendTime = 0x08 // timestamps were set by the broker, not the producer
+	batchTransactional = 0x10 // the records are part of a transaction
+	batchControl       = 0x20 // the batch holds a transaction marker, not records
+)
+
+// Transaction marker types: the second int16 of a control record's key.
+const (
+	controlAbort  = int16(0)
+	controlCommit = int16(1)
+)
+
+type recordHeader struct {
+	key   string
+	value []byte // nil = null
+}
+
+// record is one entry of a batch. Timestamp and offset are deltas from the
+// batch's baseTimestamp and baseOffset.
+type record struct {
+	attributes     int8
+	timestampDelta int64
+	offsetDelta    int32
+	key            []byte // nil = null
+	value          []byte // nil = null
+	headers        []recordHeader
+}
+
+// recordBatch is a decoded RecordBatch v2. For uncompressed batches key,
+// value and header values point into the slice it was decoded from.
+type recordBatch struct {
+	baseOffset           int64
+	batchLength          int32
+	partitionLeaderEpoch int32
+	magic                int8
+	crc                  uint32
+	attributes           int16
+	lastOffsetDelta      int32
+	baseTimestamp        int64
+	maxTimestamp         int64
+	producerID           int64
+	producerEpoch        int16
+	baseSequence         int32
+	records              []record
+}
+
+func (rb *recordBatch) codec() int8 { return int8(rb.attributes & batchCodecMask) }
+
+// timestamp returns r's absolute timestamp. With LogAppendTime every record
+// carries the batch's maxTimestamp.
+func (rb *recordBatch) timestamp(r record) int64 {
+	if rb.attributes&batchLogAppendTime != 0 {
+		return rb.maxTimestamp
+	}
+	return rb.baseTimestamp + r.timestampDelta
+}
+
+// decodeRecordBatch parses one RecordBatch v2 from the start of b, including
+// every record in it, decompressing them first when needed. It does not
+// check the CRC; see splitBatch.
+func decodeRecordBatch(b []byte) (recordBatch, error) {
+	var rb recordBatch
+	c := &cursor{b: b}
+	var err error
+	if rb.baseOffset, err = c.i64(); err != nil {
+		return rb, errBadBatch
+	}
+	if rb.batchLength, err = c.i32(); err != nil {
+		return rb, errBadBatch
+	}
+	if rb.batchLength < batchHeaderSize-batchLogOverhead || int(rb.batchLength) > len(b)-batchLogOverhead {
+		return rb, errBadBatch
+	}
+	c.b = b[:batchLogOverhead+int(rb.batchLength)]
+	rb.partitionLeaderEpoch, _ = c.i32()
+	rb.magic, _ = c.i8()
+	if rb.magic != currentBatchMagic {
+		return rb, fmt.Errorf("%w: magic %d", errBadBatch, rb.magic)
+	}
+	crc, _ := c.i32()
+	rb.crc = uint32(crc)
+	rb.attributes, _ = c.i16()
+	rb.lastOffsetDelta, _ = c.i32()
+	rb.baseTimestamp, _ = c.i64()
+	rb.maxTimestamp, _ = c.i64()
+	rb.producerID, _ = c.i64()
+	rb.producerEpoch, _ = c.i16()
+	rb.baseSequence, _ = c.i32()
+	count, _ := c.i32()
+	if count < 0 {
+		return rb, errBadBatch
+	}
+
+	if rb.codec() != codecNone {
+		inner, err := decompressRecords(rb.codec(), c.b[c.off:])
+		if err != nil {
+			return rb, err
+		}
+		c = &cursor{b: inner}
+	}
+	// Every record takes at least seven bytes, which bounds a hostile count.
+	if int(count) > (len(c.b)-c.off)/7 {
+		return rb, errBadBatch
+	}
+	rb.records = make([]record, 0, count)
+	for i := int32(0); i < count; i++ {
+		r, err := decodeRecord(c)
+		if err != nil {
+			return rb, fmt.Errorf("%w: record %d: %v", errBadBatch, i, err)
+		}
+		rb.records = append(rb.records, r)
+	}
+	return rb, nil
+}
+
+// controlType returns the marker type of a control batch: one record whose
+// key is {version int16, type int16}.
+func controlType(batch []byte) (int16, error) {
+	rb, err := decodeRecordBatch(batch)
+	if err != nil {
+		return -1, err
+	}
+	if len(rb.records) != 1 || len(rb.records[0].key) < 4 {
+		return -1, fmt.Errorf("%w: bad control record", errBadBatch)
+	}
+	return int16(binary.BigEndian.Uint16(rb.records[0].key[2:])), nil
+}
+
+// decodeRecord reads one varint-length-prefixed record:
+//
+//	length varint, attributes int8, timestampDelta varlong, offsetDelta varint,
+//	key varbytes, value varbytes, headers [varint count]{key varstring, value varbytes}
+func decodeRecord(c *cursor) (record, error) {
+	var r record
+	length, err := c.varint()
+	if err != nil {
+		return r, err
+	}
+	if length < 0 || length > int64(len(c.b)-c.off) {
+		return r, errBadBatch
+	}
+	rc := &cursor{b: c.b[c.off : c.off+int(length)]}
+	c.off += int(length)
+
+	if r.attributes, err = rc.i8(); err != nil {
+		return r, err
+	}
+	if r.timestampDelta, err = rc.varint(); err != nil {
+		return r, err
+	}
+	delta, err := rc.varint()
+	if err != nil {
+		return r, err
+	}
+	r.offsetDelta = int32(delta)
+	if r.key, err = rc.varBytes(); err != nil {
+		return r, err
+	}
+	if r.value, err = rc.varBytes(); err != nil {
+		return r, err
+	}
+	nHeaders, err := rc.varint()
+	if err != nil {
+		return r, err
+	}
+	if nHeaders < 0 || nHeaders > int64(len(rc.b)-rc.off) {
+		return r, errBadBatch
+	}
+	for i := int64(0); i < nHeaders; i++ {
+		key, err := rc.varBytes()
+		if err != nil {
+			return r, err
+		}
+		if key == nil { // only a header's value may be null
+			return r, errBadBatch
+		}
+		value, err := rc.varBytes()
+		if err != nil {
+			return r, err
+		}
+		r.headers = append(r.headers, recordHeader{key: string(key), value: value})
+	}
+	if rc.off != len(rc.b) {
+		return r, errBadBatch
+	}
+	return r, nil
+}
+
+// encodeRecordBatch serializes rb uncompressed, whatever codec its attributes
+// name, filling in batchLength and the CRC. The records' offset and timestamp
+// deltas are kept as they are, so they must stay relative to rb's base.
+func encodeRecordBatch(rb recordBatch) []byte {
+	var records []byte
+	for _, r := range rb.records {
+		records = appendRecord(records, r)
+	}
+	return appendBatch(rb, rb.attributes&^batchCodecMask, records)
+}
+
+// encodeCompressedRecordBatch is encodeRecordBatch with the records section
+// compressed with codec, which the attributes then name.
+func encodeCompressedRecordBatch(rb recordBatch, codec int8) ([]byte, error) {
+	var records []byte
+	for _, r := range rb.records {
+		records = appendRecord(records, r)
+	}
+	compressed, err := compressRecords(codec, records)
+	if err != nil {
+		return nil, err
+	}
+	return appendBatch(rb, rb.attributes&^batchCodecMask|int16(codec), compressed), nil
+}
+
+// appendBatch lays out a batch of rb's header fields, attributes attrs and
+// the encoded records section records.
+func appendBatch(rb recordBatch, attrs int16, records []byte) []byte {
+	b := make([]byte, 0, batchHeaderSize+len(records))
+	b = binary.BigEndian.AppendUint64(b, uint64(rb.baseOffset))
+	b = binary.BigEndian.AppendUint32(b, 0) // batchLength, set below
+	b = binary.BigEndian.AppendUint32(b, uint32(rb.partitionLeaderEpoch))
+	b = append(b, currentBatchMagic)
+	b = binary.BigEndian.AppendUint32(b, 0) // crc, set below
+	b = binary.BigEndian.AppendUint16(b, uint16(attrs))
+	b = binary.BigEndian.AppendUint32(b, uint32(rb.lastOffsetDelta))
+	b = binary.BigEndian.AppendUint64(b, uint64(rb.baseTimestamp))
+	b = binary.BigEndian.AppendUint64(b, uint64(rb.maxTimestamp))
+	b = binary.BigEndian.AppendUint64(b, uint64(rb.producerID))
+	b = binary.BigEndian.AppendUint16(b, uint16(rb.producerEpoch))
+	b = binary.BigEndian.AppendUint32(b, uint32(rb.baseSequence))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(rb.records)))
+	b = append(b, records...)
+	binary.BigEndian.PutUint32(b[batchLengthOffset:], uint32(len(b)-batchLogOverhead))
+	binary.BigEndian.PutUint32(b[batchCRCOffset:], crc32c(b[batchAttrsOffset:]))
+	return b
+}
+
+// appendRecord appends r in the layout decodeRecord reads.
+func appendRecord(b []byte, r record) []byte {
+	body := []byte{byte(r.attributes)}
+	body = binary.AppendVarint(body, r.timestampDelta)
+	body = binary.AppendVarint(body, int64(r.offsetDelta))
+	body = appendVarBytes(body, r.key)
+	body = appendVarBytes(body, r.value)
+	body = binary.AppendVarint(body, int64(len(r.headers)))
+	for _, h := range r.headers {
+		body = appendVarBytes(body, []byte(h.key))
+		body = appendVarBytes(body, h.value)
+	}
+	b = binary.AppendVarint(b, int64(len(body)))
+	return append(b, body...)
+}
+
+// appendVarBytes appends a varint length, -1 for nil, then v.
+func appendVarBytes(b, v []byte) []byte {
+	if v == nil {
+		return binary.AppendVarint(b, -1)
+	}
+	b = binary.AppendVarint(b, int64(len(v)))
+	return append(b, v...)
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func FuzzDecodeRecordBatch(f *testing.F) {
+	f.Add(encodeRecordBatch(recordBatch{producerID: -1, baseSequence: -1, records: []record{
+		{key: []byte("k"), value: []byte("v"), headers: []recordHeader{{"h", []byte("x")}}},
+		{offsetDelta: 1, value: nil},
+	}}))
+	for _, codec := range []int8{codecGzip, codecSnappy, codecLZ4, codecZstd} {
+		b, err := encodeCompressedRecordBatch(recordBatch{producerID: -1, baseSequence: -1, records: []record{{value: []byte("compressed")}}}, codec)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	f.Add(make([]byte, batchHeaderSize))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		rb, err := decodeRecordBatch(b)
+		if err != nil {
+			return
+		}
+		// Whatever decodes must survive re-encoding.
+		again, err := decodeRecordBatch(encodeRecordBatch(rb))
+		if err != nil {
+			t.Fatalf("re-encoded batch doesn't decode: %v", err)
+		}
+		if len(again.records) != len(rb.records) {
+			t.Fatalf("re-encoded batch has %d records, want %d", len(again.records), len(rb.records))
+		}
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import "encoding/binary"
+
+// ----- response writer -----
+
+// putUvarint appends v as an unsigned varint, the same encoding
+// binary.PutUvarint produces and cursor.uvarint reads.
+func putUvarint(buf []byte, v uint64) []byte {
+	return binary.AppendUvarint(buf, v)
+}
+
+// putCompactString appends a COMPACT_STRING: uvarint(len+1) then bytes.
+func putCompactString(buf []byte, s string) []byte {
+	buf = putUvarint(buf, uint64(len(s)+1))
+	return append(buf, s...)
+}
+
+// putCompactArrayLen appends a COMPACT_ARRAY length: uvarint(n+1).
+// n < 0 writes a null array.
+func putCompactArrayLen(buf []byte, n int) []byte {
+	if n < 0 {
+		return putUvarint(buf, 0)
+	}
+	return putUvarint(buf, uint64(n+1))
+}
+
+// respBuf accumulates a response body. finish prepends the response header
+// and frame length once the body is complete, so handlers never back-patch
+// lengths themselves.
+type respBuf struct {
+	b []byte
+}
+
+func (r *respBuf) putI8(v int8)   { r.b = append(r.b, byte(v)) }
+func (r *respBuf) putI16(v int16) { r.b = binary.BigEndian.AppendUint16(r.b, uint16(v)) }
+func (r *respBuf) putI32(v int32) { r.b = binary.BigEndian.AppendUint32(r.b, uint32(v)) }
+func (r *respBuf) putI64(v int64) { r.b = binary.BigEndian.AppendUint64(r.b, uint64(v)) }
+
+func (r *respBuf) putBool(v bool) {
+	if v {
+		r.b = append(r.b, 1)
+	} else {
+		r.b = append(r.b, 0)
+	}
+}
+
+func (r *respBuf) putUUID(u [16]byte)  { r.b = append(r.b, u[:]...) }
+func (r *respBuf) putUvarint(v uint64) { r.b = putUvarint(r.b, v) }
+
+func (r *respBuf) putCompactString(s string) { r.b = putCompactString(r.b, s) }
+
+// STRING: int16 length then bytes, for non-flexible versions.
+func (r *respBuf) putString(s string) {
+	r.putI16(int16(len(s)))
+	r.b = append(r.b, s...)
+}
+
+// COMPACT_NULLABLE_STRING; "" is written as null, mirroring how the cursor
+// decodes null to "".
+func (r *respBuf) putCompactNullableString(s string) {
+	if s == "" {
+		r.putUvarint(0)
+		return
+	}
+	r.putCompactString(s)
+}
+
+func (r *respBuf) putCompactArrayLen(n int) { r.b = putCompactArrayLen(r.b, n) }
+
+// COMPACT_RECORDS / COMPACT_BYTES: uvarint(len+1) then the concatenated parts
+func (r *respBuf) putCompactRecords(parts [][]byte) {
+	size := 0
+	for _, p := range parts {
+		size += len(p)
+	}
+	r.putUvarint(uint64(size + 1))
+	for _, p := range parts {
+		r.b = append(r.b, p...)
+	}
+}
+
+// COMPACT_BYTES; nil is written as empty, not null.
+func (r *respBuf) putCompactBytes(b []byte) {
+	r.putUvarint(uint64(len(b) + 1))
+	r.b = append(r.b, b...)
+}
+
+// putTags writes an empty TAG_BUFFER.
+func (r *respBuf) putTags() { r.b = append(r.b, 0x00) }
+
+// The methods below write the types whose encoding depends on whether the
+// response version is flexible; see cursor.arrayLenFor.
+
+// putArrayLenFor writes an array length, COMPACT_ARRAY when flexible, else
+// ARRAY. n < 0 writes a null array.
+func (r *respBuf) putArrayLenFor(flexible bool, n int) {
+	switch {
+	case flexible:
+		r.putCompactArrayLen(n)
+	case n < 0:
+		r.putI32(-1)
+	default:
+		r.putI32(int32(n))
+	}
+}
+
+// putStringFor writes s as a COMPACT_STRING when flexible, else a STRING.
+func (r *respBuf) putStringFor(flexible bool, s string) {
+	if flexible {
+		r.putCompactString(s)
+	} else {
+		r.putString(s)
+	}
+}
+
+// putNullableStringFor writes s as putStringFor does, but "" as null.
+func (r *respBuf) putNullableStringFor(flexible bool, s string) {
+	switch {
+	case flexible:
+		r.putCompactNullableString(s)
+	case s == "":
+		r.putI16(-1)
+	default:
+		r.putString(s)
+	}
+}
+
+// putRecordsFor writes the concatenated parts as COMPACT_RECORDS when
+// flexible, else RECORDS.
+func (r *respBuf) putRecordsFor(flexible bool, parts [][]byte) {
+	if flexible {
+		r.putCompactRecords(parts)
+		return
+	}
+	size := 0
+	for _, p := range parts {
+		size += len(p)
+	}
+	r.putI32(int32(size))
+	for _, p := range parts {
+		r.b = append(r.b, p...)
+	}
+}
+
+// putTagsFor writes an empty TAG_BUFFER when flexible.
+func (r *respBuf) putTagsFor(flexible bool) {
+	if flexible {
+		r.putTags()
+	}
+}
+
+// finish returns the framed response:
+// [length INT32][response header][body]
+func (r *respBuf) finish(corrID int32, headerVersion int) []byte {
+	resp := make([]byte, 4, 4+5+len(r.b))
+	resp = writeResponseHeader(resp, corrID, headerVersion)
+	resp = append(resp, r.b...)
+	binary.BigEndian.PutUint32(resp[0:4], uint32(len(resp)-4))
+	return resp
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// ----- log retention -----
+
+// retentionCheckInterval is how often the broker looks for segments to
+// delete or compact, like Kafka's log.retention.check.interval.ms. Set with
+// the -log-retention-check-interval flag.
+var retentionCheckInterval = 5 * time.Minute
+
+// expiredSegments returns how many segments at the start of pl can go: those
+// whose newest record is more than retentionMs old, then as many more as
+// bring the partition back within retentionBytes. -1 disables either limit.
+// Like Kafka, only whole segments are deleted, oldest first, and the active
+// segment never is.
+func (pl *partitionLog) expiredSegments(retentionMs, retentionBytes int64, now time.Time) int {
+	n := 0
+	if retentionMs >= 0 {
+		cutoff := now.UnixMilli() - retentionMs
+		for n+1 < len(pl.segments) && pl.segments[n].maxTime < cutoff {
+			n++
+		}
+	}
+	if retentionBytes >= 0 {
+		var size int64
+		for _, sg := range pl.segments[n:] {
+			size += sg.size
+		}
+		for excess := size - retentionBytes; n+1 < len(pl.segments) && pl.segments[n].size <= excess; n++ {
+			excess -= pl.segments[n].size
+		}
+	}
+	return n
+}
+
+// enforceRetention deletes the segments that have outlived their topic's
+// retention.ms or retention.bytes, moving each partition's log start offset
+// up past them. Topics whose cleanup.policy doesn't include delete are left
+// alone.
+func (s *logStore) enforceRetention(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for topic, parts := range s.topics {
+		if !s.cleanupPolicyLocked(topic, "delete") {
+			continue
+		}
+		retentionMs, err := strconv.ParseInt(s.topicConfigValueLocked(topic, "retention.ms"), 10, 64)
+		if err != nil {
+			retentionMs = -1
+		}
+		retentionBytes, err := strconv.ParseInt(s.topicConfigValueLocked(topic, "retention.bytes"), 10, 64)
+		if err != nil {
+			retentionBytes = -1
+		}
+		for partition, pl := range parts {
+			n := pl.expiredSegments(retentionMs, retentionBytes, now)
+			if n == 0 {
+				continue
+			}
+			if err := pl.advanceLogStart(pl.segments[n].baseOffset); err != nil {
+				logger.Warn("failed to delete expired segments", "topic", topic, "partition", partition, "err", err)
+				continue
+			}
+			logger.Info("deleted expired segments", "topic", topic, "partition", partition,
+				"segments", n, "log_start_offset", pl.logStart)
+		}
+	}
+}
+
+// cleanupLoop runs enforceRetention and compactLogs every interval for as
+// long as the broker runs.
+func (s *logStore) cleanupLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.enforceRetention(now)
+		s.compactLogs(now)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Retention deletes the segments whose newest record is older than
+// retention.ms and keeps the rest, including the active segment however
+// old it is.
+func TestRetentionDeletesOldSegments(t *testing.T) {
+	s, err := openLogStore(t.TempDir(), 1, 0) // a segment per batch
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	for topic, configs := range map[string]map[string]string{
+		"orders":    {"retention.ms": "60000"},
+		"forever":   {"retention.ms": "-1"},
+		"compacted": {"retention.ms": "60000", "cleanup.policy": "compact"},
+	} {
+		if _, err := s.createTopic(topic, 1, configs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	old, recent := now.Add(-2*time.Hour).UnixMilli(), now.Add(-10*time.Second).UnixMilli()
+	for _, topic := range []string{"orders", "forever", "compacted"} {
+		for _, ts := range [][]int64{{old, old + 1}, {old + 2}, {old + 3, recent}, {recent}, {old}} {
+			if _, err := s.append(topic, 0, timedBatch(ts...)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	s.enforceRetention(now)
+	for topic, want := range map[string]int64{"orders": 3, "forever": 0, "compacted": 0} {
+		raw, hwm, err := s.readRaw(topic, 0, want, 1<<20)
+		if err != nil || hwm != 7 || len(raw) == 0 || peekBatch(raw).baseOffset != want {
+			t.Errorf("%s: read from %d after retention = %d bytes, hwm %d (%v); want the batch at %d", topic, want, len(raw), hwm, err, want)
+		}
+		if want == 0 {
+			continue
+		}
+		if _, _, err := s.readRaw(topic, 0, want-1, 1<<20); kafkaErrorCode(err) != errOffsetOutOfRange {
+			t.Errorf("%s: read from %d after retention = %v, want out of range", topic, want-1, err)
+		}
+	}
+}
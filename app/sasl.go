@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+func init() {
+	registerHandler(apiKeySaslHandshake, handleSaslHandshake)
+	registerHandler(apiKeySaslAuthenticate, handleSaslAuthenticate)
+}
+
+// ----- SASL authentication -----
+
+const saslPlain = "PLAIN"
+
+// plainUsers maps SASL/PLAIN usernames to passwords. While no SASL
+// mechanism has users the listener is PLAINTEXT and connections need no
+// authentication; otherwise it is SASL_PLAINTEXT and every connection must
+// authenticate first. Set with the SASL_PLAIN_USERS environment variable,
+// e.g. "alice:secret,bob:pw".
+var plainUsers = map[string]string{}
+
+// parseUserPasswords parses a comma separated list of user:password pairs.
+func parseUserPasswords(s string) (map[string]string, error) {
+	users := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" {
+			continue
+		}
+		user, pass, ok := strings.Cut(pair, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("bad user:password pair %q", pair)
+		}
+		users[user] = pass
+	}
+	return users, nil
+}
+
+// saslMechanisms returns the mechanisms clients may pick in SaslHandshake:
+// those with at least one user configured.
+func saslMechanisms() []string {
+	var mechanisms []string
+	if len(plainUsers) > 0 {
+		mechanisms = append(mechanisms, saslPlain)
+	}
+	if len(scramUsers) > 0 {
+		mechanisms = append(mechanisms, scramSHA256)
+	}
+	return mechanisms
+}
+
+// authState tracks where a connection is in the SASL exchange:
+// SaslHandshake picks a mechanism, then SaslAuthenticate carries the
+// credentials. Only ApiVersions may be used before that.
+type authState int
+
+const (
+	authHandshake    authState = iota // waiting for SaslHandshake
+	authAuthenticate                  // waiting for SaslAuthenticate
+	authDone                          // authenticated, or no SASL configured
+	authFailed                        // bad credentials; handleConn hangs up
+)
+
+// initialAuthState is the state a new connection starts in.
+func initialAuthState() authState {
+	if len(saslMechanisms()) == 0 {
+		return authDone
+	}
+	return authHandshake
+}
+
+// allows reports whether a request with apiKey may be handled in the
+// session's auth state: until authentication completes, only ApiVersions
+// and the SASL requests in their turn.
+func (s *session) allows(apiKey int16) bool {
+	switch s.auth {
+	case authHandshake:
+		return apiKey == apiKeyApiVersions || apiKey == apiKeySaslHandshake
+	case authAuthenticate:
+		return apiKey == apiKeySaslAuthenticate
+	case authDone:
+		return true
+	}
+	return false
+}
+
+// ----- SaslHandshake (api key 17) -----
+
+// handleSaslHandshake parses a v1 SaslHandshake request and, if the
+// mechanism is enabled, moves the connection on to SaslAuthenticate.
+func handleSaslHandshake(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	mechanism, err := c.str16()
+	if err != nil {
+		return nil, err
+	}
+
+	mechanisms := saslMechanisms()
+	errCode := errUnsupportedSaslMechanism
+	for _, m := range mechanisms {
+		if m == mechanism {
+			errCode = errNone
+		}
+	}
+	switch {
+	case sess.auth != authHandshake:
+		errCode = errIllegalSaslState
+	case errCode == errNone:
+		sess.auth = authAuthenticate
+		sess.mechanism = mechanism
+	}
+
+	// Body (v1): error_code (INT16), mechanisms (ARRAY of STRING)
+	var r respBuf
+	r.putI16(errCode)
+	r.putI32(int32(len(mechanisms)))
+	for _, m := range mechanisms {
+		r.putString(m)
+	}
+	return r.finish(corrID, responseHeaderVersion(apiKeySaslHandshake, apiVer)), nil
+}
+
+// ----- SaslAuthenticate (api key 36) -----
+
+// handleSaslAuthenticate parses a v2 SaslAuthenticate request and checks the
+// credentials for the mechanism picked in SaslHandshake. A failed attempt
+// gets SASL_AUTHENTICATION_FAILED, after which handleConn closes the
+// connection.
+func handleSaslAuthenticate(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	authBytes, err := c.compactBytes()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+
+	errCode, errMsg := errNone, ""
+	var reply []byte
+	if sess.auth != authAuthenticate {
+		errCode, errMsg = errIllegalSaslState, "Unexpected SaslAuthenticate request"
+	} else if reply, err = sess.saslStep(authBytes); err != nil {
+		sess.auth = authFailed
+		errCode, errMsg = errSaslAuthenticationFailed, "Authentication failed: "+err.Error()
+		sess.log.Warn("SASL authentication failed", "mechanism", sess.mechanism, "correlation_id", corrID, "err", err)
+	}
+
+	// Body (flex v2):
+	// error_code (INT16), error_message (COMPACT_NULLABLE_STRING),
+	// auth_bytes (COMPACT_BYTES), session_lifetime_ms (INT64)
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI16(errCode)
+	r.putCompactNullableString(errMsg)
+	r.putCompactBytes(reply)
+	r.putI64(0) // session_lifetime_ms: sessions don't expire
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeySaslAuthenticate, apiVer)), nil
+}
+
+// saslStep feeds one SaslAuthenticate message to the mechanism picked in
+// SaslHandshake and returns the reply for the client. The session becomes
+// authenticated once the mechanism's exchange completes.
+func (s *session) saslStep(msg []byte) ([]byte, error) {
+	switch s.mechanism {
+	case saslPlain:
+		user, err := authenticatePlain(msg)
+		if err != nil {
+			return nil, err
+		}
+		s.auth, s.principal = authDone, user
+		return nil, nil
+	case scramSHA256:
+		// SCRAM takes two round trips: client-first, then client-final.
+		if s.scram == nil {
+			s.scram = &scramConversation{}
+			return s.scram.first(msg)
+		}
+		reply, err := s.scram.final(msg)
+		if err != nil {
+			return nil, err
+		}
+		s.auth, s.principal, s.scram = authDone, s.scram.user, nil
+		return reply, nil
+	}
+	return nil, fmt.Errorf("unsupported mechanism %q", s.mechanism)
+}
+
+var errBadPlainCredentials = errors.New("invalid username or password")
+
+// authenticatePlain checks a PLAIN message, authzid NUL authcid NUL passwd
+// (RFC 4616), against plainUsers and returns the authenticated user.
+// Acting as another user (an authzid other than authcid) isn't allowed.
+func authenticatePlain(msg []byte) (string, error) {
+	parts := bytes.Split(msg, []byte{0})
+	if len(parts) != 3 {
+		return "", errors.New("invalid PLAIN message")
+	}
+	authzid, user, pass := string(parts[0]), string(parts[1]), parts[2]
+	if user == "" || (authzid != "" && authzid != user) {
+		return "", errBadPlainCredentials
+	}
+	want, ok := plainUsers[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(want), pass) != 1 {
+		return "", errBadPlainCredentials
+	}
+	return user, nil
+}
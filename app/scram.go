@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ----- SASL/SCRAM-SHA-256 (RFC 5802, RFC 7677) -----
+
+const (
+	scramSHA256 = "SCRAM-SHA-256"
+
+	// scramIterations is Kafka's minimum, and what kafka-configs.sh uses by
+	// default.
+	scramIterations = 4096
+)
+
+// scramCredential is what the broker keeps for a SCRAM user: the password
+// itself is never stored.
+type scramCredential struct {
+	salt       []byte
+	iterations int
+	storedKey  []byte // H(ClientKey)
+	serverKey  []byte
+}
+
+// scramUsers maps SCRAM-SHA-256 usernames to their credentials. Set with the
+// SASL_SCRAM_SHA_256_USERS environment variable, given as user:password
+// pairs like SASL_PLAIN_USERS; passwords are salted on startup.
+var scramUsers = map[string]scramCredential{}
+
+// parseScramUsers parses user:password pairs into salted credentials.
+func parseScramUsers(s string) (map[string]scramCredential, error) {
+	passwords, err := parseUserPasswords(s)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]scramCredential, len(passwords))
+	for user, pass := range passwords {
+		if users[user], err = newScramCredential(pass, scramIterations); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// newScramCredential salts password with a random salt.
+func newScramCredential(password string, iterations int) (scramCredential, error) {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	salted, err := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	if err != nil {
+		return scramCredential{}, err
+	}
+	storedKey := sha256.Sum256(hmacSHA256(salted, "Client Key"))
+	return scramCredential{
+		salt:       salt,
+		iterations: iterations,
+		storedKey:  storedKey[:],
+		serverKey:  hmacSHA256(salted, "Server Key"),
+	}, nil
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+var errBadScramCredentials = errors.New("invalid user credentials")
+
+// scramConversation is the server side of one SCRAM exchange, carried
+// across the two SaslAuthenticate requests it takes.
+type scramConversation struct {
+	user            string
+	cred            scramCredential
+	gs2Header       string // e.g. "n,,"; echoed back base64'd in client-final
+	clientFirstBare string
+	serverFirst     string
+	nonce           string // client nonce + server nonce
+}
+
+// first handles client-first-message, "n,,n=user,r=nonce", and returns
+// server-first-message with the combined nonce, salt and iteration count.
+func (sc *scramConversation) first(msg []byte) ([]byte, error) {
+	gs2Flag, rest, ok1 := strings.Cut(string(msg), ",")
+	authzid, bare, ok2 := strings.Cut(rest, ",")
+	if !ok1 || !ok2 {
+		return nil, errors.New("invalid SCRAM client-first message")
+	}
+	if gs2Flag != "n" && gs2Flag != "y" {
+		return nil, errors.New("SCRAM channel binding is not supported")
+	}
+	sc.gs2Header = gs2Flag + "," + authzid + ","
+	sc.clientFirstBare = bare
+
+	var clientNonce string
+	for _, attr := range strings.Split(bare, ",") {
+		switch {
+		case strings.HasPrefix(attr, "n="):
+			sc.user = unescapeScramName(attr[2:])
+		case strings.HasPrefix(attr, "r="):
+			clientNonce = attr[2:]
+		case strings.HasPrefix(attr, "m="):
+			return nil, errors.New("SCRAM mandatory extensions are not supported")
+		}
+	}
+	if sc.user == "" || clientNonce == "" {
+		return nil, errors.New("invalid SCRAM client-first message")
+	}
+	if authzid != "" && authzid != "a="+sc.user {
+		return nil, errBadScramCredentials
+	}
+	cred, ok := scramUsers[sc.user]
+	if !ok {
+		return nil, errBadScramCredentials
+	}
+	sc.cred = cred
+
+	serverNonce := make([]byte, 18)
+	rand.Read(serverNonce)
+	sc.nonce = clientNonce + base64.StdEncoding.EncodeToString(serverNonce)
+	sc.serverFirst = "r=" + sc.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(cred.salt) +
+		",i=" + strconv.Itoa(cred.iterations)
+	return []byte(sc.serverFirst), nil
+}
+
+// final handles client-final-message, "c=binding,r=nonce,p=proof", checks
+// the proof and returns server-final-message with the server's signature.
+func (sc *scramConversation) final(msg []byte) ([]byte, error) {
+	withoutProof, proofAttr, ok := strings.Cut(string(msg), ",p=")
+	if !ok {
+		return nil, errors.New("invalid SCRAM client-final message")
+	}
+	var binding, nonce string
+	for _, attr := range strings.Split(withoutProof, ",") {
+		switch {
+		case strings.HasPrefix(attr, "c="):
+			binding = attr[2:]
+		case strings.HasPrefix(attr, "r="):
+			nonce = attr[2:]
+		}
+	}
+	if binding != base64.StdEncoding.EncodeToString([]byte(sc.gs2Header)) {
+		return nil, errors.New("SCRAM channel binding mismatch")
+	}
+	if nonce != sc.nonce {
+		return nil, errors.New("SCRAM nonce mismatch")
+	}
+	proof, err := base64.StdEncoding.DecodeString(proofAttr)
+	if err != nil || len(proof) != sha256.Size {
+		return nil, errors.New("invalid SCRAM client proof")
+	}
+
+	authMessage := sc.clientFirstBare + "," + sc.serverFirst + "," + withoutProof
+	// ClientKey = ClientProof XOR ClientSignature; its hash must be StoredKey.
+	clientKey := hmacSHA256(sc.cred.storedKey, authMessage)
+	for i := range clientKey {
+		clientKey[i] ^= proof[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], sc.cred.storedKey) != 1 {
+		return nil, errBadScramCredentials
+	}
+	serverSignature := hmacSHA256(sc.cred.serverKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// unescapeScramName decodes a saslname, where "=2C" is "," and "=3D" is "=".
+func unescapeScramName(s string) string {
+	return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(s)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// saslAuthenticate sends one SaslAuthenticate message and returns the
+// response's error code and auth bytes.
+func (c *testConn) saslAuthenticate(msg string) (int16, string) {
+	c.t.Helper()
+	var req respBuf
+	req.putCompactBytes([]byte(msg))
+	req.putTags()
+	r := c.call(apiKeySaslAuthenticate, 2, req.b)
+	errCode, _ := r.i16()
+	r.compactNullableString() // error_message
+	reply, _ := r.compactBytes()
+	r.i64() // session_lifetime_ms
+	if err := r.skipTagged(); err != nil {
+		c.t.Fatal(err)
+	}
+	checkConsumed(c.t, r)
+	return errCode, string(reply)
+}
+
+// scramLogin runs the client side of a SCRAM-SHA-256 exchange as user with
+// password: SaslHandshake, then client-first and client-final in two
+// SaslAuthenticate requests. It returns the client-final error code, after
+// checking the server's signature if there was no error.
+func (c *testConn) scramLogin(user, password string) int16 {
+	c.t.Helper()
+	r := c.call(apiKeySaslHandshake, 1, appendStr16(nil, scramSHA256))
+	if errCode, _ := r.i16(); errCode != errNone {
+		c.t.Fatalf("SaslHandshake = error %d", errCode)
+	}
+
+	clientFirstBare := "n=" + user + ",r=fyko+d2lbbFgONRv9qkxdawL"
+	errCode, serverFirst := c.saslAuthenticate("n,," + clientFirstBare)
+	if errCode != errNone {
+		c.t.Fatalf("client-first = error %d", errCode)
+	}
+	var nonce, salt string
+	iterations := 0
+	for _, attr := range strings.Split(serverFirst, ",") {
+		switch {
+		case strings.HasPrefix(attr, "r="):
+			nonce = attr[2:]
+		case strings.HasPrefix(attr, "s="):
+			salt = attr[2:]
+		case strings.HasPrefix(attr, "i="):
+			iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+	rawSalt, err := base64.StdEncoding.DecodeString(salt)
+	if !strings.HasPrefix(nonce, "fyko+d2lbbFgONRv9qkxdawL") || err != nil || iterations != scramIterations {
+		c.t.Fatalf("server-first %q doesn't extend the client nonce with a salt and %d iterations", serverFirst, scramIterations)
+	}
+
+	salted, err := pbkdf2.Key(sha256.New, password, rawSalt, iterations, sha256.Size)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte("n,,")) + ",r=" + nonce
+	authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+	proof := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	errCode, serverFinal := c.saslAuthenticate(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof))
+	if errCode == errNone {
+		want := "v=" + base64.StdEncoding.EncodeToString(hmacSHA256(hmacSHA256(salted, "Server Key"), authMessage))
+		if serverFinal != want {
+			c.t.Errorf("server-final %q, want %q", serverFinal, want)
+		}
+	}
+	return errCode
+}
+
+// setScramUsers configures SCRAM-SHA-256 users, as SASL_SCRAM_SHA_256_USERS
+// does, for the rest of the test.
+func setScramUsers(t *testing.T, userPasswords string) {
+	t.Helper()
+	users, err := parseScramUsers(userPasswords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldUsers := scramUsers
+	scramUsers = users
+	t.Cleanup(func() { scramUsers = oldUsers })
+}
+
+func TestScramAuthentication(t *testing.T) {
+	setScramUsers(t, "alice:secret")
+	c := dialWithACLs(t, aclBinding{
+		ResourceType: aclResourceTopic,
+		ResourceName: "orders",
+		PatternType:  aclPatternLiteral,
+		Principal:    "User:alice",
+		Operation:    aclOpDescribeConfigs,
+		Permission:   aclAllow,
+	})
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if errCode := c.scramLogin("alice", "secret"); errCode != errNone {
+		t.Fatalf("SCRAM login = error %d", errCode)
+	}
+	// The connection is now User:alice, whom the ACL lets describe orders.
+	checkErrCode(t, "DescribeConfigs as alice", c.describeTopicConfigs("orders"), errNone)
+}
+
+func TestScramBadPassword(t *testing.T) {
+	setScramUsers(t, "alice:secret")
+	c := newTestServer(t).dial()
+	if errCode := c.scramLogin("alice", "guess"); errCode != errSaslAuthenticationFailed {
+		t.Fatalf("SCRAM login with the wrong password = error %d, want %d", errCode, errSaslAuthenticationFailed)
+	}
+	// handleConn hangs up after a failed authentication.
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := c.conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("read %d bytes after the failed login, want the connection closed", n)
+	}
+}
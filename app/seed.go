@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ----- topic seeding -----
+
+// seedRecord is one line of a -seed file. Key, value and header values are
+// strings, or null.
+type seedRecord struct {
+	Topic     string       `json:"topic"`
+	Partition *int32       `json:"partition"` // null: pick one as a client would
+	Key       *string      `json:"key"`
+	Value     *string      `json:"value"`
+	Headers   []seedHeader `json:"headers"`
+	Timestamp int64        `json:"timestamp"` // ms since the epoch; 0 means now
+}
+
+type seedHeader struct {
+	Key   string  `json:"key"`
+	Value *string `json:"value"`
+}
+
+func seedBytes(s *string) []byte {
+	if s == nil {
+		return nil
+	}
+	return []byte(*s)
+}
+
+// seedTopics appends the records in path, a newline-delimited JSON file of
+// seedRecords, to s, one batch per partition in the order the partitions
+// first appear. Unknown topics are created as Produce would create them,
+// with enough partitions for the file, unless auto-creation is off. A
+// record without a partition goes where Kafka's default partitioner would
+// send it: by the hash of its key, or round-robin if it has none. It returns
+// how many records were appended.
+func seedTopics(s *logStore, path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var recs []seedRecord
+	var topics []string
+	need := map[string]int32{} // partitions each topic must have
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(nil, len(b)+1)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var rec seedRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return 0, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		switch {
+		case rec.Topic == "" || rec.Topic == offsetsTopic:
+			return 0, fmt.Errorf("%s:%d: invalid topic %q", path, line, rec.Topic)
+		case rec.Partition != nil && *rec.Partition < 0:
+			return 0, fmt.Errorf("%s:%d: invalid partition %d", path, line, *rec.Partition)
+		}
+		if _, ok := need[rec.Topic]; !ok {
+			topics = append(topics, rec.Topic)
+			need[rec.Topic] = 0
+		}
+		if rec.Partition != nil {
+			need[rec.Topic] = max(need[rec.Topic], *rec.Partition+1)
+		}
+		recs = append(recs, rec)
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+
+	numPartitions := map[string]int32{}
+	for _, topic := range topics {
+		if s.partitions(topic) == nil {
+			if !autoCreateTopics {
+				return 0, fmt.Errorf("unknown topic %q", topic)
+			}
+			if _, err := s.createTopic(topic, max(defaultPartitions, need[topic]), nil); err != nil {
+				return 0, err
+			}
+		}
+		numPartitions[topic] = int32(len(s.partitions(topic)))
+	}
+
+	var order []topicPartition
+	batches := map[topicPartition][]seedRecord{}
+	next := map[string]int32{} // round-robin position of keyless records
+	for _, rec := range recs {
+		tp := topicPartition{topic: rec.Topic}
+		switch {
+		case rec.Partition != nil:
+			tp.partition = *rec.Partition
+		case rec.Key != nil:
+			tp.partition = partitionForKey(seedBytes(rec.Key), numPartitions[rec.Topic])
+		default:
+			tp.partition = next[rec.Topic] % numPartitions[rec.Topic]
+			next[rec.Topic]++
+		}
+		if _, ok := batches[tp]; !ok {
+			order = append(order, tp)
+		}
+		batches[tp] = append(batches[tp], rec)
+	}
+
+	n := 0
+	for _, tp := range order {
+		if !s.hasPartition(tp.topic, tp.partition) {
+			return n, fmt.Errorf("unknown partition %d of topic %q", tp.partition, tp.topic)
+		}
+		if _, err := s.append(tp.topic, tp.partition, encodeSeedBatch(batches[tp], time.Now())); err != nil {
+			return n, err
+		}
+		n += len(batches[tp])
+	}
+	return n, nil
+}
+
+// encodeSeedBatch encodes recs as one uncompressed, non-transactional batch.
+// Records without a timestamp get now.
+func encodeSeedBatch(recs []seedRecord, now time.Time) []byte {
+	rb := recordBatch{
+		partitionLeaderEpoch: -1,
+		lastOffsetDelta:      int32(len(recs) - 1),
+		baseTimestamp:        -1,
+		producerID:           -1,
+		producerEpoch:        -1,
+		baseSequence:         -1,
+	}
+	timestamps := make([]int64, len(recs))
+	for i, rec := range recs {
+		timestamps[i] = rec.Timestamp
+		if timestamps[i] == 0 {
+			timestamps[i] = now.UnixMilli()
+		}
+		if rb.baseTimestamp == -1 || timestamps[i] < rb.baseTimestamp {
+			rb.baseTimestamp = timestamps[i]
+		}
+		rb.maxTimestamp = max(rb.maxTimestamp, timestamps[i])
+	}
+	for i, rec := range recs {
+		r := record{
+			timestampDelta: timestamps[i] - rb.baseTimestamp,
+			offsetDelta:    int32(i),
+			key:            seedBytes(rec.Key),
+			value:          seedBytes(rec.Value),
+		}
+		for _, h := range rec.Headers {
+			r.headers = append(r.headers, recordHeader{key: h.Key, value: seedBytes(h.Value)})
+		}
+		rb.records = append(rb.records, r)
+	}
+	return encodeRecordBatch(rb)
+}
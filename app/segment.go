@@ -0,0 +1,620 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ----- log segments -----
+
+// Kafka's log.segment.bytes default.
+const defaultSegmentBytes = 1 << 30
+
+// batchPeekSize covers baseOffset through baseSequence: enough of a batch
+// header to know where the batch ends, which offsets it holds, how recent its
+// records are and which producer sent them.
+const batchPeekSize = batchCountOffset
+
+// segmentData is the byte store behind a segment: its .log file, or a
+// growable buffer when the store runs without a data directory.
+type segmentData interface {
+	io.ReaderAt
+	io.Writer // appends
+	io.Closer
+	Sync() error
+}
+
+type memSegment struct {
+	b []byte
+}
+
+func (m *memSegment) Write(p []byte) (int, error) {
+	m.b = append(m.b, p...)
+	return len(p), nil
+}
+
+func (m *memSegment) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m.b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memSegment) Close() error { return nil }
+func (m *memSegment) Sync() error  { return nil }
+
+type segment struct {
+	baseOffset int64
+	size       int64
+	maxTime    int64 // largest batch maxTimestamp, -1 while empty
+	data       segmentData
+	index      offsetIndex
+}
+
+// close flushes the segment's data to disk and releases its files.
+func (sg *segment) close() error {
+	err := sg.data.Sync()
+	if cerr := sg.data.Close(); err == nil {
+		err = cerr
+	}
+	if ierr := sg.index.close(); err == nil {
+		err = ierr
+	}
+	return err
+}
+
+// remove closes the segment and deletes its files from dir, if it has any.
+func (sg *segment) remove(dir string) error {
+	err := sg.close()
+	if dir == "" {
+		return err
+	}
+	for _, ext := range []string{".log", ".index"} {
+		if rerr := os.Remove(filepath.Join(dir, segmentFileName(sg.baseOffset, ext))); rerr != nil && !os.IsNotExist(rerr) && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// segmentFileName returns Kafka's zero-padded segment name for baseOffset.
+func segmentFileName(baseOffset int64, ext string) string {
+	return fmt.Sprintf("%020d%s", baseOffset, ext)
+}
+
+// partitionDirName returns Kafka's "topic-partition" directory name.
+func partitionDirName(topic string, partition int32) string {
+	return topic + "-" + strconv.Itoa(int(partition))
+}
+
+// parsePartitionDirName splits a "topic-partition" directory name. Topic
+// names may themselves contain '-', so split on the last one.
+func parsePartitionDirName(name string) (topic string, partition int32, ok bool) {
+	i := strings.LastIndexByte(name, '-')
+	if i <= 0 {
+		return "", 0, false
+	}
+	p, err := strconv.ParseInt(name[i+1:], 10, 32)
+	if err != nil || p < 0 {
+		return "", 0, false
+	}
+	return name[:i], int32(p), true
+}
+
+// batchInfo is what scan learns about each batch from its header.
+type batchInfo struct {
+	pos           int64
+	size          int
+	baseOffset    int64
+	nextOffset    int64 // baseOffset + lastOffsetDelta + 1
+	maxTime       int64 // maxTimestamp
+	leaderEpoch   int32 // partitionLeaderEpoch
+	attributes    int16
+	producerID    int64
+	producerEpoch int16
+	baseSequence  int32
+}
+
+// peekBatch reads the batchInfo of the batch whose header starts hdr, which
+// holds at least batchPeekSize bytes.
+func peekBatch(hdr []byte) batchInfo {
+	bi := batchInfo{
+		size:          batchLogOverhead + int(int32(binary.BigEndian.Uint32(hdr[batchLengthOffset:]))),
+		baseOffset:    int64(binary.BigEndian.Uint64(hdr[0:])),
+		maxTime:       int64(binary.BigEndian.Uint64(hdr[batchMaxTimeOffset:])),
+		leaderEpoch:   int32(binary.BigEndian.Uint32(hdr[batchEpochOffset:])),
+		attributes:    int16(binary.BigEndian.Uint16(hdr[batchAttrsOffset:])),
+		producerID:    int64(binary.BigEndian.Uint64(hdr[batchProducerIDOffset:])),
+		producerEpoch: int16(binary.BigEndian.Uint16(hdr[batchProducerEpochOffset:])),
+		baseSequence:  int32(binary.BigEndian.Uint32(hdr[batchBaseSequenceOffset:])),
+	}
+	bi.nextOffset = bi.baseOffset + int64(int32(binary.BigEndian.Uint32(hdr[batchLastDeltaOffset:]))) + 1
+	return bi
+}
+
+// scan walks the batch headers of sg starting at byte position from, calling
+// fn for each complete batch until fn returns false. It returns the position
+// just past the last complete batch it saw.
+func (sg *segment) scan(from int64, fn func(batchInfo) bool) (int64, error) {
+	var hdr [batchPeekSize]byte
+	pos := from
+	for pos+batchPeekSize <= sg.size {
+		if _, err := sg.data.ReadAt(hdr[:], pos); err != nil {
+			return pos, err
+		}
+		length := int32(binary.BigEndian.Uint32(hdr[batchLengthOffset:]))
+		size := batchLogOverhead + int64(length)
+		if length < 0 || size < batchHeaderSize || pos+size > sg.size {
+			break // partial or garbage tail
+		}
+		bi := peekBatch(hdr[:])
+		bi.pos = pos
+		pos += size
+		if !fn(bi) {
+			break
+		}
+	}
+	return pos, nil
+}
+
+// openFileSegment opens (creating if needed) the segment starting at
+// baseOffset in dir, replaying its batch headers. A partially written
+// trailing batch, e.g. from a crash mid-append, is truncated away, and a
+// missing or corrupt .index is rebuilt from the replay. It returns the segment
+// and the offset following its last batch.
+func openFileSegment(dir string, baseOffset, indexInterval int64) (*segment, int64, error) {
+	f, err := os.OpenFile(filepath.Join(dir, segmentFileName(baseOffset, ".log")), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	sg := &segment{baseOffset: baseOffset, size: fi.Size(), maxTime: -1, data: f}
+	next := baseOffset
+	rebuilt := offsetIndex{interval: indexInterval}
+	end, err := sg.scan(0, func(bi batchInfo) bool {
+		next = bi.nextOffset
+		sg.maxTime = max(sg.maxTime, bi.maxTime)
+		rebuilt.add(bi.baseOffset-baseOffset, bi.pos, int64(bi.size))
+		return true
+	})
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if end < sg.size {
+		if err := f.Truncate(end); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		sg.size = end
+	}
+	sg.index, err = openIndex(filepath.Join(dir, segmentFileName(baseOffset, ".index")), sg.size, rebuilt.entries, indexInterval)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return sg, next, nil
+}
+
+// newSegment starts an empty segment at baseOffset, backed by files in dir
+// or by memory when dir is "".
+func newSegment(dir string, baseOffset, indexInterval int64) (*segment, error) {
+	if dir == "" {
+		return &segment{
+			baseOffset: baseOffset,
+			maxTime:    -1,
+			data:       &memSegment{},
+			index:      offsetIndex{interval: indexInterval},
+		}, nil
+	}
+	sg, _, err := openFileSegment(dir, baseOffset, indexInterval)
+	return sg, err
+}
+
+// openPartitionLog loads every .log segment in dir, creating a first empty
+// segment when there are none.
+func openPartitionLog(dir string, indexInterval int64) (*partitionLog, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var bases []int64
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() && strings.HasSuffix(name, cleanedSuffix) {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if e.IsDir() || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		base, err := strconv.ParseInt(strings.TrimSuffix(name, ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+		bases = append(bases, base)
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+
+	pl := &partitionLog{dir: dir, indexInterval: indexInterval}
+	for _, base := range bases {
+		sg, next, err := openFileSegment(dir, base, indexInterval)
+		if err != nil {
+			pl.close()
+			return nil, err
+		}
+		pl.segments = append(pl.segments, sg)
+		pl.nextOffset = next
+	}
+	if len(pl.segments) == 0 {
+		sg, err := newSegment(dir, 0, indexInterval)
+		if err != nil {
+			return nil, err
+		}
+		pl.segments = append(pl.segments, sg)
+	}
+	// Whatever made it to disk was committed before the restart.
+	pl.highWatermark = pl.nextOffset
+	pl.logStart = pl.segments[0].baseOffset
+	if start, err := readLogStartCheckpoint(dir); err != nil {
+		pl.close()
+		return nil, err
+	} else if start > pl.logStart {
+		pl.logStart = min(start, pl.nextOffset)
+	}
+	if err := pl.loadProducerState(); err != nil {
+		pl.close()
+		return nil, err
+	}
+	if pl.epochs, err = readLeaderEpochCheckpoint(dir); err != nil {
+		pl.close()
+		return nil, err
+	}
+	if pl.epochs == nil {
+		if err := pl.rebuildEpochs(); err != nil {
+			pl.close()
+			return nil, err
+		}
+	}
+	// Loading the partition is this broker becoming its leader again, which
+	// starts a new leader epoch at the end of the log.
+	if err := pl.assignEpoch(pl.leaderEpoch()+1, pl.nextOffset); err != nil {
+		pl.close()
+		return nil, err
+	}
+	return pl, nil
+}
+
+// logStartFileName holds a partition's log start offset once DeleteRecords
+// has moved it past the start of the first segment. (Kafka keeps one
+// log-start-offset-checkpoint file for all partitions instead.)
+const logStartFileName = "log-start-offset"
+
+// readLogStartCheckpoint returns the log start offset saved in dir, or -1.
+func readLogStartCheckpoint(dir string) (int64, error) {
+	b, err := os.ReadFile(filepath.Join(dir, logStartFileName))
+	if os.IsNotExist(err) {
+		return -1, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	start, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return -1, fmt.Errorf("bad %s: %w", logStartFileName, err)
+	}
+	return start, nil
+}
+
+// advanceLogStart moves the log start offset up to offset, which must not
+// be past the high watermark, and deletes the segments holding only records
+// below it. The active segment is always kept.
+func (pl *partitionLog) advanceLogStart(offset int64) error {
+	if offset < 0 || offset > pl.highWatermark {
+		return errOffsetRange
+	}
+	if offset > pl.logStart && pl.dir != "" {
+		path := filepath.Join(pl.dir, logStartFileName)
+		if err := os.WriteFile(path+".tmp", []byte(strconv.FormatInt(offset, 10)), 0o644); err != nil {
+			return err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+	}
+	pl.logStart = max(pl.logStart, offset)
+	n := 0
+	for n+1 < len(pl.segments) && pl.segments[n+1].baseOffset <= offset {
+		n++
+	}
+	var firstErr error
+	for _, sg := range pl.segments[:n] {
+		if err := sg.remove(pl.dir); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	pl.segments = pl.segments[n:]
+	pl.dropAbortedTxnsBelow(pl.logStart)
+	return firstErr
+}
+
+// cleanedSuffix marks a compacted copy of a segment that is still being
+// written; one left behind by a crash is deleted on startup.
+const cleanedSuffix = ".cleaned"
+
+// rewriteSegment replaces the contents of pl.segments[i] with data, batches
+// holding a subset of its offsets, and rebuilds its index. On disk the new
+// log is written beside the old one and renamed over it.
+func (pl *partitionLog) rewriteSegment(i int, data []byte) error {
+	old := pl.segments[i]
+	if pl.dir == "" {
+		sg := &segment{
+			baseOffset: old.baseOffset,
+			size:       int64(len(data)),
+			maxTime:    -1,
+			data:       &memSegment{b: data},
+			index:      offsetIndex{interval: pl.indexInterval},
+		}
+		if _, err := sg.scan(0, func(bi batchInfo) bool {
+			sg.maxTime = max(sg.maxTime, bi.maxTime)
+			sg.index.add(bi.baseOffset-sg.baseOffset, bi.pos, int64(bi.size))
+			return true
+		}); err != nil {
+			return err
+		}
+		pl.segments[i] = sg
+		return nil
+	}
+
+	logPath := filepath.Join(pl.dir, segmentFileName(old.baseOffset, ".log"))
+	f, err := os.Create(logPath + cleanedSuffix)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(logPath + cleanedSuffix)
+		return err
+	}
+	if err := old.close(); err != nil {
+		return err
+	}
+	// Dropping the index first means a crash leaves either log with a
+	// rebuilt index, never the new log with the old index.
+	if err := os.Remove(filepath.Join(pl.dir, segmentFileName(old.baseOffset, ".index"))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(logPath+cleanedSuffix, logPath); err != nil {
+		return err
+	}
+	sg, _, err := openFileSegment(pl.dir, old.baseOffset, pl.indexInterval)
+	if err != nil {
+		return err
+	}
+	pl.segments[i] = sg
+	return nil
+}
+
+func (pl *partitionLog) close() error {
+	var firstErr error
+	for _, sg := range pl.segments {
+		if err := sg.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// append writes batch at the end of the log with its baseOffset rewritten to
+// the next offset and its partitionLeaderEpoch stamped, rolling to a new
+// segment once the active one would grow past segmentBytes.
+func (pl *partitionLog) append(batch []byte, segmentBytes int64) (int64, error) {
+	bi := peekBatch(batch)
+	if off, err := pl.checkSequence(bi); err != nil {
+		return off, err
+	}
+	marker := int16(-1)
+	if bi.attributes&batchControl != 0 {
+		var err error
+		if marker, err = controlType(batch); err != nil {
+			return -1, err
+		}
+	}
+	active := pl.segments[len(pl.segments)-1]
+	if active.size > 0 && active.size+int64(len(batch)) > segmentBytes {
+		sg, err := newSegment(pl.dir, pl.nextOffset, pl.indexInterval)
+		if err != nil {
+			return -1, err
+		}
+		pl.segments = append(pl.segments, sg)
+		active = sg
+	}
+
+	// Keep our own copy; the payload buffer belongs to the connection.
+	b := append([]byte(nil), batch...)
+	base := pl.nextOffset
+	// Producers send baseOffset 0 and partitionLeaderEpoch -1; the broker
+	// assigns both. They sit before the CRC range, so the stored CRC stays
+	// valid and consumers fetch back absolute offsets.
+	binary.BigEndian.PutUint64(b[0:], uint64(base))
+	binary.BigEndian.PutUint32(b[batchEpochOffset:], uint32(pl.leaderEpoch()))
+	if _, err := active.data.Write(b); err != nil {
+		return -1, err
+	}
+	if err := active.index.add(base-active.baseOffset, active.size, int64(len(b))); err != nil {
+		return -1, err
+	}
+	active.size += int64(len(b))
+	active.maxTime = max(active.maxTime, int64(binary.BigEndian.Uint64(b[batchMaxTimeOffset:])))
+	pl.nextOffset = base + int64(int32(binary.BigEndian.Uint32(b[batchLastDeltaOffset:]))) + 1
+	bi.baseOffset, bi.nextOffset = base, pl.nextOffset
+	pl.trackProducer(bi)
+	pl.trackTxn(bi, marker)
+	return base, nil
+}
+
+// read returns the batches holding offsets at or after fetchOffset and
+// starting before endOffset, stopping at the batch boundary before maxBytes
+// would be exceeded (see logStore.readBatches for minOne). They are read
+// back to back into raw, which they share: the batches of a segment lie
+// next to each other, so each segment takes one read and the whole fetch
+// one allocation.
+func (pl *partitionLog) read(fetchOffset, endOffset int64, maxBytes int, minOne bool) (raw []byte, batches [][]byte, err error) {
+	// Last segment starting at or before fetchOffset.
+	i := sort.Search(len(pl.segments), func(i int) bool {
+		return pl.segments[i].baseOffset > fetchOffset
+	}) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	// The run of batches to read from each segment.
+	type span struct {
+		sg    *segment
+		pos   int64
+		sizes []int
+	}
+	var (
+		spans []span
+		size  int
+		n     int
+	)
+	// Only the first segment needs the index; later ones are read from the start.
+	from := pl.segments[i].index.lookup(fetchOffset - pl.segments[i].baseOffset)
+	for ; i < len(pl.segments); i, from = i+1, 0 {
+		sg := pl.segments[i]
+		sp := span{sg: sg, pos: -1}
+		full := false
+		_, err := sg.scan(from, func(bi batchInfo) bool {
+			if bi.nextOffset <= fetchOffset {
+				return true
+			}
+			if bi.baseOffset >= endOffset {
+				full = true
+				return false
+			}
+			if size+bi.size > maxBytes && !(minOne && n == 0) {
+				full = true
+				return false
+			}
+			if sp.pos < 0 {
+				sp.pos = bi.pos
+			}
+			sp.sizes = append(sp.sizes, bi.size)
+			size += bi.size
+			n++
+			return true
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if sp.pos >= 0 {
+			spans = append(spans, sp)
+		}
+		if full {
+			break
+		}
+	}
+	if n == 0 {
+		return nil, nil, nil
+	}
+
+	raw = make([]byte, size)
+	batches = make([][]byte, 0, n)
+	off := 0
+	for _, sp := range spans {
+		start := off
+		for _, sz := range sp.sizes {
+			batches = append(batches, raw[off:off+sz:off+sz])
+			off += sz
+		}
+		if _, err := sp.sg.data.ReadAt(raw[start:off], sp.pos); err != nil {
+			return nil, nil, err
+		}
+	}
+	return raw, batches, nil
+}
+
+// offsetForTimestamp finds the first record whose timestamp is at or after
+// ts and returns its offset and timestamp, or -1, -1 when no record is that
+// recent. Batch maxTimestamps narrow the search to one batch, which is then
+// decoded to find the record.
+func (pl *partitionLog) offsetForTimestamp(ts int64) (offset, timestamp int64, err error) {
+	for _, sg := range pl.segments {
+		var (
+			batch   []byte
+			readErr error
+		)
+		_, err := sg.scan(0, func(bi batchInfo) bool {
+			if bi.maxTime < ts {
+				return true
+			}
+			batch = make([]byte, bi.size)
+			_, readErr = sg.data.ReadAt(batch, bi.pos)
+			return false
+		})
+		if err == nil {
+			err = readErr
+		}
+		if err != nil {
+			return -1, -1, err
+		}
+		if batch == nil {
+			continue
+		}
+		rb, err := decodeRecordBatch(batch)
+		if err != nil {
+			return -1, -1, err
+		}
+		for _, r := range rb.records {
+			if t := rb.timestamp(r); t >= ts {
+				return rb.baseOffset + int64(r.offsetDelta), t, nil
+			}
+		}
+		// Only reachable if maxTimestamp overstates the records; answer at
+		// batch granularity.
+		return rb.baseOffset, rb.maxTimestamp, nil
+	}
+	return -1, -1, nil
+}
+
+// maxTimestampOffset returns the last offset of the batch holding the
+// largest timestamp in the log, with that timestamp, or -1, -1 for an empty
+// log. Like offsetForTimestamp it works at batch granularity.
+func (pl *partitionLog) maxTimestampOffset() (offset, timestamp int64, err error) {
+	offset, timestamp = -1, -1
+	for _, sg := range pl.segments {
+		if _, err := sg.scan(0, func(bi batchInfo) bool {
+			if offset < 0 || bi.maxTime > timestamp {
+				offset, timestamp = bi.nextOffset-1, bi.maxTime
+			}
+			return true
+		}); err != nil {
+			return -1, -1, err
+		}
+	}
+	return offset, timestamp, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ----- TLS listener -----
+
+// tlsHandshakeTimeout bounds how long a client may take to complete the TLS
+// handshake before its connection is dropped.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// tlsHandshakeRecord is the content type byte that opens a TLS ClientHello.
+const tlsHandshakeRecord = 0x16
+
+// tlsConfig is non-nil when the listener is SSL (or SASL_SSL): accepted
+// connections are wrapped with tls.Server. Set from the TLS_CERT_FILE and
+// TLS_KEY_FILE environment variables; TLS_CA_FILE additionally requires
+// clients to present a certificate signed by that CA (mTLS).
+var tlsConfig *tls.Config
+
+// loadTLSConfig builds the server's TLS config from PEM files. caFile may be
+// empty, in which case client certificates aren't asked for.
+func loadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// tlsHandshake completes the handshake on a TLS connection and records the
+// client certificate's subject, if one was presented, on the session.
+func tlsHandshake(conn *tls.Conn, sess *session) error {
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		sess.tlsSubject = certs[0].Subject.String()
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a generated certificate and its key.
+type testCert struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a certificate from tmpl, valid for the next hour and
+// signed by parent, or self-signed if parent is nil.
+func newTestCert(t *testing.T, tmpl *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore, tmpl.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, der: der, key: key}
+}
+
+// writePEM writes c's certificate and key to dir as name.pem and
+// name-key.pem and returns their paths.
+func (c *testCert) writePEM(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// dialTLS connects to s over TLS with cfg and completes the handshake.
+func (s *testServer) dialTLS(cfg *tls.Config) (*testConn, error) {
+	conn, err := tls.Dial("tcp", s.addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.t.Cleanup(func() { conn.Close() })
+	return &testConn{t: s.t, conn: conn}, nil
+}
+
+// With TLS_CA_FILE set, clients must present a certificate signed by that
+// CA, and its subject is the connection's principal.
+func TestTLSClientCertificate(t *testing.T) {
+	ca := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "broker"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	client := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "alice", Organization: []string{"Acme"}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+
+	dir := t.TempDir()
+	caFile, _ := ca.writePEM(t, dir, "ca")
+	certFile, keyFile := server.writePEM(t, dir, "server")
+	cfg, err := loadTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldTLSConfig := tlsConfig
+	tlsConfig = cfg
+	t.Cleanup(func() { tlsConfig = oldTLSConfig })
+
+	s := newTestServer(t)
+	useACLs(t, aclBinding{
+		ResourceType: aclResourceTopic,
+		ResourceName: "orders",
+		PatternType:  aclPatternLiteral,
+		Principal:    "User:CN=alice,O=Acme",
+		Operation:    aclOpDescribeConfigs,
+		Permission:   aclAllow,
+	})
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	c, err := s.dialTLS(&tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{client.der}, PrivateKey: client.key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkErrCode(t, "DescribeConfigs as CN=alice,O=Acme", c.describeTopicConfigs("orders"), errNone)
+
+	// Without a certificate the broker rejects the handshake. With TLS 1.3
+	// the client only learns of it on its first read.
+	c, err = s.dialTLS(&tls.Config{RootCAs: roots})
+	if err == nil {
+		c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err = c.conn.Write([]byte{0, 0, 0, 0}); err == nil {
+			_, err = c.conn.Read(make([]byte, 1))
+		}
+	}
+	if err == nil {
+		t.Error("a client without a certificate was served")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ----- topic ids -----
+
+// Every topic gets a random UUID when it is created (KIP-516), which newer
+// requests may use in place of its name. Like Kafka, each partition
+// directory records it in a partition.metadata file.
+const partitionMetadataFileName = "partition.metadata"
+
+// randomUUID returns a random version 4 UUID.
+func randomUUID() [16]byte {
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = u[6]&0x0f | 0x40 // version 4
+	u[8] = u[8]&0x3f | 0x80 // RFC 4122 variant
+	return u
+}
+
+// topicIDString formats id as Kafka does: URL-safe base64 without padding.
+func topicIDString(id [16]byte) string {
+	return base64.RawURLEncoding.EncodeToString(id[:])
+}
+
+// writePartitionMetadata records topic id id in the partition directory dir.
+func writePartitionMetadata(dir string, id [16]byte) error {
+	path := filepath.Join(dir, partitionMetadataFileName)
+	b := fmt.Appendf(nil, "version: 0\ntopic_id: %s\n", topicIDString(id))
+	if err := os.WriteFile(path+".tmp", b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// readPartitionMetadata returns the topic id recorded in the partition
+// directory dir; ok is false if there is none.
+func readPartitionMetadata(dir string) (id [16]byte, ok bool, err error) {
+	b, err := os.ReadFile(filepath.Join(dir, partitionMetadataFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return id, false, nil
+	}
+	if err != nil {
+		return id, false, err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		key, value, found := strings.Cut(sc.Text(), ":")
+		if !found || strings.TrimSpace(key) != "topic_id" {
+			continue
+		}
+		raw, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(raw) != len(id) {
+			return id, false, fmt.Errorf("bad topic_id in %s", partitionMetadataFileName)
+		}
+		copy(id[:], raw)
+		return id, true, nil
+	}
+	return id, false, fmt.Errorf("no topic_id in %s", partitionMetadataFileName)
+}
+
+// assignTopicIDLocked gives topic a new id, unless it has one. Caller holds
+// mu.
+func (s *logStore) assignTopicIDLocked(topic string) [16]byte {
+	if id, ok := s.topicIDs[topic]; ok {
+		return id
+	}
+	id := randomUUID()
+	s.topicIDs[topic] = id
+	s.topicsByID[id] = topic
+	return id
+}
+
+// forgetTopicIDLocked drops topic's id. Caller holds mu.
+func (s *logStore) forgetTopicIDLocked(topic string) {
+	if id, ok := s.topicIDs[topic]; ok {
+		delete(s.topicsByID, id)
+		delete(s.topicIDs, topic)
+	}
+}
+
+// topicID returns topic's id, or the zero UUID if there is no such topic.
+func (s *logStore) topicID(topic string) [16]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.topicIDs[topic]
+}
+
+// topicByID returns the name of the topic with id id, or "" if there is
+// none.
+func (s *logStore) topicByID(id [16]byte) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.topicsByID[id]
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"fmt"
+)
+
+func init() {
+	registerHandler(apiKeyCreateTopics, handleCreateTopics)
+	registerHandler(apiKeyDeleteTopics, handleDeleteTopics)
+	registerHandler(apiKeyCreatePartitions, handleCreatePartitions)
+}
+
+// ----- CreateTopics (api key 19) -----
+
+type createTopicResult struct {
+	name              string
+	topicID           [16]byte
+	errCode           int16
+	errMessage        string
+	numPartitions     int32
+	replicationFactor int16
+	configs           []configEntry
+}
+
+// handleCreateTopics parses a v7 CreateTopics request and creates each topic
+// in the store. num_partitions and replication_factor of -1 ask for the
+// broker defaults; as a single node we can only ever hold one replica. Topic
+// configs are validated and kept as the new topic's overrides.
+func handleCreateTopics(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	type topicReq struct {
+		name              string
+		numPartitions     int32
+		replicationFactor int16
+		assignments       int
+		configs           map[string]string
+		configErr         error
+	}
+
+	nTopics, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	reqs := make([]topicReq, 0, nTopics)
+	for i := 0; i < nTopics; i++ {
+		var t topicReq
+		if t.name, err = c.compactNullableString(); err != nil {
+			return nil, err
+		}
+		if t.numPartitions, err = c.i32(); err != nil {
+			return nil, err
+		}
+		if t.replicationFactor, err = c.i16(); err != nil {
+			return nil, err
+		}
+		// assignments: {partition_index, broker_ids []int32, TAGS}
+		if t.assignments, _, err = c.compactArrayLen(); err != nil {
+			return nil, err
+		}
+		for j := 0; j < t.assignments; j++ {
+			if _, err := c.i32(); err != nil {
+				return nil, err
+			}
+			nBrokers, _, err := c.compactArrayLen()
+			if err != nil {
+				return nil, err
+			}
+			for k := 0; k < nBrokers; k++ {
+				if _, err := c.i32(); err != nil {
+					return nil, err
+				}
+			}
+			if err := c.skipTagged(); err != nil {
+				return nil, err
+			}
+		}
+		// configs: {name, value, TAGS}
+		nConfigs, _, err := c.compactArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < nConfigs; j++ {
+			name, err := c.compactNullableString()
+			if err != nil {
+				return nil, err
+			}
+			value, err := c.compactNullableString()
+			if err != nil {
+				return nil, err
+			}
+			if err := c.skipTagged(); err != nil {
+				return nil, err
+			}
+			if t.configErr == nil {
+				t.configErr = validateTopicConfig(name, value)
+			}
+			if t.configs == nil {
+				t.configs = map[string]string{}
+			}
+			t.configs[name] = value
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, t)
+	}
+	if _, err := c.i32(); err != nil { // timeout_ms
+		return nil, err
+	}
+	validateOnly, err := c.boolean()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+
+	results := make([]createTopicResult, 0, len(reqs))
+	for _, t := range reqs {
+		res := createTopicResult{name: t.name, numPartitions: t.numPartitions, replicationFactor: t.replicationFactor}
+		if t.assignments > 0 {
+			res.numPartitions = int32(t.assignments)
+		}
+		if res.numPartitions == -1 {
+			res.numPartitions = defaultPartitions
+		}
+		if res.replicationFactor == -1 {
+			res.replicationFactor = 1
+		}
+
+		nameErr := checkTopicName(t.name)
+		switch {
+		case nameErr != nil:
+			res.errCode, res.errMessage = errInvalidTopic, nameErr.Error()
+		case !sess.canCreateTopic(t.name):
+			res.errCode, res.errMessage = errTopicAuthorizationFailed, "Authorization failed."
+		case res.numPartitions <= 0:
+			res.errCode, res.errMessage = errInvalidPartitions, "Number of partitions must be larger than 0"
+		case res.replicationFactor != 1:
+			res.errCode, res.errMessage = errInvalidReplicationFactor, "Replication factor must be 1 on a single broker"
+		case t.configErr != nil:
+			res.errCode, res.errMessage = errInvalidConfig, t.configErr.Error()
+		case store.partitions(t.name) != nil:
+			res.errCode, res.errMessage = errTopicAlreadyExists, fmt.Sprintf("Topic '%s' already exists", t.name)
+		case validateOnly:
+			// All checks passed; create nothing.
+		default:
+			created, err := store.createTopic(t.name, res.numPartitions, t.configs)
+			if err != nil {
+				sess.log.Error("failed to create topic", "topic", t.name, "correlation_id", corrID, "err", err)
+				res.errCode, res.errMessage = errUnknownServerError, err.Error()
+			} else if !created {
+				// Lost a race with a concurrent create.
+				res.errCode, res.errMessage = errTopicAlreadyExists, fmt.Sprintf("Topic '%s' already exists", t.name)
+			}
+		}
+		if res.errCode != errNone {
+			res.numPartitions, res.replicationFactor = -1, -1
+		} else {
+			res.topicID = store.topicID(t.name) // zero with validate_only
+			res.configs = store.topicConfigEntries(t.configs, nil)
+		}
+		results = append(results, res)
+	}
+	return buildCreateTopicsResponse(corrID, apiVer, results), nil
+}
+
+func buildCreateTopicsResponse(corrID int32, apiVer int16, results []createTopicResult) []byte {
+	// Body (flex v7):
+	// throttle_time_ms (INT32)
+	// topics (COMPACT_ARRAY) -> {name, topic_id, error_code, error_message,
+	//                            num_partitions, replication_factor, configs, TAGS}
+	//   configs -> {name, value, read_only, config_source, is_sensitive, TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putCompactArrayLen(len(results))
+	for _, t := range results {
+		r.putCompactString(t.name)
+		r.putUUID(t.topicID)
+		r.putI16(t.errCode)
+		r.putCompactNullableString(t.errMessage)
+		r.putI32(t.numPartitions)
+		r.putI16(t.replicationFactor)
+		r.putCompactArrayLen(len(t.configs))
+		for _, e := range t.configs {
+			r.putCompactString(e.name)
+			r.putCompactNullableString(e.value)
+			r.putBool(e.readOnly)
+			r.putI8(e.source)
+			r.putBool(false) // is_sensitive
+			r.putTags()
+		}
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyCreateTopics, apiVer))
+}
+
+// ----- DeleteTopics (api key 20) -----
+
+type deleteTopicResult struct {
+	name       string
+	topicID    [16]byte
+	errCode    int16
+	errMessage string
+}
+
+// handleDeleteTopics parses a v6 DeleteTopics request. Topics may be named or
+// given by topic_id.
+func handleDeleteTopics(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	nTopics, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]deleteTopicResult, 0, nTopics)
+	for i := 0; i < nTopics; i++ {
+		var res deleteTopicResult
+		if res.name, err = c.compactNullableString(); err != nil {
+			return nil, err
+		}
+		if res.topicID, err = c.uuid(); err != nil {
+			return nil, err
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+	}
+	if _, err := c.i32(); err != nil { // timeout_ms
+		return nil, err
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		res := &results[i]
+		if res.name == "" {
+			if res.name = store.topicByID(res.topicID); res.name == "" {
+				res.errCode, res.errMessage = errUnknownTopicID, "Unknown topic id "+topicIDString(res.topicID)
+				continue
+			}
+		} else {
+			res.topicID = store.topicID(res.name)
+		}
+		if !sess.authorized(aclOpDelete, aclResourceTopic, res.name) {
+			res.errCode, res.errMessage = errTopicAuthorizationFailed, "Authorization failed."
+			continue
+		}
+		if res.name == offsetsTopic {
+			res.errCode, res.errMessage = errInvalidTopic, "Internal topic "+offsetsTopic+" cannot be deleted"
+			continue
+		}
+		if err := store.deleteTopic(res.name); err != nil {
+			res.errCode = kafkaErrorCode(err)
+			if res.errCode == errUnknownServerError {
+				sess.log.Error("failed to delete topic", "topic", res.name, "correlation_id", corrID, "err", err)
+			}
+			res.errMessage = err.Error()
+		}
+	}
+	return buildDeleteTopicsResponse(corrID, apiVer, results), nil
+}
+
+func buildDeleteTopicsResponse(corrID int32, apiVer int16, results []deleteTopicResult) []byte {
+	// Body (flex v6):
+	// throttle_time_ms (INT32)
+	// responses (COMPACT_ARRAY) -> {name, topic_id, error_code, error_message, TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putCompactArrayLen(len(results))
+	for _, t := range results {
+		r.putCompactNullableString(t.name)
+		r.putUUID(t.topicID)
+		r.putI16(t.errCode)
+		r.putCompactNullableString(t.errMessage)
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyDeleteTopics, apiVer))
+}
+
+// ----- CreatePartitions (api key 37) -----
+
+type createPartitionsResult struct {
+	name       string
+	errCode    int16
+	errMessage string
+}
+
+// handleCreatePartitions parses a v3 CreatePartitions request and grows each
+// topic to its new partition count, which takes ALTER on the topic.
+// Assignments, if given, may only place the new partitions on this broker.
+func handleCreatePartitions(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	type topicReq struct {
+		name        string
+		count       int32
+		assignments int
+		badBroker   int32 // a broker id other than ours, or -1
+	}
+
+	nTopics, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	reqs := make([]topicReq, 0, nTopics)
+	for i := 0; i < nTopics; i++ {
+		t := topicReq{badBroker: -1}
+		if t.name, err = c.compactNullableString(); err != nil {
+			return nil, err
+		}
+		if t.count, err = c.i32(); err != nil {
+			return nil, err
+		}
+		// assignments (nullable): {broker_ids []int32, TAGS} per new partition
+		var isNull bool
+		if t.assignments, isNull, err = c.compactArrayLen(); err != nil {
+			return nil, err
+		}
+		if isNull {
+			t.assignments = -1
+		}
+		for j := 0; j < t.assignments; j++ {
+			nBrokers, _, err := c.compactArrayLen()
+			if err != nil {
+				return nil, err
+			}
+			for k := 0; k < nBrokers; k++ {
+				id, err := c.i32()
+				if err != nil {
+					return nil, err
+				}
+				if id != brokerID {
+					t.badBroker = id
+				}
+			}
+			if err := c.skipTagged(); err != nil {
+				return nil, err
+			}
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, t)
+	}
+	if _, err := c.i32(); err != nil { // timeout_ms
+		return nil, err
+	}
+	validateOnly, err := c.boolean()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+
+	results := make([]createPartitionsResult, 0, len(reqs))
+	for _, t := range reqs {
+		res := createPartitionsResult{name: t.name}
+		current := int32(len(store.partitions(t.name)))
+		switch {
+		case !sess.authorized(aclOpAlter, aclResourceTopic, t.name):
+			res.errCode, res.errMessage = errTopicAuthorizationFailed, "Authorization failed."
+		case current == 0:
+			res.errCode, res.errMessage = errUnknownTopicOrPartition, fmt.Sprintf("Topic '%s' does not exist", t.name)
+		case t.count < current:
+			res.errCode, res.errMessage = errInvalidPartitions, fmt.Sprintf("Topic currently has %d partitions, which is higher than the requested %d.", current, t.count)
+		case t.count == current:
+			res.errCode, res.errMessage = errInvalidPartitions, fmt.Sprintf("Topic already has %d partitions.", current)
+		case t.assignments >= 0 && int32(t.assignments) != t.count-current:
+			res.errCode, res.errMessage = errInvalidReplicaAssignment, fmt.Sprintf("Increasing the number of partitions by %d but %d assignments provided.", t.count-current, t.assignments)
+		case t.badBroker >= 0:
+			res.errCode, res.errMessage = errInvalidReplicaAssignment, fmt.Sprintf("Unknown broker %d in the replica assignment", t.badBroker)
+		case validateOnly:
+			// All checks passed; create nothing.
+		default:
+			if err := store.addPartitions(t.name, t.count); err != nil {
+				res.errCode, res.errMessage = kafkaErrorCode(err), err.Error()
+				if res.errCode == errUnknownServerError {
+					sess.log.Error("failed to create partitions", "topic", t.name, "correlation_id", corrID, "err", err)
+				}
+			}
+		}
+		results = append(results, res)
+	}
+	return buildCreatePartitionsResponse(corrID, apiVer, results), nil
+}
+
+func buildCreatePartitionsResponse(corrID int32, apiVer int16, results []createPartitionsResult) []byte {
+	// Body (flex v3):
+	// throttle_time_ms (INT32)
+	// results (COMPACT_ARRAY) -> {name, error_code, error_message, TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putCompactArrayLen(len(results))
+	for _, t := range results {
+		r.putCompactString(t.name)
+		r.putI16(t.errCode)
+		r.putCompactNullableString(t.errMessage)
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyCreatePartitions, apiVer))
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ----- transaction coordinator -----
+
+func init() {
+	registerHandler(apiKeyAddPartitionsToTxn, handleAddPartitionsToTxn)
+	registerHandler(apiKeyAddOffsetsToTxn, handleAddOffsetsToTxn)
+	registerHandler(apiKeyEndTxn, handleEndTxn)
+	registerHandler(apiKeyTxnOffsetCommit, handleTxnOffsetCommit)
+}
+
+// maxTransactionTimeout is Kafka's transaction.max.timeout.ms default. A
+// producer asking for longer is refused, since its open transactions hold
+// back read_committed consumers for as long as they last.
+const maxTransactionTimeout = 15 * time.Minute
+
+var (
+	errFencedProducer     = errors.New("producer has been fenced by a newer instance")
+	errProducerIDMapping  = errors.New("producer id does not match the transactional id")
+	errTxnState           = errors.New("transaction is not in a state that allows this")
+	errTransactionTimeout = errors.New("transaction timeout out of range")
+)
+
+// transaction is the state of one transactional id: the producer id and
+// epoch it was last given and, while a transaction is open, what it spans.
+// groups holds, for each group added with AddOffsetsToTxn, the offsets sent
+// with TxnOffsetCommit, which are stored only if the transaction commits.
+type transaction struct {
+	producerID int64
+	epoch      int16
+	timeout    time.Duration
+
+	ongoing    bool
+	started    time.Time
+	partitions map[topicPartition]bool
+	groups     map[string][]partitionOffset
+}
+
+// transactionCoordinator tracks the transactional producers. Being the only
+// broker it is the coordinator for every transactional id, and it writes
+// the transaction markers itself.
+type transactionCoordinator struct {
+	mu   sync.Mutex
+	txns map[string]*transaction
+}
+
+func newTransactionCoordinator() *transactionCoordinator {
+	return &transactionCoordinator{txns: map[string]*transaction{}}
+}
+
+var txnCoordinator = newTransactionCoordinator()
+
+// initProducer returns the producer id and epoch for a transactional
+// producer starting up. The first instance of a transactional id gets a new
+// producer id; later ones keep it with the epoch bumped, which fences off
+// the previous instance and aborts whatever transaction it left open.
+func (tc *transactionCoordinator) initProducer(txnID string, timeout time.Duration) (int64, int16, error) {
+	if timeout <= 0 || timeout > maxTransactionTimeout {
+		return -1, -1, errTransactionTimeout
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	t := tc.txns[txnID]
+	if t != nil && t.epoch < math.MaxInt16 {
+		// The previous instance's transaction is aborted under the new
+		// epoch, so the partitions fence off its late writes too.
+		t.epoch++
+		if t.ongoing {
+			if err := tc.completeLocked(txnID, t, false); err != nil {
+				return -1, -1, err
+			}
+		}
+	} else {
+		// Like Kafka, an exhausted epoch moves to a new producer id.
+		if t != nil && t.ongoing {
+			if err := tc.completeLocked(txnID, t, false); err != nil {
+				return -1, -1, err
+			}
+		}
+		id, err := producerIDs.allocate()
+		if err != nil {
+			return -1, -1, err
+		}
+		t = &transaction{producerID: id}
+		tc.txns[txnID] = t
+	}
+	t.timeout = timeout
+	return t.producerID, t.epoch, nil
+}
+
+// checkProducerLocked returns the transaction of txnID if producerID/epoch
+// is its current producer.
+func (tc *transactionCoordinator) checkProducerLocked(txnID string, producerID int64, epoch int16) (*transaction, error) {
+	t := tc.txns[txnID]
+	switch {
+	case t == nil || t.producerID != producerID:
+		return nil, errProducerIDMapping
+	case t.epoch != epoch:
+		return nil, errFencedProducer
+	}
+	return t, nil
+}
+
+// begin marks t's transaction as open if it isn't already.
+func (t *transaction) begin() {
+	if t.ongoing {
+		return
+	}
+	t.ongoing = true
+	t.started = time.Now()
+	t.partitions = map[topicPartition]bool{}
+	t.groups = map[string][]partitionOffset{}
+}
+
+// addPartitions adds partitions to txnID's transaction, setting each one's
+// errCode. If any partition is unknown none are added, and the others fail
+// with OPERATION_NOT_ATTEMPTED.
+func (tc *transactionCoordinator) addPartitions(txnID string, producerID int64, epoch int16, parts []partitionOffset) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	t, err := tc.checkProducerLocked(txnID, producerID, epoch)
+	if err != nil {
+		for i := range parts {
+			parts[i].errCode = kafkaErrorCode(err)
+		}
+		return
+	}
+	unknown := false
+	for i := range parts {
+		if !store.hasPartition(parts[i].topic, parts[i].partition) {
+			parts[i].errCode = errUnknownTopicOrPartition
+			unknown = true
+		}
+	}
+	if unknown {
+		for i := range parts {
+			if parts[i].errCode == errNone {
+				parts[i].errCode = errOperationNotAttempted
+			}
+		}
+		return
+	}
+	t.begin()
+	for _, p := range parts {
+		t.partitions[topicPartition{p.topic, p.partition}] = true
+	}
+}
+
+// addOffsets links groupID's offsets to txnID's transaction.
+func (tc *transactionCoordinator) addOffsets(txnID string, producerID int64, epoch int16, groupID string) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	t, err := tc.checkProducerLocked(txnID, producerID, epoch)
+	if err != nil {
+		return err
+	}
+	t.begin()
+	if _, ok := t.groups[groupID]; !ok {
+		t.groups[groupID] = nil
+	}
+	return nil
+}
+
+// addGroupOffsets holds the parts without an errCode in txnID's transaction
+// until it ends, setting the errCode of each if they can't be. groupID must
+// have been added with addOffsets first.
+func (tc *transactionCoordinator) addGroupOffsets(txnID string, producerID int64, epoch int16, groupID string, parts []partitionOffset) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	t, err := tc.checkProducerLocked(txnID, producerID, epoch)
+	if err == nil {
+		if _, ok := t.groups[groupID]; !t.ongoing || !ok {
+			err = errTxnState
+		}
+	}
+	for i := range parts {
+		switch {
+		case parts[i].errCode != errNone:
+			// Refused by the group coordinator.
+		case err != nil:
+			parts[i].errCode = kafkaErrorCode(err)
+		default:
+			t.groups[groupID] = append(t.groups[groupID], parts[i])
+		}
+	}
+}
+
+// endTxn commits or aborts txnID's open transaction.
+func (tc *transactionCoordinator) endTxn(txnID string, producerID int64, epoch int16, commit bool) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	t, err := tc.checkProducerLocked(txnID, producerID, epoch)
+	if err != nil {
+		return err
+	}
+	if !t.ongoing {
+		return errTxnState
+	}
+	return tc.completeLocked(txnID, t, commit)
+}
+
+// completeLocked writes a commit or abort marker to every partition in t's
+// transaction and closes it, storing the group offsets it holds if it
+// commits. A partition deleted since it was added has no records left to
+// decide.
+func (tc *transactionCoordinator) completeLocked(txnID string, t *transaction, commit bool) error {
+	m := txnMarkerEntry{producerID: t.producerID, epoch: t.epoch, commit: commit}
+	for tp := range t.partitions {
+		m.parts = append(m.parts, partitionOffset{topic: tp.topic, partition: tp.partition})
+	}
+	sort.Slice(m.parts, func(i, j int) bool {
+		if m.parts[i].topic != m.parts[j].topic {
+			return m.parts[i].topic < m.parts[j].topic
+		}
+		return m.parts[i].partition < m.parts[j].partition
+	})
+	err := writeTxnMarkers(&m)
+	for _, p := range m.parts {
+		if p.errCode == errNone || p.errCode == errUnknownTopicOrPartition {
+			delete(t.partitions, topicPartition{p.topic, p.partition})
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if commit {
+		for groupID, parts := range t.groups {
+			if err := coordinator.commitTxnOffsets(groupID, parts); err != nil {
+				return err
+			}
+		}
+	}
+	logger.Debug("completed transaction", "transactional_id", txnID, "producer_id", t.producerID,
+		"commit", commit, "partitions", len(m.parts), "groups", len(t.groups))
+	t.ongoing = false
+	t.partitions, t.groups = nil, nil
+	return nil
+}
+
+// abortExpired aborts transactions open for longer than their timeout and
+// bumps their epoch, fencing the producer that abandoned them.
+func (tc *transactionCoordinator) abortExpired(now time.Time) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	for id, t := range tc.txns {
+		if !t.ongoing || now.Sub(t.started) <= t.timeout || t.epoch == math.MaxInt16 {
+			continue
+		}
+		t.epoch++
+		if err := tc.completeLocked(id, t, false); err != nil {
+			logger.Error("failed to abort expired transaction", "transactional_id", id, "err", err)
+		}
+	}
+}
+
+// expireLoop runs abortExpired every interval, so a producer that dies
+// mid-transaction can't hold back read_committed consumers forever.
+func (tc *transactionCoordinator) expireLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		tc.abortExpired(now)
+	}
+}
+
+// txnProducer is the transactional_id, producer_id and producer_epoch that
+// open every transactional request.
+type txnProducer struct {
+	txnID      string
+	producerID int64
+	epoch      int16
+}
+
+func readTxnProducer(c *cursor) (txnProducer, error) {
+	var p txnProducer
+	var err error
+	if p.txnID, err = c.compactNullableString(); err != nil {
+		return p, err
+	}
+	if p.producerID, err = c.i64(); err != nil {
+		return p, err
+	}
+	p.epoch, err = c.i16()
+	return p, err
+}
+
+// ----- AddPartitionsToTxn (api key 24) -----
+
+// handleAddPartitionsToTxn parses a v3 AddPartitionsToTxn request, which a
+// transactional producer sends before its first write to a partition in
+// each transaction, and adds the partitions to the transaction. It takes
+// WRITE on the transactional id and on every topic; if a topic is denied,
+// none are added and the others fail with OPERATION_NOT_ATTEMPTED.
+func handleAddPartitionsToTxn(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	p, err := readTxnProducer(c)
+	if err != nil {
+		return nil, err
+	}
+	nTopics, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	var parts []partitionOffset
+	for i := 0; i < nTopics; i++ {
+		name, err := c.compactNullableString()
+		if err != nil {
+			return nil, err
+		}
+		nParts, _, err := c.compactArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < nParts; j++ {
+			index, err := c.i32()
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, partitionOffset{topic: name, partition: index})
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+
+	if !sess.authorized(aclOpWrite, aclResourceTransactionalID, p.txnID) {
+		for i := range parts {
+			parts[i].errCode = errTxnIDAuthorizationFailed
+		}
+		return buildAddPartitionsToTxnResponse(corrID, apiVer, parts), nil
+	}
+	allowed := map[string]bool{}
+	denied := false
+	for _, part := range parts {
+		if _, ok := allowed[part.topic]; !ok {
+			allowed[part.topic] = sess.authorized(aclOpWrite, aclResourceTopic, part.topic)
+			denied = denied || !allowed[part.topic]
+		}
+	}
+	if denied {
+		for i := range parts {
+			parts[i].errCode = errOperationNotAttempted
+			if !allowed[parts[i].topic] {
+				parts[i].errCode = errTopicAuthorizationFailed
+			}
+		}
+		return buildAddPartitionsToTxnResponse(corrID, apiVer, parts), nil
+	}
+	txnCoordinator.addPartitions(p.txnID, p.producerID, p.epoch, parts)
+	return buildAddPartitionsToTxnResponse(corrID, apiVer, parts), nil
+}
+
+func buildAddPartitionsToTxnResponse(corrID int32, apiVer int16, parts []partitionOffset) []byte {
+	// Body (flex v3):
+	// throttle_time_ms (INT32)
+	// results (COMPACT_ARRAY) -> {name, results (COMPACT_ARRAY), TAGS}
+	//   results -> {partition_index, partition_error_code, TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	topics := groupByTopic(parts)
+	r.putCompactArrayLen(len(topics))
+	for _, tp := range topics {
+		r.putCompactString(tp[0].topic)
+		r.putCompactArrayLen(len(tp))
+		for _, p := range tp {
+			r.putI32(p.partition)
+			r.putI16(p.errCode)
+			r.putTags()
+		}
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyAddPartitionsToTxn, apiVer))
+}
+
+// ----- AddOffsetsToTxn (api key 25) -----
+
+// handleAddOffsetsToTxn parses a v3 AddOffsetsToTxn request, which a
+// producer sends before TxnOffsetCommit to commit a consumer group's
+// offsets as part of its transaction. It takes WRITE on the transactional id and READ on the
+// group.
+func handleAddOffsetsToTxn(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	p, err := readTxnProducer(c)
+	if err != nil {
+		return nil, err
+	}
+	groupID, err := c.compactNullableString()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+	var errCode int16
+	switch {
+	case !sess.authorized(aclOpWrite, aclResourceTransactionalID, p.txnID):
+		errCode = errTxnIDAuthorizationFailed
+	case !sess.authorized(aclOpRead, aclResourceGroup, groupID):
+		errCode = errGroupAuthorizationFailed
+	case groupID == "":
+		errCode = errInvalidGroupID
+	default:
+		errCode = kafkaErrorCode(txnCoordinator.addOffsets(p.txnID, p.producerID, p.epoch, groupID))
+	}
+	return buildTxnResponse(corrID, apiKeyAddOffsetsToTxn, apiVer, errCode), nil
+}
+
+// ----- EndTxn (api key 26) -----
+
+// handleEndTxn parses a v3 EndTxn request and commits or aborts the
+// producer's transaction, which takes WRITE on its transactional id.
+func handleEndTxn(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	p, err := readTxnProducer(c)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := c.boolean()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+	if !sess.authorized(aclOpWrite, aclResourceTransactionalID, p.txnID) {
+		return buildTxnResponse(corrID, apiKeyEndTxn, apiVer, errTxnIDAuthorizationFailed), nil
+	}
+	err = txnCoordinator.endTxn(p.txnID, p.producerID, p.epoch, commit)
+	if kafkaErrorCode(err) == errUnknownServerError {
+		sess.log.Error("failed to end transaction", "transactional_id", p.txnID, "commit", commit, "err", err)
+	}
+	return buildTxnResponse(corrID, apiKeyEndTxn, apiVer, kafkaErrorCode(err)), nil
+}
+
+// ----- TxnOffsetCommit (api key 28) -----
+
+// handleTxnOffsetCommit parses a v3 TxnOffsetCommit request. The offsets
+// are checked as OffsetCommit would check them, then held by the
+// producer's transaction and stored when it commits. It takes WRITE on the
+// transactional id, READ on the group and READ on each topic.
+func handleTxnOffsetCommit(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	p, err := readTxnProducer(c)
+	if err != nil {
+		return nil, err
+	}
+	groupID, err := c.compactNullableString()
+	if err != nil {
+		return nil, err
+	}
+	generation, err := c.i32()
+	if err != nil {
+		return nil, err
+	}
+	memberID, err := c.compactNullableString()
+	if err != nil {
+		return nil, err
+	}
+	instanceID, err := c.compactNullableString()
+	if err != nil {
+		return nil, err
+	}
+	nTopics, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	var parts []partitionOffset
+	for i := 0; i < nTopics; i++ {
+		name, err := c.compactNullableString()
+		if err != nil {
+			return nil, err
+		}
+		nParts, _, err := c.compactArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < nParts; j++ {
+			po := partitionOffset{topic: name}
+			if po.partition, err = c.i32(); err != nil {
+				return nil, err
+			}
+			if po.offset, err = c.i64(); err != nil {
+				return nil, err
+			}
+			if po.leaderEpoch, err = c.i32(); err != nil {
+				return nil, err
+			}
+			if po.metadata, err = c.compactNullableString(); err != nil {
+				return nil, err
+			}
+			if err := c.skipTagged(); err != nil {
+				return nil, err
+			}
+			parts = append(parts, po)
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+	var errCode int16
+	switch {
+	case !sess.authorized(aclOpWrite, aclResourceTransactionalID, p.txnID):
+		errCode = errTxnIDAuthorizationFailed
+	case !sess.authorized(aclOpRead, aclResourceGroup, groupID):
+		errCode = errGroupAuthorizationFailed
+	}
+	for i := range parts {
+		switch {
+		case errCode != errNone:
+			parts[i].errCode = errCode
+		case !sess.authorized(aclOpRead, aclResourceTopic, parts[i].topic):
+			parts[i].errCode = errTopicAuthorizationFailed
+		}
+	}
+	if errCode == errNone {
+		coordinator.checkCommit(groupID, memberID, instanceID, generation, parts)
+		txnCoordinator.addGroupOffsets(p.txnID, p.producerID, p.epoch, groupID, parts)
+	}
+	return buildOffsetCommitResponse(corrID, apiKeyTxnOffsetCommit, apiVer, parts), nil
+}
+
+// buildTxnResponse encodes the AddOffsetsToTxn and EndTxn responses, which
+// share a layout.
+func buildTxnResponse(corrID int32, apiKey, apiVer int16, errCode int16) []byte {
+	// Body (flex v3):
+	// throttle_time_ms (INT32), error_code (INT16), TAG_BUFFER
+	var r respBuf
+	r.putI32(0) // throttle_time_ms
+	r.putI16(errCode)
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKey, apiVer))
+}
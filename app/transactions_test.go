@@ -0,0 +1,255 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"testing"
+)
+
+// initTxnProducer starts transactional producer txnID and returns its
+// producer id and epoch.
+func (c *testConn) initTxnProducer(txnID string) txnProducer {
+	c.t.Helper()
+	errCode, id, epoch := c.initProducerID(txnID)
+	if errCode != errNone {
+		c.t.Fatalf("InitProducerId(%q) = error %d", txnID, errCode)
+	}
+	return txnProducer{txnID: txnID, producerID: id, epoch: epoch}
+}
+
+// putTxnProducer writes the fields that open every transactional request.
+func putTxnProducer(req *respBuf, p txnProducer) {
+	req.putCompactString(p.txnID)
+	req.putI64(p.producerID)
+	req.putI16(p.epoch)
+}
+
+// addPartitionsToTxn sends a v3 AddPartitionsToTxn request adding
+// topic/partition to p's transaction and returns the partition's error
+// code.
+func (c *testConn) addPartitionsToTxn(p txnProducer, topic string, partition int32) int16 {
+	c.t.Helper()
+	var req respBuf
+	putTxnProducer(&req, p)
+	req.putCompactArrayLen(1)
+	req.putCompactString(topic)
+	req.putCompactArrayLen(1)
+	req.putI32(partition)
+	req.putTags()
+	req.putTags()
+	r := c.call(apiKeyAddPartitionsToTxn, 3, req.b)
+	r.i32() // throttle_time_ms
+	if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+		c.t.Fatalf("%d topics (%v), want 1", n, err)
+	}
+	r.compactNullableString() // name
+	if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+		c.t.Fatalf("%d partitions (%v), want 1", n, err)
+	}
+	r.i32() // partition_index
+	errCode, _ := r.i16()
+	return errCode
+}
+
+// endTxn sends a v3 EndTxn request committing or aborting p's transaction
+// and returns its error code.
+func (c *testConn) endTxn(p txnProducer, commit bool) int16 {
+	c.t.Helper()
+	var req respBuf
+	putTxnProducer(&req, p)
+	req.putBool(commit)
+	req.putTags()
+	r := c.call(apiKeyEndTxn, 3, req.b)
+	r.i32() // throttle_time_ms
+	errCode, _ := r.i16()
+	return errCode
+}
+
+// txnBatch encodes a transactional batch from p holding one record per
+// value, its first record numbered seq.
+func txnBatch(p txnProducer, seq int32, values ...string) []byte {
+	rb := recordBatch{attributes: batchTransactional, producerID: p.producerID, producerEpoch: p.epoch,
+		baseSequence: seq, lastOffsetDelta: int32(len(values) - 1)}
+	for i, v := range values {
+		rb.records = append(rb.records, record{offsetDelta: int32(i), value: []byte(v)})
+	}
+	return encodeRecordBatch(rb)
+}
+
+// consumedValues returns the record values a consumer keeps from a Fetch
+// partition result: like Kafka's clients it skips control batches, and the
+// batches of each transaction aborted_transactions lists, from the
+// transaction's first offset up to its abort marker.
+func consumedValues(t testing.TB, pr fetchPartitionResult) []string {
+	t.Helper()
+	var values []string
+	pending := slices.Clone(pr.aborted)
+	slices.SortFunc(pending, func(a, b abortedTxn) int { return cmp.Compare(a.firstOffset, b.firstOffset) })
+	aborting := map[int64]bool{}
+	for _, b := range pr.records {
+		rb, err := decodeRecordBatch(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for len(pending) > 0 && pending[0].firstOffset <= rb.baseOffset {
+			aborting[pending[0].producerID] = true
+			pending = pending[1:]
+		}
+		if rb.attributes&batchControl != 0 {
+			delete(aborting, rb.producerID)
+			continue
+		}
+		if aborting[rb.producerID] {
+			continue
+		}
+		for _, r := range rb.records {
+			values = append(values, string(r.value))
+		}
+	}
+	return values
+}
+
+// addOffsetsToTxn sends a v3 AddOffsetsToTxn request adding group's offsets
+// to p's transaction and returns its error code.
+func (c *testConn) addOffsetsToTxn(p txnProducer, group string) int16 {
+	c.t.Helper()
+	var req respBuf
+	putTxnProducer(&req, p)
+	req.putCompactString(group)
+	req.putTags()
+	r := c.call(apiKeyAddOffsetsToTxn, 3, req.b)
+	r.i32() // throttle_time_ms
+	errCode, _ := r.i16()
+	return errCode
+}
+
+// txnOffsetCommit sends a v3 TxnOffsetCommit request committing offset for
+// group's topic/partition in p's transaction, as a client not using group
+// management, and returns the partition's error code.
+func (c *testConn) txnOffsetCommit(p txnProducer, group, topic string, partition int32, offset int64) int16 {
+	c.t.Helper()
+	var req respBuf
+	putTxnProducer(&req, p)
+	req.putCompactString(group)
+	req.putI32(-1)                   // generation_id
+	req.putCompactString("")         // member_id
+	req.putCompactNullableString("") // group_instance_id
+	req.putCompactArrayLen(1)
+	req.putCompactString(topic)
+	req.putCompactArrayLen(1)
+	req.putI32(partition)
+	req.putI64(offset)
+	req.putI32(-1) // committed_leader_epoch
+	req.putCompactNullableString("")
+	req.putTags()
+	req.putTags()
+	req.putTags()
+	r := c.call(apiKeyTxnOffsetCommit, 3, req.b)
+	r.i32() // throttle_time_ms
+	if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+		c.t.Fatalf("%d topics (%v), want 1", n, err)
+	}
+	r.compactNullableString() // name
+	if n, _, err := r.compactArrayLen(); err != nil || n != 1 {
+		c.t.Fatalf("%d partitions (%v), want 1", n, err)
+	}
+	r.i32() // partition_index
+	errCode, _ := r.i16()
+	return errCode
+}
+
+// committedValues returns the records a read_committed consumer of
+// topic/partition sees.
+func (c *testConn) committedValues(topic string, partition int32) []string {
+	c.t.Helper()
+	resp := c.fetch(12, fetchOptions{maxBytes: 1 << 20, isolation: readCommitted, sessionEpoch: -1},
+		fetchTopicRequest{name: topic, partitions: []fetchPartitionRequest{fetchPartition(partition, 0)}})
+	return consumedValues(c.t, resp.topics[0].partitions[0])
+}
+
+// groupOffset returns group's committed offset for topic/partition, or -1.
+func groupOffset(group, topic string, partition int32) int64 {
+	return coordinator.fetchOffsets(group, []partitionOffset{{topic: topic, partition: partition}})[0].offset
+}
+
+// beginTxn starts a transaction for a new producer of txnID that writes
+// values to orders/0 and commits offset 7 for group "g".
+func (c *testConn) beginTxn(txnID string, values ...string) txnProducer {
+	c.t.Helper()
+	p := c.initTxnProducer(txnID)
+	if errCode := c.addPartitionsToTxn(p, "orders", 0); errCode != errNone {
+		c.t.Fatalf("AddPartitionsToTxn = error %d", errCode)
+	}
+	if res := c.produce("orders", 0, txnBatch(p, 0, values...)); res.errCode != errNone {
+		c.t.Fatalf("transactional produce = error %d", res.errCode)
+	}
+	if errCode := c.addOffsetsToTxn(p, "g"); errCode != errNone {
+		c.t.Fatalf("AddOffsetsToTxn = error %d", errCode)
+	}
+	if errCode := c.txnOffsetCommit(p, "g", "orders", 0, 7); errCode != errNone {
+		c.t.Fatalf("TxnOffsetCommit = error %d", errCode)
+	}
+	return p
+}
+
+func TestTransactionCommit(t *testing.T) {
+	c := newTestServer(t).dial()
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	p := c.beginTxn("tx", "a", "b")
+	if got := c.committedValues("orders", 0); len(got) != 0 || groupOffset("g", "orders", 0) != -1 {
+		t.Errorf("before EndTxn: consumed %q, group offset %d; want nothing", got, groupOffset("g", "orders", 0))
+	}
+
+	if errCode := c.endTxn(p, true); errCode != errNone {
+		t.Fatalf("EndTxn(commit) = error %d", errCode)
+	}
+	if got := c.committedValues("orders", 0); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("after commit: consumed %q, want a and b", got)
+	}
+	if off := groupOffset("g", "orders", 0); off != 7 {
+		t.Errorf("after commit: group offset %d, want 7", off)
+	}
+}
+
+func TestTransactionAbort(t *testing.T) {
+	c := newTestServer(t).dial()
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	p := c.beginTxn("tx", "a", "b")
+	if errCode := c.endTxn(p, false); errCode != errNone {
+		t.Fatalf("EndTxn(abort) = error %d", errCode)
+	}
+	if got := c.committedValues("orders", 0); len(got) != 0 {
+		t.Errorf("after abort: consumed %q, want nothing", got)
+	}
+	if off := groupOffset("g", "orders", 0); off != -1 {
+		t.Errorf("after abort: group offset %d, want none", off)
+	}
+}
+
+// A second instance of a transactional id fences the first: its pending
+// transaction is aborted and its requests fail with PRODUCER_FENCED.
+func TestTransactionFencedProducer(t *testing.T) {
+	c := newTestServer(t).dial()
+	if _, err := store.createTopic("orders", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	old := c.beginTxn("tx", "a")
+	c.initTxnProducer("tx")
+
+	if errCode := c.addPartitionsToTxn(old, "orders", 0); errCode != errProducerFenced {
+		t.Errorf("AddPartitionsToTxn with the old epoch = error %d, want %d", errCode, errProducerFenced)
+	}
+	if errCode := c.txnOffsetCommit(old, "g", "orders", 0, 9); errCode != errProducerFenced {
+		t.Errorf("TxnOffsetCommit with the old epoch = error %d, want %d", errCode, errProducerFenced)
+	}
+	if errCode := c.endTxn(old, true); errCode != errProducerFenced {
+		t.Errorf("EndTxn with the old epoch = error %d, want %d", errCode, errProducerFenced)
+	}
+	if got, off := c.committedValues("orders", 0), groupOffset("g", "orders", 0); len(got) != 0 || off != -1 {
+		t.Errorf("after fencing: consumed %q, group offset %d; want the old transaction aborted", got, off)
+	}
+}
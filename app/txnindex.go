@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// ----- transactions in the log -----
+
+// Transactional producers write their records to each partition as they go
+// and a transaction marker (a control batch) once the transaction commits or
+// aborts. Until then the records are pending: read_committed consumers only
+// read up to the last stable offset, the first offset of the earliest open
+// transaction, and are told which ranges of what they fetch were aborted so
+// they can skip them.
+
+// abortedTxn is an aborted transaction's span in one partition: its first
+// record through its abort marker.
+type abortedTxn struct {
+	producerID  int64
+	firstOffset int64
+	lastOffset  int64
+}
+
+// trackTxn updates pl's transaction state for bi, a batch just appended or
+// replayed. marker is the type of a control batch and ignored otherwise.
+func (pl *partitionLog) trackTxn(bi batchInfo, marker int16) {
+	if bi.producerID < 0 {
+		return
+	}
+	if bi.attributes&batchControl != 0 {
+		first, ok := pl.ongoingTxns[bi.producerID]
+		if !ok {
+			return // the transaction wrote nothing here
+		}
+		delete(pl.ongoingTxns, bi.producerID)
+		if marker == controlAbort {
+			pl.abortedTxns = append(pl.abortedTxns, abortedTxn{bi.producerID, first, bi.baseOffset})
+		}
+		return
+	}
+	if bi.attributes&batchTransactional == 0 {
+		return
+	}
+	if _, ok := pl.ongoingTxns[bi.producerID]; !ok {
+		if pl.ongoingTxns == nil {
+			pl.ongoingTxns = map[int64]int64{}
+		}
+		pl.ongoingTxns[bi.producerID] = bi.baseOffset
+	}
+}
+
+// lastStableOffset returns the offset below which every transaction is
+// decided: the first offset of the earliest open transaction, or the high
+// watermark when none is open.
+func (pl *partitionLog) lastStableOffset() int64 {
+	lso := pl.highWatermark
+	for _, first := range pl.ongoingTxns {
+		lso = min(lso, first)
+	}
+	return lso
+}
+
+// uncommittedTxn reports whether rb holds records of a transaction that is
+// still open in pl or was aborted.
+func (pl *partitionLog) uncommittedTxn(rb recordBatch) bool {
+	if rb.attributes&batchTransactional == 0 || rb.producerID < 0 {
+		return false
+	}
+	if first, ok := pl.ongoingTxns[rb.producerID]; ok && rb.baseOffset >= first {
+		return true
+	}
+	for _, t := range pl.abortedTxns {
+		if t.producerID == rb.producerID && t.firstOffset <= rb.baseOffset && rb.baseOffset < t.lastOffset {
+			return true
+		}
+	}
+	return false
+}
+
+// abortedTxnsBetween returns the aborted transactions with records in
+// [from, to).
+func (pl *partitionLog) abortedTxnsBetween(from, to int64) []abortedTxn {
+	var txns []abortedTxn
+	for _, t := range pl.abortedTxns {
+		if t.lastOffset >= from && t.firstOffset < to {
+			txns = append(txns, t)
+		}
+	}
+	return txns
+}
+
+// dropAbortedTxnsBelow forgets the aborted transactions that ended before
+// offset, which retention or DeleteRecords has removed.
+func (pl *partitionLog) dropAbortedTxnsBelow(offset int64) {
+	n := 0
+	for n < len(pl.abortedTxns) && pl.abortedTxns[n].lastOffset < offset {
+		n++
+	}
+	pl.abortedTxns = pl.abortedTxns[n:]
+}
+
+// txnMarker returns a control batch holding a commit or abort marker for
+// producerID's transaction.
+func txnMarker(producerID int64, epoch int16, commit bool, coordinatorEpoch int32) []byte {
+	marker := controlAbort
+	if commit {
+		marker = controlCommit
+	}
+	// A control record's key is a version and the marker type, its value a
+	// version and the coordinator epoch.
+	key := binary.BigEndian.AppendUint16(make([]byte, 2, 4), uint16(marker))
+	value := binary.BigEndian.AppendUint32(make([]byte, 2, 6), uint32(coordinatorEpoch))
+	now := time.Now().UnixMilli()
+	return encodeRecordBatch(recordBatch{
+		partitionLeaderEpoch: -1,
+		attributes:           batchTransactional | batchControl,
+		baseTimestamp:        now,
+		maxTimestamp:         now,
+		producerID:           producerID,
+		producerEpoch:        epoch,
+		baseSequence:         -1,
+		records:              []record{{key: key, value: value}},
+	})
+}
+
+// writeTxnMarker appends a commit or abort marker for producerID's
+// transaction to topic/partition, which decides the transaction's records
+// there and lets the last stable offset move past them.
+func (s *logStore) writeTxnMarker(topic string, partition int32, producerID int64, epoch int16, commit bool, coordinatorEpoch int32) error {
+	_, err := s.append(topic, partition, txnMarker(producerID, epoch, commit, coordinatorEpoch))
+	return err
+}
+
+// abortOpenTxns aborts the transactions a previous run left open in pl. The
+// transaction coordinator keeps its state in memory, so nothing else would
+// ever end them.
+func (pl *partitionLog) abortOpenTxns(segmentBytes int64) error {
+	for pid := range pl.ongoingTxns {
+		epoch := int16(0)
+		if ps := pl.producers[pid]; ps != nil {
+			epoch = ps.epoch
+		}
+		if _, err := pl.append(txnMarker(pid, epoch, false, 0), segmentBytes); err != nil {
+			return err
+		}
+		pl.advanceHighWatermark()
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// ----- build info -----
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.gitCommit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%FT%TZ)" ./app
+//
+// Left unset, gitCommit and buildDate fall back to what the Go toolchain
+// stamped into the binary, if anything.
+var (
+	version   = "dev"
+	gitCommit = ""
+	buildDate = ""
+)
+
+type buildInfo struct {
+	version, commit, date, goVersion string
+}
+
+// currentBuildInfo returns this binary's build info.
+func currentBuildInfo() buildInfo {
+	bi := buildInfo{version: version, commit: gitCommit, date: buildDate, goVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && bi.commit == "":
+				bi.commit = s.Value[:min(len(s.Value), 12)]
+			case s.Key == "vcs.time" && bi.date == "":
+				bi.date = s.Value
+			}
+		}
+	}
+	if bi.commit == "" {
+		bi.commit = "unknown"
+	}
+	if bi.date == "" {
+		bi.date = "unknown"
+	}
+	return bi
+}
+
+// String formats bi as -version prints it, e.g.
+// "kafka-broker 1.2.0 (commit 1a2b3c4, built 2026-01-02T15:04:05Z, go1.24.1)".
+func (bi buildInfo) String() string {
+	return fmt.Sprintf("kafka-broker %s (commit %s, built %s, %s)", bi.version, bi.commit, bi.date, bi.goVersion)
+}
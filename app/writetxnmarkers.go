@@ -0,0 +1,128 @@
+package main
+
+import "errors"
+
+// ----- WriteTxnMarkers (api key 27) -----
+
+func init() {
+	registerHandler(apiKeyWriteTxnMarkers, handleWriteTxnMarkers)
+}
+
+// txnMarkerEntry asks for a producer's transaction to be committed or
+// aborted in each of parts.
+type txnMarkerEntry struct {
+	producerID       int64
+	epoch            int16
+	commit           bool
+	coordinatorEpoch int32
+	parts            []partitionOffset // errCode is set by writeTxnMarkers
+}
+
+// writeTxnMarkers appends m's marker to each of its partitions, setting
+// each one's errCode, and returns the first failure other than an unknown
+// partition.
+func writeTxnMarkers(m *txnMarkerEntry) error {
+	var firstErr error
+	for i := range m.parts {
+		p := &m.parts[i]
+		err := store.writeTxnMarker(p.topic, p.partition, m.producerID, m.epoch, m.commit, m.coordinatorEpoch)
+		p.errCode = kafkaErrorCode(err)
+		if err != nil && !errors.Is(err, errNoSuchPartition) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// handleWriteTxnMarkers parses a v1 WriteTxnMarkers request. In a cluster
+// the transaction coordinator sends it to the leaders of a transaction's
+// partitions; here EndTxn writes its markers directly, but the request is
+// served all the same.
+func handleWriteTxnMarkers(c *cursor, corrID int32, apiVer int16, sess *session) ([]byte, error) {
+	nMarkers, _, err := c.compactArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	markers := make([]txnMarkerEntry, 0, nMarkers)
+	for i := 0; i < nMarkers; i++ {
+		var m txnMarkerEntry
+		if m.producerID, err = c.i64(); err != nil {
+			return nil, err
+		}
+		if m.epoch, err = c.i16(); err != nil {
+			return nil, err
+		}
+		if m.commit, err = c.boolean(); err != nil {
+			return nil, err
+		}
+		nTopics, _, err := c.compactArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < nTopics; j++ {
+			name, err := c.compactNullableString()
+			if err != nil {
+				return nil, err
+			}
+			nParts, _, err := c.compactArrayLen()
+			if err != nil {
+				return nil, err
+			}
+			for k := 0; k < nParts; k++ {
+				index, err := c.i32()
+				if err != nil {
+					return nil, err
+				}
+				m.parts = append(m.parts, partitionOffset{topic: name, partition: index})
+			}
+			if err := c.skipTagged(); err != nil {
+				return nil, err
+			}
+		}
+		if m.coordinatorEpoch, err = c.i32(); err != nil {
+			return nil, err
+		}
+		if err := c.skipTagged(); err != nil {
+			return nil, err
+		}
+		markers = append(markers, m)
+	}
+	if err := c.skipTagged(); err != nil {
+		return nil, err
+	}
+
+	for i := range markers {
+		if err := writeTxnMarkers(&markers[i]); err != nil {
+			sess.log.Error("failed to write transaction markers", "producer_id", markers[i].producerID, "correlation_id", corrID, "err", err)
+		}
+	}
+	return buildWriteTxnMarkersResponse(corrID, apiVer, markers), nil
+}
+
+func buildWriteTxnMarkersResponse(corrID int32, apiVer int16, markers []txnMarkerEntry) []byte {
+	// Body (flex v1):
+	// markers (COMPACT_ARRAY) -> {producer_id, topics (COMPACT_ARRAY), TAGS}
+	//   topics -> {name, partitions (COMPACT_ARRAY), TAGS}
+	//   partitions -> {partition_index, error_code, TAGS}
+	// response TAG_BUFFER count = 0
+	var r respBuf
+	r.putCompactArrayLen(len(markers))
+	for _, m := range markers {
+		r.putI64(m.producerID)
+		topics := groupByTopic(m.parts)
+		r.putCompactArrayLen(len(topics))
+		for _, tp := range topics {
+			r.putCompactString(tp[0].topic)
+			r.putCompactArrayLen(len(tp))
+			for _, p := range tp {
+				r.putI32(p.partition)
+				r.putI16(p.errCode)
+				r.putTags()
+			}
+			r.putTags()
+		}
+		r.putTags()
+	}
+	r.putTags()
+	return r.finish(corrID, responseHeaderVersion(apiKeyWriteTxnMarkers, apiVer))
+}
@@ -1,3 +1,9 @@
 module github.com/codecrafters-io/kafka-starter-go
 
 go 1.24.0
+
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/pierrec/lz4/v4 v4.1.22
+	github.com/segmentio/kafka-go v0.4.51
+)